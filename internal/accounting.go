@@ -0,0 +1,175 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// accounting tracks monthly traffic of users.
+type accounting struct {
+	m     sync.Mutex
+	users map[string]*userTraffic
+	dirty bool
+
+	saveM sync.Mutex
+}
+
+// userTraffic is a traffic counter of a single user, persisted in the state file.
+type userTraffic struct {
+	Period string `json:"period"` // calendar month in UTC, "2006-01"
+	Bytes  int64  `json:"bytes"`
+	Fired  []int  `json:"fired,omitempty"` // thresholds (in percents) already reported within period
+}
+
+func newAccounting() *accounting {
+	return &accounting{
+		users: make(map[string]*userTraffic),
+	}
+}
+
+func accountingPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// get returns counter of user for the current period, resetting it when a new period begins.
+// a.m must be held.
+func (a *accounting) get(user string, now time.Time) *userTraffic {
+	period := accountingPeriod(now)
+	u := a.users[user]
+	if u == nil || u.Period != period {
+		u = &userTraffic{Period: period}
+		a.users[user] = u
+		a.dirty = true
+	}
+	return u
+}
+
+// Add adds n bytes of user's traffic. If quota is positive,
+// it returns its thresholds crossed for the first time within the period.
+func (a *accounting) Add(user string, n, quota int64, thresholds []int, now time.Time) []int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	u := a.get(user, now)
+	u.Bytes += n
+	a.dirty = true
+	if quota <= 0 {
+		return nil
+	}
+
+	var fired []int
+next:
+	for _, t := range thresholds {
+		if float64(u.Bytes)*100 < float64(quota)*float64(t) {
+			continue
+		}
+		for _, f := range u.Fired {
+			if f == t {
+				continue next
+			}
+		}
+		u.Fired = append(u.Fired, t)
+		fired = append(fired, t)
+	}
+	return fired
+}
+
+// Used returns user's traffic within the current period.
+func (a *accounting) Used(user string, now time.Time) int64 {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if u := a.users[user]; u != nil && u.Period == accountingPeriod(now) {
+		return u.Bytes
+	}
+	return 0
+}
+
+// corruptStateError is returned when the state file can't be parsed.
+type corruptStateError struct {
+	err error
+}
+
+func (e *corruptStateError) Error() string {
+	return "corrupt state file: " + e.err.Error()
+}
+
+// Load reads counters from the state file. Missing file is not an error.
+func (a *accounting) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]*userTraffic)
+	if err = json.Unmarshal(b, &users); err != nil {
+		return &corruptStateError{err}
+	}
+
+	a.m.Lock()
+	a.users = users
+	a.dirty = false
+	a.m.Unlock()
+	return nil
+}
+
+// Save atomically writes counters to the state file if they were changed since the last save.
+func (a *accounting) Save(path string) error {
+	a.saveM.Lock()
+	defer a.saveM.Unlock()
+
+	a.m.Lock()
+	if !a.dirty {
+		a.m.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(a.users, "", "  ")
+	a.dirty = false
+	a.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = writeFileAtomic(path, b); err != nil {
+		a.m.Lock()
+		a.dirty = true
+		a.m.Unlock()
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it, so the file is never left half-written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
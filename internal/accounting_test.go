@@ -0,0 +1,109 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// testAccountingServer returns server persisting traffic counters to path, with counters loaded.
+func testAccountingServer(t *testing.T, path string) (*Server, *testLog) {
+	t.Helper()
+
+	conf := &Config{
+		Users:      []User{{Username: "user1", Password: "pass1"}},
+		Accounting: Accounting{StateFile: path, FlushInterval: 20 * time.Millisecond},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	l, log := testLogger(zapcore.InfoLevel)
+	srv.LoadAccounting(l)
+	return srv, log
+}
+
+func TestAccountingRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	srv, log := testAccountingServer(t, path)
+	if entries := log.Entries(""); len(entries) != 0 {
+		t.Errorf("missing state file should not be logged, got %v", entries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.RunAccounting(ctx, zap.NewNop().Sugar())
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	now := time.Now()
+	srv.accounting.Add("user1", 1000, 0, nil, now)
+
+	// the process crashes after a periodic flush, without the final one
+	waitFor(t, func() bool {
+		restarted, _ := testAccountingServer(t, path)
+		return restarted.accounting.Used("user1", now) == 1000
+	})
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+
+	// counting continues after restart
+	restarted, _ := testAccountingServer(t, path)
+	restarted.accounting.Add("user1", 24, 0, nil, now)
+	if used := restarted.accounting.Used("user1", now); used != 1024 {
+		t.Errorf("expected 1024, got %d", used)
+	}
+}
+
+func TestAccountingCorruptState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"user1": {"period": "2018-01", "bytes": 10`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// counting starts from zero, and the corrupt file is kept for investigation
+	srv, log := testAccountingServer(t, path)
+	if used := srv.accounting.Used("user1", time.Now()); used != 0 {
+		t.Errorf("expected 0, got %d", used)
+	}
+	if entries := log.Entries(""); len(entries) != 1 || entries[0]["level"] != "error" {
+		t.Errorf("expected a single error, got %v", entries)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Error(err)
+	}
+
+	// the next flush writes a valid file
+	srv.accounting.Add("user1", 10, 0, nil, time.Now())
+	if err := srv.saveAccounting(); err != nil {
+		t.Fatal(err)
+	}
+	restarted, log := testAccountingServer(t, path)
+	if used := restarted.accounting.Used("user1", time.Now()); used != 10 {
+		t.Errorf("expected 10, got %d", used)
+	}
+	if entries := log.Entries(""); len(entries) != 0 {
+		t.Errorf("expected no errors, got %v", entries)
+	}
+}
@@ -0,0 +1,372 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// minAdminTokenLength is the minimal length of admin API token.
+const minAdminTokenLength = 16
+
+// Admin configures access to admin API; its listening address is set by --admin-listen flag.
+// If Token is set, it is required in "Authorization: Bearer <token>" header of all requests except health checks.
+// Otherwise, admin API is available only on loopback addresses.
+// Requests changing state are rejected if they are sent by a browser from a page of another site,
+// so web pages opened on the same host can't change server state.
+type Admin struct {
+	Token string `yaml:"token"`
+}
+
+// validate checks admin API settings.
+func (a *Admin) validate() error {
+	if a.Token != "" && len(a.Token) < minAdminTokenLength {
+		return fmt.Errorf("admin: token should be at least %d characters long", minAdminTokenLength)
+	}
+	return nil
+}
+
+// CheckListen returns error if admin API can't listen on given address without a token.
+func (a *Admin) CheckListen(addr string) error {
+	if addr == "" || a.Token != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin: token should be set to listen on non-loopback address %s", addr)
+	}
+	return nil
+}
+
+// adminAuthorized returns true if admin API request has a valid token, or if no token is configured
+// and request is received on a loopback address.
+func adminAuthorized(conf *Config, req *http.Request) bool {
+	if conf.Admin.Token == "" {
+		addr, _ := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		return addr != nil && addr.IP.IsLoopback()
+	}
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	expected, actual := sha256.Sum256([]byte(conf.Admin.Token)), sha256.Sum256([]byte(auth[len("Bearer "):]))
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
+
+// crossSiteRequest returns true if request was sent by a browser from a page of another origin,
+// as indicated by Sec-Fetch-Site or Origin headers; other HTTP clients don't send them.
+func crossSiteRequest(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none":
+		return false
+	default:
+		return true
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != req.Host
+}
+
+// AdminHandler returns HTTP handler for administrative API.
+// Only health checks are served for unauthorized requests, see Admin.
+func (s *Server) AdminHandler(l *zap.SugaredLogger) http.Handler {
+	mux := http.NewServeMux()
+
+	// liveness check, also reports upstreams health to authorized requests
+	mux.HandleFunc("/health", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, "ok")
+		conf := s.Config()
+		if !adminAuthorized(conf, req) {
+			return
+		}
+		for _, u := range conf.upstreams() {
+			status := "healthy"
+			if !s.upstreams.Healthy(u.Address) {
+				status = "unhealthy"
+			}
+			fmt.Fprintf(rw, "upstream %s: %s\n", u.Address, status)
+		}
+	})
+
+	// readiness check, fails during maintenance and shutdown
+	mux.HandleFunc("/ready", func(rw http.ResponseWriter, req *http.Request) {
+		if s.ShuttingDown() {
+			http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		if s.Maintenance() {
+			http.Error(rw, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(rw, "ok")
+	})
+
+	// GET returns maintenance mode state, POST enters it, DELETE leaves it
+	mux.HandleFunc("/maintenance", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if s.SetMaintenance(true) {
+				l.Warnf("Entering maintenance mode via admin API, %d active connections.", s.Active())
+			}
+		case http.MethodDelete:
+			if s.SetMaintenance(false) {
+				l.Warnf("Leaving maintenance mode via admin API.")
+			}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(rw, "maintenance: %t, active connections: %d\n", s.Maintenance(), s.Active())
+	})
+
+	// monthly traffic of users with quota
+	mux.HandleFunc("/quota", func(rw http.ResponseWriter, req *http.Request) {
+		now := time.Now()
+		for _, u := range s.Config().Users {
+			if u.MonthlyQuota > 0 {
+				used := s.accounting.Used(u.Username, now)
+				fmt.Fprintf(
+					rw, "%s: %s of %s used, %s remaining\n",
+					u.Username, ByteSize(used), u.MonthlyQuota, ByteSize(remaining(u.MonthlyQuota, used)),
+				)
+			}
+		}
+	})
+
+	// users availability with backoff hints; for a single user (?user=name),
+	// 429 status with Retry-After header (if known) is returned when user's connections are refused
+	mux.HandleFunc("/availability", func(rw http.ResponseWriter, req *http.Request) {
+		conf := s.Config()
+		now := time.Now()
+		name := req.URL.Query().Get("user")
+		var found bool
+		for i := range conf.Users {
+			u := &conf.Users[i]
+			if name != "" && u.Username != name {
+				continue
+			}
+			found = true
+
+			reason, retry := s.availability(conf, u, now)
+			if reason == "" {
+				fmt.Fprintf(rw, "%s: available\n", u.Username)
+				continue
+			}
+
+			if name != "" {
+				if retry > 0 {
+					rw.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds()+1)))
+				}
+				rw.WriteHeader(http.StatusTooManyRequests)
+			}
+			if retry > 0 {
+				fmt.Fprintf(rw, "%s: throttled, %s, retry after %s\n", u.Username, reason, retry.Truncate(time.Second))
+			} else {
+				fmt.Fprintf(rw, "%s: throttled, %s\n", u.Username, reason)
+			}
+		}
+		if name != "" && !found {
+			http.Error(rw, "unknown user", http.StatusNotFound)
+		}
+	})
+
+	// GET returns users logged at debug level, POST adds user (?user=name), DELETE removes user added by POST;
+	// users from debug_users setting can't be removed
+	mux.HandleFunc("/debug_users", func(rw http.ResponseWriter, req *http.Request) {
+		conf := s.Config()
+		name := req.URL.Query().Get("user")
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodDelete:
+			if name == "" {
+				http.Error(rw, "user is required", http.StatusBadRequest)
+				return
+			}
+			if _, ok := conf.users[sha256.Sum256([]byte(name))]; !ok {
+				http.Error(rw, "unknown user", http.StatusNotFound)
+				return
+			}
+			on := req.Method == http.MethodPost
+			if s.SetDebugUser(name, on) {
+				if on {
+					l.Warnf("Debug logging enabled for user %q via admin API.", name)
+				} else {
+					l.Warnf("Debug logging disabled for user %q via admin API.", name)
+				}
+			}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, u := range conf.DebugUsers {
+			fmt.Fprintf(rw, "%s: debug_users\n", u)
+		}
+		for _, u := range s.debugUserNames() {
+			fmt.Fprintf(rw, "%s: admin\n", u)
+		}
+	})
+
+	// GET lists capture rules, POST adds temporary rule (?user=name&destination=pattern&duration=10m),
+	// DELETE removes all rules added by POST; capture should be enabled in configuration,
+	// and admin token should be set for POST, so local users can't capture other users' traffic
+	mux.HandleFunc("/capture", func(rw http.ResponseWriter, req *http.Request) {
+		conf := s.Config()
+		now := time.Now()
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !conf.Capture.Enabled {
+				http.Error(rw, "capture is disabled", http.StatusForbidden)
+				return
+			}
+			if conf.Admin.Token == "" {
+				http.Error(rw, "admin token is required to add capture rules", http.StatusForbidden)
+				return
+			}
+			q := req.URL.Query()
+			r := CaptureRule{User: q.Get("user"), Destination: q.Get("destination")}
+			d := defaultCaptureRuleDuration
+			if v := q.Get("duration"); v != "" {
+				var err error
+				if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+					http.Error(rw, "invalid duration", http.StatusBadRequest)
+					return
+				}
+			}
+			if err := r.validate(); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.captureRules.Add(r, d, now)
+			l.Warnf("Traffic capture rule %s added via admin API for %s, files are written to %s.", r, d, conf.Capture.Dir)
+		case http.MethodDelete:
+			if n := s.captureRules.Clear(now); n > 0 {
+				l.Warnf("%d traffic capture rules removed via admin API.", n)
+			}
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		fmt.Fprintf(rw, "capture: %t\n", conf.Capture.Enabled)
+		for _, r := range conf.Capture.Rules {
+			fmt.Fprintf(rw, "%s: configuration\n", r)
+		}
+		for _, r := range s.captureRules.Active(now) {
+			fmt.Fprintf(rw, "%s: expires in %s\n", r.CaptureRule, r.expires.Sub(now).Truncate(time.Second))
+		}
+	})
+
+	// GET returns effective chaos settings, POST changes them for new connections (?client_latency=100ms&reset_probability=0.1),
+	// DELETE restores configured ones; chaos should be enabled in configuration
+	mux.HandleFunc("/chaos", func(rw http.ResponseWriter, req *http.Request) {
+		conf := s.Config()
+		c := s.Chaos(conf)
+		if c == nil {
+			http.Error(rw, "chaos is disabled", http.StatusForbidden)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var err error
+			if c, err = c.update(req.URL.Query()); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			s.setChaos(c)
+			l.Warnf("Chaos settings changed via admin API: %s.", c)
+		case http.MethodDelete:
+			s.setChaos(nil)
+			c = s.Chaos(conf)
+			l.Warnf("Chaos settings restored via admin API: %s.", c)
+		default:
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintf(rw, "%s\n", c)
+	})
+
+	// live statistics of relayed connections
+	mux.HandleFunc("/connections", func(rw http.ResponseWriter, req *http.Request) {
+		for _, id := range s.ConnIDs() {
+			st, ok := s.ConnStats(id)
+			if !ok {
+				continue // closed meanwhile
+			}
+			fmt.Fprintf(
+				rw, "%d %s %s %s -> %s: %s, %s from client, %s from server\n",
+				st.ID, st.Listener, st.Client, st.User, st.Target, st.Duration.Truncate(time.Second),
+				ByteSize(st.FromClient), ByteSize(st.FromServer),
+			)
+		}
+	})
+
+	// destinations with the most concurrent outbound connections (?n=100 by default), tracked if destination_limit is set
+	mux.HandleFunc("/destinations", func(rw http.ResponseWriter, req *http.Request) {
+		n := 100
+		if v := req.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				http.Error(rw, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, e := range s.destConns.Top(n) {
+			fmt.Fprintf(rw, "%s %d\n", e.Key, e.Count)
+		}
+	})
+
+	// recently closed connections with termination reasons, the most recent first
+	mux.HandleFunc("/closed", func(rw http.ResponseWriter, req *http.Request) {
+		s.closes.WriteText(rw)
+	})
+
+	// metrics in Prometheus text format
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		s.updateGauges()
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.WriteText(rw)
+	})
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if p := req.URL.Path; p != "/health" && p != "/ready" && !adminAuthorized(s.Config(), req) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && crossSiteRequest(req) {
+			l.Warnf("Cross-site admin API request %s %s from %s rejected.", req.Method, req.URL.Path, req.Header.Get("Origin"))
+			http.Error(rw, "cross-site request", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,242 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testAdminToken = "0123456789abcdef-admin"
+
+// testAdminRequest makes admin API request received on local address, returning response status.
+func testAdminRequest(h http.Handler, method, path, local, token string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.ParseIP(local), Port: 8080}))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw.Code
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	for name, tc := range map[string]struct {
+		token    string // configured
+		local    string
+		reqToken string
+		status   int
+	}{
+		"Loopback":           {local: "127.0.0.1", status: 200},
+		"LoopbackIPv6":       {local: "::1", status: 200},
+		"NonLoopback":        {local: "192.0.2.1", status: 401},
+		"Token":              {token: testAdminToken, local: "192.0.2.1", reqToken: testAdminToken, status: 200},
+		"TokenMissing":       {token: testAdminToken, local: "192.0.2.1", status: 401},
+		"TokenMissingLoop":   {token: testAdminToken, local: "127.0.0.1", status: 401},
+		"TokenInvalid":       {token: testAdminToken, local: "192.0.2.1", reqToken: testAdminToken + "x", status: 401},
+		"TokenInvalidPrefix": {token: testAdminToken, local: "192.0.2.1", reqToken: testAdminToken[:16], status: 401},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{
+				Users: []User{{Username: "user1", Password: "pass1"}},
+				Admin: Admin{Token: tc.token},
+			}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			h := NewServer(conf).AdminHandler(zap.NewNop().Sugar())
+
+			// health checks are always available
+			for _, path := range []string{"/health", "/ready"} {
+				if status := testAdminRequest(h, "GET", path, tc.local, tc.reqToken); status != 200 {
+					t.Errorf("%s: expected 200, got %d", path, status)
+				}
+			}
+
+			for _, r := range []struct{ method, path string }{
+				{"GET", "/metrics"},
+				{"GET", "/connections"},
+				{"POST", "/maintenance"},
+				{"POST", "/capture?user=user1"},
+			} {
+				status := testAdminRequest(h, r.method, r.path, tc.local, tc.reqToken)
+				if tc.status == 401 && status != 401 || tc.status != 401 && status == 401 {
+					t.Errorf("%s %s: expected %d, got %d", r.method, r.path, tc.status, status)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminAvailability(t *testing.T) {
+	conf := &Config{
+		Users: []User{
+			{Username: "user1", Password: "pass1"},
+			{Username: "over-quota", Password: "pass2", MonthlyQuota: 1024},
+			{Username: "expired", Password: "pass3", Expires: time.Now().Add(-time.Hour)},
+		},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	srv.accounting.Add("over-quota", 2048, 1024, nil, time.Now())
+	h := srv.AdminHandler(zap.NewNop().Sugar())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// all users are listed with 200 status
+	rw := get("/availability")
+	if rw.Code != 200 {
+		t.Fatalf("expected 200, got %d", rw.Code)
+	}
+	for _, line := range []string{
+		"user1: available\n",
+		"over-quota: throttled, monthly quota is used, retry after ",
+		"expired: throttled, account expired\n",
+	} {
+		if !strings.Contains(rw.Body.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, rw.Body.String())
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		status int
+		retry  bool // Retry-After header is expected
+	}{
+		"user1":      {status: 200},
+		"over-quota": {status: 429, retry: true},
+		"expired":    {status: 429},
+		"unknown":    {status: 404},
+	} {
+		rw := get("/availability?user=" + name)
+		if rw.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", name, tc.status, rw.Code)
+		}
+		retry := rw.Header().Get("Retry-After")
+		if seconds, err := strconv.Atoi(retry); tc.retry && (err != nil || seconds <= 0) || !tc.retry && retry != "" {
+			t.Errorf("%s: unexpected Retry-After %q", name, retry)
+		}
+	}
+}
+
+func TestAdminCheckListen(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"":               true,
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"192.0.2.1:8080": false,
+	} {
+		if err := (&Admin{}).CheckListen(addr); (err == nil) != ok {
+			t.Errorf("%q: unexpected error %v", addr, err)
+		}
+		if err := (&Admin{Token: testAdminToken}).CheckListen(addr); err != nil {
+			t.Errorf("%q: unexpected error with token %v", addr, err)
+		}
+	}
+
+	if err := (&Config{Admin: Admin{Token: "short"}}).Validate(); err == nil {
+		t.Error("expected short token to be rejected")
+	}
+}
+
+func TestAdminCaptureRules(t *testing.T) {
+	for name, tc := range map[string]struct {
+		token  string
+		status int
+	}{
+		"NoToken": {status: 403},
+		"Token":   {token: testAdminToken, status: 200},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{
+				Users:   []User{{Username: "user1", Password: "pass1"}},
+				Admin:   Admin{Token: tc.token},
+				Capture: Capture{Enabled: true, Dir: t.TempDir()},
+			}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			h := srv.AdminHandler(zap.NewNop().Sugar())
+
+			if status := testAdminRequest(h, "POST", "/capture?user=user1", "127.0.0.1", tc.token); status != tc.status {
+				t.Fatalf("expected %d, got %d", tc.status, status)
+			}
+			rules := srv.captureRules.Active(time.Now())
+			if tc.status == 200 && len(rules) != 1 || tc.status != 200 && len(rules) != 0 {
+				t.Fatalf("unexpected rules %v", rules)
+			}
+		})
+	}
+}
+
+func TestAdminCrossSite(t *testing.T) {
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	h := srv.AdminHandler(zap.NewNop().Sugar())
+
+	for name, tc := range map[string]struct {
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		"Client":          {method: "POST", status: 200},
+		"SameOrigin":      {method: "POST", headers: map[string]string{"Origin": "http://example.com", "Sec-Fetch-Site": "same-origin"}, status: 200},
+		"SameOriginOld":   {method: "POST", headers: map[string]string{"Origin": "http://example.com"}, status: 200},
+		"UserInitiated":   {method: "POST", headers: map[string]string{"Sec-Fetch-Site": "none"}, status: 200},
+		"CrossSite":       {method: "POST", headers: map[string]string{"Origin": "http://evil.example", "Sec-Fetch-Site": "cross-site"}, status: 403},
+		"SameSite":        {method: "DELETE", headers: map[string]string{"Origin": "http://other.example.com", "Sec-Fetch-Site": "same-site"}, status: 403},
+		"CrossSiteOld":    {method: "DELETE", headers: map[string]string{"Origin": "http://evil.example"}, status: 403},
+		"NullOrigin":      {method: "POST", headers: map[string]string{"Origin": "null"}, status: 403},
+		"CrossSiteGet":    {method: "GET", headers: map[string]string{"Origin": "http://evil.example", "Sec-Fetch-Site": "cross-site"}, status: 200},
+		"CrossSiteOldGet": {method: "GET", headers: map[string]string{"Origin": "http://evil.example"}, status: 200},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv.SetMaintenance(false)
+
+			// httptest requests are sent to example.com
+			req := httptest.NewRequest(tc.method, "/maintenance", nil)
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}))
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tc.status {
+				t.Errorf("expected %d, got %d", tc.status, rw.Code)
+			}
+			if tc.status == 403 && srv.Maintenance() {
+				t.Error("rejected request changed maintenance mode")
+			}
+		})
+	}
+}
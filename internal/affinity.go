@@ -0,0 +1,63 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// affinitySweepSize is the number of cached entries after which expired ones are removed.
+const affinitySweepSize = 1024
+
+type affinityEntry struct {
+	port    int
+	expires time.Time
+}
+
+// affinityCache maps (client, destination) pairs to outbound local ports,
+// so repeated connections from the same client to the same destination use the same source port.
+type affinityCache struct {
+	m     sync.Mutex
+	ports map[string]affinityEntry
+}
+
+func newAffinityCache() *affinityCache {
+	return &affinityCache{
+		ports: make(map[string]affinityEntry),
+	}
+}
+
+// Get returns preferred local port for key, or 0 if there is none.
+func (a *affinityCache) Get(key string, now time.Time) int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	e, ok := a.ports[key]
+	if !ok || now.After(e.expires) {
+		return 0
+	}
+	return e.port
+}
+
+// Set remembers local port for key for a window.
+func (a *affinityCache) Set(key string, port int, window time.Duration, now time.Time) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if len(a.ports) >= affinitySweepSize {
+		for k, e := range a.ports {
+			if now.After(e.expires) {
+				delete(a.ports, k)
+			}
+		}
+	}
+	a.ports[key] = affinityEntry{port: port, expires: now.Add(window)}
+}
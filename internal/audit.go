@@ -0,0 +1,261 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Audit event types.
+const (
+	AuditAuthSuccess = "auth_success"
+	AuditAuthFailure = "auth_failure"
+	AuditOverQuota   = "over_quota"
+	AuditACLDeny     = "acl_deny"
+)
+
+const (
+	defaultAuditBufferSize = 1000
+	auditSendTimeout       = 5 * time.Second
+)
+
+// AuditEvent is a security-relevant event sent to audit sinks.
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	User        string    `json:"user,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Listener    string    `json:"listener,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// AuditSink delivers audit events to an external system. Send is called from a single goroutine.
+type AuditSink interface {
+	Send(ctx context.Context, e *AuditEvent) error
+}
+
+// webhookSink POSTs events as JSON objects to HTTP(S) URL.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookSink) Send(ctx context.Context, e *AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogSink sends events as RFC 5424 messages with JSON payload over UDP or TCP (newline-framed).
+// Connection is re-established after errors.
+type syslogSink struct {
+	network  string
+	addr     string
+	hostname string
+	conn     net.Conn
+}
+
+func (s *syslogSink) Send(ctx context.Context, e *AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// facility security/authorization (4), severity notice (5) or warning (4) for failures and denials
+	pri := 4*8 + 5
+	if e.Type != AuditAuthSuccess {
+		pri = 4*8 + 4
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s telesock %d %s - %s\n",
+		pri, e.Time.UTC().Format(time.RFC3339Nano), s.hostname, os.Getpid(), e.Type, b,
+	)
+
+	if s.conn == nil {
+		d := &net.Dialer{Timeout: auditSendTimeout}
+		if s.conn, err = d.DialContext(ctx, s.network, s.addr); err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	}
+	if _, err = s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// newAuditSink returns sink for webhook URL or syslog URL (udp://host:port or tcp://host:port),
+// checked by Config.Validate.
+func newAuditSink(rawurl string) (AuditSink, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &webhookSink{url: rawurl, client: &http.Client{Timeout: auditSendTimeout}}, nil
+	case "udp", "tcp":
+		if _, _, err = net.SplitHostPort(u.Host); err != nil {
+			return nil, err
+		}
+		hostname, _ := os.Hostname()
+		if hostname == "" {
+			hostname = "-"
+		}
+		return &syslogSink{network: u.Scheme, addr: u.Host, hostname: hostname}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+}
+
+// auditQueue buffers events for a single sink, so slow or unavailable sinks never block connections.
+type auditQueue struct {
+	name   string
+	sink   AuditSink
+	events chan *AuditEvent
+}
+
+// newAuditQueues returns queues for sinks configured in Audit.
+func newAuditQueues(a Audit) []*auditQueue {
+	size := a.BufferSize
+	if size == 0 {
+		size = defaultAuditBufferSize
+	}
+
+	var res []*auditQueue
+	for _, s := range []struct {
+		name string
+		url  string
+	}{
+		{"webhook", a.Webhook},
+		{"syslog", a.Syslog},
+	} {
+		if s.url == "" {
+			continue
+		}
+		sink, err := newAuditSink(s.url)
+		if err != nil {
+			continue // checked by Config.Validate
+		}
+		res = append(res, &auditQueue{name: s.name, sink: sink, events: make(chan *AuditEvent, size)})
+	}
+	return res
+}
+
+// audit queues event for all audit sinks. Events are dropped when a queue is full.
+func (s *Server) audit(e *AuditEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, q := range s.auditQueues {
+		select {
+		case q.events <- e:
+		default:
+			s.metrics.Inc("audit_events_dropped_total", "sink", q.name)
+		}
+	}
+}
+
+// RunAudit sends queued audit events to sinks until context is canceled.
+// Sinks are configured on start, so changing them requires restart.
+func (s *Server) RunAudit(ctx context.Context, l *zap.SugaredLogger) {
+	done := make(chan struct{})
+	for _, q := range s.auditQueues {
+		go func(q *auditQueue) {
+			s.runAuditQueue(ctx, q, l.With(zap.String("sink", q.name)))
+			done <- struct{}{}
+		}(q)
+	}
+	for range s.auditQueues {
+		<-done
+	}
+}
+
+// runAuditQueue sends events from a single queue. Failures are logged only when sink becomes unavailable
+// and when it recovers, so an unavailable sink doesn't flood logs.
+func (s *Server) runAuditQueue(ctx context.Context, q *auditQueue, l *zap.SugaredLogger) {
+	var failing bool
+	for {
+		var e *AuditEvent
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-q.events:
+		}
+
+		sctx, cancel := context.WithTimeout(ctx, auditSendTimeout)
+		err := q.sink.Send(sctx, e)
+		cancel()
+		if err != nil {
+			s.metrics.Inc("audit_events_failed_total", "sink", q.name)
+			if !failing {
+				l.Warnf("Failed to send audit event: %s; following failures are not logged until recovery.", err)
+				failing = true
+			}
+			continue
+		}
+
+		s.metrics.Inc("audit_events_sent_total", "sink", q.name)
+		if failing {
+			l.Infof("Audit events are sent again.")
+			failing = false
+		}
+	}
+}
+
+// audit sends audit event of given type for this connection.
+func (tcp *TCPConn) audit(typ, username, destination, reason string) {
+	tcp.srv.audit(&AuditEvent{
+		Type:        typ,
+		User:        username,
+		Client:      remoteAddrString(tcp.client),
+		Listener:    tcp.listener,
+		Destination: destination,
+		Reason:      reason,
+	})
+}
+
+// remoteAddrString returns remote address of the connection, or empty string if it is not available.
+func remoteAddrString(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
@@ -0,0 +1,150 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAuditWebhook(t *testing.T) {
+	// the first request fails
+	var m sync.Mutex
+	var requests int
+	var events []AuditEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e AuditEvent
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		events = append(events, e)
+	}))
+	defer ts.Close()
+	received := func() int {
+		m.Lock()
+		defer m.Unlock()
+		return requests
+	}
+
+	conf := &Config{
+		Users: []User{{Username: "user1", Password: "pass1"}},
+		Audit: Audit{Webhook: ts.URL},
+	}
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, conf, l)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.RunAudit(ctx, l)
+		close(done)
+	}()
+	defer waitReturned(t, done)
+	defer cancel()
+
+	authFailure := func() string {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = c.Write([]byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'w', 'r', 'o', 'n', 'g'}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		return c.LocalAddr().String()
+	}
+
+	// failed event is not retried, next events are delivered
+	authFailure()
+	waitFor(t, func() bool { return received() == 1 })
+	c, _ := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	c.Close()
+	waitFor(t, func() bool { return received() == 2 })
+	client := authFailure()
+	waitFor(t, func() bool { return received() == 3 })
+	time.Sleep(100 * time.Millisecond)
+	if r := received(); r != 3 {
+		t.Fatalf("expected 3 requests, got %d", r)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(events) != 2 || events[0].Type != AuditAuthSuccess || events[0].User != "user1" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	e := events[1]
+	if e.Type != AuditAuthFailure || e.User != "user1" || e.Client != client || e.Listener != ListenerDefault ||
+		e.Reason != "invalid username or password" || time.Since(e.Time) > time.Minute {
+		t.Errorf("unexpected event: %+v", e)
+	}
+
+	// failure and recovery are logged once and counted
+	var warnings, recoveries int
+	for _, e := range log.Entries("") {
+		msg, _ := e["msg"].(string)
+		warnings += strings.Count(msg, "Failed to send audit event: ")
+		recoveries += strings.Count(msg, "Audit events are sent again.")
+	}
+	if warnings != 1 || recoveries != 1 {
+		t.Errorf("expected a single failure and recovery messages, got %d and %d", warnings, recoveries)
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	for _, line := range []string{
+		`telesock_audit_events_failed_total{sink="webhook"} 1`,
+		`telesock_audit_events_sent_total{sink="webhook"} 2`,
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("expected %s:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestAuditQueueFull(t *testing.T) {
+	conf := &Config{Audit: Audit{Webhook: "http://127.0.0.1:1/", BufferSize: 2}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+
+	// events are dropped without blocking when the sink doesn't keep up
+	for i := 0; i < 5; i++ {
+		srv.audit(&AuditEvent{Type: AuditAuthSuccess})
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), `telesock_audit_events_dropped_total{sink="webhook"} 3`+"\n") {
+		t.Errorf("expected dropped events to be counted:\n%s", metrics.String())
+	}
+}
@@ -0,0 +1,157 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthSessions configures fast re-authentication of rapidly reconnecting clients: after successful authentication,
+// the following connections from the same client address with the same username and password skip
+// password hash verification for TTL. The protocol exchange is unchanged.
+type AuthSessions struct {
+	TTL        time.Duration `yaml:"ttl"`         // zero disables sessions
+	IPv4Prefix int           `yaml:"ipv4_prefix"` // addresses in the same network share sessions, 32 if zero
+	IPv6Prefix int           `yaml:"ipv6_prefix"` // 64 if zero
+	Exclude    []string      `yaml:"exclude"`     // shared addresses and networks (NAT, CGNAT) never get sessions
+}
+
+// authSessionsSweepSize is the number of sessions after which expired ones are removed.
+const authSessionsSweepSize = 1024
+
+type authSession struct {
+	user     *User
+	password [sha256.Size]byte // salted hash
+	expires  time.Time
+}
+
+// authSessions remembers recently authenticated (client network, username) pairs.
+// It is built by Config.Validate, so all sessions are dropped on configuration reload,
+// including changes of users' passwords.
+type authSessions struct {
+	conf     AuthSessions
+	exclude  []*net.IPNet
+	v4Mask   net.IPMask
+	v6Mask   net.IPMask
+	salt     [16]byte
+	m        sync.Mutex
+	sessions map[string]authSession
+}
+
+// newAuthSessions returns sessions store for validated settings, or nil if sessions are disabled.
+func newAuthSessions(conf AuthSessions) (*authSessions, error) {
+	if conf.TTL <= 0 {
+		return nil, nil
+	}
+
+	exclude, err := parseNets(conf.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("auth_sessions: exclude: %s", err)
+	}
+	v4, v6 := conf.IPv4Prefix, conf.IPv6Prefix
+	if v4 == 0 {
+		v4 = 32
+	}
+	if v6 == 0 {
+		v6 = 64
+	}
+	if v4 < 0 || v4 > 32 || v6 < 0 || v6 > 128 {
+		return nil, fmt.Errorf("auth_sessions: invalid ipv4_prefix or ipv6_prefix")
+	}
+
+	s := &authSessions{
+		conf:     conf,
+		exclude:  exclude,
+		v4Mask:   net.CIDRMask(v4, 32),
+		v6Mask:   net.CIDRMask(v6, 128),
+		sessions: make(map[string]authSession),
+	}
+	if _, err := rand.Read(s.salt[:]); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// key returns session key for client address and username, or empty string if address is excluded.
+func (s *authSessions) key(ip net.IP, username []byte) string {
+	for _, n := range s.exclude {
+		if n.Contains(ip) {
+			return ""
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(s.v4Mask).String() + "\x00" + string(username)
+	}
+	return ip.Mask(s.v6Mask).String() + "\x00" + string(username)
+}
+
+func (s *authSessions) hash(password []byte) [sha256.Size]byte {
+	return sha256.Sum256(append(s.salt[:len(s.salt):len(s.salt)], password...))
+}
+
+// Get returns user of unexpired session with the same password, or nil.
+func (s *authSessions) Get(key string, password []byte, now time.Time) *User {
+	s.m.Lock()
+	e, ok := s.sessions[key]
+	s.m.Unlock()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+
+	h := s.hash(password)
+	if subtle.ConstantTimeCompare(h[:], e.password[:]) != 1 {
+		return nil
+	}
+	return e.user
+}
+
+// Set remembers successfully authenticated user for TTL.
+func (s *authSessions) Set(key string, u *User, password []byte, now time.Time) {
+	e := authSession{user: u, password: s.hash(password), expires: now.Add(s.conf.TTL)}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if len(s.sessions) >= authSessionsSweepSize {
+		for k, e := range s.sessions {
+			if now.After(e.expires) {
+				delete(s.sessions, k)
+			}
+		}
+	}
+	s.sessions[key] = e
+}
+
+// authenticateFrom is Authenticate for client address ip using auth sessions, if enabled.
+// It returns true if user was authenticated by session.
+func (c *Config) authenticateFrom(ip net.IP, username, password []byte, now time.Time) (*User, bool) {
+	var key string
+	if c.sessions != nil && ip != nil {
+		key = c.sessions.key(ip, username)
+	}
+	if key == "" {
+		return c.Authenticate(ip, username, password), false
+	}
+
+	if u := c.sessions.Get(key, password, now); u != nil {
+		return u, true
+	}
+	u := c.Authenticate(ip, username, password)
+	if u != nil {
+		c.sessions.Set(key, u, password, now)
+	}
+	return u, false
+}
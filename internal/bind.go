@@ -0,0 +1,144 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultBindTimeout is used when bind timeout is not set.
+const defaultBindTimeout = 2 * time.Minute
+
+// Bind configures support of SOCKS5 BIND command, which accepts an inbound connection for the client.
+type Bind struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"` // for inbound connection; defaultBindTimeout if not set
+}
+
+// validate checks BIND settings.
+func (b *Bind) validate() error {
+	if b.Timeout < 0 {
+		return fmt.Errorf("bind: timeout should not be negative")
+	}
+	return nil
+}
+
+// timeout returns the time to wait for inbound connection.
+func (b *Bind) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return defaultBindTimeout
+}
+
+// bind handles BIND request: it listens for an inbound connection, sends the first reply with listening address,
+// accepts connection from peer (if its IP address is known), and sends the second reply with its address.
+// Accepted connection is then relayed by Run. It returns false if request failed.
+func (tcp *TCPConn) bind(ctx context.Context, peer *net.TCPAddr, l *zap.SugaredLogger) bool {
+	if !tcp.admit("BIND listener", "", l) {
+		return false
+	}
+
+	ln, err := net.ListenTCP("tcp", nil)
+	if err != nil {
+		l.Errorf("Failed to listen for BIND: %s.", err)
+		tcp.replyFailure(failConnect, l)
+		return false
+	}
+	defer ln.Close()
+
+	// listening address is the one the client connected to, unknown for non-TCP connections (e.g. tunnel)
+	bnd := &net.TCPAddr{Port: ln.Addr().(*net.TCPAddr).Port}
+	if addr, ok := tcp.client.LocalAddr().(*net.TCPAddr); ok {
+		bnd.IP = addr.IP
+	}
+	if err = tcp.writeReply(0, bnd); err != nil {
+		l.Error(err)
+		return false
+	}
+
+	timeout := tcp.conf.Bind.timeout()
+	from := "any address"
+	if peer.IP != nil && !peer.IP.IsUnspecified() {
+		from = peer.IP.String()
+	}
+	l.Infof("Waiting up to %s for inbound connection from %s on %s.", timeout, from, bnd)
+
+	// listener is closed when the client closes control connection or ctx is canceled
+	watchCtx, stopWatch := tcp.watchClient(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-watchCtx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+	server, err := tcp.acceptPeer(ln, peer, time.Now().Add(timeout), l)
+	close(stop)
+	if stopWatch() {
+		if server != nil {
+			server.Close()
+		}
+		l.Infof("Client disconnected while waiting for inbound connection.")
+		tcp.end(endClientAbandoned)
+		return false
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			l.Warnf("No inbound connection from %s within %s.", from, timeout)
+			tcp.replyFailure(failBindTimeout, l)
+		} else {
+			l.Error(err)
+			tcp.replyFailure(failConnect, l)
+		}
+		return false
+	}
+
+	tcp.server = server
+	raddr := server.RemoteAddr().(*net.TCPAddr)
+	tcp.target = raddr.String()
+	tcp.l = tcp.l.With(zap.String("relay_path", relayPathBind))
+	l = l.With(zap.String("relay_path", relayPathBind))
+	if err = tcp.writeReply(0, raddr); err != nil {
+		l.Error(err)
+		return false
+	}
+
+	tcp.srv.metrics.Inc("bind_accepted_total")
+	l.Infof("Inbound connection %s->%s is accepted.", raddr, server.LocalAddr())
+	return true
+}
+
+// acceptPeer accepts the first connection from peer's IP address until deadline; connections from other
+// addresses are closed. Any address is accepted if peer's IP address is unspecified.
+func (tcp *TCPConn) acceptPeer(ln *net.TCPListener, peer *net.TCPAddr, deadline time.Time, l *zap.SugaredLogger) (*net.TCPConn, error) {
+	if err := ln.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		raddr := c.RemoteAddr().(*net.TCPAddr)
+		if peer.IP == nil || peer.IP.IsUnspecified() || peer.IP.Equal(raddr.IP) {
+			return c, nil
+		}
+		l.Warnf("Inbound connection from unexpected address %s is closed, waiting for %s.", raddr, peer.IP)
+		tcp.srv.metrics.Inc("bind_rejected_total")
+		c.Close()
+	}
+}
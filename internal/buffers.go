@@ -0,0 +1,80 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Relay buffer sizes: default, reduced when memory budget is nearly exhausted, and minimal.
+const (
+	relayBufferSize        = 32 * 1024
+	relayBufferSizeReduced = 4 * 1024
+	relayBufferSizeMin     = 1024
+)
+
+// relayPace is a delay after each full buffer read while memory budget is exceeded.
+const relayPace = 10 * time.Millisecond
+
+// relayBuffers tracks approximate memory committed to relay buffers.
+type relayBuffers struct {
+	used int64 // atomic
+}
+
+// Get allocates relay buffer, shrinking it if budget would be exceeded. Zero budget means unlimited.
+// Buffers are never refused: connections are slowed down instead.
+func (rb *relayBuffers) Get(budget int64) []byte {
+	size := relayBufferSize
+	if budget > 0 {
+		used := atomic.LoadInt64(&rb.used)
+		switch {
+		case used+relayBufferSize <= budget:
+		case used+relayBufferSizeReduced <= budget:
+			size = relayBufferSizeReduced
+		default:
+			size = relayBufferSizeMin
+		}
+	}
+
+	atomic.AddInt64(&rb.used, int64(size))
+	return make([]byte, size)
+}
+
+// Put releases buffer returned by Get.
+func (rb *relayBuffers) Put(b []byte) {
+	atomic.AddInt64(&rb.used, -int64(len(b)))
+}
+
+// Used returns memory committed to relay buffers.
+func (rb *relayBuffers) Used() int64 {
+	return atomic.LoadInt64(&rb.used)
+}
+
+// Over returns true if budget is exceeded.
+func (rb *relayBuffers) Over(budget int64) bool {
+	return budget > 0 && rb.Used() > budget
+}
+
+// pacedReader paces reads filling the whole buffer (i.e. the heaviest connections) while memory budget is exceeded.
+// It also hides io.WriterTo of the underlying reader, so io.CopyBuffer uses the given buffer.
+type pacedReader struct {
+	r   io.Reader
+	tcp *TCPConn
+}
+
+func (pr *pacedReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n == len(p) && pr.tcp.srv.buffers.Over(int64(pr.tcp.conf.RelayMemoryBudget)) {
+		time.Sleep(relayPace)
+	}
+	return n, err
+}
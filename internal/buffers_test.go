@@ -0,0 +1,107 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelayBuffersBudget(t *testing.T) {
+	var rb relayBuffers
+	budget := int64(relayBufferSize + relayBufferSizeReduced)
+
+	// buffers shrink as budget is used, but are never refused
+	var bufs [][]byte
+	for _, size := range []int{relayBufferSize, relayBufferSizeReduced, relayBufferSizeMin, relayBufferSizeMin} {
+		b := rb.Get(budget)
+		if len(b) != size {
+			t.Fatalf("expected %d bytes, got %d", size, len(b))
+		}
+		bufs = append(bufs, b)
+	}
+	if used := rb.Used(); used != budget+2*relayBufferSizeMin || !rb.Over(budget) {
+		t.Errorf("expected budget to be exceeded, used %d", used)
+	}
+
+	for _, b := range bufs {
+		rb.Put(b)
+	}
+	if used := rb.Used(); used != 0 || rb.Over(budget) {
+		t.Errorf("expected all buffers to be released, used %d", used)
+	}
+
+	// zero budget is unlimited
+	for i := 0; i < 10; i++ {
+		if b := rb.Get(0); len(b) != relayBufferSize {
+			t.Fatalf("expected %d bytes, got %d", relayBufferSize, len(b))
+		}
+	}
+	if rb.Over(0) {
+		t.Error("zero budget should never be exceeded")
+	}
+}
+
+func TestRelayMemoryBudget(t *testing.T) {
+	const conns = 4
+	conf := &Config{
+		Users:             []User{{Username: "user1", Password: "pass1"}},
+		RelayMemoryBudget: 2 * relayBufferSizeReduced,
+	}
+	srv, addr := testServer(t, conf)
+
+	// all connections are relayed with small buffers and paced, without losing data
+	payload := bytes.Repeat([]byte("telesock "), 64*1024/9)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+		defer c.Close()
+		if res[1] != 0 {
+			t.Fatalf("request failed: % x", res)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.SetDeadline(time.Now().Add(10 * time.Second))
+			go c.Write(payload)
+			actual := make([]byte, len(payload))
+			if _, err := io.ReadFull(c, actual); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(actual, payload) {
+				t.Error("data is corrupted")
+			}
+		}()
+	}
+
+	// committed memory is bounded by the budget plus minimal buffers
+	waitFor(t, func() bool { return srv.Active() == conns })
+	if used, max := srv.buffers.Used(), int64(conf.RelayMemoryBudget)+2*conns*relayBufferSizeMin; used > max {
+		t.Errorf("expected at most %d bytes of buffers, got %d", max, used)
+	}
+	srv.updateGauges()
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "telesock_relay_buffer_budget_bytes 8192\n") {
+		t.Errorf("expected budget gauge:\n%s", metrics.String())
+	}
+
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 10*relayPace {
+		t.Errorf("expected relay to be paced, took %s", elapsed)
+	}
+}
@@ -0,0 +1,328 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Values of capture format setting.
+const (
+	CaptureFormatRaw  = "raw" // default
+	CaptureFormatPcap = "pcap"
+)
+
+const (
+	defaultCaptureMaxSize      = 64 << 20
+	defaultCaptureMaxDuration  = 10 * time.Minute
+	defaultCaptureRuleDuration = 10 * time.Minute // for rules added via admin API
+)
+
+// Capture configures copying of relayed traffic of matching connections to files, for debugging
+// in controlled environments. Captured files contain all relayed data, including credentials
+// and personal data, so capture is disabled unless Enabled is set explicitly.
+type Capture struct {
+	Enabled     bool          `yaml:"enabled"`
+	Dir         string        `yaml:"dir"`
+	Format      string        `yaml:"format"`       // CaptureFormatRaw if empty
+	MaxSize     ByteSize      `yaml:"max_size"`     // per connection, both directions; defaultCaptureMaxSize if zero
+	MaxDuration time.Duration `yaml:"max_duration"` // per connection; defaultCaptureMaxDuration if zero
+	Rules       []CaptureRule `yaml:"rules"`        // more rules may be added via admin API
+}
+
+// CaptureRule matches connections by user and/or destination; at least one is required.
+type CaptureRule struct {
+	User        string `yaml:"user"`
+	Destination string `yaml:"destination"` // CIDR, IP address or host pattern
+}
+
+// validate checks capture settings.
+func (c *Capture) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Dir == "" {
+		return fmt.Errorf("capture: dir is required")
+	}
+	switch c.Format {
+	case "", CaptureFormatRaw, CaptureFormatPcap:
+	default:
+		return fmt.Errorf("capture: format should be %q or %q", CaptureFormatRaw, CaptureFormatPcap)
+	}
+	if c.MaxSize < 0 || c.MaxDuration < 0 {
+		return fmt.Errorf("capture: max_size and max_duration should not be negative")
+	}
+	for i, r := range c.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("capture: rules[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// limits returns configured or default limits.
+func (c *Capture) limits() (int64, time.Duration) {
+	size, d := int64(c.MaxSize), c.MaxDuration
+	if size == 0 {
+		size = defaultCaptureMaxSize
+	}
+	if d == 0 {
+		d = defaultCaptureMaxDuration
+	}
+	return size, d
+}
+
+// validate checks capture rule.
+func (r CaptureRule) validate() error {
+	if r.User == "" && r.Destination == "" {
+		return fmt.Errorf("user or destination is required")
+	}
+	if r.Destination != "" {
+		return validateDestination(r.Destination)
+	}
+	return nil
+}
+
+// match returns true if connection of user to destination host or IP address matches the rule.
+func (r CaptureRule) match(user, host string, ip net.IP) bool {
+	if r.User != "" && r.User != user {
+		return false
+	}
+	return r.Destination == "" || matchDestination(r.Destination, host, ip)
+}
+
+// String returns rule description for logs and admin API.
+func (r CaptureRule) String() string {
+	return fmt.Sprintf("user=%q destination=%q", r.User, r.Destination)
+}
+
+// captureRule is a temporary rule added via admin API.
+type captureRule struct {
+	CaptureRule
+	expires time.Time
+}
+
+// captureRules holds temporary rules added via admin API. They are kept on reload,
+// but used only while capture is enabled in configuration.
+type captureRules struct {
+	m     sync.Mutex
+	rules []captureRule
+}
+
+// Add adds rule for duration.
+func (cr *captureRules) Add(r CaptureRule, d time.Duration, now time.Time) {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	cr.rules = append(cr.rules, captureRule{CaptureRule: r, expires: now.Add(d)})
+}
+
+// Clear removes all rules. It returns the number of removed unexpired rules.
+func (cr *captureRules) Clear(now time.Time) int {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	var n int
+	for _, r := range cr.rules {
+		if now.Before(r.expires) {
+			n++
+		}
+	}
+	cr.rules = nil
+	return n
+}
+
+// Active returns unexpired rules, removing expired ones.
+func (cr *captureRules) Active(now time.Time) []captureRule {
+	cr.m.Lock()
+	defer cr.m.Unlock()
+
+	active := cr.rules[:0]
+	for _, r := range cr.rules {
+		if now.Before(r.expires) {
+			active = append(active, r)
+		}
+	}
+	cr.rules = active
+	return append([]captureRule(nil), active...)
+}
+
+// captureMatch returns true if capture is enabled and connection of user to destination host or IP address
+// matches any configured rule or unexpired rule added via admin API.
+func (s *Server) captureMatch(conf *Config, user, host string, ip net.IP) bool {
+	if !conf.Capture.Enabled {
+		return false
+	}
+	for _, r := range conf.Capture.Rules {
+		if r.match(user, host, ip) {
+			return true
+		}
+	}
+	for _, r := range s.captureRules.Active(time.Now()) {
+		if r.match(user, host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// capture writes a copy of relayed data of both directions to files until size or time limit is reached.
+// Errors never affect the relay: the first one is logged, and the following data is not captured.
+type capture struct {
+	m       sync.Mutex
+	l       *zap.SugaredLogger
+	files   []*os.File // raw format: data sent by the client and by the server; pcap: single file
+	pcap    *pcapWriter
+	size    int64
+	maxSize int64
+	timer   *time.Timer // stops capture after time limit
+	stopped bool        // by limit or error
+	failed  bool        // by error
+	refs    int         // directions still relaying
+}
+
+// captureWriter writes data of a single direction to capture.
+type captureWriter struct {
+	c          *capture
+	fromClient bool
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	cw.c.write(cw.fromClient, p)
+	return len(p), nil
+}
+
+// Close is called when direction is finished; files are closed after both directions are finished.
+func (cw *captureWriter) Close() error {
+	cw.c.release()
+	return nil
+}
+
+func (c *capture) write(fromClient bool, p []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.stopped {
+		return
+	}
+	if c.size+int64(len(p)) > c.maxSize {
+		c.l.Warnf("Capture stopped: size limit %s reached.", ByteSize(c.maxSize))
+		c.stopped = true
+		return
+	}
+
+	var err error
+	switch {
+	case c.pcap != nil:
+		err = c.pcap.Data(fromClient, p)
+	case fromClient:
+		_, err = c.files[0].Write(p)
+	default:
+		_, err = c.files[1].Write(p)
+	}
+	if err != nil {
+		c.l.Errorf("Capture stopped: %s.", err)
+		c.stopped, c.failed = true, true
+		return
+	}
+	c.size += int64(len(p))
+}
+
+// expire stops capture after time limit.
+func (c *capture) expire(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if !c.stopped {
+		c.l.Warnf("Capture stopped: time limit %s reached, %s captured.", d, ByteSize(c.size))
+		c.stopped = true
+	}
+}
+
+// release closes files after the last direction is finished.
+func (c *capture) release() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.refs--; c.refs > 0 {
+		return
+	}
+	c.timer.Stop()
+	if c.pcap != nil && !c.failed {
+		c.pcap.Close()
+	}
+	for _, f := range c.files {
+		f.Close()
+	}
+	c.l.Infof("Capture finished, %s captured.", ByteSize(c.size))
+}
+
+// captureFileNameReplacer makes addresses safe for file names.
+var captureFileNameReplacer = strings.NewReplacer(":", "_", "/", "_", "\\", "_", "[", "", "]", "")
+
+// openCapture creates capture files and returns writers for data sent by the client and by the server.
+// Both writers should be closed when their directions are finished.
+func (tcp *TCPConn) openCapture(destination string) (fromClient, fromServer *captureWriter, err error) {
+	conf := &tcp.conf.Capture
+	prefix := filepath.Join(conf.Dir, captureFileNameReplacer.Replace(fmt.Sprintf(
+		"%s-%s-%s-%s",
+		time.Now().UTC().Format("20060102T150405.000000"), tcp.user.Username, remoteAddrString(tcp.client), destination,
+	)))
+
+	suffixes, name := []string{".client", ".server"}, prefix+".{client,server}"
+	if conf.Format == CaptureFormatPcap {
+		suffixes, name = []string{".pcap"}, prefix+".pcap"
+	}
+	var files []*os.File
+	for _, suffix := range suffixes {
+		f, err := os.OpenFile(prefix+suffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		files = append(files, f)
+	}
+
+	maxSize, maxDuration := conf.limits()
+	c := &capture{
+		l:       tcp.l,
+		files:   files,
+		maxSize: maxSize,
+		refs:    2,
+	}
+	if conf.Format == CaptureFormatPcap {
+		if c.pcap, err = newPcapWriter(files[0], tcpAddr(tcp.client.RemoteAddr()), tcpAddr(tcp.server.RemoteAddr())); err != nil {
+			files[0].Close()
+			return nil, nil, err
+		}
+	}
+	c.timer = time.AfterFunc(maxDuration, func() { c.expire(maxDuration) })
+
+	tcp.l.Warnf("Relayed traffic is captured to %s (up to %s or %s).", name, ByteSize(maxSize), maxDuration)
+	return &captureWriter{c: c, fromClient: true}, &captureWriter{c: c}, nil
+}
+
+// tcpAddr returns TCP address, or zero IPv4 address for other addresses.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
@@ -0,0 +1,90 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCapture(t *testing.T) {
+	fromClient, fromServer := make([]byte, 300<<10), make([]byte, 200<<10)
+	rand.Read(fromClient)
+	rand.Read(fromServer)
+
+	// destination reads client's data while sending its own
+	received := make(chan []byte, 2)
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		go c.Write(fromServer)
+		b, _ := ioutil.ReadAll(io.LimitReader(c, int64(len(fromClient))))
+		received <- b
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	dir := t.TempDir()
+	conf := &Config{
+		Users:   []User{{Username: "user1", Password: "pass1"}, {Username: "user2", Password: "pass2"}},
+		Capture: Capture{Enabled: true, Dir: dir, Rules: []CaptureRule{{User: "user1"}}},
+	}
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, conf, l)
+
+	for _, u := range conf.Users {
+		c, res := testRequest(t, addr, u.Username, u.Password, cmdConnect, dstAddr)
+		if res[1] != 0 {
+			t.Fatalf("%s: request failed: % x", u.Username, res)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		go c.Write(fromClient)
+		b := make([]byte, len(fromServer))
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, fromServer) {
+			t.Fatalf("%s: relayed data from server differs", u.Username)
+		}
+		if b = <-received; !bytes.Equal(b, fromClient) {
+			t.Fatalf("%s: relayed data from client differs", u.Username)
+		}
+		c.Close()
+		waitFor(t, func() bool { return srv.Active() == 0 })
+	}
+
+	// only the matching connection is captured, byte for byte
+	msg := "Capture finished, " + ByteSize(len(fromClient)+len(fromServer)).String() + " captured."
+	waitFor(t, func() bool { return len(log.Entries(msg)) == 1 })
+	for suffix, expected := range map[string][]byte{".client": fromClient, ".server": fromServer} {
+		files, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || !strings.Contains(filepath.Base(files[0]), "-user1-") {
+			t.Fatalf("expected a single user1 %s file, got %v", suffix, files)
+		}
+		actual, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: captured %d bytes differ from %d relayed", suffix, len(actual), len(expected))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/units"
+)
+
+// Chaos configures injection of network problems for testing clients. It breaks connections on purpose,
+// so it is used only if Enabled is set and the server is started with an explicit command-line flag.
+type Chaos struct {
+	Enabled          bool          `yaml:"enabled"`
+	ClientLatency    time.Duration `yaml:"client_latency"`    // added to every read from the client
+	ServerLatency    time.Duration `yaml:"server_latency"`    // added to every read from the server
+	Throughput       ByteSize      `yaml:"throughput"`        // per second and direction, randomly halved; zero disables
+	ResetProbability float64       `yaml:"reset_probability"` // of resetting a connection after reset_after bytes
+	ResetAfter       ByteSize      `yaml:"reset_after"`
+	ReplyDelay       time.Duration `yaml:"reply_delay"` // before successful CONNECT reply
+}
+
+// validate checks chaos settings.
+func (c *Chaos) validate() error {
+	if c.ClientLatency < 0 || c.ServerLatency < 0 || c.ReplyDelay < 0 {
+		return fmt.Errorf("chaos: client_latency, server_latency and reply_delay should not be negative")
+	}
+	if c.Throughput < 0 || c.ResetAfter < 0 {
+		return fmt.Errorf("chaos: throughput and reset_after should not be negative")
+	}
+	if c.ResetProbability < 0 || c.ResetProbability > 1 {
+		return fmt.Errorf("chaos: reset_probability should be between 0 and 1")
+	}
+	return nil
+}
+
+// String returns settings for logs and admin API.
+func (c *Chaos) String() string {
+	return fmt.Sprintf(
+		"client_latency=%s server_latency=%s throughput=%s reset_probability=%g reset_after=%s reply_delay=%s",
+		c.ClientLatency, c.ServerLatency, c.Throughput, c.ResetProbability, c.ResetAfter, c.ReplyDelay,
+	)
+}
+
+// update returns a copy of settings with values from query parameters of the same names.
+func (c Chaos) update(q url.Values) (*Chaos, error) {
+	for _, d := range []struct {
+		name string
+		p    *time.Duration
+	}{
+		{"client_latency", &c.ClientLatency},
+		{"server_latency", &c.ServerLatency},
+		{"reply_delay", &c.ReplyDelay},
+	} {
+		if v := q.Get(d.name); v != "" {
+			var err error
+			if *d.p, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("chaos: %s: %s", d.name, err)
+			}
+		}
+	}
+	for _, s := range []struct {
+		name string
+		p    *ByteSize
+	}{
+		{"throughput", &c.Throughput},
+		{"reset_after", &c.ResetAfter},
+	} {
+		if v := q.Get(s.name); v != "" {
+			n, err := units.ParseStrictBytes(v)
+			if err != nil {
+				return nil, fmt.Errorf("chaos: %s: invalid size %q", s.name, v)
+			}
+			*s.p = ByteSize(n)
+		}
+	}
+	if v := q.Get("reset_probability"); v != "" {
+		var err error
+		if c.ResetProbability, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("chaos: reset_probability: %s", err)
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Chaos returns effective chaos settings, or nil if chaos testing is disabled in configuration.
+// Settings changed via admin API take precedence over configured ones.
+func (s *Server) Chaos(conf *Config) *Chaos {
+	if !conf.Chaos.Enabled {
+		return nil
+	}
+	if c, _ := s.chaos.Load().(*Chaos); c != nil {
+		return c
+	}
+	return &conf.Chaos
+}
+
+// setChaos replaces settings changed via admin API; nil restores configured ones.
+func (s *Server) setChaos(c *Chaos) {
+	s.chaos.Store(c)
+}
+
+// chaosReader injects latency, throttling and resets into a single relay direction.
+type chaosReader struct {
+	r          io.Reader
+	tcp        *TCPConn
+	latency    time.Duration
+	throughput int64
+	resetAfter int64 // zero if connection is not reset
+}
+
+func (cr *chaosReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	if cr.latency > 0 {
+		time.Sleep(cr.latency)
+	}
+	if cr.throughput > 0 {
+		// between the configured throughput and a half of it
+		rate := float64(cr.throughput) * (0.5 + rand.Float64()/2)
+		time.Sleep(time.Duration(float64(n) / rate * float64(time.Second)))
+	}
+	if cr.resetAfter > 0 && atomic.AddInt64(&cr.tcp.chaosRelayed, int64(n)) >= cr.resetAfter {
+		if cr.tcp.stop(CloseChaosReset) {
+			cr.tcp.l.Warnf("Chaos: connection reset after %s.", ByteSize(cr.resetAfter))
+			cr.tcp.srv.metrics.Inc("chaos_injections_total", "kind", "reset")
+		}
+	}
+	return n, err
+}
+
+// chaosReaders wraps relay readers if chaos testing is enabled.
+func (tcp *TCPConn) chaosReaders(fromClient, fromServer io.Reader) (io.Reader, io.Reader) {
+	c := tcp.srv.Chaos(tcp.conf)
+	if c == nil {
+		return fromClient, fromServer
+	}
+
+	var resetAfter int64
+	if c.ResetAfter > 0 && rand.Float64() < c.ResetProbability {
+		resetAfter = int64(c.ResetAfter)
+	}
+	if c.ClientLatency == 0 && c.ServerLatency == 0 && c.Throughput == 0 && resetAfter == 0 {
+		return fromClient, fromServer
+	}
+
+	reset := "no reset"
+	if resetAfter > 0 {
+		reset = "reset after " + ByteSize(resetAfter).String()
+	}
+	tcp.l.Warnf(
+		"Chaos: client_latency=%s, server_latency=%s, throughput=%s, %s.",
+		c.ClientLatency, c.ServerLatency, c.Throughput, reset,
+	)
+	for kind, on := range map[string]bool{
+		"client_latency": c.ClientLatency > 0,
+		"server_latency": c.ServerLatency > 0,
+		"throughput":     c.Throughput > 0,
+	} {
+		if on {
+			tcp.srv.metrics.Inc("chaos_injections_total", "kind", kind)
+		}
+	}
+
+	fromClient = &chaosReader{r: fromClient, tcp: tcp, latency: c.ClientLatency, throughput: int64(c.Throughput), resetAfter: resetAfter}
+	fromServer = &chaosReader{r: fromServer, tcp: tcp, latency: c.ServerLatency, throughput: int64(c.Throughput), resetAfter: resetAfter}
+	return fromClient, fromServer
+}
+
+// chaosReplyDelay delays successful CONNECT reply if chaos testing is enabled.
+func (tcp *TCPConn) chaosReplyDelay() {
+	c := tcp.srv.Chaos(tcp.conf)
+	if c == nil || c.ReplyDelay <= 0 {
+		return
+	}
+
+	tcp.l.Warnf("Chaos: delaying reply by %s.", c.ReplyDelay)
+	tcp.srv.metrics.Inc("chaos_injections_total", "kind", "reply_delay")
+	time.Sleep(c.ReplyDelay)
+}
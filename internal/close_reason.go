@@ -0,0 +1,126 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Reasons of connection termination. Every connection gets exactly one, logged on close,
+// used as a metric label and reported by admin API.
+const (
+	endClientEOF       = "client-eof" // client closed its side of the relay
+	endServerEOF       = "server-eof" // server closed its side of the relay
+	endIdleTimeout     = "idle-timeout"
+	endMaxAge          = "max-age"
+	endSlowConnection  = "slow-connection"
+	endWriteTimeout    = "write-timeout"
+	endMemoryPressure  = "memory-pressure"
+	endBan             = "ban" // client is in deny_clients
+	endQuota           = "quota"
+	endRelayError      = "relay-error"
+	endClientAbandoned = "client-abandoned-handshake" // client disconnected while the destination was being dialed
+	endPreAuthEvicted  = "pre-auth-evicted"           // the oldest not authenticated connection closed by pre_auth limit
+	endPreAuthLimit    = "pre-auth-limit"             // refused by pre_auth max_per_client
+	endChaosReset      = "chaos-reset"
+	endShutdown        = "shutdown"
+	endHandshakeFailed = "handshake-failed" // followed by the step in parentheses, e.g. "handshake-failed(auth)"
+)
+
+// closeEndReasons maps reasons of connections closed on purpose to termination reasons.
+var closeEndReasons = map[string]string{
+	CloseMaxConnectionAge: endMaxAge,
+	CloseSlowConnection:   endSlowConnection,
+	CloseWriteTimeout:     endWriteTimeout,
+	CloseMemoryPressure:   endMemoryPressure,
+	CloseChaosReset:       endChaosReset,
+	ClosePreAuthEvicted:   endPreAuthEvicted,
+	CloseShutdown:         endShutdown,
+}
+
+// failEndReasons maps reasons of failed requests to termination reasons;
+// other failures are reported as failed handshake.
+var failEndReasons = map[string]string{
+	failQuota:          endQuota,
+	failMemoryPressure: endMemoryPressure,
+}
+
+// end records termination reason. The first one wins, so concurrent teardown of both relay directions
+// reports a single reason.
+func (tcp *TCPConn) end(reason string) {
+	if reason == "" {
+		return
+	}
+	tcp.endReason.CompareAndSwap(nil, reason)
+}
+
+// closeReason returns recorded termination reason. Connections closed without one failed the handshake
+// at the last started step.
+func (tcp *TCPConn) closeReason() string {
+	if reason, _ := tcp.endReason.Load().(string); reason != "" {
+		return reason
+	}
+	switch tcp.step {
+	case "":
+		return endHandshakeFailed
+	case "relay":
+		return endRelayError
+	}
+	return fmt.Sprintf("%s(%s)", endHandshakeFailed, tcp.step)
+}
+
+// maxRecentCloses is a number of recently closed connections reported by admin API.
+const maxRecentCloses = 100
+
+// closedConn describes recently closed connection.
+type closedConn struct {
+	at     time.Time
+	client string
+	user   string
+	reason string
+}
+
+// recentCloses keeps the last closed connections.
+type recentCloses struct {
+	m     sync.Mutex
+	conns []closedConn // ring buffer
+	next  int
+}
+
+// Add records closed connection, replacing the oldest one if full.
+func (rc *recentCloses) Add(c closedConn) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	if len(rc.conns) < maxRecentCloses {
+		rc.conns = append(rc.conns, c)
+		return
+	}
+	rc.conns[rc.next] = c
+	rc.next = (rc.next + 1) % maxRecentCloses
+}
+
+// WriteText writes closed connections, the most recent first, in plain text.
+func (rc *recentCloses) WriteText(w io.Writer) {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	for i := len(rc.conns) - 1; i >= 0; i-- {
+		c := rc.conns[(rc.next+i)%len(rc.conns)]
+		user := c.user
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(w, "%s %s %s %s\n", c.at.UTC().Format(time.RFC3339), c.client, user, c.reason)
+	}
+}
@@ -0,0 +1,180 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestCloseReasons(t *testing.T) {
+	for name, tc := range map[string]struct {
+		conf     func(conf *Config)
+		srv      func(srv *Server)
+		dst      func(c net.Conn) // destination behavior
+		client   func(c net.Conn, cancel context.CancelFunc)
+		password string // user1's password if empty
+		reasons  []string
+	}{
+		"ClientEOF": {
+			dst:     func(c net.Conn) { io.Copy(ioutil.Discard, c) },
+			client:  func(c net.Conn, _ context.CancelFunc) { c.(*net.TCPConn).CloseWrite() },
+			reasons: []string{endClientEOF},
+		},
+		"ServerEOF": {
+			dst:     func(c net.Conn) {},
+			reasons: []string{endServerEOF},
+		},
+		"IdleTimeout": {
+			conf:    func(conf *Config) { conf.IdleTimeout = 100 * time.Millisecond },
+			reasons: []string{endIdleTimeout},
+		},
+		"MaxAge": {
+			conf:    func(conf *Config) { conf.MaxConnectionAge = 100 * time.Millisecond },
+			reasons: []string{endMaxAge},
+		},
+		"Shutdown": {
+			client:  func(c net.Conn, cancel context.CancelFunc) { cancel() },
+			reasons: []string{endShutdown},
+		},
+		"Quota": {
+			conf: func(conf *Config) { conf.Users[0].MonthlyQuota = 1024 },
+			srv: func(srv *Server) {
+				srv.accounting.Add("user1", 2048, 1024, nil, time.Now())
+			},
+			reasons: []string{endQuota},
+		},
+		"HandshakeFailed": {
+			password: "wrong",
+			reasons:  []string{endHandshakeFailed + "(auth)"},
+		},
+
+		// both sides close at the same time
+		"Concurrent": {
+			dst:     func(c net.Conn) {},
+			client:  func(c net.Conn, _ context.CancelFunc) { c.Close() },
+			reasons: []string{endClientEOF, endServerEOF},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// destination keeps connection open until the end of the test by default
+			dst := testListen(t, func(ctx context.Context, c net.Conn) {
+				defer c.Close()
+				if tc.dst != nil {
+					tc.dst(c)
+					return
+				}
+				<-ctx.Done()
+			})
+			dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			if tc.conf != nil {
+				tc.conf(conf)
+			}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			if tc.srv != nil {
+				tc.srv(srv)
+			}
+			l, log := testLogger(zapcore.InfoLevel)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			addr, conns := testConns(t, ctx, l, srv)
+
+			if tc.password != "" {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				b := append([]byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', byte(len(tc.password))}, tc.password...)
+				if _, err = c.Write(b); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				c, _ := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+				defer c.Close()
+				if tc.client != nil {
+					tc.client(c, cancel)
+				}
+			}
+
+			tcp := testNextConn(t, conns)
+			reason := tcp.closeReason()
+			var found bool
+			for _, r := range tc.reasons {
+				found = found || r == reason
+			}
+			if !found {
+				t.Fatalf("expected one of %v, got %q", tc.reasons, reason)
+			}
+
+			// the same single reason is logged, reported by admin API and counted
+			entries := log.Entries("Connection closed.")
+			if len(entries) != 1 || entries[0]["close_reason"] != reason {
+				t.Errorf("expected a single close message with %q, got %v", reason, entries)
+			}
+			var closes strings.Builder
+			srv.closes.WriteText(&closes)
+			if fields := strings.Fields(closes.String()); len(fields) != 4 || fields[3] != reason {
+				t.Errorf("expected a single recent close with %q, got %q", reason, closes.String())
+			}
+			var metrics strings.Builder
+			srv.metrics.WriteText(&metrics)
+			var closed []string
+			for _, line := range strings.Split(metrics.String(), "\n") {
+				if strings.HasPrefix(line, "telesock_connections_closed_total{") {
+					closed = append(closed, line)
+				}
+			}
+			if len(closed) != 1 || !strings.Contains(closed[0], `reason="`+reason+`"`) {
+				t.Errorf("expected a single closed connections metric with %q, got %q", reason, closed)
+			}
+		})
+	}
+}
+
+func TestEndConcurrent(t *testing.T) {
+	tcp, _ := testTCPConn(t)
+	reasons := []string{endClientEOF, endServerEOF, endIdleTimeout, endShutdown, endRelayError}
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, r := range reasons {
+		wg.Add(1)
+		go func(r string) {
+			defer wg.Done()
+			<-start
+			tcp.end(r)
+		}(r)
+	}
+	close(start)
+	wg.Wait()
+
+	// the first reason wins, and later ones don't replace it
+	reason := tcp.closeReason()
+	for _, r := range reasons {
+		tcp.end(r)
+		if actual := tcp.closeReason(); actual != reason {
+			t.Fatalf("reason changed from %q to %q", reason, actual)
+		}
+	}
+}
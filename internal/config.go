@@ -9,11 +9,1125 @@
 
 package internal
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"go.uber.org/multierr"
+	"go.uber.org/zap/zapcore"
+)
+
 // Config represents Telesock configuration.
 type Config struct {
-	Server string
-	Users  []struct {
-		Username string
-		Password string
+	Server            string
+	Servers           []AdvertisedServer `yaml:"servers"`
+	PublicAddress     PublicAddress      `yaml:"public_address"`
+	StrictServerCheck bool               `yaml:"strict_server_check"` // fail on start if advertised servers don't match this host
+	Users             []User
+	UsersCSV          string `yaml:"users_csv"`      // merged with Users by LoadUserFiles
+	UsersHtpasswd     string `yaml:"users_htpasswd"` // merged with Users by LoadUserFiles
+	UsersDir          string `yaml:"users_dir"`      // merged with Users by LoadUserFiles
+
+	DialTimeout    time.Duration `yaml:"dial_timeout"` // used if connect_timeout is not set; may be set by --dial-timeout flag
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ConnectRetries int           `yaml:"connect_retries"`
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`
+	Overrides      []Override    `yaml:"overrides"`
+
+	MaxConnectionAge  time.Duration `yaml:"max_connection_age"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	TCPUserTimeout    time.Duration `yaml:"tcp_user_timeout"` // Linux only, zero means system default
+	DNSTimeout        time.Duration `yaml:"dns_timeout"`
+	Resolvers         []Resolver    `yaml:"resolvers"`
+	OutboundPortRange PortRange     `yaml:"outbound_port_range"`
+	PortAffinity      time.Duration `yaml:"port_affinity"` // zero disables
+	EarlyData         string        `yaml:"early_data"`
+	DestinationType   string        `yaml:"destination_type"`
+	ProtocolMismatch  string        `yaml:"protocol_mismatch"`
+
+	StealthAuthFailures string `yaml:"stealth_auth_failures"`
+
+	RelayMemoryBudget ByteSize `yaml:"relay_memory_budget"` // zero means unlimited
+	FDWatermark       int      `yaml:"fd_watermark"`        // percents of open files limit, zero disables; Linux only
+	AcceptGoroutines  int      `yaml:"accept_goroutines"`   // per listener, read on start; one if zero
+
+	MemoryWatchdog MemoryWatchdog `yaml:"memory_watchdog"`
+
+	SlowConnectionThroughput ByteSize      `yaml:"slow_connection_throughput"` // per second, zero disables detection
+	SlowConnectionDuration   time.Duration `yaml:"slow_connection_duration"`
+	SlowConnectionAction     string        `yaml:"slow_connection_action"`
+
+	AbortiveClose []string `yaml:"abortive_close"` // close reasons; defaultAbortiveClose if not set
+
+	EchoHost        string `yaml:"echo_host"`
+	TopDestinations int    `yaml:"top_destinations"`
+	UserMetrics     bool   `yaml:"user_metrics"` // label metrics with usernames
+
+	DistinctDestinations DistinctDestinations `yaml:"distinct_destinations"`
+	DestinationLimit     DestinationLimit     `yaml:"destination_limit"`
+	ConnectionPool       ConnectionPool       `yaml:"connection_pool"`
+	UDPAssociate         UDPAssociate         `yaml:"udp_associate"`
+	Bind                 Bind                 `yaml:"bind"`
+	Quota                Quota                `yaml:"quota"`
+	Accounting           Accounting           `yaml:"accounting"`
+	GeoIP                GeoIP                `yaml:"geoip"`
+	Audit                Audit                `yaml:"audit"`
+	Capture              Capture              `yaml:"capture"`
+	Chaos                Chaos                `yaml:"chaos"`
+
+	DenyClients []string `yaml:"deny_clients"` // IP addresses and CIDR networks
+	Tarpit      Tarpit   `yaml:"tarpit"`
+	PreAuth     PreAuth  `yaml:"pre_auth"`
+
+	AuthSessions AuthSessions `yaml:"auth_sessions"`
+
+	DebugUsers   []string `yaml:"debug_users"`   // connections of those users are logged at debug level
+	DebugClients []string `yaml:"debug_clients"` // IP addresses and CIDR networks logged at debug level from the start
+
+	Listeners []Listener `yaml:"listeners"`
+	Tunnel    Tunnel     `yaml:"tunnel"`
+	Admin     Admin      `yaml:"admin"`
+	MTProto   MTProto    `yaml:"mtproto"`
+	Upstream  *Upstream  `yaml:"upstream"`
+	Upstreams []Upstream `yaml:"upstreams"`
+
+	Routes              []Route             `yaml:"routes"`
+	BypassUpstream      []string            `yaml:"bypass_upstream"`
+	UpstreamMaxFailures int                 `yaml:"upstream_max_failures"`
+	UpstreamCooldown    time.Duration       `yaml:"upstream_cooldown"`
+	UpstreamHealthCheck UpstreamHealthCheck `yaml:"upstream_health_check"`
+
+	users     map[[sha256.Size]byte]int // index of Users by username hash, built by Validate
+	verified  *verifiedPasswords        // cache of verified password hashes, built by Validate
+	denyNets  []*net.IPNet              // parsed DenyClients, built by Validate
+	sessions  *authSessions             // nil if disabled, built by Validate
+	debugNets []*net.IPNet              // parsed DebugClients, built by Validate
+	resolvers map[string]*net.Resolver  // Resolvers by name, built by Validate
+}
+
+// User represents a single user.
+type User struct {
+	Username string
+	Password string
+	Label    string    `yaml:"label"`   // free-form, added to connection logs
+	Expires  time.Time `yaml:"expires"` // connections are refused after that time, zero means never
+
+	// overrides of global and per-destination values, zero means unlimited
+	IdleTimeout       *time.Duration `yaml:"idle_timeout"`
+	MaxConnectionAge  *time.Duration `yaml:"max_connection_age"`
+	OutboundPortRange PortRange      `yaml:"outbound_port_range"`
+
+	MonthlyQuota   ByteSize `yaml:"monthly_quota"`   // zero means unlimited
+	MaxConnections int      `yaml:"max_connections"` // zero means unlimited
+	RateLimit      ByteSize `yaml:"rate_limit"`      // per second for all connections, zero means unlimited
+
+	// name of upstreams group to use, "direct" for direct connections, unnamed upstreams if empty
+	Upstream string `yaml:"upstream"`
+
+	// name of DNS resolver for domain name destinations, the system one if empty
+	Resolver string `yaml:"resolver"`
+
+	// overrides global log level for user's connections after authentication
+	LogLevel string `yaml:"log_level"`
+
+	// tags of listeners user may connect to, all if empty
+	Listeners []string `yaml:"listeners"`
+
+	// 16 bytes in hex for MTProto proxy listeners, "dd" prefix is allowed; MTProto is not allowed if empty
+	MTProtoSecret string `yaml:"mtproto_secret"`
+
+	passwordHash  string            // used instead of Password for users from htpasswd file
+	passwordSum   [sha256.Size]byte // of Password, so passwords of any length are compared in constant time
+	mtprotoSecret []byte            // decoded MTProtoSecret
+	source        string            // file the user is read from, empty for the configuration file
+}
+
+// name returns quoted username and its source for error messages.
+func (u *User) name() string {
+	if u.source == "" {
+		return strconv.Quote(u.Username)
+	}
+	return fmt.Sprintf("%q (%s)", u.Username, u.source)
+}
+
+// PasswordHashed returns true if user's plain password is unknown.
+func (u *User) PasswordHashed() bool {
+	return u.passwordHash != ""
+}
+
+// AllowedListener returns true if user may connect to listener with given tag.
+func (u *User) AllowedListener(tag string) bool {
+	if len(u.Listeners) == 0 {
+		return true
+	}
+	for _, t := range u.Listeners {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns true if user's account is expired.
+func (u *User) Expired(now time.Time) bool {
+	return !u.Expires.IsZero() && !now.Before(u.Expires)
+}
+
+// ByteSize represents size in bytes, "10GiB" or "500MB" in configuration file.
+type ByteSize int64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	n, err := units.ParseStrictBytes(s)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	*b = ByteSize(n)
+	return nil
+}
+
+func (b ByteSize) String() string {
+	if b%1000 == 0 && b%1024 != 0 {
+		return units.MetricBytes(b).String()
+	}
+	return units.Base2Bytes(b).String()
+}
+
+// PortRange represents inclusive range of ports, "first-last" in configuration file.
+// Zero value means unset.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *PortRange) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return fmt.Errorf("invalid port range %q", s)
+	}
+
+	r.First, r.Last = first, last
+	return nil
+}
+
+func (r PortRange) String() string {
+	if r.First == 0 {
+		return "any"
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// AdvertisedServer is a server address used in share links.
+type AdvertisedServer struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"` // listen port if zero
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. Both "host" and {host: host, port: port} forms are accepted.
+func (s *AdvertisedServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var host string
+	if err := unmarshal(&host); err == nil {
+		s.Host = host
+		return nil
+	}
+
+	type plain AdvertisedServer
+	return unmarshal((*plain)(s))
+}
+
+// AdvertisedServers returns all server addresses used in share links: Server and Servers.
+func (c *Config) AdvertisedServers() []AdvertisedServer {
+	var res []AdvertisedServer
+	if c.Server != "" {
+		res = append(res, AdvertisedServer{Host: c.Server})
+	}
+	return append(res, c.Servers...)
+}
+
+// dummyPasswordSum is compared with given password's hash for unknown users to keep timing uniform.
+var dummyPasswordSum [sha256.Size]byte
+
+// Authenticate returns user with given username and password sent from client IP address (may be nil), or nil.
+// Users are looked up by username hash, so lookup time doesn't depend on the number of users
+// or on how much of the username matches; password hashes are compared in constant time, so timing doesn't depend
+// on password lengths either.
+func (c *Config) Authenticate(ip net.IP, username, password []byte) *User {
+	var client string
+	if ip != nil {
+		client = ip.String()
+	}
+
+	sum := sha256.Sum256(password)
+	i, ok := c.users[sha256.Sum256(username)]
+	if !ok {
+		subtle.ConstantTimeCompare(sum[:], dummyPasswordSum[:])
+		c.verified.VerifyUnknown(client, password)
+		return nil
+	}
+
+	u := &c.Users[i]
+	if u.passwordHash != "" {
+		if !c.verified.Verify(client, u.passwordHash, password) {
+			return nil
+		}
+		return u
+	}
+	if subtle.ConstantTimeCompare(sum[:], u.passwordSum[:]) != 1 {
+		return nil
+	}
+	return u
+}
+
+// AutoServer is a special advertised server host: public address of this host is detected on start.
+const AutoServer = "auto"
+
+// DefaultPublicAddressURL is the default endpoint used to detect public address.
+const DefaultPublicAddressURL = "https://api.ipify.org"
+
+// PublicAddress configures detection of public address for "auto" advertised server.
+type PublicAddress struct {
+	URL             string        `yaml:"url"`              // HTTPS endpoint returning client's address as plain text
+	RecheckInterval time.Duration `yaml:"recheck_interval"` // zero disables re-checks
+}
+
+// Endpoint returns configured or default endpoint URL.
+func (p PublicAddress) Endpoint() string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return DefaultPublicAddressURL
+}
+
+// HasAutoServer returns true if any advertised server is "auto".
+func (c *Config) HasAutoServer() bool {
+	for _, s := range c.AdvertisedServers() {
+		if s.Host == AutoServer {
+			return true
+		}
+	}
+	return false
+}
+
+// Override changes connection policy for destinations matching CIDR, IP address or host pattern.
+// Unset fields are inherited from global configuration.
+type Override struct {
+	Destination    string         `yaml:"destination"`
+	ConnectTimeout *time.Duration `yaml:"connect_timeout"`
+	ConnectRetries *int           `yaml:"connect_retries"`
+	IdleTimeout    *time.Duration `yaml:"idle_timeout"`
+}
+
+// DistinctDestinations limits the number of distinct destination hosts a single user connects to
+// within a time window. Exceeding it is logged and counted; with Reject, connections to new hosts are refused.
+type DistinctDestinations struct {
+	Limit  int           `yaml:"limit"` // zero means unlimited
+	Window time.Duration `yaml:"window"`
+	Reject bool          `yaml:"reject"`
+}
+
+// Quota configures monthly traffic quotas set per user.
+// Reported thresholds are persisted in accounting state file together with traffic counters.
+type Quota struct {
+	Thresholds []int `yaml:"thresholds"` // in percents, 80, 95 and 100 by default
+}
+
+// Accounting configures persistence of per-user monthly traffic counters,
+// so they survive restarts and crashes.
+type Accounting struct {
+	StateFile     string        `yaml:"state_file"`     // counters are not persisted if empty
+	FlushInterval time.Duration `yaml:"flush_interval"` // one minute by default
+}
+
+// Tarpit configures handling of denied clients: instead of being closed immediately, their connections
+// are held open without any response, so scanners don't retry faster.
+type Tarpit struct {
+	Duration       time.Duration `yaml:"duration"`        // zero disables tarpit
+	MaxConnections int           `yaml:"max_connections"` // required; denied clients over it are closed immediately
+}
+
+// thresholds returns configured or default thresholds.
+func (q Quota) thresholds() []int {
+	if len(q.Thresholds) == 0 {
+		return []int{80, 95, 100}
+	}
+	return q.Thresholds
+}
+
+// MemoryWatchdog sheds load when process memory usage is high. If both limits are not set,
+// they default to 80% and 95% of GOMEMLIMIT, if it is set.
+type MemoryWatchdog struct {
+	SoftLimit ByteSize      `yaml:"soft_limit"` // new connections are refused above it
+	HardLimit ByteSize      `yaml:"hard_limit"` // least recently active connections are closed above it
+	Interval  time.Duration `yaml:"interval"`   // read on start, defaultMemoryWatchdogInterval if zero
+}
+
+// Audit configures sinks of security events: authentication, quota and access denials.
+// Events are sent asynchronously and dropped when a sink can't keep up. Sinks are configured on start.
+type Audit struct {
+	Webhook    string `yaml:"webhook"`     // URL events are POSTed to as JSON
+	Syslog     string `yaml:"syslog"`      // udp://host:port or tcp://host:port
+	BufferSize int    `yaml:"buffer_size"` // events buffered per sink, defaultAuditBufferSize if zero
+}
+
+// GeoIP configures MaxMind DB files used to add client's country and ASN to connection logs.
+// Databases are read on start.
+type GeoIP struct {
+	CountryDB string `yaml:"country_db"`
+	ASNDB     string `yaml:"asn_db"`
+}
+
+// Tags of built-in listeners: the main one (--tcp-listen flag) and the tunnel one.
+const (
+	ListenerDefault = "default"
+	ListenerTunnel  = "tunnel"
+)
+
+// Types of additional listeners.
+const (
+	ListenerTypeSOCKS5  = "socks5" // default
+	ListenerTypeMTProto = "mtproto"
+)
+
+// Listener configures an additional SOCKS5 or MTProto proxy listener. Connections are tagged with its tag in logs
+// and metrics, and users may be restricted to some listeners. Listeners are started only once, so changes require restart.
+type Listener struct {
+	Listen string `yaml:"listen"`
+	Tag    string `yaml:"tag"`
+	Type   string `yaml:"type"`
+}
+
+// MTProto configures MTProto proxy listeners.
+type MTProto struct {
+	Datacenters   []string `yaml:"datacenters"`    // addresses of DC 1, 2, ...; defaultMTProtoDatacenters if empty
+	FakeTLSDomain string   `yaml:"faketls_domain"` // if set, only FakeTLS clients with that SNI are accepted
+	Fallback      string   `yaml:"fallback"`       // where other clients are forwarded; FakeTLSDomain:443 if empty
+}
+
+// defaultMTProtoDatacenters are addresses of Telegram datacenters 1-5.
+var defaultMTProtoDatacenters = []string{
+	"149.154.175.50:443",
+	"149.154.167.51:443",
+	"149.154.175.100:443",
+	"149.154.167.91:443",
+	"149.154.171.5:443",
+}
+
+// datacenters returns configured or default datacenters.
+func (m MTProto) datacenters() []string {
+	if len(m.Datacenters) == 0 {
+		return defaultMTProtoDatacenters
+	}
+	return m.Datacenters
+}
+
+// fallback returns address other clients of FakeTLS listeners are forwarded to.
+func (m MTProto) fallback() string {
+	if m.Fallback == "" {
+		return net.JoinHostPort(m.FakeTLSDomain, "443")
+	}
+	return m.Fallback
+}
+
+// Tunnel configures a listener for encrypted connections from other telesock instances.
+// Inside the tunnel, the usual SOCKS5 protocol with authentication is used.
+// Listener is started only once, so changing Listen requires restart.
+type Tunnel struct {
+	Listen string `yaml:"listen"`
+	PSK    string `yaml:"psk"`
+}
+
+// Upstream configures SOCKS5 server all outbound connections are made through.
+// If PSK is set, the upstream must be a telesock instance with the same tunnel PSK.
+// With several upstreams, the first healthy one with the lowest Priority value is used.
+// Upstreams with the same Name form a group used by users referencing it; unnamed ones are used by other users.
+type Upstream struct {
+	Name     string `yaml:"name"`
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	PSK      string `yaml:"psk"`
+	Priority int    `yaml:"priority"`
+}
+
+// UpstreamHealthCheck configures active health checks of upstreams.
+type UpstreamHealthCheck struct {
+	Interval time.Duration `yaml:"interval"` // zero disables checks
+	Timeout  time.Duration `yaml:"timeout"`
+	Target   string        `yaml:"target"` // if empty, only SOCKS5 handshake is checked
+}
+
+// upstreams returns all configured upstreams ordered by priority.
+func (c *Config) upstreams() []Upstream {
+	var res []Upstream
+	if c.Upstream != nil {
+		res = append(res, *c.Upstream)
+	}
+	res = append(res, c.Upstreams...)
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Priority < res[j].Priority })
+	return res
+}
+
+// userLabels returns metric labels for given user, empty unless user_metrics is enabled.
+func (c *Config) userLabels(username string) []string {
+	if !c.UserMetrics {
+		return nil
+	}
+	return []string{"user", username}
+}
+
+// Route sends connections to destinations matching CIDR, IP address or host pattern
+// through named upstreams group or directly.
+type Route struct {
+	Destination string `yaml:"destination"`
+	Upstream    string `yaml:"upstream"` // upstreams group name or "direct"
+}
+
+// directRoute is a reserved upstream name for direct connections.
+const directRoute = "direct"
+
+// routeUpstreams returns upstreams used for given user (may be nil) and destination ordered by priority,
+// or nothing for direct connections, and the reason of that decision.
+// Destinations in bypass list are always connected directly; then user's upstream setting
+// takes precedence over the first matching route; without both, unnamed upstreams are used.
+// Patterns are matched against both host and IP address, so resolved domain names match CIDRs.
+func (c *Config) routeUpstreams(user *User, host string, ip net.IP) ([]Upstream, string) {
+	for _, p := range c.BypassUpstream {
+		if matchDestination(p, host, ip) {
+			return nil, fmt.Sprintf("bypass %q", p)
+		}
+	}
+
+	name, reason := "", "default"
+	if user != nil && user.Upstream != "" {
+		name, reason = user.Upstream, "user setting"
+	} else {
+		for _, r := range c.Routes {
+			if matchDestination(r.Destination, host, ip) {
+				name, reason = r.Upstream, fmt.Sprintf("route %q", r.Destination)
+				break
+			}
+		}
+	}
+	if name == directRoute {
+		return nil, reason
+	}
+
+	var res []Upstream
+	for _, u := range c.upstreams() {
+		if u.Name == name {
+			res = append(res, u)
+		}
+	}
+	return res, reason
+}
+
+// upstreamHealthPolicy returns consecutive failures count making upstream unhealthy and
+// cooldown before it is tried again, using defaults for unset values.
+func (c *Config) upstreamHealthPolicy() (int, time.Duration) {
+	maxFailures, cooldown := c.UpstreamMaxFailures, c.UpstreamCooldown
+	if maxFailures == 0 {
+		maxFailures = 3
+	}
+	if cooldown == 0 {
+		cooldown = 30 * time.Second
+	}
+	return maxFailures, cooldown
+}
+
+// Values of early_data setting: what to do with payload sent by the client before the reply.
+const (
+	EarlyDataRelay  = "relay" // default
+	EarlyDataReject = "reject"
+)
+
+// Values of destination_type setting: which requested destinations are allowed.
+const (
+	DestinationTypeAny      = "any" // default
+	DestinationTypeHostname = "hostname"
+	DestinationTypeIP       = "ip"
+)
+
+// Values of slow_connection_action setting.
+const (
+	SlowConnectionLog   = "log" // default
+	SlowConnectionClose = "close"
+)
+
+// Reasons of connections closed on purpose, used in abortive_close setting.
+const (
+	CloseMaxConnectionAge = "max_connection_age"
+	CloseSlowConnection   = "slow_connection"
+	CloseWriteTimeout     = "write_timeout"
+	CloseProtocolMismatch = "protocol_mismatch" // rejected before handshake
+	CloseMemoryPressure   = "memory_pressure"   // closed by memory watchdog above hard limit
+	CloseDenied           = "denied"            // client is in deny_clients
+	CloseChaosReset       = "chaos_reset"       // reset by chaos testing; always abortive, not configurable
+	ClosePreAuthEvicted   = "pre_auth_evicted"  // the oldest not authenticated connection closed by pre_auth limit
+	CloseShutdown         = "shutdown"          // relayed connection closed on server shutdown
+)
+
+var closeReasons = []string{
+	CloseMaxConnectionAge, CloseSlowConnection, CloseWriteTimeout, CloseProtocolMismatch, CloseDenied, CloseMemoryPressure,
+	ClosePreAuthEvicted, CloseShutdown,
+}
+
+// defaultAbortiveClose is used if abortive_close is not set.
+var defaultAbortiveClose = []string{CloseSlowConnection}
+
+// parseNets parses IP addresses and CIDR networks.
+func parseNets(list []string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, s := range list {
+		cidr := s
+		if ip := net.ParseIP(s); ip != nil {
+			cidr = s + "/128"
+			if ip.To4() != nil {
+				cidr = ip.String() + "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or network %q", s)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// debugClient returns true if client's address is in debug_clients.
+func (c *Config) debugClient(ip net.IP) bool {
+	for _, n := range c.debugNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denied returns true if client's address is in deny_clients.
+func (c *Config) denied(ip net.IP) bool {
+	for _, n := range c.denyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// abortiveClose returns true if connections closed for given reason should be reset (SO_LINGER 0).
+func (c *Config) abortiveClose(reason string) bool {
+	reasons := c.AbortiveClose
+	if reasons == nil {
+		reasons = defaultAbortiveClose
+	}
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of protocol_mismatch setting: how to report non-SOCKS5 traffic.
+const (
+	ProtocolMismatchLog   = "log"   // default: logged as error and counted
+	ProtocolMismatchQuiet = "quiet" // only counted, logged at debug level
+)
+
+// minPSKLength is the minimal length of pre-shared key.
+const minPSKLength = 16
+
+// Policy represents effective connection policy for a single destination.
+type Policy struct {
+	ConnectTimeout time.Duration
+	ConnectRetries int
+	IdleTimeout    time.Duration
+	Override       string // matched override destination, empty if none
+
+	MaxConnectionAge  time.Duration
+	OutboundPortRange PortRange
+}
+
+// LoadUserFiles appends users from CSV and htpasswd files and users directory, if they are set.
+// It should be called before Validate, so duplicates are checked in merged list.
+func (c *Config) LoadUserFiles() error {
+	if c.UsersCSV != "" {
+		users, err := readUsersCSV(c.UsersCSV)
+		if err != nil {
+			return fmt.Errorf("users_csv: %s", err)
+		}
+		c.Users = append(c.Users, users...)
+	}
+	if c.UsersHtpasswd != "" {
+		users, err := readHtpasswd(c.UsersHtpasswd)
+		if err != nil {
+			return fmt.Errorf("users_htpasswd: %s", err)
+		}
+		c.Users = append(c.Users, users...)
+	}
+	if c.UsersDir != "" {
+		users, err := readUsersDir(c.UsersDir)
+		if err != nil {
+			return fmt.Errorf("users_dir: %s", err)
+		}
+		c.Users = append(c.Users, users...)
+	}
+	return nil
+}
+
+// validateUser checks user's settings, returning all found problems.
+func (c *Config) validateUser(u *User, listenerTags map[string]bool) error {
+	var errs []error
+	add := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf("user %s: "+format, append([]interface{}{u.name()}, a...)...))
+	}
+
+	// username/password authentication limits both to 1-255 bytes
+	if len(u.Username) == 0 || len(u.Username) > 255 {
+		add("username should be 1-255 bytes long")
+	}
+	if u.passwordHash == "" && (len(u.Password) == 0 || len(u.Password) > 255) {
+		add("password should be 1-255 bytes long")
+	}
+	u.passwordSum = sha256.Sum256([]byte(u.Password))
+
+	if u.IdleTimeout != nil && *u.IdleTimeout < 0 {
+		add("idle_timeout must not be negative")
+	}
+	if u.MaxConnectionAge != nil && *u.MaxConnectionAge < 0 {
+		add("max_connection_age must not be negative")
+	}
+	if u.MonthlyQuota < 0 {
+		add("monthly_quota must not be negative")
+	}
+	if u.MaxConnections < 0 {
+		add("max_connections must not be negative")
+	}
+	if u.RateLimit < 0 {
+		add("rate_limit must not be negative")
+	}
+	if u.LogLevel != "" {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(u.LogLevel)); err != nil {
+			add("log_level: %s", err)
+		}
+	}
+	for _, t := range u.Listeners {
+		if !listenerTags[t] {
+			add("listener %q is not defined", t)
+		}
+	}
+	u.mtprotoSecret = nil
+	if u.MTProtoSecret != "" {
+		s := u.MTProtoSecret
+		if len(s) == 34 && strings.HasPrefix(s, "dd") {
+			s = s[2:]
+		}
+		if b, err := hex.DecodeString(s); err != nil || len(b) != 16 {
+			add("mtproto_secret should be 16 bytes in hex (32 characters)")
+		} else {
+			u.mtprotoSecret = b
+		}
+	}
+	r, g := u.OutboundPortRange, c.OutboundPortRange
+	if r.First != 0 && g.First != 0 && (r.First < g.First || r.Last > g.Last) {
+		add("outbound_port_range %s is not within %s", r, g)
+	}
+
+	return multierr.Combine(errs...)
+}
+
+// Validate checks configuration, reporting all found errors at once.
+func (c *Config) Validate() error {
+	var errs error
+
+	if c.DialTimeout < 0 || c.ConnectTimeout < 0 || c.ConnectRetries < 0 || c.IdleTimeout < 0 || c.MaxConnectionAge < 0 || c.WriteTimeout < 0 {
+		errs = multierr.Append(errs, fmt.Errorf(
+			"dial_timeout, connect_timeout, connect_retries, idle_timeout, max_connection_age and write_timeout must not be negative",
+		))
+	}
+	if c.DNSTimeout < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("dns_timeout must not be negative"))
+	}
+	if c.TCPUserTimeout < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("tcp_user_timeout must not be negative"))
+	}
+	if c.PortAffinity < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("port_affinity must not be negative"))
+	}
+	if c.FDWatermark < 0 || c.FDWatermark > 100 {
+		errs = multierr.Append(errs, fmt.Errorf("fd_watermark should be 0-100"))
+	}
+	if c.FDWatermark != 0 && !fdsSupported {
+		errs = multierr.Append(errs, fmt.Errorf("fd_watermark is supported only on Linux"))
+	}
+	if c.AcceptGoroutines < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("accept_goroutines should not be negative"))
+	}
+	if u := c.Audit.Webhook; u != "" {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			errs = multierr.Append(errs, fmt.Errorf("audit: webhook should be HTTP(S) URL"))
+		}
+		if _, err := newAuditSink(u); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("audit: webhook: %s", err))
+		}
+	}
+	if u := c.Audit.Syslog; u != "" {
+		if !strings.HasPrefix(u, "udp://") && !strings.HasPrefix(u, "tcp://") {
+			errs = multierr.Append(errs, fmt.Errorf("audit: syslog should be udp://host:port or tcp://host:port"))
+		}
+		if _, err := newAuditSink(u); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("audit: syslog: %s", err))
+		}
+	}
+	if m := c.MemoryWatchdog; m.SoftLimit < 0 || m.HardLimit < 0 || m.Interval < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("memory_watchdog: limits and interval should not be negative"))
+	}
+	if m := c.MemoryWatchdog; m.SoftLimit > 0 && m.HardLimit > 0 && m.SoftLimit > m.HardLimit {
+		errs = multierr.Append(errs, fmt.Errorf("memory_watchdog: soft_limit should not be greater than hard_limit"))
+	}
+	errs = multierr.Append(errs, c.Capture.validate())
+	errs = multierr.Append(errs, c.Chaos.validate())
+	errs = multierr.Append(errs, c.PreAuth.validate())
+	errs = multierr.Append(errs, c.DestinationLimit.validate())
+	errs = multierr.Append(errs, c.ConnectionPool.validate())
+	errs = multierr.Append(errs, c.UDPAssociate.validate())
+	errs = multierr.Append(errs, c.Bind.validate())
+	errs = multierr.Append(errs, c.Admin.validate())
+	if c.Audit.BufferSize < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("audit: buffer_size should not be negative"))
+	}
+
+	var err error
+	if c.denyNets, err = parseNets(c.DenyClients); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("deny_clients: %s", err))
+	}
+	if c.debugNets, err = parseNets(c.DebugClients); err != nil {
+		errs = multierr.Append(errs, fmt.Errorf("debug_clients: %s", err))
+	}
+	if c.AuthSessions.TTL < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("auth_sessions: ttl should not be negative"))
+	}
+	if c.sessions, err = newAuthSessions(c.AuthSessions); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	if c.resolvers, err = newResolvers(c.Resolvers); err != nil {
+		errs = multierr.Append(errs, err)
+	} else {
+		for _, u := range c.Users {
+			if u.Resolver != "" && c.resolvers[u.Resolver] == nil {
+				errs = multierr.Append(errs, fmt.Errorf("user %s: resolver %q is not defined", u.name(), u.Resolver))
+			}
+		}
+	}
+	if c.Tarpit.Duration < 0 || (c.Tarpit.Duration > 0 && c.Tarpit.MaxConnections <= 0) {
+		errs = multierr.Append(errs, fmt.Errorf("tarpit: duration must not be negative, max_connections must be positive"))
+	}
+
+	for i, s := range c.Servers {
+		if s.Host == "" {
+			errs = multierr.Append(errs, fmt.Errorf("servers[%d]: empty host", i))
+		}
+		if s.Port < 0 || s.Port > 65535 {
+			errs = multierr.Append(errs, fmt.Errorf("servers[%d]: invalid port %d", i, s.Port))
+		}
+	}
+	if c.PublicAddress.URL != "" {
+		if u, err := url.Parse(c.PublicAddress.URL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = multierr.Append(errs, fmt.Errorf("public_address: url must be an HTTPS URL"))
+		}
+	}
+	if c.PublicAddress.RecheckInterval < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("public_address: recheck_interval must not be negative"))
+	}
+
+	tags := map[string]bool{ListenerDefault: true, ListenerTunnel: true}
+	for i, l := range c.Listeners {
+		if l.Listen == "" || l.Tag == "" {
+			errs = multierr.Append(errs, fmt.Errorf("listeners[%d]: listen and tag must be set", i))
+			continue
+		}
+		if tags[l.Tag] {
+			errs = multierr.Append(errs, fmt.Errorf("listeners[%d]: duplicate or reserved tag %q", i, l.Tag))
+			continue
+		}
+		tags[l.Tag] = true
+		switch l.Type {
+		case "", ListenerTypeSOCKS5, ListenerTypeMTProto:
+		default:
+			errs = multierr.Append(errs, fmt.Errorf("listeners[%d]: type should be %q or %q", i, ListenerTypeSOCKS5, ListenerTypeMTProto))
+		}
+	}
+	for i, dc := range c.MTProto.Datacenters {
+		if _, _, err := net.SplitHostPort(dc); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("mtproto: datacenters[%d]: %s", i, err))
+		}
+	}
+	if d := c.MTProto.FakeTLSDomain; strings.ContainsAny(d, ":/ ") {
+		errs = multierr.Append(errs, fmt.Errorf("mtproto: faketls_domain should be a domain name, got %q", d))
+	}
+	if f := c.MTProto.Fallback; f != "" {
+		if c.MTProto.FakeTLSDomain == "" {
+			errs = multierr.Append(errs, fmt.Errorf("mtproto: fallback requires faketls_domain"))
+		}
+		if _, _, err := net.SplitHostPort(f); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("mtproto: fallback: %s", err))
+		}
+	}
+
+	c.users = make(map[[sha256.Size]byte]int, len(c.Users))
+	var userErrs error
+	for i := range c.Users {
+		u := &c.Users[i]
+		key := sha256.Sum256([]byte(u.Username))
+		if _, ok := c.users[key]; ok {
+			userErrs = multierr.Append(userErrs, fmt.Errorf("user %s: duplicate username", u.name()))
+			continue
+		}
+		c.users[key] = i
+		userErrs = multierr.Append(userErrs, c.validateUser(u, tags))
+	}
+	secrets := make(map[string]bool)
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.mtprotoSecret == nil {
+			continue
+		}
+		if secrets[string(u.mtprotoSecret)] {
+			userErrs = multierr.Append(userErrs, fmt.Errorf("user %s: duplicate mtproto_secret", u.name()))
+		}
+		secrets[string(u.mtprotoSecret)] = true
+	}
+	if userErrs == nil {
+		c.verified = newVerifiedPasswords(c.Users)
+	}
+	errs = multierr.Append(errs, userErrs)
+	for _, name := range c.DebugUsers {
+		if _, ok := c.users[sha256.Sum256([]byte(name))]; !ok {
+			errs = multierr.Append(errs, fmt.Errorf("debug_users: unknown user %q", name))
+		}
+	}
+
+	switch c.EarlyData {
+	case "", EarlyDataRelay, EarlyDataReject:
+	default:
+		errs = multierr.Append(errs, fmt.Errorf("early_data should be %q or %q", EarlyDataRelay, EarlyDataReject))
+	}
+	switch c.DestinationType {
+	case "", DestinationTypeAny, DestinationTypeHostname, DestinationTypeIP:
+	default:
+		errs = multierr.Append(errs, fmt.Errorf("destination_type should be %q, %q or %q", DestinationTypeAny, DestinationTypeHostname, DestinationTypeIP))
+	}
+	switch c.ProtocolMismatch {
+	case "", ProtocolMismatchLog, ProtocolMismatchQuiet:
+	default:
+		errs = multierr.Append(errs, fmt.Errorf("protocol_mismatch should be %q or %q", ProtocolMismatchLog, ProtocolMismatchQuiet))
+	}
+	switch c.StealthAuthFailures {
+	case "", StealthAuthNormal, StealthAuthSilent:
+	case StealthAuthDecoy:
+		if c.MTProto.FakeTLSDomain == "" {
+			errs = multierr.Append(errs, fmt.Errorf("stealth_auth_failures: %q requires mtproto faketls_domain", StealthAuthDecoy))
+		}
+	default:
+		errs = multierr.Append(errs, fmt.Errorf(
+			"stealth_auth_failures should be %q, %q or %q", StealthAuthNormal, StealthAuthSilent, StealthAuthDecoy,
+		))
+	}
+
+	if c.SlowConnectionThroughput < 0 || (c.SlowConnectionThroughput > 0 && c.SlowConnectionDuration <= 0) {
+		errs = multierr.Append(errs, fmt.Errorf("slow_connection_throughput must not be negative, slow_connection_duration must be positive"))
+	}
+	switch c.SlowConnectionAction {
+	case "", SlowConnectionLog, SlowConnectionClose:
+	default:
+		errs = multierr.Append(errs, fmt.Errorf("slow_connection_action should be %q or %q", SlowConnectionLog, SlowConnectionClose))
+	}
+
+	for _, r := range c.AbortiveClose {
+		var found bool
+		for _, cr := range closeReasons {
+			found = found || r == cr
+		}
+		if !found {
+			errs = multierr.Append(errs, fmt.Errorf("abortive_close: unknown reason %q, should be one of %s", r, strings.Join(closeReasons, ", ")))
+		}
+	}
+
+	if c.RelayMemoryBudget < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("relay_memory_budget must not be negative"))
+	}
+
+	if c.TopDestinations < 0 || c.TopDestinations > maxTopDestinations {
+		errs = multierr.Append(errs, fmt.Errorf("top_destinations must be between 0 and %d", maxTopDestinations))
+	}
+
+	if d := c.DistinctDestinations; d.Limit < 0 || (d.Limit > 0 && d.Window <= 0) {
+		errs = multierr.Append(errs, fmt.Errorf("distinct_destinations: limit must not be negative, window must be positive"))
+	}
+
+	if c.Accounting.FlushInterval < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("accounting: flush_interval must not be negative"))
+	}
+	for _, t := range c.Quota.Thresholds {
+		if t < 1 || t > 100 {
+			errs = multierr.Append(errs, fmt.Errorf("quota: thresholds must be between 1 and 100"))
+			break
+		}
+	}
+
+	for i, o := range c.Overrides {
+		if err := validateDestination(o.Destination); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("overrides[%d]: %s", i, err))
+		}
+		if (o.ConnectTimeout != nil && *o.ConnectTimeout < 0) ||
+			(o.ConnectRetries != nil && *o.ConnectRetries < 0) ||
+			(o.IdleTimeout != nil && *o.IdleTimeout < 0) {
+			errs = multierr.Append(errs, fmt.Errorf("overrides[%d]: values must not be negative", i))
+		}
+	}
+
+	if c.Tunnel.Listen != "" && len(c.Tunnel.PSK) < minPSKLength {
+		errs = multierr.Append(errs, fmt.Errorf("tunnel: psk should be at least %d characters long", minPSKLength))
+	}
+	names := make(map[string]bool)
+	for _, u := range c.upstreams() {
+		if u.Address == "" {
+			errs = multierr.Append(errs, fmt.Errorf("upstream: empty address"))
+			continue
+		}
+		if u.Name == directRoute {
+			errs = multierr.Append(errs, fmt.Errorf("upstream %s: name %q is reserved", u.Address, directRoute))
+		}
+		names[u.Name] = true
+		if u.PSK != "" && len(u.PSK) < minPSKLength {
+			errs = multierr.Append(errs, fmt.Errorf("upstream %s: psk should be at least %d characters long", u.Address, minPSKLength))
+		}
+		if len(u.Username) > 255 || len(u.Password) > 255 {
+			errs = multierr.Append(errs, fmt.Errorf("upstream %s: username and password should be at most 255 bytes long", u.Address))
+		}
+	}
+	for _, u := range c.Users {
+		if u.Upstream != "" && u.Upstream != directRoute && !names[u.Upstream] {
+			errs = multierr.Append(errs, fmt.Errorf("user %s: upstream %q is not defined", u.name(), u.Upstream))
+		}
+	}
+	for i, r := range c.Routes {
+		if err := validateDestination(r.Destination); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("routes[%d]: %s", i, err))
+		}
+		if r.Upstream != directRoute && (r.Upstream == "" || !names[r.Upstream]) {
+			errs = multierr.Append(errs, fmt.Errorf("routes[%d]: upstream %q is not defined", i, r.Upstream))
+		}
+	}
+	for i, p := range c.BypassUpstream {
+		if err := validateDestination(p); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("bypass_upstream[%d]: %s", i, err))
+		}
+	}
+	if c.UpstreamMaxFailures < 0 || c.UpstreamCooldown < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("upstream_max_failures and upstream_cooldown must not be negative"))
+	}
+	if hc := c.UpstreamHealthCheck; hc.Interval < 0 || hc.Timeout < 0 {
+		errs = multierr.Append(errs, fmt.Errorf("upstream_health_check: interval and timeout must not be negative"))
+	}
+	if t := c.UpstreamHealthCheck.Target; t != "" {
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("upstream_health_check: invalid target: %s", err))
+		}
+	}
+
+	return errs
+}
+
+// defaultDialTimeout is used if neither dial_timeout nor connect_timeout is set (or set to zero by override),
+// so dials to black-holed destinations don't wait for the kernel to give up.
+const defaultDialTimeout = 10 * time.Second
+
+// dialTimeout returns dial_timeout, or its default.
+func (c *Config) dialTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return c.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+// connectTimeout returns global connect_timeout, or dial timeout.
+func (c *Config) connectTimeout() time.Duration {
+	if c.ConnectTimeout > 0 {
+		return c.ConnectTimeout
+	}
+	return c.dialTimeout()
+}
+
+// Policy returns effective connection policy for given authenticated user (may be nil) and destination.
+// The first matching destination override wins; user's values take precedence over it.
+func (c *Config) Policy(user *User, host string, ip net.IP) Policy {
+	p := Policy{
+		ConnectTimeout:    c.ConnectTimeout,
+		ConnectRetries:    c.ConnectRetries,
+		IdleTimeout:       c.IdleTimeout,
+		MaxConnectionAge:  c.MaxConnectionAge,
+		OutboundPortRange: c.OutboundPortRange,
+	}
+
+	for _, o := range c.Overrides {
+		if !matchDestination(o.Destination, host, ip) {
+			continue
+		}
+
+		p.Override = o.Destination
+		if o.ConnectTimeout != nil {
+			p.ConnectTimeout = *o.ConnectTimeout
+		}
+		if o.ConnectRetries != nil {
+			p.ConnectRetries = *o.ConnectRetries
+		}
+		if o.IdleTimeout != nil {
+			p.IdleTimeout = *o.IdleTimeout
+		}
+		break
+	}
+
+	if user != nil {
+		if user.IdleTimeout != nil {
+			p.IdleTimeout = *user.IdleTimeout
+		}
+		if user.MaxConnectionAge != nil {
+			p.MaxConnectionAge = *user.MaxConnectionAge
+		}
+		if user.OutboundPortRange.First != 0 {
+			p.OutboundPortRange = user.OutboundPortRange
+		}
+	}
+
+	if p.ConnectTimeout == 0 {
+		p.ConnectTimeout = c.dialTimeout()
 	}
+	return p
 }
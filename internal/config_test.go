@@ -0,0 +1,252 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testUsers returns valid configuration with n users "userN" with passwords "passwordN".
+func testUsers(t testing.TB, n int) *Config {
+	c := new(Config)
+	for i := 0; i < n; i++ {
+		c.Users = append(c.Users, User{Username: fmt.Sprintf("user%d", i), Password: fmt.Sprintf("password%d", i)})
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// minDuration returns the shortest of n runs of f; i is the run number.
+func minDuration(n int, f func(i int)) time.Duration {
+	var res time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		f(i)
+		if d := time.Since(start); i == 0 || d < res {
+			res = d
+		}
+	}
+	return res
+}
+
+// checkSimilar fails the test if durations differ more than twice.
+func checkSimilar(t *testing.T, a, b time.Duration) {
+	t.Helper()
+
+	t.Logf("%s vs %s", a, b)
+	if a*2 < b || b*2 < a {
+		t.Errorf("timing differs: %s vs %s", a, b)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	c := testUsers(t, 3)
+
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"user1", "password1", true},
+		{"user1", "password2", false},
+		{"user1", "password", false},
+		{"user1", "password11", false},
+		{"user3", "password3", false},
+		{"User1", "password1", false},
+	} {
+		u := c.Authenticate(nil, []byte(tc.username), []byte(tc.password))
+		if tc.ok != (u != nil) {
+			t.Errorf("%s / %s: expected %t, got %v", tc.username, tc.password, tc.ok, u)
+		}
+		if u != nil && u.Username != tc.username {
+			t.Errorf("%s / %s: got user %q", tc.username, tc.password, u.Username)
+		}
+	}
+}
+
+func TestAuthenticateTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	t.Run("Password", func(t *testing.T) {
+		c := testUsers(t, 1000)
+
+		// passwords of other lengths than the user's one take the same time to check
+		for _, password := range []string{"x", "password", "password500x", string(make([]byte, 255))} {
+			unknown := minDuration(10000, func(int) { c.Authenticate(nil, []byte("nobody"), []byte(password)) })
+			wrong := minDuration(10000, func(int) { c.Authenticate(nil, []byte("user500"), []byte(password)) })
+			checkSimilar(t, unknown, wrong)
+		}
+	})
+
+	t.Run("Htpasswd", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost+2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{Users: []User{{Username: "bcrypt", passwordHash: string(hash)}}}
+		if err = c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		// different client addresses are used to avoid verification limits
+		ip := func(i int) net.IP { return net.IPv4(192, 0, 2, byte(i)) }
+		unknown := minDuration(10, func(i int) { c.Authenticate(ip(i), []byte("nobody"), []byte("wrong")) })
+		wrong := minDuration(10, func(i int) { c.Authenticate(ip(100+i), []byte("bcrypt"), []byte("wrong")) })
+		checkSimilar(t, unknown, wrong)
+	})
+}
+
+func TestAuthenticateUsersCount(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	// lookup time doesn't reveal the number of users
+	small, large := testUsers(t, 100), testUsers(t, 100000)
+	for _, username := range []string{"user50", "nobody"} {
+		s := minDuration(10000, func(int) { small.Authenticate(nil, []byte(username), []byte("password")) })
+		l := minDuration(10000, func(int) { large.Authenticate(nil, []byte(username), []byte("password")) })
+		checkSimilar(t, s, l)
+	}
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	for _, n := range []int{100, 10000, 100000} {
+		c := testUsers(b, n)
+		username, password := []byte(fmt.Sprintf("user%d", n/2)), []byte(fmt.Sprintf("password%d", n/2))
+
+		b.Run(fmt.Sprintf("Found%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if c.Authenticate(nil, username, password) == nil {
+					b.Fatal("expected user")
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("NotFound%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if c.Authenticate(nil, []byte("nobody"), password) != nil {
+					b.Fatal("unexpected user")
+				}
+			}
+		})
+	}
+}
+
+func TestValidateDuplicateUsername(t *testing.T) {
+	t.Run("Config", func(t *testing.T) {
+		c := &Config{Users: []User{
+			{Username: "user1", Password: "pass1"},
+			{Username: "user2", Password: "pass2"},
+			{Username: "user1", Password: "other"},
+		}}
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), `user "user1": duplicate username`) {
+			t.Fatalf("expected duplicate username error, got %v", err)
+		}
+	})
+
+	t.Run("Htpasswd", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "htpasswd")
+		if err := ioutil.WriteFile(path, []byte("user1:{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c := &Config{
+			Users:         []User{{Username: "user1", Password: "pass1"}},
+			UsersHtpasswd: path,
+		}
+		if err := c.LoadUserFiles(); err != nil {
+			t.Fatal(err)
+		}
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), `user "user1" (`) || !strings.Contains(err.Error(), "duplicate username") {
+			t.Fatalf("expected duplicate username error, got %v", err)
+		}
+	})
+}
+
+func TestValidateErrors(t *testing.T) {
+	c := &Config{
+		Users:           []User{{Username: "user1", Password: "pass1", MaxConnections: -1}},
+		DNSTimeout:      -1,
+		PortAffinity:    -1,
+		DenyClients:     []string{"invalid"},
+		Listeners:       []Listener{{Listen: ":1080"}},
+		EarlyData:       "invalid",
+		TopDestinations: -1,
+		Quota:           Quota{Thresholds: []int{0, 200}},
+		Upstreams:       []Upstream{{}},
+	}
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+
+	for _, expected := range []string{
+		"dns_timeout must not be negative",
+		"port_affinity must not be negative",
+		"deny_clients: ",
+		"listeners[0]: listen and tag must be set",
+		`user "user1": `,
+		"early_data should be",
+		"top_destinations must be between",
+		"quota: thresholds must be between 1 and 100",
+		"upstream: empty address",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q not found in %q", expected, err)
+		}
+	}
+	if n := len(multierr.Errors(err)); n != 9 {
+		t.Errorf("expected 9 errors, got %d: %s", n, err)
+	}
+}
+
+func TestUserMetrics(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			conf := &Config{
+				Users:       []User{{Username: "user1", Password: "pass1", MonthlyQuota: 1000}},
+				UserMetrics: enabled,
+			}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			srv.updateGauges()
+			srv.metrics.Inc("quota_threshold_events_total", append(conf.userLabels("user1"), "threshold", "80")...)
+
+			var buf strings.Builder
+			srv.metrics.WriteText(&buf)
+			text := buf.String()
+			if !strings.Contains(text, `quota_threshold_events_total{`) {
+				t.Fatalf("threshold metric is missing:\n%s", text)
+			}
+			if actual := strings.Contains(text, `user="user1"`); actual != enabled {
+				t.Fatalf("expected user label %t, got %t:\n%s", enabled, actual, text)
+			}
+			if actual := strings.Contains(text, "quota_used_bytes"); actual != enabled {
+				t.Fatalf("expected quota gauge %t, got %t:\n%s", enabled, actual, text)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultPoolIdleTimeout is used when connection_pool idle_timeout is not set.
+const defaultPoolIdleTimeout = 30 * time.Second
+
+// ConnectionPool keeps idle pre-established direct connections to configured destinations,
+// so clients making many short connections don't wait for TCP handshake.
+// Relayed connections are never returned to the pool, as streams have no boundaries the proxy could see;
+// each pooled connection is handed out once, and the pool is refilled in background.
+type ConnectionPool struct {
+	Destinations []string      `yaml:"destinations"` // host:port as requested by clients
+	Size         int           `yaml:"size"`         // idle connections per destination
+	IdleTimeout  time.Duration `yaml:"idle_timeout"` // defaultPoolIdleTimeout if not set
+
+	destinations map[string]bool
+}
+
+// validate checks connection pool settings.
+func (p *ConnectionPool) validate() error {
+	if p.Size < 0 || p.IdleTimeout < 0 {
+		return fmt.Errorf("connection_pool: size and idle_timeout should not be negative")
+	}
+	if len(p.Destinations) > 0 && p.Size == 0 {
+		return fmt.Errorf("connection_pool: size should be set for destinations")
+	}
+
+	p.destinations = make(map[string]bool, len(p.Destinations))
+	for _, d := range p.Destinations {
+		host, port, err := net.SplitHostPort(d)
+		if err != nil || host == "" || port == "" {
+			return fmt.Errorf("connection_pool: invalid destination %q, host:port expected", d)
+		}
+		p.destinations[poolKey(host, port)] = true
+	}
+	return nil
+}
+
+// idleTimeout returns the time after which idle connections are closed.
+func (p *ConnectionPool) idleTimeout() time.Duration {
+	if p.IdleTimeout > 0 {
+		return p.IdleTimeout
+	}
+	return defaultPoolIdleTimeout
+}
+
+// poolable returns pool key for destination, or empty string if it should not be pooled.
+func (p *ConnectionPool) poolable(host string, raddr *net.TCPAddr) string {
+	key := poolKey(host, fmt.Sprint(raddr.Port))
+	if !p.destinations[key] {
+		return ""
+	}
+	return key
+}
+
+func poolKey(host, port string) string {
+	return net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// pooledConn is an idle connection in the pool.
+type pooledConn struct {
+	net.Conn
+	timer *time.Timer // closes connection after idle timeout
+}
+
+// connPool holds idle connections per destination.
+type connPool struct {
+	m       sync.Mutex
+	idle    map[string][]*pooledConn // oldest first
+	dialing map[string]int
+}
+
+func newConnPool() *connPool {
+	return &connPool{
+		idle:    make(map[string][]*pooledConn),
+		dialing: make(map[string]int),
+	}
+}
+
+// Len returns the number of idle connections.
+func (p *connPool) Len() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var n int
+	for _, conns := range p.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+// Get returns the newest idle connection to the destination still open by the server, or nil.
+func (p *connPool) Get(key string) net.Conn {
+	for {
+		p.m.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.m.Unlock()
+			return nil
+		}
+		pc := conns[len(conns)-1]
+		p.removeLocked(key, pc)
+		p.m.Unlock()
+
+		if !pc.timer.Stop() {
+			continue // closed by timer meanwhile
+		}
+		if connAlive(pc.Conn) {
+			return pc.Conn
+		}
+		pc.Close()
+	}
+}
+
+// Refill dials connections to the destination in background until there are size of them,
+// including ones being dialed.
+func (p *connPool) Refill(key string, size int, idleTimeout time.Duration, dial func(context.Context) (net.Conn, error), l *zap.SugaredLogger) {
+	p.m.Lock()
+	n := size - len(p.idle[key]) - p.dialing[key]
+	p.dialing[key] += n
+	p.m.Unlock()
+
+	for i := 0; i < n; i++ {
+		go func() {
+			c, err := dial(context.Background())
+
+			p.m.Lock()
+			defer p.m.Unlock()
+
+			if p.dialing[key]--; p.dialing[key] <= 0 {
+				delete(p.dialing, key)
+			}
+			if err != nil {
+				l.Warnf("Failed to refill connection pool for %s: %s.", key, err)
+				return
+			}
+			pc := &pooledConn{Conn: c}
+			pc.timer = time.AfterFunc(idleTimeout, func() {
+				p.m.Lock()
+				p.removeLocked(key, pc)
+				p.m.Unlock()
+				pc.Close()
+			})
+			p.idle[key] = append(p.idle[key], pc)
+		}()
+	}
+}
+
+// removeLocked removes connection from the pool if it is there; p.m should be held.
+func (p *connPool) removeLocked(key string, pc *pooledConn) {
+	conns := p.idle[key]
+	for i, c := range conns {
+		if c == pc {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.idle, key)
+		return
+	}
+	p.idle[key] = conns
+}
+
+// dialPooled connects to the destination directly, using an idle connection from the pool if the destination
+// is poolable. In that case, the pool is refilled afterwards. It returns the relay path taken.
+func (tcp *TCPConn) dialPooled(ctx context.Context, host string, raddr *net.TCPAddr, l *zap.SugaredLogger) (net.Conn, string, error) {
+	pool := &tcp.conf.ConnectionPool
+	key := pool.poolable(host, raddr)
+	if key == "" {
+		return tcp.dial(ctx, raddr, nil, l)
+	}
+
+	c, path := tcp.srv.pool.Get(key), relayPathPooled
+	var err error
+	if c != nil {
+		l.Debugf("Using idle connection from the pool for %s.", key)
+		tcp.srv.metrics.Inc("connection_pool_hits_total")
+	} else {
+		tcp.srv.metrics.Inc("connection_pool_misses_total")
+		if c, path, err = tcp.dial(ctx, raddr, nil, l); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// pooled connections are shared by all users, so port affinity is not used for them
+	policy := tcp.policy
+	dial := func(ctx context.Context) (net.Conn, error) {
+		d := &net.Dialer{
+			Timeout: policy.ConnectTimeout,
+		}
+		return dialPortRange(ctx, d, "tcp", raddr.String(), policy.OutboundPortRange)
+	}
+	tcp.srv.pool.Refill(key, pool.Size, pool.idleTimeout(), dial, l)
+	return c, path, nil
+}
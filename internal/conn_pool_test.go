@@ -0,0 +1,115 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestConnectionPool(t *testing.T) {
+	// destinations answer client's request with the accept number of the connection;
+	// servers speaking first are not pooled, as their connections are not idle
+	greeter := func(accepted *int32) string {
+		return testListen(t, func(ctx context.Context, c net.Conn) {
+			defer c.Close()
+			go func() {
+				<-ctx.Done()
+				c.Close()
+			}()
+			n := byte(atomic.AddInt32(accepted, 1))
+			b := make([]byte, 1)
+			if _, err := c.Read(b); err != nil {
+				return
+			}
+			c.Write([]byte{n})
+			io.Copy(ioutil.Discard, c)
+		})
+	}
+	var pooledAccepted, otherAccepted int32
+	pooled, other := greeter(&pooledAccepted), greeter(&otherAccepted)
+	pooledAddr, _ := net.ResolveTCPAddr("tcp", pooled)
+	otherAddr, _ := net.ResolveTCPAddr("tcp", other)
+
+	conf := &Config{
+		Users:          []User{{Username: "user1", Password: "pass1"}},
+		ConnectionPool: ConnectionPool{Destinations: []string{pooled}, Size: 1},
+	}
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, conf, l)
+
+	// greeting tells which upstream connection the client got
+	greeting := func(dst *net.TCPAddr) byte {
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dst)
+		defer c.Close()
+		if res[1] != 0 {
+			t.Fatalf("request failed: % x", res)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b := []byte{0}
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		return b[0]
+	}
+
+	// the first connection is dialed, and the pool is filled in background;
+	// the next ones get the single connection accepted before they were requested and not used yet
+	used := map[byte]bool{greeting(pooledAddr): true}
+	for i := 2; i <= 3; i++ {
+		waitFor(t, func() bool { return srv.pool.Len() == 1 && atomic.LoadInt32(&pooledAccepted) == int32(i) })
+		g := greeting(pooledAddr)
+		if used[g] || int(g) > i {
+			t.Errorf("expected pooled upstream connection (%d accepted, used %v), got %d", i, used, g)
+		}
+		used[g] = true
+	}
+
+	// other destinations are dialed for each connection and never pooled
+	for i := byte(1); i <= 3; i++ {
+		if g := greeting(otherAddr); g != i {
+			t.Errorf("expected upstream connection %d, got %d", i, g)
+		}
+	}
+	waitFor(t, func() bool { return srv.Active() == 0 && srv.pool.Len() == 1 })
+	if n := atomic.LoadInt32(&otherAccepted); n != 3 {
+		t.Errorf("expected 3 connections to not poolable destination, got %d", n)
+	}
+
+	paths := make(map[string]int)
+	for _, e := range log.Entries("Connection closed.") {
+		paths[e["relay_path"].(string)]++
+	}
+	if paths[relayPathPooled] != 2 || paths[relayPathDirect] != 4 {
+		t.Errorf("expected 2 pooled and 4 direct connections, got %v", paths)
+	}
+
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	for _, line := range []string{
+		"telesock_connection_pool_hits_total 2",
+		"telesock_connection_pool_misses_total 1",
+	} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("expected %s:\n%s", line, metrics.String())
+		}
+	}
+}
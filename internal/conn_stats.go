@@ -0,0 +1,94 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of relayed connection's statistics.
+type ConnStats struct {
+	ID         uint64
+	Listener   string
+	Client     string
+	User       string
+	Target     string // destination host:port
+	Started    time.Time
+	Duration   time.Duration
+	FromClient int64 // bytes relayed from the client to the server so far
+	FromServer int64 // bytes relayed from the server to the client so far
+}
+
+// ID returns connection ID, unique within the Server.
+func (tcp *TCPConn) ID() uint64 {
+	return tcp.id
+}
+
+// stats returns connection's statistics. Counters are read atomically, so it is safe to call during relay.
+func (tcp *TCPConn) stats(now time.Time) ConnStats {
+	return ConnStats{
+		ID:         tcp.id,
+		Listener:   tcp.listener,
+		Client:     remoteAddrString(tcp.client),
+		User:       tcp.user.Username,
+		Target:     tcp.target,
+		Started:    tcp.started,
+		Duration:   now.Sub(tcp.started),
+		FromClient: atomic.LoadInt64(&tcp.fromClient),
+		FromServer: atomic.LoadInt64(&tcp.fromServer),
+	}
+}
+
+// ConnStats returns live statistics of relayed connection with given ID.
+// It returns false if there is no such connection, or it is not relaying yet or anymore.
+func (s *Server) ConnStats(id uint64) (ConnStats, bool) {
+	s.relaysM.Lock()
+	tcp := s.relays[id]
+	s.relaysM.Unlock()
+
+	if tcp == nil {
+		return ConnStats{}, false
+	}
+	return tcp.stats(time.Now()), true
+}
+
+// ConnIDs returns sorted IDs of relayed connections.
+func (s *Server) ConnIDs() []uint64 {
+	s.relaysM.Lock()
+	res := make([]uint64, 0, len(s.relays))
+	for id := range s.relays {
+		res = append(res, id)
+	}
+	s.relaysM.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// connectionDurationBounds are bucket bounds of connection_duration_seconds histogram in seconds,
+// from a second to a week, as connections may be relayed for days.
+var connectionDurationBounds = []float64{1, 10, 60, 300, 1800, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
+
+// oldestRelayAge returns age of the oldest relayed connection, or zero if there are none.
+// Unlike connection_duration_seconds histogram observed on close, it reflects long-lived connections while they are open.
+func (s *Server) oldestRelayAge(now time.Time) time.Duration {
+	s.relaysM.Lock()
+	defer s.relaysM.Unlock()
+
+	var oldest time.Duration
+	for _, tcp := range s.relays {
+		if age := now.Sub(tcp.started); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
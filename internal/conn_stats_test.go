@@ -0,0 +1,160 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnStats(t *testing.T) {
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	srv, addr := testServer(t, conf)
+
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const chunk = 10 << 10
+	b := make([]byte, chunk)
+	var prev ConnStats
+	for i := 1; i <= 6; i++ {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+
+		// configuration is reloaded in the middle of the transfer
+		if i == 3 {
+			newConf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}, IdleTimeout: time.Hour}
+			if err := newConf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv.SetConfig(newConf)
+		}
+
+		ids := srv.ConnIDs()
+		if len(ids) != 1 {
+			t.Fatalf("expected a single connection, got %v", ids)
+		}
+		st, ok := srv.ConnStats(ids[0])
+		if !ok {
+			t.Fatal("connection is not found")
+		}
+		if st.User != "user1" || st.Target != echoAddr.String() || st.Client != c.LocalAddr().String() || st.Listener != ListenerDefault {
+			t.Errorf("unexpected stats %+v", st)
+		}
+
+		// echoed data is counted in both directions, and counters only grow
+		if expected := int64(i * chunk); st.FromClient != expected || st.FromServer != expected {
+			t.Errorf("%d: expected %d bytes in both directions, got %d and %d", i, expected, st.FromClient, st.FromServer)
+		}
+		if i > 1 && (st.ID != prev.ID || st.Started != prev.Started || st.Duration < prev.Duration) {
+			t.Errorf("%d: unexpected stats %+v after %+v", i, st, prev)
+		}
+		if used := srv.accounting.Used("user1", time.Now()); used != st.FromClient+st.FromServer {
+			t.Errorf("%d: expected %d bytes of user's traffic, got %d", i, st.FromClient+st.FromServer, used)
+		}
+		prev = st
+	}
+
+	// server counters are not reset by reload either
+	c2, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	c2.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	c.Close()
+	waitFor(t, func() bool { return srv.Active() == 0 })
+	if _, ok := srv.ConnStats(prev.ID); ok {
+		t.Error("closed connection is found")
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "telesock_connections_total 2\n") {
+		t.Errorf("expected 2 connections:\n%s", metrics.String())
+	}
+}
+
+func TestOldestConnectionAge(t *testing.T) {
+	srv, addr := testServer(t, &Config{Users: []User{{Username: "user1", Password: "pass1"}}})
+	gauge := func() float64 {
+		t.Helper()
+
+		srv.updateGauges()
+		var metrics strings.Builder
+		srv.metrics.WriteText(&metrics)
+		for _, line := range strings.Split(metrics.String(), "\n") {
+			if v := strings.TrimPrefix(line, "telesock_oldest_connection_age_seconds "); v != line {
+				f, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return f
+			}
+		}
+		t.Fatalf("no gauge in:\n%s", metrics.String())
+		return 0
+	}
+
+	if age := gauge(); age != 0 {
+		t.Errorf("expected zero age without connections, got %f", age)
+	}
+
+	old, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	defer old.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	time.Sleep(200 * time.Millisecond)
+	young, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	defer young.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+
+	// the oldest connection is reported while it is open
+	if age := gauge(); age < 0.2 || age > 5 {
+		t.Errorf("unexpected age %f", age)
+	}
+	if age := srv.oldestRelayAge(time.Now().Add(48 * time.Hour)); age < 48*time.Hour {
+		t.Errorf("expected age of days, got %s", age)
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if strings.Contains(metrics.String(), "telesock_connection_duration_seconds_count") {
+		t.Errorf("open connections are observed:\n%s", metrics.String())
+	}
+
+	old.Close()
+	waitFor(t, func() bool { return srv.Active() == 1 })
+	if age := gauge(); age >= 0.2 {
+		t.Errorf("expected age of the younger connection, got %f", age)
+	}
+
+	young.Close()
+	waitFor(t, func() bool { return srv.Active() == 0 })
+	if age := gauge(); age != 0 {
+		t.Errorf("expected zero age after close, got %f", age)
+	}
+	metrics.Reset()
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "telesock_connection_duration_seconds_count 2\n") {
+		t.Errorf("expected closed connections to be observed:\n%s", metrics.String())
+	}
+}
@@ -0,0 +1,86 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RejectDenied closes connection of the client from deny_clients, holding it in tarpit first if configured.
+// It returns false if client is not denied. Denied connections are not counted as active or total connections.
+func (s *Server) RejectDenied(ctx context.Context, c net.Conn, l *zap.SugaredLogger) bool {
+	conf := s.Config()
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok || !conf.denied(addr.IP) {
+		return false
+	}
+
+	s.metrics.Inc("denied_connections_total")
+	s.closes.Add(closedConn{at: time.Now(), client: addr.String(), reason: endBan})
+	l = l.With(zap.String("close_reason", endBan))
+	s.audit(&AuditEvent{Type: AuditACLDeny, Client: addr.String(), Reason: "deny_clients"})
+	if t := conf.Tarpit; t.Duration > 0 && s.acquireTarpit(t.MaxConnections) {
+		l.Infof("Client is denied, holding connection in tarpit for %s.", t.Duration)
+		s.metrics.Inc("tarpit_connections_total")
+		s.tarpit(ctx, c, t.Duration)
+		atomic.AddInt64(&s.tarpitted, -1)
+	} else {
+		l.Infof("Client is denied.")
+	}
+
+	if conf.abortiveClose(CloseDenied) {
+		if lc, ok := c.(interface{ SetLinger(int) error }); ok {
+			lc.SetLinger(0)
+		}
+	}
+	c.Close()
+	return true
+}
+
+// acquireTarpit registers tarpitted connection. It returns false if limit is reached.
+func (s *Server) acquireTarpit(limit int) bool {
+	for {
+		n := atomic.LoadInt64(&s.tarpitted)
+		if n >= int64(limit) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.tarpitted, n, n+1) {
+			return true
+		}
+	}
+}
+
+// Tarpitted returns a number of connections held in tarpit.
+func (s *Server) Tarpitted() int64 {
+	return atomic.LoadInt64(&s.tarpitted)
+}
+
+// tarpit holds connection open without any response for duration, until the client closes it,
+// or until context is canceled. Received data is discarded.
+func (s *Server) tarpit(ctx context.Context, c net.Conn, d time.Duration) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	c.SetReadDeadline(time.Now().Add(d))
+	io.Copy(ioutil.Discard, c)
+}
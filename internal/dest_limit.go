@@ -0,0 +1,152 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DestinationLimit limits concurrent outbound connections per destination IP address,
+// so a single user can't make this host look like an attacker. Zero values mean unlimited.
+type DestinationLimit struct {
+	MaxConnections int           `yaml:"max_connections"` // for all users
+	MaxPerUser     int           `yaml:"max_per_user"`
+	QueueTimeout   time.Duration `yaml:"queue_timeout"` // how long to wait for a free slot; requests are rejected immediately if zero
+}
+
+// validate checks destination limit settings.
+func (d *DestinationLimit) validate() error {
+	if d.MaxConnections < 0 || d.MaxPerUser < 0 || d.QueueTimeout < 0 {
+		return fmt.Errorf("destination_limit: max_connections, max_per_user and queue_timeout should not be negative")
+	}
+	return nil
+}
+
+// enabled returns true if any limit is set.
+func (d *DestinationLimit) enabled() bool {
+	return d.MaxConnections > 0 || d.MaxPerUser > 0
+}
+
+// destinationShards is the number of independently locked parts of destinationConns.
+const destinationShards = 32
+
+// destinationShard tracks connections to a subset of destinations.
+type destinationShard struct {
+	m        sync.Mutex
+	total    map[string]int    // by destination IP address
+	users    map[[2]string]int // by destination IP address and user
+	released chan struct{}     // closed and replaced when a connection is released
+}
+
+// destinationConns tracks concurrent outbound connections per destination IP address.
+type destinationConns struct {
+	shards [destinationShards]destinationShard
+}
+
+func newDestinationConns() *destinationConns {
+	d := new(destinationConns)
+	for i := range d.shards {
+		d.shards[i].total = make(map[string]int)
+		d.shards[i].users = make(map[[2]string]int)
+		d.shards[i].released = make(chan struct{})
+	}
+	return d
+}
+
+func (d *destinationConns) shard(ip string) *destinationShard {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return &d.shards[h.Sum32()%destinationShards]
+}
+
+// Acquire registers user's connection to destination ip, waiting up to limit's queue timeout for a free slot.
+// It returns false if limit is still reached, or if context is canceled.
+func (d *destinationConns) Acquire(ctx context.Context, ip, user string, limit DestinationLimit) bool {
+	s := d.shard(ip)
+	key := [2]string{ip, user}
+
+	var timeout <-chan time.Time
+	if limit.QueueTimeout > 0 {
+		t := time.NewTimer(limit.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for {
+		s.m.Lock()
+		if (limit.MaxConnections <= 0 || s.total[ip] < limit.MaxConnections) &&
+			(limit.MaxPerUser <= 0 || s.users[key] < limit.MaxPerUser) {
+			s.total[ip]++
+			s.users[key]++
+			s.m.Unlock()
+			return true
+		}
+		released := s.released
+		s.m.Unlock()
+
+		if timeout == nil {
+			return false
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Release unregisters user's connection to destination ip, waking up waiting requests.
+func (d *destinationConns) Release(ip, user string) {
+	s := d.shard(ip)
+	key := [2]string{ip, user}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.total[ip]--; s.total[ip] <= 0 {
+		delete(s.total, ip)
+	}
+	if s.users[key]--; s.users[key] <= 0 {
+		delete(s.users, key)
+	}
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// Top returns up to n destinations with the most connections, most connected first.
+func (d *destinationConns) Top(n int) []topEntry {
+	var res []topEntry
+	for i := range d.shards {
+		s := &d.shards[i]
+		s.m.Lock()
+		for ip, c := range s.total {
+			res = append(res, topEntry{Key: ip, Count: uint64(c)})
+		}
+		s.m.Unlock()
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,53 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// validateDestination checks that destination pattern is a valid CIDR, IP address or host pattern.
+func validateDestination(pattern string) error {
+	if pattern == "" {
+		return fmt.Errorf("empty destination")
+	}
+	if strings.Contains(pattern, "/") {
+		if _, _, err := net.ParseCIDR(pattern); err != nil {
+			return err
+		}
+		return nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q: %s", pattern, err)
+	}
+	return nil
+}
+
+// matchDestination returns true if destination host or IP address matches pattern.
+// Pattern may be a CIDR ("10.0.0.0/8"), an IP address, or a host pattern ("*.example.com").
+func matchDestination(pattern string, host string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") {
+		_, ipnet, err := net.ParseCIDR(pattern)
+		return err == nil && ip != nil && ipnet.Contains(ip)
+	}
+
+	if patternIP := net.ParseIP(pattern); patternIP != nil {
+		return ip != nil && patternIP.Equal(ip)
+	}
+
+	if host == "" {
+		return false
+	}
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return ok
+}
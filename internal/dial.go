@@ -0,0 +1,113 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errOutboundPortsExhausted is returned when there is no free local port in outbound port range.
+var errOutboundPortsExhausted = errors.New("no free local port in outbound port range")
+
+// isAddrInUse returns true if error is caused by local address being already in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// dialContext dials address with given dialer. Tests replace it to simulate unreachable destinations.
+var dialContext = func(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	return d.DialContext(ctx, network, address)
+}
+
+// dialPortRange dials address binding local address to a port from given range (if it is set),
+// starting from a random one and trying the next port if it is in use.
+func dialPortRange(ctx context.Context, d *net.Dialer, network, address string, ports PortRange) (net.Conn, error) {
+	if ports.First == 0 {
+		return dialContext(ctx, d, network, address)
+	}
+
+	size := ports.Last - ports.First + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		pd := *d
+		pd.LocalAddr = &net.TCPAddr{Port: ports.First + (start+i)%size}
+		c, err := dialContext(ctx, &pd, network, address)
+		if err == nil {
+			return c, nil
+		}
+		if !isAddrInUse(err) || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errOutboundPortsExhausted
+}
+
+// interruptOnCancel makes pending and following I/O on c fail when ctx is canceled, until stop is called.
+func interruptOnCancel(ctx context.Context, c net.Conn) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// watchClient returns context canceled when the client closes its connection during the dial, so abandoned
+// connection attempts (including retries) are aborted. The returned function stops watching and returns true
+// if the client has closed its connection. Bytes the client sends meanwhile are kept buffered in clientR.
+// Only plain TCP clients are watched, as interrupted reads would break framing of wrapped connections.
+func (tcp *TCPConn) watchClient(ctx context.Context) (context.Context, func() bool) {
+	c, ok := tcp.client.(*net.TCPConn)
+	if !ok {
+		return ctx, func() bool { return false }
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var closed int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// returns on the first byte past already buffered ones, EOF or error, or on deadline set by stop
+		_, err := tcp.clientR.Peek(tcp.clientR.Buffered() + 1)
+		if err == nil || err == bufio.ErrBufferFull {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return
+		}
+		atomic.StoreInt32(&closed, 1)
+		cancel()
+	}()
+
+	return ctx, func() bool {
+		c.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.SetReadDeadline(time.Time{})
+		cancel()
+		return atomic.LoadInt32(&closed) == 1
+	}
+}
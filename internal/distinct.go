@@ -0,0 +1,75 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// distinctHosts tracks distinct destination hosts per user within a fixed time window.
+// Sets are bounded: once the limit is exceeded, new hosts are not recorded.
+type distinctHosts struct {
+	m     sync.Mutex
+	users map[string]*distinctSet
+}
+
+type distinctSet struct {
+	start   time.Time
+	hosts   map[string]struct{}
+	alerted bool
+}
+
+func newDistinctHosts() *distinctHosts {
+	return &distinctHosts{
+		users: make(map[string]*distinctSet),
+	}
+}
+
+// Add records connection of user to host at given time.
+// It returns true if host is new and over the limit, and true for the first such host within the window.
+func (d *distinctHosts) Add(user, host string, limit int, window time.Duration, now time.Time) (exceeded, first bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	s := d.users[user]
+	if s == nil || now.Sub(s.start) >= window {
+		s = &distinctSet{
+			start: now,
+			hosts: make(map[string]struct{}, limit),
+		}
+		d.users[user] = s
+	}
+
+	if _, ok := s.hosts[host]; ok {
+		return false, false
+	}
+	if len(s.hosts) < limit {
+		s.hosts[host] = struct{}{}
+		return false, false
+	}
+
+	first = !s.alerted
+	s.alerted = true
+	return true, first
+}
+
+// Exceeded returns true if user exceeded the limit within the current window, and the remaining window duration.
+func (d *distinctHosts) Exceeded(user string, window time.Duration, now time.Time) (bool, time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	s := d.users[user]
+	if s == nil || !s.alerted {
+		return false, 0
+	}
+	left := s.start.Add(window).Sub(now)
+	return left > 0, left
+}
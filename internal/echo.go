@@ -0,0 +1,88 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// echoAddr is a reserved destination served by in-process echo handler instead of a real dial.
+// 0.0.0.0/8 can't be used as destination address, so it never clashes with a real one.
+var echoAddr = &net.TCPAddr{IP: net.IPv4(0, 0, 0, 1), Port: 7}
+
+// isEcho returns true if destination should be served by in-process echo handler.
+func isEcho(conf *Config, host string, raddr *net.TCPAddr) bool {
+	if raddr.IP.Equal(echoAddr.IP) && raddr.Port == echoAddr.Port {
+		return true
+	}
+	return conf.EchoHost != "" && strings.EqualFold(conf.EchoHost, host)
+}
+
+// echoConn is a connection to in-process echo handler: everything written to it can be read back.
+// Measured throughput is logged when connection is closed.
+type echoConn struct {
+	l     *zap.SugaredLogger
+	start time.Time
+	r     *io.PipeReader
+	w     *io.PipeWriter
+	n     int64
+	once  sync.Once
+}
+
+// newEcho returns new connection to in-process echo handler.
+func newEcho(l *zap.SugaredLogger) net.Conn {
+	r, w := io.Pipe()
+	return &echoConn{
+		l:     l,
+		start: time.Now(),
+		r:     r,
+		w:     w,
+	}
+}
+
+func (e *echoConn) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	atomic.AddInt64(&e.n, int64(n))
+	return n, err
+}
+
+func (e *echoConn) Write(b []byte) (int, error) {
+	return e.w.Write(b)
+}
+
+// CloseWrite makes Read return io.EOF after all written data is read.
+func (e *echoConn) CloseWrite() error {
+	return e.w.Close()
+}
+
+func (e *echoConn) Close() error {
+	e.once.Do(func() {
+		e.w.Close()
+		e.r.Close()
+
+		n := atomic.LoadInt64(&e.n)
+		d := time.Since(e.start)
+		e.l.Infof("Echo closed: %d bytes echoed in %s (%.0f bytes/s).", n, d, float64(n)/d.Seconds())
+	})
+	return nil
+}
+
+func (e *echoConn) LocalAddr() net.Addr                { return echoAddr }
+func (e *echoConn) RemoteAddr() net.Addr               { return echoAddr }
+func (e *echoConn) SetDeadline(t time.Time) error      { return nil }
+func (e *echoConn) SetReadDeadline(t time.Time) error  { return nil }
+func (e *echoConn) SetWriteDeadline(t time.Time) error { return nil }
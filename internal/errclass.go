@@ -0,0 +1,79 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Classes of network errors, used in logs and metrics.
+const (
+	errClassEOF         = "eof"         // peer closed connection, possibly in the middle of a message
+	errClassReset       = "reset"       // ECONNRESET
+	errClassBrokenPipe  = "broken_pipe" // EPIPE: writing to connection closed by peer
+	errClassClosed      = "closed"      // connection closed on our side
+	errClassTimeout     = "timeout"
+	errClassRefused     = "refused"     // ECONNREFUSED
+	errClassUnreachable = "unreachable" // ENETUNREACH, EHOSTUNREACH
+	errClassOther       = "other"
+)
+
+// classifyError returns class of network error.
+func classifyError(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errClassEOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED):
+		return errClassReset
+	case errors.Is(err, syscall.EPIPE):
+		return errClassBrokenPipe
+	case errors.Is(err, net.ErrClosed):
+		return errClassClosed
+	case errors.As(err, &ne) && ne.Timeout():
+		return errClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errClassRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return errClassUnreachable
+	default:
+		return errClassOther
+	}
+}
+
+// dialFailure returns reason of failed request for dial error, so the client gets specific reply code.
+func dialFailure(err error) string {
+	switch classifyError(err) {
+	case errClassRefused:
+		return failConnectRefused
+	case errClassTimeout:
+		return failConnectTimeout
+	case errClassUnreachable:
+		if errors.Is(err, syscall.ENETUNREACH) {
+			return failNetworkUnreachable
+		}
+		return failHostUnreachable
+	default:
+		return failConnect
+	}
+}
+
+// benignErrorClass returns true for errors caused by the peer simply closing its connection.
+func benignErrorClass(class string) bool {
+	switch class {
+	case errClassEOF, errClassReset, errClassBrokenPipe, errClassClosed:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,84 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// dialError returns error as returned by net.Dialer for given cause.
+func dialError(err error) error {
+	return &net.OpError{
+		Op:   "dial",
+		Net:  "tcp",
+		Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80},
+		Err:  &os.SyscallError{Syscall: "connect", Err: err},
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	// real errors
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	_, refusedErr := net.Dial("tcp", ln.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	_, timeoutErr := new(net.Dialer).DialContext(ctx, "tcp", "192.0.2.1:80")
+
+	for name, tc := range map[string]struct {
+		err    error  // dial error, nil for policy denials
+		reason string // expected for dial errors, given for policy denials
+		rep    byte
+	}{
+		"ECONNREFUSED":     {err: dialError(syscall.ECONNREFUSED), reason: failConnectRefused, rep: 5},
+		"ECONNREFUSEDReal": {err: refusedErr, reason: failConnectRefused, rep: 5},
+		"EHOSTUNREACH":     {err: dialError(syscall.EHOSTUNREACH), reason: failHostUnreachable, rep: 4},
+		"ENETUNREACH":      {err: dialError(syscall.ENETUNREACH), reason: failNetworkUnreachable, rep: 3},
+		"ETIMEDOUT":        {err: dialError(syscall.ETIMEDOUT), reason: failConnectTimeout, rep: 6},
+		"Deadline":         {err: &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, reason: failConnectTimeout, rep: 6},
+		"TimeoutReal":      {err: timeoutErr, reason: failConnectTimeout, rep: 6},
+		"Other":            {err: dialError(syscall.EACCES), reason: failConnect, rep: 1},
+		"Unknown":          {err: errors.New("unknown"), reason: failConnect, rep: 1},
+
+		"ACLDestinationType":  {reason: failDestinationType, rep: 2},
+		"ACLDestinationLimit": {reason: failDestinationLimit, rep: 2},
+		"ACLDistinct":         {reason: failDistinctDestinations, rep: 2},
+		"ACLQuota":            {reason: failQuota, rep: 2},
+		"ACLMaxConnections":   {reason: failMaxConnections, rep: 2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			reason := tc.reason
+			if tc.err != nil {
+				if reason = dialFailure(tc.err); reason != tc.reason {
+					t.Fatalf("%v: expected %q, got %q", tc.err, tc.reason, reason)
+				}
+			}
+
+			tcp, r := testTCPConn(t)
+			tcp.replyFailure(reason, zap.NewNop().Sugar())
+			expected := []byte{5, tc.rep, 0, 1, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(r.Bytes(), expected) {
+				t.Errorf("expected % x, got % x", expected, r.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// FakeTLS transport of MTProto proxy ("ee" secrets): the client sends TLS ClientHello with random field
+// set to HMAC-SHA256 of the whole record (with zero random), keyed with user's secret and XORed with timestamp
+// in the last 4 bytes. The server replies with ServerHello, ChangeCipherSpec and a fake encrypted certificate,
+// with random field set to HMAC of client's random and the whole reply. After that, obfuscated2 traffic is
+// wrapped in TLS application data records.
+
+const (
+	tlsRecordHeaderLength     = 5
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+	tlsMaxRecordPayload       = 16384
+
+	tlsRandomOffset = 11 // in ClientHello and ServerHello records
+	tlsRandomLength = 32
+
+	// fakeTLSMaxTimeSkew is the allowed difference between client's timestamp and our time.
+	fakeTLSMaxTimeSkew = 2 * time.Minute
+
+	// fakeTLSReplaySweepSize is the number of remembered handshakes after which expired ones are removed.
+	fakeTLSReplaySweepSize = 1024
+)
+
+// clientHello holds ClientHello fields used by FakeTLS handshake.
+type clientHello struct {
+	random    []byte
+	sessionID []byte
+	sni       string
+}
+
+// parseClientHello parses TLS record with ClientHello, including record header.
+func parseClientHello(record []byte) (*clientHello, error) {
+	p := &tlsParser{b: record}
+	p.skip(tlsRecordHeaderLength)
+	if p.byte() != 1 {
+		return nil, fmt.Errorf("not a ClientHello")
+	}
+	p.skip(3 + 2) // length, version
+
+	var h clientHello
+	h.random = p.bytes(tlsRandomLength)
+	h.sessionID = p.bytes(int(p.byte()))
+	p.skip(int(p.uint16())) // cipher suites
+	p.skip(int(p.byte()))   // compression methods
+	ext := &tlsParser{b: p.bytes(int(p.uint16()))}
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	for len(ext.b) > 0 && ext.err == nil {
+		typ := ext.uint16()
+		data := &tlsParser{b: ext.bytes(int(ext.uint16()))}
+		if typ != 0 { // server_name
+			continue
+		}
+		list := &tlsParser{b: data.bytes(int(data.uint16()))}
+		for len(list.b) > 0 && list.err == nil {
+			nameType := list.byte()
+			name := list.bytes(int(list.uint16()))
+			if nameType == 0 && list.err == nil { // host_name
+				h.sni = string(name)
+			}
+		}
+		if data.err != nil || list.err != nil {
+			return nil, fmt.Errorf("malformed server_name extension")
+		}
+	}
+	if ext.err != nil {
+		return nil, ext.err
+	}
+
+	if len(h.sessionID) != 32 {
+		return nil, fmt.Errorf("unexpected session ID length %d", len(h.sessionID))
+	}
+	return &h, nil
+}
+
+// tlsParser reads big-endian fields; after the first error, it returns zero values.
+type tlsParser struct {
+	b   []byte
+	err error
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if p.err != nil || n > len(p.b) {
+		p.err = fmt.Errorf("truncated TLS message")
+		return nil
+	}
+	res := p.b[:n]
+	p.b = p.b[n:]
+	return res
+}
+
+func (p *tlsParser) skip(n int) { p.bytes(n) }
+
+func (p *tlsParser) byte() byte {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *tlsParser) uint16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// fakeTLSClient finds the user whose secret authenticates ClientHello record and checks its timestamp.
+func (c *Config) fakeTLSClient(record, random []byte, now time.Time) (*User, error) {
+	zeroed := append([]byte{}, record...)
+	copy(zeroed[tlsRandomOffset:tlsRandomOffset+tlsRandomLength], make([]byte, tlsRandomLength))
+
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.mtprotoSecret == nil {
+			continue
+		}
+
+		mac := hmac.New(sha256.New, u.mtprotoSecret)
+		mac.Write(zeroed)
+		sum := mac.Sum(nil)
+		if subtle.ConstantTimeCompare(sum[:28], random[:28]) != 1 {
+			continue
+		}
+
+		for j := 28; j < 32; j++ {
+			sum[j] ^= random[j]
+		}
+		ts := time.Unix(int64(binary.LittleEndian.Uint32(sum[28:])), 0)
+		if skew := now.Sub(ts); skew > fakeTLSMaxTimeSkew || skew < -fakeTLSMaxTimeSkew {
+			return u, fmt.Errorf("timestamp %s is too far from current time", ts.UTC().Format(time.RFC3339))
+		}
+		return u, nil
+	}
+	return nil, fmt.Errorf("unknown secret")
+}
+
+// fakeTLSServerHello returns ServerHello, ChangeCipherSpec and fake certificate records authenticated
+// with user's secret.
+func fakeTLSServerHello(secret []byte, hello *clientHello) ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err = rand.Read(size[:]); err != nil {
+		return nil, err
+	}
+	cert := make([]byte, 1024+int(binary.BigEndian.Uint16(size[:]))%3072)
+	if _, err = rand.Read(cert); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.Write([]byte{tlsRecordHandshake, 3, 3, 0, 122})
+	b.Write([]byte{2, 0, 0, 118}) // ServerHello
+	b.Write([]byte{3, 3})
+	b.Write(make([]byte, tlsRandomLength))
+	b.WriteByte(byte(len(hello.sessionID)))
+	b.Write(hello.sessionID)
+	b.Write([]byte{0x13, 0x01}) // TLS_AES_128_GCM_SHA256
+	b.WriteByte(0)              // no compression
+	b.Write([]byte{0, 46})
+	b.Write([]byte{0, 0x33, 0, 36, 0, 0x1d, 0, 32}) // key_share: x25519
+	b.Write(key.PublicKey().Bytes())
+	b.Write([]byte{0, 0x2b, 0, 2, 3, 4}) // supported_versions: TLS 1.3
+
+	b.Write([]byte{tlsRecordChangeCipherSpec, 3, 3, 0, 1, 1})
+	b.Write([]byte{tlsRecordApplicationData, 3, 3, byte(len(cert) >> 8), byte(len(cert))})
+	b.Write(cert)
+
+	res := b.Bytes()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(hello.random)
+	mac.Write(res)
+	copy(res[tlsRandomOffset:], mac.Sum(nil))
+	return res, nil
+}
+
+// fakeTLSReplays remembers randoms of accepted ClientHellos, so recorded handshakes can't be replayed
+// by active probes while their timestamps are still valid.
+type fakeTLSReplays struct {
+	m    sync.Mutex
+	seen map[[tlsRandomLength]byte]time.Time
+}
+
+func newFakeTLSReplays() *fakeTLSReplays {
+	return &fakeTLSReplays{
+		seen: make(map[[tlsRandomLength]byte]time.Time),
+	}
+}
+
+// Add remembers random and returns false if it was already seen.
+func (r *fakeTLSReplays) Add(random []byte, now time.Time) bool {
+	var key [tlsRandomLength]byte
+	copy(key[:], random)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if expires, ok := r.seen[key]; ok && now.Before(expires) {
+		return false
+	}
+	if len(r.seen) >= fakeTLSReplaySweepSize {
+		for k, expires := range r.seen {
+			if now.After(expires) {
+				delete(r.seen, k)
+			}
+		}
+	}
+	r.seen[key] = now.Add(2 * fakeTLSMaxTimeSkew)
+	return true
+}
+
+// fakeTLSConn reads payload of TLS application data records from and writes it in such records
+// to the underlying connection. ChangeCipherSpec records sent by the client are skipped.
+type fakeTLSConn struct {
+	wrappedConn
+	r    io.Reader // reads from Conn, possibly starting with buffered data
+	left int       // unread bytes of the current record
+	hdr  [tlsRecordHeaderLength]byte
+	buf  []byte // for writing; there is only one writer
+}
+
+func (c *fakeTLSConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if _, err := io.ReadFull(c.r, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(c.hdr[3:]))
+		switch c.hdr[0] {
+		case tlsRecordApplicationData:
+			c.left = n
+		case tlsRecordChangeCipherSpec:
+			if _, err := io.CopyN(io.Discard, c.r, int64(n)); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("unexpected TLS record type %#02x", c.hdr[0])
+		}
+	}
+
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= n
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write writes p in one or more records. Short write breaks the stream, but it also breaks the relay.
+func (c *fakeTLSConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tlsMaxRecordPayload {
+			chunk = chunk[:tlsMaxRecordPayload]
+		}
+		c.buf = append(c.buf[:0], tlsRecordApplicationData, 3, 3, byte(len(chunk)>>8), byte(len(chunk)))
+		c.buf = append(c.buf, chunk...)
+		if _, err := c.Conn.Write(c.buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,76 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// forward relays the client connection as is to the fallback server at addr, starting with bytes
+// already consumed from the client. Active probes get genuine responses of that server,
+// so the listener can't be distinguished from it. Forwarded connections are not authenticated,
+// so they are not counted in traffic accounting; reason is used as a metric label.
+func (tcp *TCPConn) forward(ctx context.Context, addr string, consumed []byte, reason string, l *zap.SugaredLogger) {
+	l = l.With(zap.String("fallback", addr))
+	tcp.srv.metrics.Inc("fallback_connections_total", "reason", reason)
+
+	d := &net.Dialer{Timeout: tcp.conf.connectTimeout()}
+	server, err := dialContext(ctx, d, "tcp", addr)
+	if err != nil {
+		l.Errorf("Failed to connect to fallback: %s.", err)
+		return
+	}
+	tcp.server = server // closed by Close
+	l.Infof("Connection forwarded to fallback %s->%s.", server.LocalAddr(), server.RemoteAddr())
+
+	// forwarded connections are torn down like relayed ones: on shutdown and after idle timeout
+	defer tcp.stopOnShutdown(ctx)()
+	host, _, _ := net.SplitHostPort(addr)
+	tcp.policy = tcp.conf.Policy(nil, host, net.ParseIP(host))
+
+	var fromClient, fromServer io.Reader = io.MultiReader(
+		bytes.NewReader(consumed),
+		io.LimitReader(tcp.clientR, int64(tcp.clientR.Buffered())),
+		tcp.client,
+	), server
+	if tcp.policy.IdleTimeout > 0 {
+		fromClient = &idleReader{r: fromClient, tcp: tcp}
+		fromServer = &idleReader{r: fromServer, tcp: tcp}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if _, err := io.Copy(server, fromClient); err != nil {
+			if atomic.LoadInt32(&tcp.stopped) == 0 {
+				l.Debugf("Fallback: failed to read from the client: %s.", err)
+			}
+			return
+		}
+		if cw, ok := server.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	if _, err := io.Copy(tcp.clientW, fromServer); err != nil && atomic.LoadInt32(&tcp.stopped) == 0 {
+		l.Debugf("Fallback: failed to read from the server: %s.", err)
+	}
+
+	// the client direction (if still relaying) is interrupted, so it doesn't outlive the connection
+	atomic.StoreInt32(&tcp.stopped, 1)
+	tcp.clientW.Close()
+	<-done
+}
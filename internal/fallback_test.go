@@ -0,0 +1,147 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testFallback starts fallback server that reads everything and never replies, like the cover site
+// receiving a probe. It returns its address and a channel receiving the first read bytes of each connection.
+func testFallback(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+
+	received := make(chan []byte, 10)
+	addr := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+
+		b := make([]byte, 1024)
+		n, _ := c.Read(b)
+		received <- b[:n]
+		io.Copy(ioutil.Discard, c)
+	})
+	return addr, received
+}
+
+func TestForwardTeardown(t *testing.T) {
+	for name, tc := range map[string]struct {
+		idleTimeout time.Duration
+		cancel      bool
+		reason      string
+	}{
+		"Shutdown":    {cancel: true, reason: endShutdown},
+		"IdleTimeout": {idleTimeout: 100 * time.Millisecond},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fallback, received := testFallback(t)
+			conf := &Config{
+				Users:       []User{{Username: "user1", Password: "pass1"}},
+				IdleTimeout: tc.idleTimeout,
+				MTProto:     MTProto{FakeTLSDomain: "example.com", Fallback: fallback},
+			}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			tcp := NewTCPConn(c1, ListenerDefault, zap.NewNop().Sugar(), NewServer(conf))
+			defer tcp.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tcp.forward(ctx, conf.MTProto.fallback(), []byte("probe"), "test", zap.NewNop().Sugar())
+			}()
+
+			select {
+			case b := <-received:
+				if string(b) != "probe" {
+					t.Fatalf("unexpected forwarded data %q", b)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+
+			// neither the client nor the fallback server closes its connection
+			if tc.cancel {
+				cancel()
+			}
+			waitReturned(t, done)
+			if tc.reason != "" {
+				if reason := tcp.closeReason(); reason != tc.reason {
+					t.Errorf("expected %q, got %q", tc.reason, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoyShutdown(t *testing.T) {
+	fallback, received := testFallback(t)
+	conf := &Config{
+		Users:               []User{{Username: "user1", Password: "pass1"}},
+		MTProto:             MTProto{FakeTLSDomain: "example.com", Fallback: fallback},
+		StealthAuthFailures: StealthAuthDecoy,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tcp := NewTCPConn(c1, ListenerDefault, zap.NewNop().Sugar(), NewServer(conf))
+	defer tcp.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if tcp.Sniff() && tcp.Auth(ctx) {
+			t.Error("expected authentication to fail")
+		}
+	}()
+
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	credentials := []byte{1, 5, 'u', 's', 'e', 'r', '1', 5, 'w', 'r', 'o', 'n', 'g'}
+	if _, err := c2.Write(append([]byte{5, 1, 2}, credentials...)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c2, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// greeting and credentials are forwarded as is, and the client gets no failure reply
+	select {
+	case b := <-received:
+		if expected := append([]byte{5, 1, 2}, credentials...); string(b) != string(expected) {
+			t.Fatalf("expected % x, got % x", expected, b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	cancel()
+	waitReturned(t, done)
+	if reason := tcp.closeReason(); reason != endShutdown {
+		t.Errorf("expected %q, got %q", endShutdown, reason)
+	}
+}
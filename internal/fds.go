@@ -0,0 +1,68 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fdCheckInterval is the minimal interval between counts of open file descriptors.
+const fdCheckInterval = 100 * time.Millisecond
+
+// WaitFDs blocks while open file descriptors are above fd_watermark or until context is canceled.
+// It is called before accepting connections, so they wait in the listen backlog instead of failing with EMFILE.
+func (s *Server) WaitFDs(ctx context.Context, l *zap.SugaredLogger) {
+	for s.fdsOver(l) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(fdCheckInterval):
+		}
+	}
+}
+
+// fdsOver returns true if open file descriptors are above fd_watermark percents of the limit.
+// The result is cached for fdCheckInterval, so checks are cheap for all listeners.
+func (s *Server) fdsOver(l *zap.SugaredLogger) bool {
+	watermark := s.Config().FDWatermark
+	if watermark == 0 {
+		atomic.StoreInt32(&s.fdOver, 0)
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.fdCheckedAt)
+	if now-last < int64(fdCheckInterval) || !atomic.CompareAndSwapInt64(&s.fdCheckedAt, last, now) {
+		return atomic.LoadInt32(&s.fdOver) == 1
+	}
+
+	open, limit, err := openFDs()
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&s.fdErrLogged, 0, 1) {
+			l.Errorf("Can't count open file descriptors, fd_watermark is not used: %s.", err)
+		}
+		return false
+	}
+
+	if open*100 >= limit*watermark {
+		if atomic.CompareAndSwapInt32(&s.fdOver, 0, 1) {
+			l.Warnf("Accepting connections paused: %d of %d file descriptors are open, watermark is %d%%.", open, limit, watermark)
+			s.metrics.Inc("fd_watermark_pauses_total")
+		}
+		return true
+	}
+	if atomic.CompareAndSwapInt32(&s.fdOver, 1, 0) {
+		l.Warnf("Accepting connections resumed: %d of %d file descriptors are open.", open, limit)
+	}
+	return false
+}
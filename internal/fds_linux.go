@@ -0,0 +1,48 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// fdsSupported is true if openFDs is implemented on this platform.
+const fdsSupported = true
+
+// openFDs returns the number of open file descriptors of the process and their limit (RLIMIT_NOFILE).
+func openFDs() (open, limit int, err error) {
+	var rlimit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return
+	}
+
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return
+	}
+
+	limit = math.MaxInt32 // RLIM_INFINITY
+	if rlimit.Cur < math.MaxInt32 {
+		limit = int(rlimit.Cur)
+	}
+
+	// the directory itself is open while it is read
+	return len(names) - 1, limit, nil
+}
@@ -0,0 +1,111 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestFDWatermark(t *testing.T) {
+	open, _, err := openFDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lower the limit so the watermark is reachable by opening a few files
+	var rlimit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		t.Fatal(err)
+	}
+	limit := uint64(2*open + 100)
+	if rlimit.Max < limit {
+		t.Skipf("open files hard limit %d is too low", rlimit.Max)
+	}
+	saved := rlimit
+	rlimit.Cur = limit
+	if err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &saved)
+
+	conf := &Config{FDWatermark: 75}
+	if err = conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	l, log := testLogger(zapcore.InfoLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	wait := func() <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			srv.WaitFDs(ctx, l)
+			close(done)
+		}()
+		return done
+	}
+
+	// below the watermark accepts are not paused
+	waitReturned(t, wait())
+
+	// open files until above the watermark, with some margin
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+		files = nil
+	}
+	defer closeFiles()
+	for extra := 5; extra > 0; {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+		if open, _, _ = openFDs(); open*100 >= int(limit)*conf.FDWatermark {
+			extra--
+		}
+	}
+
+	time.Sleep(fdCheckInterval) // the previous count is cached
+	done := wait()
+	select {
+	case <-done:
+		t.Fatal("accepts are not paused")
+	case <-time.After(5 * fdCheckInterval):
+	}
+	if entries := log.Entries(""); len(entries) != 1 || !strings.HasPrefix(entries[0]["msg"].(string), "Accepting connections paused: ") {
+		t.Errorf("expected a single pause message, got %v", entries)
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "telesock_fd_watermark_pauses_total 1\n") {
+		t.Errorf("expected pause to be counted:\n%s", metrics.String())
+	}
+
+	// accepts resume when files are closed
+	closeFiles()
+	waitReturned(t, done)
+	if entries := log.Entries(""); len(entries) != 2 || !strings.HasPrefix(entries[1]["msg"].(string), "Accepting connections resumed: ") {
+		t.Errorf("expected resume message, got %v", entries)
+	}
+}
@@ -0,0 +1,23 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+//go:build !linux
+// +build !linux
+
+package internal
+
+import "errors"
+
+// fdsSupported is true if openFDs is implemented on this platform.
+const fdsSupported = false
+
+// openFDs returns the number of open file descriptors of the process and their limit. It is not implemented
+// on platforms other than Linux.
+func openFDs() (open, limit int, err error) {
+	return 0, 0, errors.New("counting open file descriptors is not supported")
+}
@@ -0,0 +1,307 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+// Minimal reader of MaxMind DB files (GeoIP2/GeoLite2 Country and ASN databases),
+// see https://maxmind.github.io/MaxMind-DB/.
+
+var mmdbMetadataStart = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdbMaxDepth limits nesting of maps, arrays and pointers, so corrupt databases with cycles are rejected.
+const mmdbMaxDepth = 512
+
+// mmdb is an in-memory MaxMind DB.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// openMMDB reads MaxMind DB file.
+func openMMDB(path string) (*mmdb, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(b, mmdbMetadataStart)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: MaxMind DB metadata not found", path)
+	}
+	md := &mmdbDecoder{data: b[i+len(mmdbMetadataStart):]}
+	v, _, err := md.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	meta, _ := v.(map[string]interface{})
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, fmt.Errorf("%s: %s", path, errMMDBCorrupt)
+	}
+	db := &mmdb{
+		tree:       b[:treeSize],
+		data:       b[treeSize+16 : i],
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+
+	// IPv4 addresses are stored as ::a.b.c.d in IPv6 databases
+	if db.ipVersion == 6 {
+		for j := 0; j < 96 && db.ipv4Start < db.nodeCount; j++ {
+			if db.ipv4Start, err = db.record(db.ipv4Start, 0); err != nil {
+				return nil, fmt.Errorf("%s: %s", path, err)
+			}
+		}
+	}
+	return db, nil
+}
+
+// record returns left (bit 0) or right (bit 1) record of the node.
+func (db *mmdb) record(node uint, bit uint) (uint, error) {
+	size := db.recordSize / 4 // node size in bytes
+	off := node * size
+	if off+size > uint(len(db.tree)) {
+		return 0, errMMDBCorrupt
+	}
+	b := db.tree[off : off+size]
+
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// Lookup returns data record for IP address, or nil if there is none.
+func (db *mmdb) Lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+
+	var err error
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		if node, err = db.record(node, bit); err != nil {
+			return nil, err
+		}
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	d := &mmdbDecoder{data: db.data}
+	v, _, err := d.decode(node-db.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// mmdbDecoder decodes MaxMind DB data section.
+type mmdbDecoder struct {
+	data []byte
+}
+
+// bytes returns n bytes at offset.
+func (d *mmdbDecoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.data)) || off+n < off {
+		return nil, errMMDBCorrupt
+	}
+	return d.data[off : off+n], nil
+}
+
+// uint decodes big-endian unsigned integer of n bytes.
+func (d *mmdbDecoder) uint(off, n uint) (uint64, error) {
+	b, err := d.bytes(off, n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// decode decodes value at offset and given nesting depth, returning it and the offset of the next value.
+func (d *mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("%s: maximum data structure depth exceeded", errMMDBCorrupt)
+	}
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// pointer
+		ss, vvv := uint(ctrl>>3)&3, uint(ctrl&7)
+		var p uint64
+		switch ss {
+		case 0:
+			p, err = d.uint(off, 1)
+			p += uint64(vvv) << 8
+		case 1:
+			p, err = d.uint(off, 2)
+			p += uint64(vvv)<<16 + 2048
+		case 2:
+			p, err = d.uint(off, 3)
+			p += uint64(vvv)<<24 + 526336
+		case 3:
+			p, err = d.uint(off, 4)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(uint(p), depth+1)
+		return v, off + ss + 1, err
+	}
+	if typ == 0 {
+		// extended type
+		if b, err = d.bytes(off, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		s, err := d.uint(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = [...]uint{0, 29, 285, 65821}[n] + uint(s)
+		off += n
+	}
+
+	switch typ {
+	case 2: // string
+		b, err := d.bytes(off, size)
+		return string(b), off + size, err
+	case 3: // double
+		v, err := d.uint(off, 8)
+		return math.Float64frombits(v), off + 8, err
+	case 4: // bytes
+		b, err := d.bytes(off, size)
+		return b, off + size, err
+	case 5, 6, 9, 10: // unsigned integers; uint128 is truncated
+		if size > 16 {
+			return nil, 0, errMMDBCorrupt
+		}
+		v, err := d.uint(off, size)
+		return v, off + size, err
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			if k, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[ks] = v
+		}
+		return m, off, nil
+	case 8: // int32
+		v, err := d.uint(off, size)
+		return int64(int32(v)), off + size, err
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var v interface{}
+			if v, off, err = d.decode(off, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, off, nil
+	case 14: // boolean
+		return size != 0, off, nil
+	case 15: // float
+		v, err := d.uint(off, 4)
+		return float64(math.Float32frombits(uint32(v))), off + 4, err
+	default:
+		return nil, 0, fmt.Errorf("%s: unexpected data type %d", errMMDBCorrupt, typ)
+	}
+}
+
+// geoIP holds optional GeoIP databases.
+type geoIP struct {
+	country *mmdb
+	asn     *mmdb
+}
+
+// Lookup returns client's country ISO code and autonomous system number (empty if unknown).
+func (g *geoIP) Lookup(ip net.IP) (country, asn string) {
+	if g.country != nil {
+		if r, _ := g.country.Lookup(ip); r != nil {
+			for _, k := range []string{"country", "registered_country"} {
+				c, _ := r[k].(map[string]interface{})
+				if code, _ := c["iso_code"].(string); code != "" {
+					country = code
+					break
+				}
+			}
+		}
+	}
+	if g.asn != nil {
+		if r, _ := g.asn.Lookup(ip); r != nil {
+			if n, ok := r["autonomous_system_number"].(uint64); ok {
+				asn = fmt.Sprintf("AS%d", n)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,119 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Test databases in testdata:
+//   - country-test.mmdb: 81.2.69.0/24 is GB, 2001:db8::/32 is registered in ZZ;
+//   - asn-test.mmdb: 1.128.0.0/11 is AS1221;
+//   - loop-test.mmdb: 192.0.2.0/24 is a map containing a pointer to itself, 198.51.100.0/24 is a pointer to itself.
+
+// remoteAddrConn overrides remote address of the connection.
+type remoteAddrConn struct {
+	net.Conn
+	raddr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr { return c.raddr }
+
+func testGeoIPServer(t *testing.T, geoip GeoIP) *Server {
+	t.Helper()
+
+	conf := &Config{
+		Users: []User{{Username: "user1", Password: "pass1"}},
+		GeoIP: geoip,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	srv.LoadGeoIP(zap.NewNop().Sugar())
+	return srv
+}
+
+func TestGeoIP(t *testing.T) {
+	srv := testGeoIPServer(t, GeoIP{CountryDB: "testdata/country-test.mmdb", ASNDB: "testdata/asn-test.mmdb"})
+
+	for ip, expected := range map[string][2]string{
+		"81.2.69.142":    {"GB", ""},
+		"1.128.0.1":      {"", "AS1221"},
+		"2001:db8::1":    {"ZZ", ""},
+		"203.0.113.1":    {"", ""},
+		"2001:db9::1":    {"", ""},
+		"::ffff:1.2.3.4": {"", ""},
+	} {
+		country, asn := srv.geoip.Lookup(net.ParseIP(ip))
+		if country != expected[0] || asn != expected[1] {
+			t.Errorf("%s: expected %q %q, got %q %q", ip, expected[0], expected[1], country, asn)
+		}
+	}
+}
+
+func TestGeoIPLogFields(t *testing.T) {
+	srv := testGeoIPServer(t, GeoIP{CountryDB: "testdata/country-test.mmdb", ASNDB: "testdata/asn-test.mmdb"})
+
+	for ip, expected := range map[string][]string{
+		"81.2.69.142": {`"client_country":"GB"`},
+		"1.128.0.1":   {`"client_asn":"AS1221"`},
+		"203.0.113.1": nil,
+	} {
+		var buf bytes.Buffer
+		core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zapcore.InfoLevel)
+		c1, c2 := net.Pipe()
+		c := &remoteAddrConn{Conn: c1, raddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}}
+		tcp := NewTCPConn(c, ListenerDefault, zap.New(core).Sugar(), srv)
+		c2.Close()
+		tcp.Close()
+
+		line := strings.SplitN(buf.String(), "\n", 2)[0]
+		if !strings.Contains(line, "Connection established.") {
+			t.Fatalf("%s: unexpected first line %s", ip, line)
+		}
+		for _, f := range expected {
+			if !strings.Contains(line, f) {
+				t.Errorf("%s: %s not found in %s", ip, f, line)
+			}
+		}
+		if expected == nil && strings.Contains(line, "client_") {
+			t.Errorf("%s: unexpected GeoIP fields in %s", ip, line)
+		}
+	}
+}
+
+func TestGeoIPMissing(t *testing.T) {
+	srv := testGeoIPServer(t, GeoIP{CountryDB: "testdata/missing.mmdb", ASNDB: "geoip_test.go"})
+
+	if country, asn := srv.geoip.Lookup(net.ParseIP("81.2.69.142")); country != "" || asn != "" {
+		t.Errorf("expected no data, got %q %q", country, asn)
+	}
+}
+
+func TestGeoIPLoop(t *testing.T) {
+	db, err := openMMDB("testdata/loop-test.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1"} {
+		r, err := db.Lookup(net.ParseIP(ip))
+		if err == nil || !strings.Contains(err.Error(), "maximum data structure depth exceeded") {
+			t.Errorf("%s: expected depth error, got %v %v", ip, r, err)
+		}
+	}
+}
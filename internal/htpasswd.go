@@ -0,0 +1,180 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// readHtpasswd reads users from htpasswd file with "username:hash" lines.
+// Users with unsupported hash formats are reported at once, so they are not silently unable to authenticate.
+func readHtpasswd(path string) ([]User, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	var errs error
+	var unsupported []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			errs = multierr.Append(errs, fmt.Errorf("%s: line %d: expected username:hash", path, line))
+			continue
+		}
+		u := User{Username: text[:i], passwordHash: text[i+1:], source: fmt.Sprintf("%s:%d", path, line)}
+		if err := checkPasswordHash(u.passwordHash); err != nil {
+			unsupported = append(unsupported, u.Username)
+			continue
+		}
+		users = append(users, u)
+	}
+	if err = s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if unsupported != nil {
+		errs = multierr.Append(errs, fmt.Errorf(
+			"%s: unsupported password hash format (only bcrypt, MD5-crypt and SHA-1 are supported) for users %s",
+			path, strings.Join(unsupported, ", "),
+		))
+	}
+	return users, errs
+}
+
+const (
+	// slowHashRate is the number of password hashes not found in cache verified per second for a single
+	// client IP address, with the same burst. Verifications over that fail without computing hash,
+	// so a client knowing a username can't make the server compute bcrypt on every connection.
+	slowHashRate = 5
+
+	// slowHashSweepSize is the number of tracked client IP addresses after which idle ones are removed.
+	slowHashSweepSize = 1024
+)
+
+// verifiedPasswords remembers successfully verified password hashes, so slow hashes like bcrypt
+// are computed once per user and password, not on every connection. Other verifications are limited
+// per client IP address and overall.
+type verifiedPasswords struct {
+	m       sync.Mutex
+	hashes  map[[sha256.Size]byte]struct{}
+	clients map[string]*rateLimiter
+	slow    chan struct{} // limits concurrently computed hashes
+	dummy   string        // the costliest users' hash, verified for unknown usernames
+}
+
+// newVerifiedPasswords returns verifier for given users' hashes.
+func newVerifiedPasswords(users []User) *verifiedPasswords {
+	v := &verifiedPasswords{
+		hashes:  make(map[[sha256.Size]byte]struct{}),
+		clients: make(map[string]*rateLimiter),
+		slow:    make(chan struct{}, runtime.NumCPU()),
+	}
+	for _, u := range users {
+		if u.passwordHash != "" && hashCost(u.passwordHash) > hashCost(v.dummy) {
+			v.dummy = u.passwordHash
+		}
+	}
+	return v
+}
+
+// hashCost returns relative cost of verifying password hash checked by checkPasswordHash.
+func hashCost(hash string) int {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		cost, _ := bcrypt.Cost([]byte(hash))
+		return 2 + cost
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return 2
+	case strings.HasPrefix(hash, "{SHA}"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Verify returns true if password sent from client IP address matches hash.
+func (v *verifiedPasswords) Verify(ip, hash string, password []byte) bool {
+	key := sha256.Sum256(append([]byte(hash+"\x00"), password...))
+
+	v.m.Lock()
+	_, ok := v.hashes[key]
+	v.m.Unlock()
+	if ok {
+		return true
+	}
+
+	if !v.verifySlow(ip, hash, password) {
+		return false
+	}
+
+	// only matching passwords are stored, so the size is bounded by the number of users
+	v.m.Lock()
+	v.hashes[key] = struct{}{}
+	v.m.Unlock()
+	return true
+}
+
+// VerifyUnknown spends the same time for unknown username as Verify for the costliest user's wrong password,
+// so failures don't reveal whether username exists. It does nothing if there are no users with hashes.
+func (v *verifiedPasswords) VerifyUnknown(ip string, password []byte) {
+	if v.dummy != "" {
+		v.verifySlow(ip, v.dummy, password)
+	}
+}
+
+// verifySlow computes password hash if client IP address is within slowHashRate.
+func (v *verifiedPasswords) verifySlow(ip, hash string, password []byte) bool {
+	now := time.Now()
+
+	v.m.Lock()
+	if len(v.clients) >= slowHashSweepSize {
+		for k, rl := range v.clients {
+			rl.m.Lock()
+			idle := now.Sub(rl.last) > time.Second
+			rl.m.Unlock()
+			if idle {
+				delete(v.clients, k)
+			}
+		}
+	}
+	rl := v.clients[ip]
+	if rl == nil {
+		rl = new(rateLimiter)
+		v.clients[ip] = rl
+	}
+	v.m.Unlock()
+
+	if !rl.take(1, slowHashRate, now) {
+		return false
+	}
+
+	v.slow <- struct{}{}
+	defer func() { <-v.slow }()
+	return verifyPasswordHash(hash, password)
+}
@@ -0,0 +1,50 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifiedPasswordsLimit(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := []User{
+		{Username: "sha", passwordHash: "{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE="},
+		{Username: "bcrypt", passwordHash: string(hash)},
+	}
+	v := newVerifiedPasswords(users)
+	if v.dummy != string(hash) {
+		t.Fatalf("expected the costliest hash to be used for unknown usernames, got %q", v.dummy)
+	}
+
+	// unknown usernames and wrong passwords spend the same budget
+	v.VerifyUnknown("192.0.2.1", []byte("secret"))
+	for i := 1; i < slowHashRate; i++ {
+		if v.Verify("192.0.2.1", string(hash), []byte("wrong")) {
+			t.Fatal("wrong password matches")
+		}
+	}
+	if v.Verify("192.0.2.1", string(hash), []byte("secret")) {
+		t.Fatal("expected verification to be limited")
+	}
+
+	// other clients are not affected, and verified passwords are cached
+	if !v.Verify("192.0.2.2", string(hash), []byte("secret")) {
+		t.Fatal("expected password to match")
+	}
+	if !v.Verify("192.0.2.1", string(hash), []byte("secret")) {
+		t.Fatal("expected verified password to be cached")
+	}
+}
@@ -0,0 +1,55 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// levelCore filters log entries by level. The wrapped core should enable all levels,
+// so the level may be replaced for a single connection in both directions.
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+// LevelOption returns logger option filtering entries by given level.
+// It should be used with logger enabling all levels.
+func LevelOption(level zapcore.LevelEnabler) zap.Option {
+	return zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &levelCore{Core: c, level: level}
+	})
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// withLevel returns logger with level replaced. Logger should be created with LevelOption.
+func withLevel(l *zap.SugaredLogger, level zapcore.Level) *zap.SugaredLogger {
+	return l.Desugar().WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		if lc, ok := c.(*levelCore); ok {
+			return &levelCore{Core: lc.Core, level: level}
+		}
+		return c
+	})).Sugar()
+}
@@ -0,0 +1,152 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// memorySoftRecoveryPercent of soft limit is the usage below which new connections are accepted again.
+	memorySoftRecoveryPercent = 90
+
+	// memoryShedDivisor is a share of relayed connections closed on every check above hard limit (at least one).
+	memoryShedDivisor = 10
+
+	defaultMemoryWatchdogInterval = time.Second
+)
+
+// limits returns soft and hard limits in bytes, zero if disabled. If both are not set,
+// they default to 80% and 95% of GOMEMLIMIT, if it is set.
+func (m MemoryWatchdog) limits() (soft, hard int64) {
+	soft, hard = int64(m.SoftLimit), int64(m.HardLimit)
+	if soft != 0 || hard != 0 {
+		return
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		soft, hard = limit/100*80, limit/100*95
+	}
+	return
+}
+
+// memoryUsed returns memory obtained from OS and not returned to it, as accounted by GOMEMLIMIT.
+func memoryUsed() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.Sys - ms.HeapReleased)
+}
+
+// MemoryPressure returns true if memory usage is above soft limit, so new connections should be refused.
+func (s *Server) MemoryPressure() bool {
+	return atomic.LoadInt32(&s.memoryPressure) == 1
+}
+
+// RunMemoryWatchdog periodically checks memory usage until context is canceled. Above soft limit,
+// new connections are refused until usage drops below 90% of it; above hard limit, the least recently active
+// relayed connections are closed. Limits are reloadable, check interval is read on start.
+func (s *Server) RunMemoryWatchdog(ctx context.Context, l *zap.SugaredLogger) {
+	interval := s.Config().MemoryWatchdog.Interval
+	if interval <= 0 {
+		interval = defaultMemoryWatchdogInterval
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.checkMemory(l)
+		}
+	}
+}
+
+// checkMemory updates memory pressure state and sheds connections above hard limit.
+func (s *Server) checkMemory(l *zap.SugaredLogger) {
+	soft, hard := s.Config().MemoryWatchdog.limits()
+	used := memoryUsed()
+	atomic.StoreInt64(&s.memoryUsed, used)
+
+	switch {
+	case soft > 0 && used >= soft:
+		if atomic.CompareAndSwapInt32(&s.memoryPressure, 0, 1) {
+			l.Warnf("Memory usage %s is above soft limit %s, refusing new connections.", ByteSize(used), ByteSize(soft))
+		}
+	case soft <= 0 || used < soft/100*memorySoftRecoveryPercent:
+		if atomic.CompareAndSwapInt32(&s.memoryPressure, 1, 0) {
+			l.Warnf("Memory usage %s is back below soft limit %s, accepting new connections.", ByteSize(used), ByteSize(soft))
+		}
+	}
+
+	if hard <= 0 || used < hard {
+		return
+	}
+
+	conns := s.relayedConns()
+	if len(conns) == 0 {
+		return
+	}
+	n := len(conns) / memoryShedDivisor
+	if n == 0 {
+		n = 1
+	}
+	l.Warnf(
+		"Memory usage %s is above hard limit %s, closing %d of %d least recently active connections.",
+		ByteSize(used), ByteSize(hard), n, len(conns),
+	)
+	for _, tcp := range conns[:n] {
+		if tcp.stop(CloseMemoryPressure) {
+			tcp.l.Warnf("Connection closed due to memory pressure.")
+			s.metrics.Inc("memory_pressure_closed_total")
+		}
+	}
+
+	// return freed memory now, so the next check sees the effect
+	debug.FreeOSMemory()
+}
+
+// relayedConns returns relayed connections, the least recently active first.
+func (s *Server) relayedConns() []*TCPConn {
+	s.relaysM.Lock()
+	res := make([]*TCPConn, 0, len(s.relays))
+	for _, tcp := range s.relays {
+		res = append(res, tcp)
+	}
+	s.relaysM.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return atomic.LoadInt64(&res[i].lastActive) < atomic.LoadInt64(&res[j].lastActive)
+	})
+	return res
+}
+
+// addRelay registers relayed connection for memory watchdog and connection stats.
+func (s *Server) addRelay(tcp *TCPConn) {
+	s.relaysM.Lock()
+	s.relays[tcp.id] = tcp
+	s.relaysM.Unlock()
+}
+
+// removeRelay unregisters relayed connection.
+func (s *Server) removeRelay(tcp *TCPConn) {
+	s.relaysM.Lock()
+	delete(s.relays, tcp.id)
+	s.relaysM.Unlock()
+}
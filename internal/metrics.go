@@ -0,0 +1,160 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metrics is a minimal registry of counters, gauges and histograms exposed in Prometheus text format.
+// All metric names are prefixed with "telesock_".
+type metrics struct {
+	m          sync.Mutex
+	types      map[string]string  // name -> type
+	values     map[string]float64 // name{labels} -> value
+	histograms map[string]*histogram
+}
+
+// histogram counts observed values in buckets with fixed upper bounds.
+type histogram struct {
+	bounds []float64 // ascending
+	counts []uint64  // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		types:      make(map[string]string),
+		values:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// key returns metric key for given name and label name/value pairs.
+func metricKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metrics) update(typ, name string, labels []string, f func(float64) float64) {
+	name = "telesock_" + name
+	key := metricKey(name, labels)
+
+	m.m.Lock()
+	m.types[name] = typ
+	m.values[key] = f(m.values[key])
+	m.m.Unlock()
+}
+
+// Inc increments counter with given name and label name/value pairs.
+func (m *metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add adds v to counter with given name and label name/value pairs.
+func (m *metrics) Add(name string, v float64, labels ...string) {
+	m.update("counter", name, labels, func(old float64) float64 { return old + v })
+}
+
+// Set sets gauge with given name and label name/value pairs.
+func (m *metrics) Set(name string, v float64, labels ...string) {
+	m.update("gauge", name, labels, func(float64) float64 { return v })
+}
+
+// Observe adds v to histogram with given name. Bucket bounds are set by the first call.
+func (m *metrics) Observe(name string, v float64, bounds []float64) {
+	name = "telesock_" + name
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	h := m.histograms[name]
+	if h == nil {
+		h = &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+		m.histograms[name] = h
+	}
+	i := sort.SearchFloat64s(h.bounds, v) // the first bound >= v
+	h.counts[i]++
+	h.sum += v
+}
+
+// Delete removes all values of the metric with given name.
+func (m *metrics) Delete(name string) {
+	name = "telesock_" + name
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	delete(m.types, name)
+	for key := range m.values {
+		if key == name || strings.HasPrefix(key, name+"{") {
+			delete(m.values, key)
+		}
+	}
+}
+
+// WriteText writes all metrics in Prometheus text format.
+func (m *metrics) WriteText(w io.Writer) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lastName string
+	for _, key := range keys {
+		name := key
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name = key[:i]
+		}
+		if name != lastName {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.types[name])
+			lastName = name
+		}
+		fmt.Fprintf(w, "%s %s\n", key, strconv.FormatFloat(m.values[key], 'f', -1, 64))
+	}
+
+	names := make([]string, 0, len(m.histograms))
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		h := m.histograms[name]
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		var count uint64
+		for i, c := range h.counts {
+			count += c
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, count)
+		}
+		fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+		fmt.Fprintf(w, "%s_count %d\n", name, count)
+	}
+}
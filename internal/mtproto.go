@@ -0,0 +1,383 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MTProto proxy protocol with obfuscated2 transport, see https://core.telegram.org/mtproto/mtproto-transports.
+// After the handshake, traffic is relayed as is between two AES-256-CTR streams: client's one keyed with
+// user's secret, and datacenter's one keyed with random bytes, so the transport protocol doesn't matter.
+
+const mtprotoInitLength = 64
+
+// Transport protocol tags: abridged, intermediate and padded intermediate.
+var mtprotoTags = [][]byte{
+	{0xef, 0xef, 0xef, 0xef},
+	{0xee, 0xee, 0xee, 0xee},
+	{0xdd, 0xdd, 0xdd, 0xdd},
+}
+
+// mtprotoReservedStarts can't start initialization bytes sent to datacenter: they would be confused
+// with other protocols.
+var mtprotoReservedStarts = [][]byte{
+	[]byte("HEAD"), []byte("POST"), []byte("GET "), []byte("OPTI"),
+	{0x16, 0x03, 0x01, 0x02},
+	{0xdd, 0xdd, 0xdd, 0xdd},
+	{0xee, 0xee, 0xee, 0xee},
+}
+
+// wrappedConn is embedded by connections wrapping other connections, so they keep supporting
+// half-close and abortive close.
+type wrappedConn struct {
+	net.Conn
+}
+
+// CloseWrite propagates EOF, if the underlying connection supports it.
+func (c wrappedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SetLinger sets SO_LINGER for abortive close, if the underlying connection supports it.
+func (c wrappedConn) SetLinger(sec int) error {
+	if lc, ok := c.Conn.(interface{ SetLinger(int) error }); ok {
+		return lc.SetLinger(sec)
+	}
+	return nil
+}
+
+// obfuscatedConn decrypts data read from and encrypts data written to the underlying connection.
+type obfuscatedConn struct {
+	wrappedConn
+	r   io.Reader // reads from Conn, possibly starting with buffered data
+	dec cipher.Stream
+	enc cipher.Stream
+	buf []byte // for encryption; there is only one writer
+}
+
+func (c *obfuscatedConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Write encrypts and writes p. Short write breaks the stream, but it also breaks the relay.
+func (c *obfuscatedConn) Write(p []byte) (int, error) {
+	if cap(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	b := c.buf[:len(p)]
+	c.enc.XORKeyStream(b, p)
+	return c.Conn.Write(b)
+}
+
+// newCTR returns AES-256-CTR stream for key (hashed with secret, if it is not nil) and IV.
+func newCTR(key, iv, secret []byte) cipher.Stream {
+	if secret != nil {
+		h := sha256.Sum256(append(append([]byte{}, key...), secret...))
+		key = h[:]
+	}
+	block, _ := aes.NewCipher(key) // key is always 32 bytes
+	return cipher.NewCTR(block, iv)
+}
+
+// mtprotoStreams returns two streams: keyed with bytes 8-56 of initialization bytes, used by their sender
+// for encryption, and keyed with the same bytes in reverse order, used by their sender for decryption.
+func mtprotoStreams(init, secret []byte) (forward, backward cipher.Stream) {
+	rev := make([]byte, 48)
+	for i := range rev {
+		rev[i] = init[55-i]
+	}
+	return newCTR(init[8:40], init[40:56], secret), newCTR(rev[:32], rev[32:48], secret)
+}
+
+// mtprotoClient finds the user whose secret decrypts client's initialization bytes to a valid protocol tag.
+// It returns user, client's streams, protocol tag and datacenter number.
+func (c *Config) mtprotoClient(init []byte) (*User, cipher.Stream, cipher.Stream, []byte, int) {
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.mtprotoSecret == nil {
+			continue
+		}
+		if dec, enc, tag, dc := mtprotoClientInit(init, u.mtprotoSecret); tag != nil {
+			return u, dec, enc, tag, dc
+		}
+	}
+	return nil, nil, nil, nil, 0
+}
+
+// mtprotoClientInit decrypts client's initialization bytes with secret. It returns client's streams,
+// protocol tag and datacenter number, or nil tag if the secret doesn't match.
+func mtprotoClientInit(init, secret []byte) (cipher.Stream, cipher.Stream, []byte, int) {
+	// client's encryption stream is our decryption stream and vice versa
+	dec, enc := mtprotoStreams(init, secret)
+	plain := make([]byte, mtprotoInitLength)
+	dec.XORKeyStream(plain, init)
+	tag := plain[56:60]
+	for _, t := range mtprotoTags {
+		if bytes.Equal(tag, t) {
+			dc := int(int16(binary.LittleEndian.Uint16(plain[60:62])))
+			if dc < 0 {
+				dc = -dc // media datacenter
+			}
+			return dec, enc, t, dc
+		}
+	}
+	return nil, nil, nil, 0
+}
+
+// mtprotoServerInit returns random initialization bytes for datacenter with given protocol tag.
+func mtprotoServerInit(tag []byte) ([]byte, error) {
+	init := make([]byte, mtprotoInitLength)
+	for {
+		if _, err := rand.Read(init); err != nil {
+			return nil, err
+		}
+		if init[0] == 0xef || binary.BigEndian.Uint32(init[4:8]) == 0 {
+			continue
+		}
+		reserved := false
+		for _, s := range mtprotoReservedStarts {
+			reserved = reserved || bytes.Equal(init[:4], s)
+		}
+		if !reserved {
+			copy(init[56:60], tag)
+			return init, nil
+		}
+	}
+}
+
+// MTProto performs MTProto proxy handshake: it identifies the user by secret, checks limits,
+// and connects to the requested Telegram datacenter. After that, Run relays traffic as for SOCKS5 connections.
+// Nothing is sent to clients that fail the handshake, so the listener doesn't reveal itself; with FakeTLS,
+// they are forwarded to the cover site instead.
+func (tcp *TCPConn) MTProto(ctx context.Context) bool {
+	tcp.step = "mtproto"
+	l := tcp.l.With(zap.String("step", tcp.step))
+
+	var user *User
+	if tcp.conf.MTProto.FakeTLSDomain != "" {
+		if user = tcp.fakeTLS(ctx, l); user == nil {
+			return false
+		}
+	}
+
+	init := make([]byte, mtprotoInitLength)
+	if _, err := io.ReadFull(tcp.clientR, init); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return false
+	}
+
+	var dec, enc cipher.Stream
+	var tag []byte
+	var dc int
+	if user != nil {
+		if dec, enc, tag, dc = mtprotoClientInit(init, user.mtprotoSecret); tag == nil {
+			user = nil
+		}
+	} else {
+		user, dec, enc, tag, dc = tcp.conf.mtprotoClient(init)
+	}
+	switch {
+	case user == nil:
+		l.Errorf("MTProto handshake failed: unknown secret or protocol.")
+		tcp.srv.metrics.Inc("mtproto_handshake_failures_total")
+		tcp.audit(AuditAuthFailure, "", "", "unknown MTProto secret")
+		tcp.setAbortive(CloseProtocolMismatch)
+		return false
+	case !user.AllowedListener(tcp.listener):
+		l.Errorf("User %q is not allowed on listener %q.", user.Username, tcp.listener)
+		tcp.audit(AuditACLDeny, user.Username, "", "listener not allowed")
+		return false
+	case user.Expired(time.Now()):
+		l.Errorf("User %q account expired at %s.", user.Username, user.Expires.Format(time.RFC3339))
+		tcp.audit(AuditAuthFailure, user.Username, "", "account expired")
+		return false
+	}
+	tcp.setUser(user)
+	l = l.With(zap.String("user", user.Username))
+	l.Info("Connection authenticated.")
+	tcp.audit(AuditAuthSuccess, user.Username, "", "")
+
+	dcs := tcp.conf.MTProto.datacenters()
+	if dc < 1 || dc > len(dcs) {
+		l.Errorf("Unknown datacenter %d.", dc)
+		return false
+	}
+	raddr, err := net.ResolveTCPAddr("tcp", dcs[dc-1])
+	if err != nil {
+		l.Errorf("Datacenter %d: %s.", dc, err)
+		return false
+	}
+	host := "dc" + strconv.Itoa(dc)
+	l = l.With(zap.String("dc", host))
+	tcp.policy = tcp.conf.Policy(tcp.user, raddr.IP.String(), raddr.IP)
+	tcp.target = raddr.String()
+	if tcp.srv.captureMatch(tcp.conf, user.Username, raddr.IP.String(), raddr.IP) {
+		tcp.capture = host + "-" + raddr.String()
+	}
+
+	if tcp.srv.MemoryPressure() {
+		l.Warnf("Connection to %s refused: memory usage is above soft limit.", raddr)
+		tcp.srv.metrics.Inc("memory_pressure_refused_total")
+		return false
+	}
+	if q := user.MonthlyQuota; q > 0 && tcp.srv.accounting.Used(user.Username, time.Now()) >= int64(q) {
+		l.Warnf("Connection to %s refused: monthly quota %s is used.", raddr, q)
+		tcp.audit(AuditOverQuota, user.Username, host, "monthly quota is used")
+		return false
+	}
+	if !tcp.srv.acquireUserConn(user.Username, user.MaxConnections) {
+		l.Warnf("Connection to %s refused: connections limit %d reached.", raddr, user.MaxConnections)
+		return false
+	}
+	tcp.userConn = true
+
+	upstreams, reason := tcp.conf.routeUpstreams(user, raddr.IP.String(), raddr.IP)
+	l.Infof("Route for %s (%s): %d upstreams, %s.", host, raddr, len(upstreams), reason)
+	l.Infof("Connecting to %s ...", raddr)
+	server, path, err := tcp.dial(ctx, raddr, upstreams, l)
+	if err != nil {
+		l.Error(err)
+		return false
+	}
+	tcp.l = tcp.l.With(zap.String("relay_path", path), zap.String("dc", host))
+	if t := tcp.conf.TCPUserTimeout; t > 0 {
+		if err := setUserTimeout(server, t); err != nil {
+			l.Warnf("Failed to set TCP user timeout: %s.", err)
+		}
+	}
+
+	serverInit, err := mtprotoServerInit(tag)
+	if err != nil {
+		server.Close()
+		l.Error(err)
+		return false
+	}
+	serverEnc, serverDec := mtprotoStreams(serverInit, nil)
+	encrypted := make([]byte, mtprotoInitLength)
+	serverEnc.XORKeyStream(encrypted, serverInit)
+	copy(serverInit[56:], encrypted[56:])
+	if _, err = server.Write(serverInit); err != nil {
+		server.Close()
+		l.Error(err)
+		return false
+	}
+
+	// bytes sent by the client after initialization are decrypted first
+	buffered := io.MultiReader(io.LimitReader(tcp.clientR, int64(tcp.clientR.Buffered())), tcp.client)
+	tcp.client = &obfuscatedConn{wrappedConn: wrappedConn{tcp.client}, r: buffered, dec: dec, enc: enc}
+	tcp.clientR = bufio.NewReaderSize(tcp.client, 128)
+	tcp.clientW = tcp.client
+	tcp.server = &obfuscatedConn{wrappedConn: wrappedConn{server}, r: server, dec: serverDec, enc: serverEnc}
+
+	if tcp.conf.TopDestinations > 0 {
+		tcp.srv.destinations.Add(host)
+	}
+	tcp.srv.metrics.Inc("mtproto_connections_total", "dc", host)
+	l.Infof("Connection %s->%s is established.", server.LocalAddr(), raddr)
+	return true
+}
+
+// fakeTLS performs FakeTLS handshake and returns the authenticated user. After that, client connection
+// is wrapped in TLS records. Clients that fail the handshake are forwarded to the fallback (the cover site),
+// and nil is returned.
+func (tcp *TCPConn) fakeTLS(ctx context.Context, l *zap.SugaredLogger) *User {
+	record := make([]byte, tlsRecordHeaderLength)
+	if _, err := io.ReadFull(tcp.clientR, record); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return nil
+	}
+
+	fail := func(format string, a ...interface{}) *User {
+		l.Errorf("FakeTLS handshake failed: %s.", fmt.Sprintf(format, a...))
+		tcp.srv.metrics.Inc("mtproto_handshake_failures_total")
+		tcp.forward(ctx, tcp.conf.MTProto.fallback(), record, "mtproto", l)
+		return nil
+	}
+
+	if record[0] != tlsRecordHandshake || record[1] != 3 {
+		return fail("not a TLS handshake")
+	}
+	n := int(binary.BigEndian.Uint16(record[3:]))
+	record = append(record, make([]byte, n)...)
+	if _, err := io.ReadFull(tcp.clientR, record[tlsRecordHeaderLength:]); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return nil
+	}
+
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return fail("%s", err)
+	}
+	if domain := tcp.conf.MTProto.FakeTLSDomain; !strings.EqualFold(hello.sni, domain) {
+		return fail("SNI %q doesn't match %q", hello.sni, domain)
+	}
+	now := time.Now()
+	user, err := tcp.conf.fakeTLSClient(record, hello.random, now)
+	if err != nil {
+		var username string
+		if user != nil {
+			username = user.Username
+		}
+		tcp.audit(AuditAuthFailure, username, "", "FakeTLS: "+err.Error())
+		return fail("%s", err)
+	}
+	if !tcp.srv.replays.Add(hello.random, now) {
+		return fail("replayed ClientHello")
+	}
+
+	reply, err := fakeTLSServerHello(user.mtprotoSecret, hello)
+	if err != nil {
+		l.Error(err)
+		return nil
+	}
+	if _, err = tcp.clientW.Write(reply); err != nil {
+		l.Error(err)
+		return nil
+	}
+
+	buffered := io.MultiReader(io.LimitReader(tcp.clientR, int64(tcp.clientR.Buffered())), tcp.client)
+	tcp.client = &fakeTLSConn{wrappedConn: wrappedConn{tcp.client}, r: buffered}
+	tcp.clientR = bufio.NewReaderSize(tcp.client, 128)
+	tcp.clientW = tcp.client
+	return user
+}
+
+// MTProtoLinkSecret returns user's secret for MTProto proxy share links, or empty string if there is none.
+// Secret is prefixed with "dd", so clients use padded intermediate protocol that is harder to detect.
+// With FakeTLS cover domain, secret is prefixed with "ee" and followed by the domain instead.
+func (u *User) MTProtoLinkSecret(fakeTLSDomain string) string {
+	if u.mtprotoSecret == nil {
+		return ""
+	}
+	if fakeTLSDomain != "" {
+		return fmt.Sprintf("ee%x%x", u.mtprotoSecret, fakeTLSDomain)
+	}
+	return fmt.Sprintf("dd%x", u.mtprotoSecret)
+}
@@ -0,0 +1,126 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashes used in htpasswd files: bcrypt ($2y$, $2b$, $2a$), MD5-crypt ($apr1$, $1$) and SHA-1 ({SHA}).
+
+// cryptAlphabet is used by MD5-crypt hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// checkPasswordHash returns an error if hash format is not supported.
+func checkPasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		return nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		return nil
+	default:
+		return fmt.Errorf("unsupported password hash format")
+	}
+}
+
+// verifyPasswordHash returns true if password matches hash checked by checkPasswordHash.
+func verifyPasswordHash(hash string, password []byte) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		// compared in constant time by bcrypt package
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed = md5Crypt(password, hash, "$apr1$")
+	case strings.HasPrefix(hash, "$1$"):
+		computed = md5Crypt(password, hash, "$1$")
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum(password)
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// md5Crypt returns MD5-crypt hash of password with magic prefix and salt taken from the given hash.
+func md5Crypt(password []byte, hash, magic string) string {
+	salt := strings.TrimPrefix(hash, magic)
+	if i := strings.IndexByte(salt, '$'); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alt := md5.Sum([]byte(string(password) + salt + string(password)))
+	h := md5.New()
+	h.Write(password)
+	h.Write([]byte(magic + salt))
+	for n := len(password); n > 0; n -= 16 {
+		if n > 16 {
+			h.Write(alt[:])
+		} else {
+			h.Write(alt[:n])
+		}
+	}
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(password[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(password)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(password)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(password)
+		}
+		sum = h.Sum(sum[:0])
+	}
+
+	out := []byte(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(sum[i[0]])<<16|uint32(sum[i[1]])<<8|uint32(sum[i[2]]), 4)
+	}
+	encode(uint32(sum[11]), 2)
+	return string(out)
+}
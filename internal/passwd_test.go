@@ -0,0 +1,60 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	for _, tc := range []struct {
+		hash     string
+		password string
+	}{
+		// PHP password_verify documentation
+		{"$2y$10$.vGA1O9wmRjrwAVXD98HNOgsNpDczlqm3Jq7KnEd1rVAGv3Fykk1a", "rasmuslerdorf"},
+		// OpenBSD bcrypt test vectors
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		{"$2b$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U"},
+		// Apache httpd password encryption documentation
+		{"$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword"},
+		{"{SHA}VBPuJHI7uixaa6LQGWx4s+5GKNE=", "myPassword"},
+		// openssl passwd -1
+		{"$1$saltstri$qQY4WxjABChYG1ccLpfkz/", "password"},
+	} {
+		t.Run(tc.hash, func(t *testing.T) {
+			if err := checkPasswordHash(tc.hash); err != nil {
+				t.Fatal(err)
+			}
+			if !verifyPasswordHash(tc.hash, []byte(tc.password)) {
+				t.Errorf("password %q doesn't match", tc.password)
+			}
+			for _, wrong := range []string{"", tc.password[1:], tc.password + "x", "myPassword1"} {
+				if verifyPasswordHash(tc.hash, []byte(wrong)) {
+					t.Errorf("wrong password %q matches", wrong)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordHashUnsupported(t *testing.T) {
+	for _, hash := range []string{
+		"rl5FGRH2lPtDs", // crypt(3)
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZF5KpdA.D",
+		"$2y$10$tooshort",
+		"$2y$99$.vGA1O9wmRjrwAVXD98HNOgsNpDczlqm3Jq7KnEd1rVAGv3Fykk1a",
+		"plain",
+	} {
+		if err := checkPasswordHash(hash); err == nil {
+			t.Errorf("%q: expected error", hash)
+		}
+	}
+}
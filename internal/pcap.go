@@ -0,0 +1,186 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapLinkTypeRaw = 101   // packets start with IPv4 or IPv6 header
+	pcapSnapLen     = 65535 // maximal packet size
+	pcapMaxSegment  = 32768 // maximal TCP payload of a single synthetic packet
+
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// pcapWriter writes relayed data of a single connection as a pcap file with synthetic IP and TCP headers,
+// so it can be analyzed with usual tools (e.g. Wireshark's "Follow TCP Stream"). The stream starts with
+// a three-way handshake and ends with FIN segments in both directions; there are no retransmissions.
+type pcapWriter struct {
+	w              io.Writer
+	client, server *net.TCPAddr
+	ipv6           bool
+	clientSeq      uint32 // next sequence number of the client
+	serverSeq      uint32 // next sequence number of the server
+	ipID           uint16
+}
+
+// newPcapWriter writes pcap file header and synthetic handshake between client and server.
+func newPcapWriter(w io.Writer, client, server *net.TCPAddr) (*pcapWriter, error) {
+	pw := &pcapWriter{
+		w:      w,
+		client: client,
+		server: server,
+		ipv6:   client.IP.To4() == nil || server.IP.To4() == nil,
+	}
+
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkTypeRaw)
+	if _, err := w.Write(h); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := pw.packet(now, true, tcpFlagSYN, nil); err != nil {
+		return nil, err
+	}
+	if err := pw.packet(now, false, tcpFlagSYN|tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	if err := pw.packet(now, true, tcpFlagACK, nil); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Data writes data sent by the client or by the server.
+func (pw *pcapWriter) Data(fromClient bool, p []byte) error {
+	now := time.Now()
+	for len(p) > 0 {
+		n := len(p)
+		if n > pcapMaxSegment {
+			n = pcapMaxSegment
+		}
+		if err := pw.packet(now, fromClient, tcpFlagPSH|tcpFlagACK, p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// Close writes FIN segments in both directions. It doesn't close the underlying writer.
+func (pw *pcapWriter) Close() error {
+	now := time.Now()
+	if err := pw.packet(now, true, tcpFlagFIN|tcpFlagACK, nil); err != nil {
+		return err
+	}
+	return pw.packet(now, false, tcpFlagFIN|tcpFlagACK, nil)
+}
+
+// packet writes a single packet record, advancing sequence numbers.
+func (pw *pcapWriter) packet(now time.Time, fromClient bool, flags byte, payload []byte) error {
+	src, dst := pw.client, pw.server
+	seq, ack := &pw.clientSeq, pw.serverSeq
+	if !fromClient {
+		src, dst = pw.server, pw.client
+		seq, ack = &pw.serverSeq, pw.clientSeq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+
+	tcpHeader := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcpHeader[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcpHeader[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcpHeader[4:], *seq)
+	binary.BigEndian.PutUint32(tcpHeader[8:], ack)
+	tcpHeader[12] = 5 << 4 // data offset in 32-bit words
+	tcpHeader[13] = flags
+	binary.BigEndian.PutUint16(tcpHeader[14:], 65535) // window
+	segment := append(tcpHeader, payload...)
+
+	var ipHeader, pseudo []byte
+	if pw.ipv6 {
+		ipHeader = make([]byte, 40)
+		ipHeader[0] = 6 << 4
+		binary.BigEndian.PutUint16(ipHeader[4:], uint16(len(segment)))
+		ipHeader[6] = 6 // TCP
+		ipHeader[7] = 64
+		copy(ipHeader[8:], src.IP.To16())
+		copy(ipHeader[24:], dst.IP.To16())
+
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], ipHeader[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(segment)))
+		pseudo[39] = 6
+	} else {
+		pw.ipID++
+		ipHeader = make([]byte, 20)
+		ipHeader[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(ipHeader[2:], uint16(20+len(segment)))
+		binary.BigEndian.PutUint16(ipHeader[4:], pw.ipID)
+		binary.BigEndian.PutUint16(ipHeader[6:], 0x4000) // don't fragment
+		ipHeader[8] = 64
+		ipHeader[9] = 6 // TCP
+		copy(ipHeader[12:], src.IP.To4())
+		copy(ipHeader[16:], dst.IP.To4())
+		binary.BigEndian.PutUint16(ipHeader[10:], internetChecksum(ipHeader))
+
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], ipHeader[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	}
+	binary.BigEndian.PutUint16(segment[16:], internetChecksum(append(pseudo, segment...)))
+
+	record := make([]byte, 16, 16+len(ipHeader)+len(segment))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(ipHeader)+len(segment)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(ipHeader)+len(segment)))
+	record = append(record, ipHeader...)
+	record = append(record, segment...)
+	if _, err := pw.w.Write(record); err != nil {
+		return err
+	}
+
+	*seq += uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		*seq++
+	}
+	return nil
+}
+
+// internetChecksum returns RFC 1071 checksum of b.
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
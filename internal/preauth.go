@@ -0,0 +1,122 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// PreAuth limits connections that haven't completed authentication yet, which are not covered by per-user limits.
+// Zero values mean unlimited.
+type PreAuth struct {
+	MaxConnections int `yaml:"max_connections"` // the oldest connection is closed when reached
+	MaxPerClient   int `yaml:"max_per_client"`  // per client IP address; new connections are refused when reached
+}
+
+// validate checks pre-authentication limits.
+func (p *PreAuth) validate() error {
+	if p.MaxConnections < 0 || p.MaxPerClient < 0 {
+		return fmt.Errorf("pre_auth: max_connections and max_per_client should not be negative")
+	}
+	return nil
+}
+
+// preAuthConns tracks connections that haven't completed authentication, oldest first.
+type preAuthConns struct {
+	m       sync.Mutex
+	conns   *list.List     // of *TCPConn
+	clients map[string]int // connections per client IP address
+}
+
+func newPreAuthConns() *preAuthConns {
+	return &preAuthConns{
+		conns:   list.New(),
+		clients: make(map[string]int),
+	}
+}
+
+// Len returns the number of tracked connections.
+func (p *preAuthConns) Len() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.conns.Len()
+}
+
+// clientIP returns client IP address as a string, or empty string for non-TCP connections.
+func (tcp *TCPConn) clientIP() string {
+	if addr, ok := tcp.client.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// EnterPreAuth registers connection as not authenticated yet. If the client has too many such connections,
+// it returns false, and the connection should be closed. If there are too many such connections overall,
+// the oldest one is closed.
+func (tcp *TCPConn) EnterPreAuth() bool {
+	limits := tcp.conf.PreAuth
+	p := tcp.srv.preAuth
+	ip := tcp.clientIP()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if limits.MaxPerClient > 0 && p.clients[ip] >= limits.MaxPerClient {
+		tcp.l.Infof("Connection refused: client has %d connections not authenticated yet.", p.clients[ip])
+		tcp.srv.metrics.Inc("pre_auth_refused_total")
+		tcp.end(endPreAuthLimit)
+		return false
+	}
+
+	if limits.MaxConnections > 0 && p.conns.Len() >= limits.MaxConnections {
+		oldest := p.conns.Front().Value.(*TCPConn)
+		p.remove(oldest)
+
+		// the evicted connection's handshake fails as if the client closed it
+		oldest.l.Infof("Connection closed: %d connections are not authenticated yet, this one is the oldest.", limits.MaxConnections)
+		tcp.srv.metrics.Inc("pre_auth_evicted_total")
+		oldest.end(endPreAuthEvicted)
+		oldest.setAbortive(ClosePreAuthEvicted)
+		oldest.client.Close()
+	}
+
+	tcp.preAuth = p.conns.PushBack(tcp)
+	tcp.preAuthIP = ip
+	p.clients[ip]++
+	return true
+}
+
+// leavePreAuth unregisters connection after authentication or on close. It does nothing if connection
+// is not registered.
+func (tcp *TCPConn) leavePreAuth() {
+	p := tcp.srv.preAuth
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.remove(tcp)
+}
+
+// remove unregisters connection; p.m should be held.
+func (p *preAuthConns) remove(tcp *TCPConn) {
+	if tcp.preAuth == nil {
+		return
+	}
+
+	p.conns.Remove(tcp.preAuth)
+	tcp.preAuth = nil
+	if p.clients[tcp.preAuthIP]--; p.clients[tcp.preAuthIP] <= 0 {
+		delete(p.clients, tcp.preAuthIP)
+	}
+}
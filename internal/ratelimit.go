@@ -0,0 +1,115 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// rateQuantum is the maximal number of bytes reserved at once. Connections reserve bandwidth in turns
+// of at most that size, so a bulk transfer delays other connections of the same user by a few quanta at most
+// instead of draining the bucket first.
+const rateQuantum = 4096
+
+// rateLimiter is a token bucket shared by all user's connections. Reservations may put it into debt;
+// waiting time is a debt divided by rate.
+type rateLimiter struct {
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds tokens for the time passed since the last call; rl.m should be held.
+func (rl *rateLimiter) refill(rate float64, now time.Time) {
+	// burst is one second of traffic
+	if !rl.last.IsZero() {
+		rl.tokens += now.Sub(rl.last).Seconds() * rate
+	} else {
+		rl.tokens = rate
+	}
+	if rl.tokens > rate {
+		rl.tokens = rate
+	}
+	rl.last = now
+}
+
+// reserve takes n bytes from the bucket with given rate, returning how long to wait before using them.
+func (rl *rateLimiter) reserve(n int, rate float64, now time.Time) time.Duration {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	rl.refill(rate, now)
+	rl.tokens -= float64(n)
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rate * float64(time.Second))
+}
+
+// take takes n tokens from the bucket with given rate if there are enough of them, without going into debt.
+func (rl *rateLimiter) take(n int, rate float64, now time.Time) bool {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	rl.refill(rate, now)
+	if rl.tokens < float64(n) {
+		return false
+	}
+	rl.tokens -= float64(n)
+	return true
+}
+
+// rateLimiters holds per-user rate limiters.
+type rateLimiters struct {
+	m     sync.Mutex
+	users map[string]*rateLimiter
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{
+		users: make(map[string]*rateLimiter),
+	}
+}
+
+// Get returns user's rate limiter, creating it if needed.
+func (r *rateLimiters) Get(user string) *rateLimiter {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	rl := r.users[user]
+	if rl == nil {
+		rl = new(rateLimiter)
+		r.users[user] = rl
+	}
+	return rl
+}
+
+// rateLimitedWrite writes p in quanta, waiting for the user's rate limit before each one.
+func rateLimitedWrite(write func([]byte) (int, error), p []byte, rl *rateLimiter, rate float64) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > rateQuantum {
+			chunk = chunk[:rateQuantum]
+		}
+		if d := rl.reserve(len(chunk), rate, time.Now()); d > 0 {
+			time.Sleep(d)
+		}
+
+		n, err := write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
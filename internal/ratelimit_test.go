@@ -0,0 +1,87 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitFairness(t *testing.T) {
+	const rate = 64 * 1024
+
+	// bulk destination sends data as fast as possible
+	bulk := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		b := make([]byte, relayBufferSize)
+		for ctx.Err() == nil {
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+	})
+	bulkAddr, _ := net.ResolveTCPAddr("tcp", bulk)
+
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1", RateLimit: rate}}}
+	_, addr := testServer(t, conf)
+
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, bulkAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	var received int64
+	start := time.Now()
+	go func() {
+		b := make([]byte, relayBufferSize)
+		for {
+			n, err := c.Read(b)
+			atomic.AddInt64(&received, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// let the bulk transfer drain the burst
+	time.Sleep(500 * time.Millisecond)
+
+	// the same user's interactive connection waits a few quanta at most, not for the bulk transfer
+	trickle, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	defer trickle.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	trickle.SetDeadline(time.Now().Add(5 * time.Second))
+	maxRTT := 250 * time.Millisecond // 16KB at the rate; the bulk connection has 32KB buffer
+	for i := 0; i < 5; i++ {
+		pingStart := time.Now()
+		if _, err := trickle.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(trickle, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		if rtt := time.Since(pingStart); rtt > maxRTT {
+			t.Errorf("ping %d: expected round trip within %s, got %s", i, maxRTT, rtt)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// while the bulk transfer is still limited: one second burst plus the rate
+	elapsed := time.Since(start)
+	if n, max := atomic.LoadInt64(&received), int64(rate+elapsed.Seconds()*rate)+2*rateQuantum; n > max {
+		t.Errorf("expected at most %d bytes in %s, got %d", max, elapsed, n)
+	}
+}
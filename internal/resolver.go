@@ -0,0 +1,61 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Resolver is a named DNS server users may be assigned to with "resolver" user setting.
+type Resolver struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"` // IP address with optional port, 53 by default
+}
+
+// newResolvers validates resolvers and returns them by name.
+func newResolvers(resolvers []Resolver) (map[string]*net.Resolver, error) {
+	res := make(map[string]*net.Resolver, len(resolvers))
+	for i, r := range resolvers {
+		if r.Name == "" {
+			return nil, fmt.Errorf("resolvers[%d]: name is required", i)
+		}
+		if res[r.Name] != nil {
+			return nil, fmt.Errorf("resolvers[%d]: duplicate name %q", i, r.Name)
+		}
+
+		address := r.Address
+		if net.ParseIP(address) != nil {
+			address = net.JoinHostPort(address, "53")
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("resolvers[%d]: invalid address %q, should be IP address with optional port", i, r.Address)
+		}
+
+		res[r.Name] = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, address)
+			},
+		}
+	}
+	return res, nil
+}
+
+// resolver returns DNS resolver assigned to user, or the system one.
+func (c *Config) resolver(user *User) *net.Resolver {
+	if user != nil && user.Resolver != "" {
+		return c.resolvers[user.Resolver]
+	}
+	return net.DefaultResolver
+}
@@ -0,0 +1,94 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserResolvers(t *testing.T) {
+	// the same name resolves to different destinations on the same port, identified by their greetings
+	dstA := testListen(t, func(ctx context.Context, c net.Conn) {
+		c.Write([]byte("A"))
+		c.Close()
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dstA)
+	port := dstAddr.Port
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", strconv.Itoa(port)))
+	if err != nil {
+		t.Skipf("can't listen on the second loopback address: %s", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("B"))
+			c.Close()
+		}
+	}()
+
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	conf := &Config{
+		Users: []User{
+			{Username: "user-a", Password: "pass1", Resolver: "a"},
+			{Username: "user-b", Password: "pass2", Resolver: "b"},
+			{Username: "user-down", Password: "pass3", Resolver: "down"},
+		},
+		Resolvers: []Resolver{
+			{Name: "a", Address: testResolver(t, net.IPv4(127, 0, 0, 1))},
+			{Name: "b", Address: testResolver(t, net.IPv4(127, 0, 0, 2))},
+			{Name: "down", Address: closed.LocalAddr().String()},
+		},
+		DNSTimeout: 200 * time.Millisecond,
+	}
+	_, addr := testServer(t, conf)
+
+	for _, tc := range []struct {
+		user, password string
+		rep            byte
+		greeting       string
+	}{
+		{"user-a", "pass1", 0, "A"},
+		{"user-b", "pass2", 0, "B"},
+		{"user-down", "pass3", 4, ""},
+
+		// unavailable resolver of one user doesn't affect others
+		{"user-a", "pass1", 0, "A"},
+		{"user-b", "pass2", 0, "B"},
+	} {
+		start := time.Now()
+		c, res := testDomainRequest(t, addr, tc.user, tc.password, "split.example", port)
+		if res[1] != tc.rep {
+			t.Fatalf("%s: expected reply %d, got % x", tc.user, tc.rep, res)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: reply took %s", tc.user, elapsed)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		b, _ := ioutil.ReadAll(c)
+		c.Close()
+		if string(b) != tc.greeting {
+			t.Errorf("%s: expected destination %q, got %q", tc.user, tc.greeting, b)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Server holds state shared by all connections. It survives configuration reloads.
+type Server struct {
+	rw   sync.RWMutex
+	conf *Config
+
+	maintenance int32
+	active      int64
+	total       int64
+	tarpitted   int64  // denied connections held in tarpit, not counted as active
+	lastConnID  uint64 // connection IDs are assigned sequentially, starting from 1
+
+	lastUpstreamConnID uint64 // the same for established connections to destinations and upstreams
+
+	memoryUsed     int64 // bytes, updated by memory watchdog
+	memoryPressure int32 // set above soft memory limit
+	shuttingDown   int32
+
+	fdCheckedAt int64 // Unix nanoseconds, see fdsOver
+	fdOver      int32
+	fdErrLogged int32
+
+	metrics      *metrics
+	destinations *topN
+	distinct     *distinctHosts
+	accounting   *accounting
+	upstreams    *upstreamHealth
+	buffers      *relayBuffers
+	affinity     *affinityCache
+	limiters     *rateLimiters
+	replays      *fakeTLSReplays
+	auditQueues  []*auditQueue // configured on start
+	geoip        geoIP
+
+	userConnsM sync.Mutex
+	userConns  map[string]int // active connections per user
+
+	debugUsersM sync.Mutex
+	debugUsers  map[string]bool // set via admin API in addition to debug_users, kept on reload
+
+	relaysM sync.Mutex
+	relays  map[uint64]*TCPConn // relayed connections by ID, for memory watchdog and connection stats
+
+	closes       *recentCloses
+	captureRules *captureRules
+	chaos        atomic.Value // *Chaos set via admin API, nil for configured settings
+
+	authSuccesses *authSuccesses // for stealth_auth_failures exemption
+	tracePayload  int            // set on start, see SetTracePayload
+	preAuth       *preAuthConns
+	destConns     *destinationConns // for destination_limit
+	pool          *connPool
+	udpAssocs     *udpAssociations
+}
+
+// maxTopDestinations is the number of tracked destination hosts.
+const maxTopDestinations = 1000
+
+// NewServer creates new Server with given initial configuration.
+func NewServer(conf *Config) *Server {
+	return &Server{
+		conf:          conf,
+		metrics:       newMetrics(),
+		destinations:  newTopN(maxTopDestinations),
+		distinct:      newDistinctHosts(),
+		accounting:    newAccounting(),
+		upstreams:     newUpstreamHealth(),
+		buffers:       new(relayBuffers),
+		affinity:      newAffinityCache(),
+		limiters:      newRateLimiters(),
+		replays:       newFakeTLSReplays(),
+		auditQueues:   newAuditQueues(conf.Audit),
+		userConns:     make(map[string]int),
+		debugUsers:    make(map[string]bool),
+		relays:        make(map[uint64]*TCPConn),
+		closes:        new(recentCloses),
+		captureRules:  new(captureRules),
+		authSuccesses: newAuthSuccesses(),
+		preAuth:       newPreAuthConns(),
+		destConns:     newDestinationConns(),
+		pool:          newConnPool(),
+		udpAssocs:     newUDPAssociations(),
+	}
+}
+
+// Config returns current configuration.
+func (s *Server) Config() *Config {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.conf
+}
+
+// SetConfig replaces current configuration. Established connections keep using the old one.
+func (s *Server) SetConfig(conf *Config) {
+	s.rw.Lock()
+	s.conf = conf
+	s.rw.Unlock()
+}
+
+// Maintenance returns true if server is in maintenance mode.
+func (s *Server) Maintenance() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+// SetMaintenance enters or leaves maintenance mode. In maintenance mode new connections are refused,
+// established connections are not affected. It returns false if mode was not changed.
+func (s *Server) SetMaintenance(on bool) bool {
+	if on {
+		return atomic.CompareAndSwapInt32(&s.maintenance, 0, 1)
+	}
+	return atomic.CompareAndSwapInt32(&s.maintenance, 1, 0)
+}
+
+// ShuttingDown returns true if server is shutting down.
+func (s *Server) ShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// SetShuttingDown marks server as shutting down, so readiness check fails.
+func (s *Server) SetShuttingDown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// Active returns a number of active connections.
+func (s *Server) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+func (s *Server) connOpened() {
+	atomic.AddInt64(&s.active, 1)
+	atomic.AddInt64(&s.total, 1)
+	s.metrics.Inc("connections_total")
+}
+
+func (s *Server) connClosed() {
+	atomic.AddInt64(&s.active, -1)
+}
+
+// DebugUser returns true if user's connections should be logged at debug level:
+// user is in debug_users setting or was added via admin API.
+func (s *Server) DebugUser(conf *Config, username string) bool {
+	for _, u := range conf.DebugUsers {
+		if u == username {
+			return true
+		}
+	}
+
+	s.debugUsersM.Lock()
+	defer s.debugUsersM.Unlock()
+	return s.debugUsers[username]
+}
+
+// SetDebugUser adds or removes user set via admin API. It returns false if it was not changed.
+func (s *Server) SetDebugUser(username string, on bool) bool {
+	s.debugUsersM.Lock()
+	defer s.debugUsersM.Unlock()
+
+	if s.debugUsers[username] == on {
+		return false
+	}
+	if on {
+		s.debugUsers[username] = true
+	} else {
+		delete(s.debugUsers, username)
+	}
+	return true
+}
+
+// debugUserNames returns sorted users set via admin API.
+func (s *Server) debugUserNames() []string {
+	s.debugUsersM.Lock()
+	defer s.debugUsersM.Unlock()
+
+	res := make([]string, 0, len(s.debugUsers))
+	for u := range s.debugUsers {
+		res = append(res, u)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// acquireUserConn registers user's connection. It returns false if limit (if positive) is reached.
+func (s *Server) acquireUserConn(user string, limit int) bool {
+	s.userConnsM.Lock()
+	defer s.userConnsM.Unlock()
+
+	if limit > 0 && s.userConns[user] >= limit {
+		return false
+	}
+	s.userConns[user]++
+	return true
+}
+
+// releaseUserConn unregisters user's connection.
+func (s *Server) releaseUserConn(user string) {
+	s.userConnsM.Lock()
+	defer s.userConnsM.Unlock()
+
+	if s.userConns[user]--; s.userConns[user] <= 0 {
+		delete(s.userConns, user)
+	}
+}
+
+// userConnsCount returns a number of user's active connections.
+func (s *Server) userConnsCount(user string) int {
+	s.userConnsM.Lock()
+	defer s.userConnsM.Unlock()
+	return s.userConns[user]
+}
+
+// availability returns the reason new connections of user are refused (empty if they are not)
+// and a hint when to retry (zero if unknown).
+func (s *Server) availability(conf *Config, u *User, now time.Time) (string, time.Duration) {
+	if u.Expired(now) {
+		return "account expired", 0
+	}
+
+	if u.MonthlyQuota > 0 && s.accounting.Used(u.Username, now) >= int64(u.MonthlyQuota) {
+		t := now.UTC()
+		next := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return "monthly quota is used", next.Sub(now)
+	}
+
+	if d := conf.DistinctDestinations; d.Limit > 0 && d.Reject {
+		if exceeded, left := s.distinct.Exceeded(u.Username, d.Window, now); exceeded {
+			return "distinct destinations limit exceeded", left
+		}
+	}
+
+	if u.MaxConnections > 0 && s.userConnsCount(u.Username) >= u.MaxConnections {
+		return fmt.Sprintf("connections limit %d reached", u.MaxConnections), 0
+	}
+
+	return "", 0
+}
+
+// updateGauges updates gauge metrics before they are exposed.
+func (s *Server) updateGauges() {
+	s.metrics.Set("active_connections", float64(s.Active()))
+	s.metrics.Set("tarpitted_connections", float64(s.Tarpitted()))
+	s.metrics.Set("pre_auth_connections", float64(s.preAuth.Len()))
+	s.metrics.Set("connection_pool_idle", float64(s.pool.Len()))
+	s.metrics.Set("udp_associations", float64(s.udpAssocs.Len()))
+	s.metrics.Set("oldest_connection_age_seconds", s.oldestRelayAge(time.Now()).Seconds())
+
+	var memoryPressure float64
+	if s.MemoryPressure() {
+		memoryPressure = 1
+	}
+	s.metrics.Set("memory_pressure", memoryPressure)
+	s.metrics.Set("memory_used_bytes", float64(atomic.LoadInt64(&s.memoryUsed)))
+
+	var maintenance float64
+	if s.Maintenance() {
+		maintenance = 1
+	}
+	s.metrics.Set("maintenance", maintenance)
+	s.metrics.Set("relay_buffer_bytes", float64(s.buffers.Used()))
+	s.metrics.Set("relay_buffer_budget_bytes", float64(s.Config().RelayMemoryBudget))
+
+	s.metrics.Delete("quota_used_bytes")
+	s.metrics.Delete("quota_remaining_bytes")
+	now := time.Now()
+	for _, u := range s.Config().Users {
+		if s.Config().UserMetrics && u.MonthlyQuota > 0 {
+			used := s.accounting.Used(u.Username, now)
+			s.metrics.Set("quota_used_bytes", float64(used), "user", u.Username)
+			s.metrics.Set("quota_remaining_bytes", float64(remaining(u.MonthlyQuota, used)), "user", u.Username)
+		}
+	}
+
+	s.metrics.Delete("upstream_healthy")
+	for _, u := range s.Config().upstreams() {
+		var healthy float64
+		if s.upstreams.Healthy(u.Address) {
+			healthy = 1
+		}
+		s.metrics.Set("upstream_healthy", healthy, "upstream", u.Address)
+	}
+
+	s.metrics.Delete("destination_connections")
+	for _, e := range s.destinations.Top(s.Config().TopDestinations) {
+		s.metrics.Set("destination_connections", float64(e.Count), "host", e.Key)
+	}
+}
+
+// RunSummary periodically logs server state summary until context is canceled.
+func (s *Server) RunSummary(ctx context.Context, interval time.Duration, l *zap.SugaredLogger) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			l.Warnf(
+				"Summary: %d active connections, %d total, %d tarpitted, maintenance: %t, %d users over quota.",
+				s.Active(), atomic.LoadInt64(&s.total), s.Tarpitted(), s.Maintenance(), s.overQuota(),
+			)
+		}
+	}
+}
+
+// remaining returns remaining quota.
+func remaining(quota ByteSize, used int64) int64 {
+	if r := int64(quota) - used; r > 0 {
+		return r
+	}
+	return 0
+}
+
+// overQuota returns a number of users who used all their quota.
+func (s *Server) overQuota() int {
+	var res int
+	now := time.Now()
+	for _, u := range s.Config().Users {
+		if u.MonthlyQuota > 0 && s.accounting.Used(u.Username, now) >= int64(u.MonthlyQuota) {
+			res++
+		}
+	}
+	return res
+}
+
+// LoadAccounting loads traffic counters from the state file, if it is configured.
+// Missing or corrupt file is not fatal: counting starts from zero, corrupt file is kept with ".corrupt" suffix.
+func (s *Server) LoadAccounting(l *zap.SugaredLogger) {
+	path := s.Config().Accounting.StateFile
+	if path == "" {
+		return
+	}
+
+	err := s.accounting.Load(path)
+	if err == nil {
+		return
+	}
+	l.Errorf("Can't load accounting state, starting from zero: %s.", err)
+	if _, ok := err.(*corruptStateError); ok {
+		if err = os.Rename(path, path+".corrupt"); err != nil {
+			l.Error(err)
+		}
+	}
+}
+
+// LoadGeoIP reads GeoIP databases, if they are configured.
+// Missing or unreadable database is not fatal: it is just not used.
+func (s *Server) LoadGeoIP(l *zap.SugaredLogger) {
+	conf := s.Config().GeoIP
+	for _, db := range []struct {
+		path string
+		dst  **mmdb
+	}{
+		{conf.CountryDB, &s.geoip.country},
+		{conf.ASNDB, &s.geoip.asn},
+	} {
+		if db.path == "" {
+			continue
+		}
+		var err error
+		if *db.dst, err = openMMDB(db.path); err != nil {
+			l.Errorf("Can't load GeoIP database, it is not used: %s.", err)
+			continue
+		}
+		l.Infof("GeoIP database %s loaded.", db.path)
+	}
+}
+
+// saveAccounting saves traffic counters to the state file, if it is configured.
+func (s *Server) saveAccounting() error {
+	path := s.Config().Accounting.StateFile
+	if path == "" {
+		return nil
+	}
+	if err := s.accounting.Save(path); err != nil {
+		return fmt.Errorf("can't save accounting state: %s", err)
+	}
+	return nil
+}
+
+// RunAccounting periodically flushes traffic counters to the state file until context is canceled,
+// then flushes them for the last time. Flush interval is read once, so changing it requires restart.
+func (s *Server) RunAccounting(ctx context.Context, l *zap.SugaredLogger) {
+	interval := s.Config().Accounting.FlushInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.saveAccounting(); err != nil {
+				l.Errorf("%s.", err)
+			}
+			return
+		case <-t.C:
+			if err := s.saveAccounting(); err != nil {
+				l.Errorf("%s.", err)
+			}
+		}
+	}
+}
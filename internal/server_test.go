@@ -0,0 +1,252 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// testServer validates configuration and starts SOCKS5 listener handling connections like main package does.
+// It returns server and listener address; both are stopped at the end of the test.
+func testServer(t testing.TB, conf *Config) (*Server, string) {
+	t.Helper()
+
+	return testServerLog(t, conf, zap.NewNop().Sugar())
+}
+
+// testServerLog is testServer with connections logged by l.
+func testServerLog(t testing.TB, conf *Config, l *zap.SugaredLogger) (*Server, string) {
+	t.Helper()
+
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	addr := testListen(t, func(ctx context.Context, c net.Conn) {
+		testHandle(ctx, c, l, srv)
+	})
+	return srv, addr
+}
+
+// testConns starts SOCKS5 listener like testServer, but connections are handled with given context,
+// so the test may shut them down. Each connection is sent to the returned channel after it is closed.
+func testConns(t *testing.T, ctx context.Context, l *zap.SugaredLogger, srv *Server) (string, <-chan *TCPConn) {
+	t.Helper()
+
+	conns := make(chan *TCPConn, 10)
+	addr := testListen(t, func(_ context.Context, c net.Conn) {
+		tcp := NewTCPConn(c, ListenerDefault, l, srv)
+		if tcp.EnterPreAuth() && tcp.Sniff() && tcp.Auth(ctx) && tcp.Req(ctx) {
+			tcp.Run(ctx)
+		}
+		tcp.Close()
+		conns <- tcp
+	})
+	return addr, conns
+}
+
+// testNextConn returns the next closed connection sent by testConns.
+func testNextConn(t *testing.T, conns <-chan *TCPConn) *TCPConn {
+	t.Helper()
+
+	select {
+	case tcp := <-conns:
+		return tcp
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+		return nil
+	}
+}
+
+// testLog collects JSON log entries written by concurrent connections.
+type testLog struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (tl *testLog) Write(p []byte) (int, error) {
+	tl.m.Lock()
+	defer tl.m.Unlock()
+	return tl.buf.Write(p)
+}
+
+func (tl *testLog) Sync() error { return nil }
+
+// Entries returns logged entries with given message (all if empty): message, level and fields.
+func (tl *testLog) Entries(msg string) []map[string]interface{} {
+	tl.m.Lock()
+	defer tl.m.Unlock()
+
+	var res []map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(tl.buf.Bytes()))
+	for {
+		var e map[string]interface{}
+		if err := d.Decode(&e); err != nil {
+			return res
+		}
+		if msg == "" || e["msg"] == msg {
+			res = append(res, e)
+		}
+	}
+}
+
+// testLogger returns logger with given level (that may be overridden per connection like in main package),
+// writing to the returned log.
+func testLogger(level zapcore.Level) (*zap.SugaredLogger, *testLog) {
+	tl := new(testLog)
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), tl, zapcore.DebugLevel)
+	return zap.New(core, LevelOption(level)).Sugar(), tl
+}
+
+// testListen starts TCP listener calling handle for each connection in a separate goroutine.
+// It returns listener address; listener is stopped and handlers are canceled at the end of the test.
+func testListen(t testing.TB, handle func(ctx context.Context, c net.Conn)) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				handle(ctx, c)
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// testHandle handles SOCKS5 connection.
+func testHandle(ctx context.Context, c net.Conn, l *zap.SugaredLogger, srv *Server) {
+	tcp := NewTCPConn(c, ListenerDefault, l, srv)
+	defer tcp.Close()
+
+	if !tcp.EnterPreAuth() || !tcp.Sniff() || !tcp.Auth(ctx) || !tcp.Req(ctx) {
+		return
+	}
+	tcp.Run(ctx)
+}
+
+// testRequest authenticates on SOCKS5 server and sends request with given command and IPv4 address.
+// It returns connection and the reply.
+func testRequest(t testing.TB, addr, username, password string, cmd byte, dst *net.TCPAddr) (net.Conn, []byte) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := []byte{5, 1, 2, 1, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	b = append(b, 5, cmd, 0, 1)
+	b = append(b, dst.IP.To4()...)
+	b = append(b, byte(dst.Port>>8), byte(dst.Port))
+	if _, err = c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make([]byte, 2+2+10)
+	if _, err = io.ReadFull(c, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res[:4]) != "\x05\x02\x01\x00" {
+		t.Fatalf("unexpected authentication reply % x", res[:4])
+	}
+	c.SetDeadline(time.Time{})
+	return c, res[4:]
+}
+
+// testDomainRequest is like testRequest, but with domain name destination.
+func testDomainRequest(t testing.TB, addr, username, password string, host string, port int) (net.Conn, []byte) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := []byte{5, 1, 2, 1, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	b = append(b, 5, cmdConnect, 0, 3, byte(len(host)))
+	b = append(b, host...)
+	b = append(b, byte(port>>8), byte(port))
+	if _, err = c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make([]byte, 2+2+10)
+	if _, err = io.ReadFull(c, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res[:4]) != "\x05\x02\x01\x00" {
+		t.Fatalf("unexpected authentication reply % x", res[:4])
+	}
+	c.SetDeadline(time.Time{})
+	return c, res[4:]
+}
+
+// waitFor waits up to a few seconds until f returns true.
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if f() {
+			return
+		}
+	}
+	t.Fatal("timeout")
+}
+
+// waitReturned fails the test if done is not closed within a few seconds.
+func waitReturned(t *testing.T, done <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
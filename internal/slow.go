@@ -0,0 +1,73 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// slowSample is the throughput estimation interval. Longer gaps without relayed data are idle periods.
+const slowSample = 10 * time.Second
+
+// slowMeter estimates connection throughput from relayed bytes and detects connections
+// staying below the floor for too long. Idle periods reset the estimate, so idle connections are never slow.
+type slowMeter struct {
+	floor    float64 // bytes per second
+	duration time.Duration
+
+	m         sync.Mutex
+	winStart  time.Time
+	winBytes  int64
+	last      time.Time
+	slowSince time.Time
+	detected  bool
+}
+
+func newSlowMeter(floor ByteSize, duration time.Duration, now time.Time) *slowMeter {
+	return &slowMeter{
+		floor:    float64(floor),
+		duration: duration,
+		winStart: now,
+		last:     now,
+	}
+}
+
+// Add records n relayed bytes at given time. It returns true once, when connection is detected to be slow.
+func (sm *slowMeter) Add(n int, now time.Time) bool {
+	sm.m.Lock()
+	defer sm.m.Unlock()
+
+	if sm.detected {
+		return false
+	}
+
+	if now.Sub(sm.last) > slowSample {
+		sm.winStart, sm.winBytes, sm.slowSince = now, 0, time.Time{}
+	}
+	sm.last = now
+	sm.winBytes += int64(n)
+
+	if d := now.Sub(sm.winStart); d >= slowSample {
+		if float64(sm.winBytes)/d.Seconds() < sm.floor {
+			if sm.slowSince.IsZero() {
+				sm.slowSince = sm.winStart
+			}
+		} else {
+			sm.slowSince = time.Time{}
+		}
+		sm.winStart, sm.winBytes = now, 0
+	}
+
+	if !sm.slowSince.IsZero() && now.Sub(sm.slowSince) >= sm.duration {
+		sm.detected = true
+	}
+	return sm.detected
+}
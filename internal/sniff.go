@@ -0,0 +1,78 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+)
+
+// Protocol categories of sniffed traffic.
+const (
+	protocolSOCKS5 = "socks5"
+	protocolSOCKS4 = "socks4"
+	protocolHTTP   = "http"
+	protocolHTTP2  = "http2"
+	protocolTLS    = "tls"
+	protocolSSH    = "ssh"
+	protocolText   = "text"
+	protocolBinary = "binary"
+)
+
+// sniffLength is the number of first bytes used to categorize traffic.
+const sniffLength = 16
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("CONNECT "), []byte("OPTIONS "), []byte("TRACE "), []byte("PATCH "),
+}
+
+// sshBanner starts SSH protocol version exchange sent by clients.
+var sshBanner = []byte("SSH-")
+
+// http2Preface starts HTTP/2 connection preface; its first byte 'P' would be a SOCKS version otherwise.
+var http2Preface = []byte("PRI * HTTP/2")
+
+// sniffProtocol categorizes traffic by its first bytes.
+func sniffProtocol(b []byte) string {
+	if len(b) == 0 {
+		return protocolBinary
+	}
+
+	switch b[0] {
+	case 5:
+		return protocolSOCKS5
+	case 4:
+		return protocolSOCKS4
+	case 0x16:
+		// TLS handshake record: content type, then major version 3
+		if len(b) == 1 || b[1] == 3 {
+			return protocolTLS
+		}
+	}
+
+	if bytes.HasPrefix(b, http2Preface) {
+		return protocolHTTP2
+	}
+	if bytes.HasPrefix(b, sshBanner) {
+		return protocolSSH
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return protocolHTTP
+		}
+	}
+
+	for _, c := range b {
+		if (c < 0x20 || c > 0x7e) && c != '\r' && c != '\n' && c != '\t' {
+			return protocolBinary
+		}
+	}
+	return protocolText
+}
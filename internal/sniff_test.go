@@ -0,0 +1,103 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestSniffProtocol(t *testing.T) {
+	for name, tc := range map[string]struct {
+		b        string
+		protocol string
+	}{
+		"SOCKS5":        {"\x05\x01\x00", protocolSOCKS5},
+		"SOCKS4":        {"\x04\x01\x00\x50\x7f\x00\x00\x01", protocolSOCKS4},
+		"TLS":           {"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03", protocolTLS},
+		"TLSFirstByte":  {"\x16", protocolTLS},
+		"HTTP":          {"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", protocolHTTP},
+		"HTTPConnect":   {"CONNECT example.com:443 HTTP/1.1\r\n", protocolHTTP},
+		"HTTP2":         {"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x12\x04\x00", protocolHTTP2},
+		"HTTP2Partial":  {"PRI * HTTP/2", protocolHTTP2},
+		"PRI":           {"PRI\r\n", protocolText},
+		"SSH":           {"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3\r\n", protocolSSH},
+		"Text":          {"hello\r\n", protocolText},
+		"LowercaseHTTP": {"get / HTTP/1.1\r\n", protocolText},
+		"Binary":        {"\x00\xff\x13\x37", protocolBinary},
+		"NotTLSVersion": {"\x16\x00\x01", protocolBinary},
+		"Empty":         {"", protocolBinary},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if protocol := sniffProtocol([]byte(tc.b)); protocol != tc.protocol {
+				t.Errorf("expected %q, got %q", tc.protocol, protocol)
+			}
+		})
+	}
+}
+
+func TestProtocolMismatch(t *testing.T) {
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, &Config{Users: []User{{Username: "user1", Password: "pass1"}}}, l)
+
+	for _, b := range []string{
+		"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03",
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n",
+		"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3\r\n",
+		"\x00\xff\x13\x37",
+	} {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = c.Write([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+
+		// the connection is closed without a reply
+		if n, _ := io.Copy(ioutil.Discard, c); n != 0 {
+			t.Errorf("%q: expected no reply, got %d bytes", b, n)
+		}
+		c.Close()
+	}
+
+	// each category is counted separately
+	waitFor(t, func() bool { return srv.Active() == 0 })
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	for _, protocol := range []string{protocolTLS, protocolHTTP, protocolHTTP2, protocolSSH, protocolBinary} {
+		if line := `telesock_protocol_mismatches_total{protocol="` + protocol + `"} 1` + "\n"; !strings.Contains(metrics.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, metrics.String())
+		}
+	}
+
+	// the category is logged instead of unsupported version
+	var http2 int
+	for _, e := range log.Entries("") {
+		msg, _ := e["msg"].(string)
+		if strings.HasPrefix(msg, "Unsupported SOCKS protocol version") {
+			t.Errorf("unexpected message %q", msg)
+		}
+		if strings.HasPrefix(msg, "Not a SOCKS5 client ("+protocolHTTP2+"): ") {
+			http2++
+		}
+	}
+	if http2 != 1 {
+		t.Errorf("expected a single HTTP/2 client message, got %d", http2)
+	}
+}
@@ -0,0 +1,102 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// getUserTimeout returns TCP_USER_TIMEOUT socket option of c.
+func getUserTimeout(c net.Conn) (time.Duration, error) {
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var v int
+	var serr error
+	if err = raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+	}); err != nil {
+		return 0, err
+	}
+	return time.Duration(v) * time.Millisecond, serr
+}
+
+func TestUserTimeout(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		<-ctx.Done()
+		c.Close()
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{
+		Users:          []User{{Username: "user1", Password: "pass1"}},
+		TCPUserTimeout: 3 * time.Second,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+
+	// both the client and the upstream sockets have the option set once connection is established
+	timeouts := make(chan [2]time.Duration, 1)
+	addr := testListen(t, func(ctx context.Context, c net.Conn) {
+		tcp := NewTCPConn(c, ListenerDefault, zap.NewNop().Sugar(), srv)
+		defer tcp.Close()
+		if tcp.EnterPreAuth() && tcp.Sniff() && tcp.Auth(ctx) && tcp.Req(ctx) {
+			client, err := getUserTimeout(c)
+			if err != nil {
+				t.Error(err)
+			}
+			upstream, err := getUserTimeout(tcp.server)
+			if err != nil {
+				t.Error(err)
+			}
+			timeouts <- [2]time.Duration{client, upstream}
+		}
+	})
+
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	select {
+	case actual := <-timeouts:
+		if expected := [2]time.Duration{conf.TCPUserTimeout, conf.TCPUserTimeout}; actual != expected {
+			t.Errorf("expected client and upstream timeouts %v, got %v", expected, actual)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// the option is not set by default
+	c2, err := net.Dial("tcp", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	actual, err := getUserTimeout(c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != 0 {
+		t.Errorf("expected no timeout by default, got %s", actual)
+	}
+}
@@ -0,0 +1,40 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+//go:build !linux
+// +build !linux
+
+package internal
+
+import (
+	"net"
+	"time"
+)
+
+// setUserTimeout sets TCP_USER_TIMEOUT socket option. It is no-op on platforms other than Linux.
+func setUserTimeout(c net.Conn, timeout time.Duration) error {
+	return nil
+}
+
+// connAliveTimeout is the time connAlive waits for the peer's data or EOF.
+const connAliveTimeout = time.Millisecond
+
+// connAlive returns true if the peer has neither closed idle connection nor sent anything over it.
+func connAlive(c net.Conn) bool {
+	// already expired deadline fails reads without checking the connection
+	if err := c.SetReadDeadline(time.Now().Add(connAliveTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := c.Read(b[:])
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return false
+	}
+	return c.SetReadDeadline(time.Time{}) == nil
+}
@@ -0,0 +1,102 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// replyError is returned when upstream SOCKS5 server replies with non-zero REP code.
+type replyError byte
+
+func (e replyError) Error() string {
+	return fmt.Sprintf("upstream SOCKS5 server replied with code %d", byte(e))
+}
+
+// socksHandshake performs SOCKS5 method negotiation and authentication over c.
+// If username is empty, no authentication is used.
+func socksHandshake(c net.Conn, username, password string) error {
+	method := byte(0)
+	if username != "" {
+		method = 2
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return err
+	}
+	if b[0] != 5 || b[1] != method {
+		return fmt.Errorf("upstream SOCKS5 server doesn't support authentication method %d", method)
+	}
+
+	if method == 2 {
+		auth := []byte{1, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return fmt.Errorf("upstream SOCKS5 server rejected username or password")
+		}
+	}
+	return nil
+}
+
+// socksRequest sends SOCKS5 CONNECT request to raddr over c after handshake and reads the reply.
+func socksRequest(c net.Conn, raddr *net.TCPAddr) error {
+	b := make([]byte, 2)
+	request := []byte{5, 1, 0, 1}
+	ip := raddr.IP.To4()
+	if ip == nil {
+		request[3] = 4
+		ip = raddr.IP.To16()
+	}
+	request = append(request, ip...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(raddr.Port))
+	if _, err := c.Write(request); err != nil {
+		return err
+	}
+
+	var res res
+	if err := binary.Read(c, binary.BigEndian, &res); err != nil {
+		return err
+	}
+	if res.Rep != 0 {
+		return replyError(res.Rep)
+	}
+
+	var addrLen int
+	switch res.Atyp {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(c, b[:1]); err != nil {
+			return err
+		}
+		addrLen = int(b[0])
+	default:
+		return fmt.Errorf("upstream SOCKS5 server replied with unexpected atyp %d", res.Atyp)
+	}
+	_, err := io.ReadFull(c, make([]byte, addrLen+2))
+	return err
+}
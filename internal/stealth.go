@@ -0,0 +1,109 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Values of stealth_auth_failures setting: how to handle failed authentication.
+const (
+	StealthAuthNormal = "normal" // default: failure reply is sent
+	StealthAuthSilent = "silent" // no reply, connection is closed after a random delay
+	StealthAuthDecoy  = "decoy"  // connection is forwarded to the fallback server
+)
+
+const (
+	stealthSilentMinDelay = time.Second
+	stealthSilentMaxDelay = 10 * time.Second
+
+	// clients authenticated successfully within that window get failure replies as usual,
+	// so legitimate users with a mistyped password are not confused
+	stealthExemptWindow = 24 * time.Hour
+
+	// authSuccessSweepSize is the number of tracked addresses after which expired ones are removed.
+	authSuccessSweepSize = 1024
+)
+
+// authSuccesses tracks client IP addresses with recent successful authentication.
+type authSuccesses struct {
+	m   sync.Mutex
+	ips map[string]time.Time // last success
+}
+
+func newAuthSuccesses() *authSuccesses {
+	return &authSuccesses{
+		ips: make(map[string]time.Time),
+	}
+}
+
+// Add records successful authentication from ip.
+func (a *authSuccesses) Add(ip net.IP, now time.Time) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if len(a.ips) >= authSuccessSweepSize {
+		for k, t := range a.ips {
+			if now.Sub(t) >= stealthExemptWindow {
+				delete(a.ips, k)
+			}
+		}
+	}
+	a.ips[ip.String()] = now
+}
+
+// Recent returns true if ip has authenticated successfully within stealthExemptWindow.
+func (a *authSuccesses) Recent(ip net.IP, now time.Time) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	t, ok := a.ips[ip.String()]
+	return ok && now.Sub(t) < stealthExemptWindow
+}
+
+// authFailed handles failed authentication according to stealth_auth_failures setting.
+// consumed are bytes of greeting and credentials read from the client, forwarded in decoy mode.
+func (tcp *TCPConn) authFailed(ctx context.Context, ip net.IP, consumed []byte, l *zap.SugaredLogger) {
+	mode := tcp.conf.StealthAuthFailures
+	if mode == "" {
+		mode = StealthAuthNormal
+	}
+	if mode != StealthAuthNormal && ip != nil && tcp.srv.authSuccesses.Recent(ip, time.Now()) {
+		l.Debugf("Client authenticated recently, replying with failure instead of %s handling.", mode)
+		mode = StealthAuthNormal
+	}
+	tcp.srv.metrics.Inc("auth_failures_total", "mode", mode)
+
+	switch mode {
+	case StealthAuthSilent:
+		d := stealthSilentMinDelay + time.Duration(rand.Int63n(int64(stealthSilentMaxDelay-stealthSilentMinDelay)))
+		l.Debugf("Closing connection without reply in %s.", d)
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+		case <-t.C:
+		}
+
+	case StealthAuthDecoy:
+		tcp.forward(ctx, tcp.conf.MTProto.fallback(), consumed, "auth", l)
+
+	default:
+		if _, err := tcp.clientW.Write([]byte{1, 1}); err != nil {
+			l.Error(err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+package internal
+
+import (
+	"strconv"
+)
+
+// redacted replaces secrets in Summary.
+const redacted = "[redacted]"
+
+// redact returns redacted for non-empty secrets.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// Summary returns effective configuration for logging on start: features, limits and timeouts with defaults applied.
+// Passwords, pre-shared keys and secrets are redacted; users are only counted.
+func (c *Config) Summary() map[string]interface{} {
+	var mtprotoUsers, hashedUsers, quotaUsers, rateLimitedUsers int
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.mtprotoSecret != nil {
+			mtprotoUsers++
+		}
+		if u.passwordHash != "" {
+			hashedUsers++
+		}
+		if u.MonthlyQuota > 0 {
+			quotaUsers++
+		}
+		if u.RateLimit > 0 {
+			rateLimitedUsers++
+		}
+	}
+
+	listeners := make([]string, len(c.Listeners))
+	for i, l := range c.Listeners {
+		typ := l.Type
+		if typ == "" {
+			typ = ListenerTypeSOCKS5
+		}
+		listeners[i] = l.Tag + " " + typ + " " + l.Listen
+	}
+
+	var upstreams []map[string]interface{}
+	for _, u := range c.upstreams() {
+		upstreams = append(upstreams, map[string]interface{}{
+			"name":     u.Name,
+			"address":  u.Address,
+			"username": u.Username,
+			"password": redact(u.Password),
+			"psk":      redact(u.PSK),
+			"priority": u.Priority,
+		})
+	}
+
+	servers := make([]string, 0, len(c.AdvertisedServers()))
+	for _, s := range c.AdvertisedServers() {
+		if s.Port != 0 {
+			servers = append(servers, s.Host+":"+strconv.Itoa(s.Port))
+			continue
+		}
+		servers = append(servers, s.Host)
+	}
+
+	earlyData := c.EarlyData
+	if earlyData == "" {
+		earlyData = EarlyDataRelay
+	}
+	destinationType := c.DestinationType
+	if destinationType == "" {
+		destinationType = DestinationTypeAny
+	}
+	protocolMismatch := c.ProtocolMismatch
+	if protocolMismatch == "" {
+		protocolMismatch = ProtocolMismatchLog
+	}
+	stealthAuthFailures := c.StealthAuthFailures
+	if stealthAuthFailures == "" {
+		stealthAuthFailures = StealthAuthNormal
+	}
+	abortiveClose := c.AbortiveClose
+	if abortiveClose == nil {
+		abortiveClose = defaultAbortiveClose
+	}
+	memorySoft, memoryHard := c.MemoryWatchdog.limits()
+	acceptGoroutines := c.AcceptGoroutines
+	if acceptGoroutines == 0 {
+		acceptGoroutines = 1
+	}
+	dnsTimeout := c.DNSTimeout
+	if dnsTimeout == 0 {
+		dnsTimeout = defaultDNSTimeout
+	}
+
+	return map[string]interface{}{
+		"servers": servers,
+		"users": map[string]interface{}{
+			"total":         len(c.Users),
+			"htpasswd":      hashedUsers,
+			"mtproto":       mtprotoUsers,
+			"quota":         quotaUsers,
+			"rate_limited":  rateLimitedUsers,
+			"csv_file":      c.UsersCSV,
+			"htpasswd_file": c.UsersHtpasswd,
+			"dir":           c.UsersDir,
+		},
+		"listeners": listeners,
+		"tunnel": map[string]interface{}{
+			"listen": c.Tunnel.Listen,
+			"psk":    redact(c.Tunnel.PSK),
+		},
+		"admin": map[string]interface{}{
+			"token": redact(c.Admin.Token),
+		},
+		"upstreams": upstreams,
+		"routes":    len(c.Routes),
+		"resolvers": len(c.Resolvers),
+		"timeouts": map[string]interface{}{
+			"dial":               c.dialTimeout().String(),
+			"connect":            c.connectTimeout().String(),
+			"connect_retries":    c.ConnectRetries,
+			"idle":               c.IdleTimeout.String(),
+			"max_connection_age": c.MaxConnectionAge.String(),
+			"write":              c.WriteTimeout.String(),
+			"dns":                dnsTimeout.String(),
+			"tcp_user":           c.TCPUserTimeout.String(),
+		},
+		"features": map[string]interface{}{
+			"mtproto":               mtprotoUsers > 0,
+			"faketls_domain":        c.MTProto.FakeTLSDomain,
+			"accounting":            c.Accounting.StateFile != "",
+			"geoip":                 c.GeoIP.CountryDB != "" || c.GeoIP.ASNDB != "",
+			"audit_webhook":         c.Audit.Webhook != "",
+			"audit_syslog":          c.Audit.Syslog != "",
+			"capture":               c.Capture.Enabled,
+			"chaos":                 c.Chaos.Enabled,
+			"debug_users":           len(c.DebugUsers),
+			"debug_clients":         len(c.DebugClients),
+			"deny_clients":          len(c.DenyClients),
+			"tarpit":                c.Tarpit.Duration > 0,
+			"pre_auth":              c.PreAuth.MaxConnections > 0 || c.PreAuth.MaxPerClient > 0,
+			"destination_limit":     c.DestinationLimit.enabled(),
+			"connection_pool":       len(c.ConnectionPool.Destinations) > 0,
+			"udp_associate":         c.UDPAssociate.Enabled,
+			"udp_max_associations":  c.UDPAssociate.MaxAssociations,
+			"bind":                  c.Bind.Enabled,
+			"auth_sessions":         c.AuthSessions.TTL.String(),
+			"fd_watermark":          c.FDWatermark,
+			"accept_goroutines":     acceptGoroutines,
+			"port_affinity":         c.PortAffinity > 0,
+			"relay_memory_budget":   c.RelayMemoryBudget.String(),
+			"memory_soft_limit":     ByteSize(memorySoft).String(),
+			"memory_hard_limit":     ByteSize(memoryHard).String(),
+			"slow_connection":       c.SlowConnectionThroughput > 0,
+			"distinct_destinations": c.DistinctDestinations.Limit > 0,
+			"early_data":            earlyData,
+			"destination_type":      destinationType,
+			"protocol_mismatch":     protocolMismatch,
+			"stealth_auth_failures": stealthAuthFailures,
+			"abortive_close":        abortiveClose,
+			"echo_host":             c.EchoHost != "",
+			"user_metrics":          c.UserMetrics,
+		},
+	}
+}
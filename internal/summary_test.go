@@ -0,0 +1,94 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	secrets := []string{
+		"user-password-secret",
+		"0123456789abcdeffedcba9876543210",
+		"upstream-password-secret",
+		"upstream-psk-secret-0123456789",
+		"tunnel-psk-secret-0123456789",
+		"admin-token-secret-0123456789",
+	}
+	conf := &Config{
+		Users: []User{
+			{Username: "user1", Password: secrets[0], MTProtoSecret: secrets[1], RateLimit: 1024},
+			{Username: "user2", Password: "pass2"},
+		},
+		Upstreams: []Upstream{
+			{Address: "127.0.0.1:1080", Username: "up", Password: secrets[2]},
+			{Address: "127.0.0.2:1080", PSK: secrets[3]},
+		},
+		Tunnel:      Tunnel{Listen: "127.0.0.1:0", PSK: secrets[4]},
+		Admin:       Admin{Token: secrets[5]},
+		IdleTimeout: time.Minute,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// marshaled like zap does it when logged
+	b, err := json.Marshal(conf.Summary())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(b)
+	for _, secret := range secrets {
+		if strings.Contains(s, secret) {
+			t.Errorf("secret %q is not redacted: %s", secret, s)
+		}
+	}
+	if n := strings.Count(s, `"`+redacted+`"`); n != 4 {
+		t.Errorf("expected 4 redacted values, got %d: %s", n, s)
+	}
+
+	// features, counts and timeouts with defaults are present
+	var summary struct {
+		Users struct {
+			Total       int `json:"total"`
+			MTProto     int `json:"mtproto"`
+			RateLimited int `json:"rate_limited"`
+		} `json:"users"`
+		Upstreams []map[string]interface{} `json:"upstreams"`
+		Timeouts  map[string]interface{}   `json:"timeouts"`
+		Features  map[string]interface{}   `json:"features"`
+	}
+	if err = json.Unmarshal(b, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Users.Total != 2 || summary.Users.MTProto != 1 || summary.Users.RateLimited != 1 {
+		t.Errorf("unexpected users: %+v", summary.Users)
+	}
+	if len(summary.Upstreams) != 2 || summary.Upstreams[0]["username"] != "up" || summary.Upstreams[1]["password"] != "" {
+		t.Errorf("unexpected upstreams: %v", summary.Upstreams)
+	}
+	if summary.Timeouts["idle"] != "1m0s" || summary.Timeouts["dns"] != defaultDNSTimeout.String() {
+		t.Errorf("unexpected timeouts: %v", summary.Timeouts)
+	}
+	for feature, expected := range map[string]interface{}{
+		"mtproto":          true,
+		"accounting":       false,
+		"udp_associate":    false,
+		"destination_type": DestinationTypeAny,
+		"early_data":       EarlyDataRelay,
+	} {
+		if actual := summary.Features[feature]; actual != expected {
+			t.Errorf("feature %s: expected %v, got %v", feature, expected, actual)
+		}
+	}
+}
@@ -11,34 +11,105 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"container/list"
 	"context"
-	"crypto/subtle"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 // TCPConn represents TCP connection between SOCKS5 client and server.
 type TCPConn struct {
-	l    *zap.SugaredLogger
-	conf *Config
+	l       *zap.SugaredLogger
+	srv     *Server
+	conf    *Config
+	id      uint64
+	started time.Time
 
-	clientR *bufio.Reader
+	client  net.Conn
+	clientR *bufio.Reader // used by all handshake steps, so pipelined bytes are never lost or reordered
 	clientW io.WriteCloser
 
-	server *net.TCPConn
+	listener string // tag of listener accepted the connection
+	user     *User
+	server   net.Conn
+	udp      *udpRelay // UDP association, server is its socket
+	policy   Policy
+	slow     *slowMeter
+	limiter  *rateLimiter // user's rate limiter, nil if unlimited
+	capture  string       // destination for capture file names if relayed traffic is captured, empty otherwise
+	target   string       // destination host:port, set before relay
+	step     string       // the last started step, for termination reason
+
+	userConn bool   // user's connection is registered for max_connections limit
+	destIP   string // connection is registered for destination_limit, if not empty
+	debug    bool   // client is in debug_clients
+
+	preAuth   *list.Element // registered as not authenticated yet, guarded by preAuthConns.m
+	preAuthIP string
+
+	stopped     int32 // set when relay is stopped on purpose, so following errors are not logged
+	interrupted int32 // set when handshake is interrupted on shutdown, so following read errors are not logged
+	abortive    int32 // set when connections are reset on close
+
+	idleDeadline int64        // current idle read deadline in Unix nanoseconds, see touch
+	lastActive   int64        // time of the last relayed write in Unix nanoseconds, for memory watchdog
+	fromClient   int64        // bytes relayed from the client to the server, handshake excluded
+	fromServer   int64        // bytes relayed from the server to the client
+	chaosRelayed int64        // bytes relayed in both directions, for chaos resets
+	relayEnd     atomic.Value // class of the first relay error, logged on close
+	endReason    atomic.Value // termination reason, see end
 }
 
-// NewTCPConn creates new TCPConn for given network connection.
-func NewTCPConn(c *net.TCPConn, l *zap.SugaredLogger, conf *Config) *TCPConn {
+// NewTCPConn creates new TCPConn for connection accepted by listener with given tag.
+// It uses server configuration current at the moment of the call.
+func NewTCPConn(c net.Conn, listener string, l *zap.SugaredLogger, srv *Server) *TCPConn {
+	conf := srv.Config()
+	id := atomic.AddUint64(&srv.lastConnID, 1)
+	l = l.With(zap.Uint64("conn_id", id))
+	var debug bool
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		country, asn := srv.geoip.Lookup(addr.IP)
+		if country != "" {
+			l = l.With(zap.String("client_country", country))
+		}
+		if asn != "" {
+			l = l.With(zap.String("client_asn", asn))
+		}
+		if debug = conf.debugClient(addr.IP); debug {
+			l = withLevel(l, zapcore.DebugLevel)
+		}
+	}
+
 	l.Info("Connection established.")
+	srv.connOpened()
+	srv.metrics.Inc("listener_connections_total", "listener", listener)
+
+	if t := conf.TCPUserTimeout; t > 0 {
+		if err := setUserTimeout(c, t); err != nil {
+			l.Warnf("Failed to set TCP user timeout: %s.", err)
+		}
+	}
 
 	return &TCPConn{
-		l:    l,
-		conf: conf,
+		l:        l,
+		srv:      srv,
+		conf:     conf,
+		id:       id,
+		started:  time.Now(),
+		listener: listener,
+		debug:    debug,
 
+		client:  c,
 		clientR: bufio.NewReaderSize(c, 128),
 		clientW: c,
 	}
@@ -50,16 +121,99 @@ func (tcp *TCPConn) Close() {
 	}
 
 	tcp.clientW.Close()
-	tcp.l.Info("Connection closed.")
-	tcp.l.Sync()
+	tcp.leavePreAuth()
+	closeType := "graceful"
+	if atomic.LoadInt32(&tcp.abortive) == 1 {
+		closeType = "abortive"
+	}
+	reason := tcp.closeReason()
+	tcp.srv.metrics.Inc("connections_closed_total", "close", closeType, "reason", reason)
+	if tcp.step == "relay" {
+		tcp.srv.metrics.Observe("connection_duration_seconds", time.Since(tcp.started).Seconds(), connectionDurationBounds)
+	}
+	var username string
+	if tcp.user != nil {
+		username = tcp.user.Username
+	}
+	tcp.srv.closes.Add(closedConn{at: time.Now(), client: remoteAddrString(tcp.client), user: username, reason: reason})
+	if tcp.userConn {
+		tcp.srv.releaseUserConn(tcp.user.Username)
+	}
+	if tcp.destIP != "" {
+		tcp.srv.destConns.Release(tcp.destIP, tcp.user.Username)
+	}
+	if tcp.udp != nil {
+		tcp.srv.udpAssocs.Release(tcp.user.Username)
+	}
+	tcp.srv.connClosed()
+	l := tcp.l.With(zap.String("close_reason", reason))
+	if class, _ := tcp.relayEnd.Load().(string); class != "" {
+		l = l.With(zap.String("relay_end", class))
+	}
+	l.Info("Connection closed.")
+	l.Sync()
+}
+
+// Refuse politely refuses connection during maintenance: it reads client's greeting
+// and replies that no acceptable authentication methods are available.
+func (tcp *TCPConn) Refuse() {
+	tcp.step = "refuse"
+	l := tcp.l.With(zap.String("step", tcp.step))
+
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(tcp.clientR, greeting); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return
+	}
+	if _, err := tcp.clientR.Discard(int(greeting[1])); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return
+	}
+	if _, err := tcp.clientW.Write([]byte{5, 255}); err != nil {
+		l.Error(err)
+		return
+	}
+	l.Info("Connection refused due to maintenance.")
+}
+
+// Sniff checks that the client speaks SOCKS5 by peeking its first bytes.
+// Other traffic is categorized (HTTP request, TLS ClientHello, plain text, etc.), reported and rejected.
+func (tcp *TCPConn) Sniff() bool {
+	tcp.step = "sniff"
+	l := tcp.l.With(zap.String("step", tcp.step))
+
+	if _, err := tcp.clientR.Peek(1); err != nil {
+		tcp.logReadError(l, "%s", err)
+		return false
+	}
+	n := tcp.clientR.Buffered()
+	if n > sniffLength {
+		n = sniffLength
+	}
+	b, _ := tcp.clientR.Peek(n)
+
+	protocol := sniffProtocol(b)
+	if protocol == protocolSOCKS5 {
+		return true
+	}
+
+	tcp.srv.metrics.Inc("protocol_mismatches_total", "protocol", protocol)
+	tcp.setAbortive(CloseProtocolMismatch)
+	if tcp.conf.ProtocolMismatch == ProtocolMismatchQuiet {
+		l.Debugf("Not a SOCKS5 client (%s): %q.", protocol, b)
+	} else {
+		l.Errorf("Not a SOCKS5 client (%s): %q.", protocol, b)
+	}
+	return false
 }
 
 func (tcp *TCPConn) Auth(ctx context.Context) bool {
-	l := tcp.l.With(zap.String("step", "auth"))
+	tcp.step = "auth"
+	l := tcp.l.With(zap.String("step", tcp.step))
 
 	ver, err := tcp.clientR.ReadByte()
 	if err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "%s", err)
 		return false
 	}
 	if ver != 5 {
@@ -69,12 +223,12 @@ func (tcp *TCPConn) Auth(ctx context.Context) bool {
 
 	nmethod, err := tcp.clientR.ReadByte()
 	if err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "%s", err)
 		return false
 	}
 	methods := make([]byte, nmethod)
 	if _, err = io.ReadFull(tcp.clientR, methods); err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "%s", err)
 		return false
 	}
 	method := byte(255)
@@ -95,9 +249,16 @@ func (tcp *TCPConn) Auth(ctx context.Context) bool {
 		return false
 	}
 
+	var ip net.IP
+	if addr, ok := tcp.client.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	// forwarded to the fallback server by decoy stealth_auth_failures mode
+	consumed := append([]byte{5, nmethod}, methods...)
+
 	ver, err = tcp.clientR.ReadByte()
 	if err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "%s", err)
 		return false
 	}
 	if ver != 1 {
@@ -105,63 +266,105 @@ func (tcp *TCPConn) Auth(ctx context.Context) bool {
 		return false
 	}
 
-	len, err := tcp.clientR.ReadByte()
+	ulen, err := tcp.clientR.ReadByte()
 	if err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "Failed to read username length: %s.", err)
 		return false
 	}
-	if len == 0 {
-		l.Errorf("Unexpected username length %d.", len)
+	consumed = append(consumed, ver, ulen)
+	if ulen == 0 {
+		l.Errorf("Empty username.")
+		tcp.authFailed(ctx, ip, consumed, l)
 		return false
 	}
-	username := make([]byte, len)
+	username := make([]byte, ulen)
 	if _, err = io.ReadFull(tcp.clientR, username); err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "Failed to read username of %d bytes: %s.", ulen, err)
 		return false
 	}
+	consumed = append(consumed, username...)
 
-	len, err = tcp.clientR.ReadByte()
+	plen, err := tcp.clientR.ReadByte()
 	if err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "Failed to read password length: %s.", err)
 		return false
 	}
-	if len == 0 {
-		l.Errorf("Unexpected password length %d.", len)
+	consumed = append(consumed, plen)
+	if plen == 0 {
+		l.Errorf("Empty password.")
+		tcp.authFailed(ctx, ip, consumed, l)
 		return false
 	}
-	password := make([]byte, len)
+	password := make([]byte, plen)
 	if _, err = io.ReadFull(tcp.clientR, password); err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "Failed to read password of %d bytes: %s.", plen, err)
 		return false
 	}
+	consumed = append(consumed, password...)
 
-	var userFound bool
-	for _, user := range tcp.conf.Users {
-		usernameOk := subtle.ConstantTimeCompare(username, []byte(user.Username)) == 1
-		passwordOk := subtle.ConstantTimeCompare(password, []byte(user.Password)) == 1
-		if usernameOk && passwordOk {
-			userFound = true
-		}
+	var session bool
+	tcp.user, session = tcp.conf.authenticateFrom(ip, username, password, time.Now())
+	if session {
+		l.Debugf("User %q authenticated by session.", tcp.user.Username)
+		tcp.srv.metrics.Inc("auth_session_hits_total")
 	}
 
-	b = []byte{1, 0}
-	if !userFound {
-		b[1] = 1
+	switch {
+	case tcp.user == nil:
+		l.Errorf("Username or password is invalid (was %q / %q).", string(username), string(password))
+		tcp.audit(AuditAuthFailure, string(username), "", "invalid username or password")
+	case !tcp.user.AllowedListener(tcp.listener):
+		l.Errorf("User %q is not allowed on listener %q.", tcp.user.Username, tcp.listener)
+		tcp.audit(AuditACLDeny, tcp.user.Username, "", "listener not allowed")
+		tcp.user = nil
+	case tcp.user.Expired(time.Now()):
+		l.Errorf("User %q account expired at %s.", tcp.user.Username, tcp.user.Expires.Format(time.RFC3339))
+		tcp.audit(AuditAuthFailure, tcp.user.Username, "", "account expired")
+		tcp.user = nil
 	}
-	if _, err = tcp.clientW.Write(b); err != nil {
+	if tcp.user == nil {
+		tcp.authFailed(ctx, ip, consumed, l)
+		return false
+	}
+	if _, err = tcp.clientW.Write([]byte{1, 0}); err != nil {
 		l.Error(err)
 		return false
 	}
-
-	if b[1] == 0 {
-		l.Info("Connection authenticated.")
-		return true
+	if ip != nil {
+		tcp.srv.authSuccesses.Add(ip, time.Now())
 	}
 
-	l.Errorf("Username or password is invalid (was %q / %q).", string(username), string(password))
-	return false
+	tcp.setUser(tcp.user)
+	l.Info("Connection authenticated.")
+	tcp.audit(AuditAuthSuccess, tcp.user.Username, "", "")
+	return true
+}
+
+// setUser sets authenticated user (so connection is not counted as pre-authentication anymore), adding user's fields and log level to the connection logger.
+func (tcp *TCPConn) setUser(u *User) {
+	tcp.leavePreAuth()
+	tcp.user = u
+	tcp.l = tcp.l.With(zap.String("user", u.Username))
+	if u.Label != "" {
+		tcp.l = tcp.l.With(zap.String("user_label", u.Label))
+	}
+	if u.LogLevel != "" {
+		var level zapcore.Level
+		level.UnmarshalText([]byte(u.LogLevel)) // validated in Config.Validate
+		tcp.l = withLevel(tcp.l, level)
+	}
+	if tcp.debug || tcp.srv.DebugUser(tcp.conf, u.Username) {
+		tcp.l = withLevel(tcp.l, zapcore.DebugLevel)
+	}
 }
 
+// Commands of SOCKS5 request.
+const (
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+)
+
 type req struct {
 	Ver  byte
 	Cmd  byte
@@ -174,6 +377,11 @@ type ipv4Addr struct {
 	Port uint16
 }
 
+type ipv6Addr struct {
+	Addr [16]byte
+	Port uint16
+}
+
 type res struct {
 	Ver  byte
 	Rep  byte
@@ -181,12 +389,104 @@ type res struct {
 	Atyp byte
 }
 
+// Reasons of failed requests.
+const (
+	failCommand              = "command"
+	failAddressType          = "address_type"
+	failResolve              = "resolve"
+	failConnect              = "connect"
+	failNetworkUnreachable   = "network_unreachable"
+	failHostUnreachable      = "host_unreachable"
+	failConnectRefused       = "connect_refused"
+	failConnectTimeout       = "connect_timeout"
+	failBindTimeout          = "bind_timeout"
+	failQuota                = "quota"
+	failMaxConnections       = "max_connections"
+	failDistinctDestinations = "distinct_destinations"
+	failEarlyData            = "early_data"
+	failMemoryPressure       = "memory_pressure"
+	failDestinationLimit     = "destination_limit"
+	failDestinationType      = "destination_type"
+	failUDPAssociations      = "udp_associations"
+)
+
+// failReplies maps reasons of failed requests to SOCKS5 reply codes.
+// Policy denials are reported as "connection not allowed by ruleset".
+var failReplies = map[string]byte{
+	failCommand:              7, // command not supported
+	failAddressType:          8, // address type not supported
+	failResolve:              4, // host unreachable
+	failConnect:              1, // general SOCKS server failure
+	failNetworkUnreachable:   3,
+	failHostUnreachable:      4,
+	failConnectRefused:       5,
+	failConnectTimeout:       6, // TTL expired is the closest one
+	failBindTimeout:          6,
+	failQuota:                2,
+	failMaxConnections:       2,
+	failDistinctDestinations: 2,
+	failEarlyData:            2,
+	failMemoryPressure:       1,
+	failDestinationLimit:     2,
+	failDestinationType:      2,
+	failUDPAssociations:      2,
+}
+
+// writeReply sends complete reply with given code and bound address, encoded according to its family
+// regardless of the request's address type; IPv4-mapped IPv6 addresses (of dual-stack sockets) are sent as IPv4.
+// Nil address is sent as zero IPv4 address and port.
+func (tcp *TCPConn) writeReply(rep byte, bnd *net.TCPAddr) error {
+	res := &res{
+		Ver: 5,
+		Rep: rep,
+	}
+	var ip net.IP
+	var port int
+	if bnd != nil {
+		ip, port = bnd.IP, bnd.Port
+	}
+
+	var bndAddr interface{}
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		res.Atyp = 1
+		var ipv4AddrRes ipv4Addr
+		copy(ipv4AddrRes.Addr[:], ip4)
+		ipv4AddrRes.Port = uint16(port)
+		bndAddr = &ipv4AddrRes
+	} else {
+		res.Atyp = 4
+		var ipv6AddrRes ipv6Addr
+		copy(ipv6AddrRes.Addr[:], ip.To16())
+		ipv6AddrRes.Port = uint16(port)
+		bndAddr = &ipv6AddrRes
+	}
+
+	// single write, so the reply is never truncated
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, res)
+	binary.Write(&buf, binary.BigEndian, bndAddr)
+	_, err := tcp.clientW.Write(buf.Bytes())
+	return err
+}
+
+// replyFailure sends failure reply with zero bound address for given reason.
+func (tcp *TCPConn) replyFailure(reason string, l *zap.SugaredLogger) {
+	if end := failEndReasons[reason]; end != "" {
+		tcp.end(end)
+	}
+	if err := tcp.writeReply(failReplies[reason], nil); err != nil {
+		l.Error(err)
+	}
+	tcp.srv.metrics.Inc("request_failures_total", "reason", reason)
+}
+
 func (tcp *TCPConn) Req(ctx context.Context) bool {
-	l := tcp.l.With(zap.String("step", "req"))
+	tcp.step = "req"
+	l := tcp.l.With(zap.String("step", tcp.step))
 
 	var req req
 	if err := binary.Read(tcp.clientR, binary.BigEndian, &req); err != nil {
-		l.Error(err)
+		tcp.logReadError(l, "%s", err)
 		return false
 
 	}
@@ -194,70 +494,781 @@ func (tcp *TCPConn) Req(ctx context.Context) bool {
 		l.Errorf("Unexpected request version %d.", req.Ver)
 		return false
 	}
-	if req.Cmd != 1 {
+	switch {
+	case req.Cmd == cmdConnect:
+	case req.Cmd == cmdBind && tcp.conf.Bind.Enabled:
+	case req.Cmd == cmdUDPAssociate && tcp.conf.UDPAssociate.Enabled:
+	default:
 		l.Errorf("Unexpected command %d.", req.Cmd)
+		tcp.replyFailure(failCommand, l)
 		return false
 	}
 	if req.Rsv != 0 {
 		l.Errorf("Unexpected reserved byte %d.", req.Rsv)
 		return false
 	}
-	if req.Atyp != 1 {
+	var raddr *net.TCPAddr
+	var host string
+	switch req.Atyp {
+	case 1:
+		var ipv4AddrReq ipv4Addr
+		if err := binary.Read(tcp.clientR, binary.BigEndian, &ipv4AddrReq); err != nil {
+			tcp.logReadError(l, "%s", err)
+			return false
+		}
+		raddr = &net.TCPAddr{
+			IP:   ipv4AddrReq.Addr[:],
+			Port: int(ipv4AddrReq.Port),
+		}
+		host = raddr.IP.String()
+
+	case 4:
+		var ipv6AddrReq ipv6Addr
+		if err := binary.Read(tcp.clientR, binary.BigEndian, &ipv6AddrReq); err != nil {
+			tcp.logReadError(l, "%s", err)
+			return false
+		}
+		raddr = &net.TCPAddr{
+			IP:   ipv6AddrReq.Addr[:],
+			Port: int(ipv6AddrReq.Port),
+		}
+		host = raddr.IP.String()
+
+	case 3:
+		var err error
+		if host, raddr, err = tcp.readDomain(); err != nil {
+			tcp.logReadError(l, "%s", err)
+			return false
+		}
+
+	default:
 		l.Errorf("Unexpected atyp byte %d.", req.Atyp)
+		tcp.replyFailure(failAddressType, l)
 		return false
 	}
 
-	var ipv4AddrReq ipv4Addr
-	if err := binary.Read(tcp.clientR, binary.BigEndian, &ipv4AddrReq); err != nil {
-		l.Error(err)
+	// the address is the one the client is going to send datagrams from, not a destination
+	if req.Cmd == cmdUDPAssociate {
+		return tcp.udpAssociate(raddr, l)
+	}
+
+	if !tcp.destinationTypeAllowed(host, raddr) {
+		l.Warnf("Connection to %s refused: destination_type is %s.", host, tcp.conf.DestinationType)
+		tcp.replyFailure(failDestinationType, l)
 		return false
+	}
 
+	// domain names are resolved locally
+	if raddr.IP == nil {
+		ip, addrs, err := tcp.resolve(ctx, host)
+		if len(addrs) > 1 {
+			// helps to diagnose unreachable or wrongly chosen addresses
+			l.Debugf("%s resolved to %d addresses: %s; using %s.", host, len(addrs), formatIPAddrs(addrs), ip)
+		}
+		if err != nil {
+			if de, ok := err.(*net.DNSError); ok && !de.IsNotFound {
+				l.Errorf("DNS failure for %s: %s.", host, err)
+				tcp.srv.metrics.Inc("dns_failures_total")
+			} else {
+				l.Errorf("Failed to resolve %s: %s.", host, err)
+			}
+			tcp.replyFailure(failResolve, l)
+			return false
+		}
+		raddr.IP = ip
 	}
 
-	res := &res{
-		Ver:  5,
-		Atyp: 1,
+	// the address is the peer expected to connect, not a destination
+	if req.Cmd == cmdBind {
+		return tcp.bind(ctx, raddr, l)
 	}
-	raddr := &net.TCPAddr{
-		IP:   ipv4AddrReq.Addr[:],
-		Port: int(ipv4AddrReq.Port),
+
+	tcp.policy = tcp.conf.Policy(tcp.user, host, raddr.IP)
+	tcp.target = net.JoinHostPort(host, strconv.Itoa(raddr.Port))
+	if tcp.srv.captureMatch(tcp.conf, tcp.user.Username, host, raddr.IP) {
+		tcp.capture = tcp.target
 	}
-	l.Infof("Connecting to %s ...", raddr)
-	server, err := net.DialTCP("tcp4", nil, raddr)
-	if err != nil {
-		l.Error(err)
-		res.Rep = 1 // TODO return better error?
-		binary.Write(tcp.clientW, binary.BigEndian, res)
+	l.Debugf(
+		"Effective policy for %s: connect_timeout=%s, connect_retries=%d, idle_timeout=%s, max_connection_age=%s, "+
+			"outbound_port_range=%s, override=%q.",
+		raddr, tcp.policy.ConnectTimeout, tcp.policy.ConnectRetries, tcp.policy.IdleTimeout, tcp.policy.MaxConnectionAge,
+		tcp.policy.OutboundPortRange, tcp.policy.Override,
+	)
+
+	if !tcp.admit(raddr.String(), host, l) {
 		return false
 	}
 
-	if err = binary.Write(tcp.clientW, binary.BigEndian, res); err != nil {
-		l.Error(err)
+	if d := tcp.conf.DistinctDestinations; d.Limit > 0 && !tcp.checkDistinct(d, host, l) {
+		tcp.replyFailure(failDistinctDestinations, l)
 		return false
 	}
 
-	tcp.server = server
-	laddr := server.LocalAddr().(*net.TCPAddr)
-	var ipv4AddrRes ipv4Addr
-	copy(ipv4AddrRes.Addr[:], laddr.IP.To4())
-	ipv4AddrRes.Port = uint16(laddr.Port)
+	if d := tcp.conf.DestinationLimit; d.enabled() && !isEcho(tcp.conf, host, raddr) {
+		ip := raddr.IP.String()
+		if !tcp.srv.destConns.Acquire(ctx, ip, tcp.user.Username, d) {
+			l.Warnf(
+				"Connection to %s refused: destination connections limit reached (max_connections=%d, max_per_user=%d).",
+				raddr, d.MaxConnections, d.MaxPerUser,
+			)
+			tcp.srv.metrics.Inc("destination_limit_refused_total")
+			tcp.replyFailure(failDestinationLimit, l)
+			return false
+		}
+		tcp.destIP = ip
+	}
+
+	// route is resolved with configuration snapshot, so reload doesn't affect it
+	upstreams, reason := tcp.conf.routeUpstreams(tcp.user, host, raddr.IP)
+	l.Infof("Route for %s (%s): %d upstreams, %s.", host, raddr, len(upstreams), reason)
+
+	var server net.Conn
+	var path string
+	var err error
+	dialCtx, stopWatch := tcp.watchClient(ctx)
+	switch {
+	case isEcho(tcp.conf, host, raddr):
+		l.Infof("Connecting to built-in echo destination %s ...", raddr)
+		server, path = newEcho(l), relayPathEcho
+	case len(upstreams) > 0:
+		l.Infof("Connecting to %s via upstream %q ...", raddr, upstreams[0].Name)
+		server, path, err = tcp.dial(dialCtx, raddr, upstreams, l)
+	default:
+		l.Infof("Connecting to %s ...", raddr)
+		server, path, err = tcp.dialPooled(dialCtx, host, raddr, l)
+	}
+	if stopWatch() {
+		// there is no one to reply to
+		if server != nil {
+			server.Close()
+		}
+		l.Infof("Client disconnected while connecting to %s, connection attempt is aborted.", raddr)
+		tcp.srv.metrics.Inc("dials_abandoned_total")
+		tcp.end(endClientAbandoned)
+		return false
+	}
+	if err != nil {
+		if err == errOutboundPortsExhausted {
+			l.Errorf("Outbound port range %s exhausted.", tcp.policy.OutboundPortRange)
+			tcp.srv.metrics.Inc("outbound_ports_exhausted_total")
+		} else {
+			l.Error(err)
+		}
+		tcp.replyFailure(dialFailure(err), l)
+		return false
+	}
+
+	// pipelining clients send greeting, credentials, request and payload without waiting for our replies;
+	// Sniff only peeks, handshake steps read exactly their fields from clientR, and bytes left buffered
+	// past the request are relayed by Run before anything else
+	if n := tcp.clientR.Buffered(); n > 0 {
+		if tcp.conf.EarlyData == EarlyDataReject {
+			l.Warnf("Client sent %d bytes before reply, rejecting.", n)
+			server.Close()
+			tcp.replyFailure(failEarlyData, l)
+			return false
+		}
+		l.Debugf("Client sent %d bytes before reply, relaying.", n)
+	}
 
-	if err := binary.Write(tcp.clientW, binary.BigEndian, &ipv4AddrRes); err != nil {
+	// relay path and outbound connection ID are logged with all following messages of this connection,
+	// so both legs of the relay can be correlated
+	fields := []interface{}{zap.String("relay_path", path)}
+	if path != relayPathEcho {
+		fields = append(fields, zap.Uint64("upstream_conn_id", atomic.AddUint64(&tcp.srv.lastUpstreamConnID, 1)))
+	}
+	tcp.l = tcp.l.With(fields...)
+	l = l.With(fields...)
+
+	if t := tcp.conf.TCPUserTimeout; t > 0 {
+		if err := setUserTimeout(server, t); err != nil {
+			l.Warnf("Failed to set TCP user timeout: %s.", err)
+		}
+	}
+
+	tcp.server = server
+	// bound address of non-TCP connections (e.g. wrapped by upstreams) is sent as zero
+	laddr, _ := server.LocalAddr().(*net.TCPAddr)
+	tcp.chaosReplyDelay()
+	if err = tcp.writeReply(0, laddr); err != nil {
 		l.Error(err)
 		return false
 	}
 
+	if tcp.conf.TopDestinations > 0 {
+		tcp.srv.destinations.Add(host)
+	}
+
 	l.Infof("Connection %s->%s is established.", laddr, raddr)
 	return true
 }
 
+// admit checks memory pressure, user's quota and connections limit before connecting to dst (host for audit).
+// It returns false if request is refused; failure reply is already sent in that case.
+func (tcp *TCPConn) admit(dst, host string, l *zap.SugaredLogger) bool {
+	if tcp.srv.MemoryPressure() {
+		l.Warnf("Connection to %s refused: memory usage is above soft limit.", dst)
+		tcp.srv.metrics.Inc("memory_pressure_refused_total")
+		tcp.replyFailure(failMemoryPressure, l)
+		return false
+	}
+
+	if q := tcp.user.MonthlyQuota; q > 0 && tcp.srv.accounting.Used(tcp.user.Username, time.Now()) >= int64(q) {
+		l.Warnf("Connection to %s refused: monthly quota %s is used.", dst, q)
+		tcp.audit(AuditOverQuota, tcp.user.Username, host, "monthly quota is used")
+		tcp.replyFailure(failQuota, l)
+		return false
+	}
+
+	if !tcp.srv.acquireUserConn(tcp.user.Username, tcp.user.MaxConnections) {
+		l.Warnf("Connection to %s refused: connections limit %d reached.", dst, tcp.user.MaxConnections)
+		tcp.replyFailure(failMaxConnections, l)
+		return false
+	}
+	tcp.userConn = true
+	return true
+}
+
+// checkDistinct records destination host for the distinct destinations limit.
+// It returns false if connection should be refused.
+func (tcp *TCPConn) checkDistinct(d DistinctDestinations, host string, l *zap.SugaredLogger) bool {
+	exceeded, first := tcp.srv.distinct.Add(tcp.user.Username, host, d.Limit, d.Window, time.Now())
+	if !exceeded {
+		return true
+	}
+
+	if first {
+		l.Warnf("User connected to more than %d distinct destinations within %s.", d.Limit, d.Window)
+		tcp.srv.metrics.Inc("distinct_destinations_exceeded_total", tcp.conf.userLabels(tcp.user.Username)...)
+	}
+	if d.Reject {
+		l.Infof("Connection to %s refused: distinct destinations limit exceeded.", host)
+		tcp.audit(AuditACLDeny, tcp.user.Username, host, "distinct destinations limit exceeded")
+		return false
+	}
+	return true
+}
+
+// destinationTypeAllowed returns true if requested destination matches destination_type setting.
+// IP addresses sent as domain names are treated as IP addresses; echo destination is always allowed.
+func (tcp *TCPConn) destinationTypeAllowed(host string, raddr *net.TCPAddr) bool {
+	if isEcho(tcp.conf, host, raddr) {
+		return true
+	}
+	isIP := net.ParseIP(host) != nil
+	switch tcp.conf.DestinationType {
+	case DestinationTypeHostname:
+		return !isIP
+	case DestinationTypeIP:
+		return isIP
+	default:
+		return true
+	}
+}
+
+// readDomain reads domain name and port of the request.
+// Returned address has no IP unless domain is configured echo host.
+func (tcp *TCPConn) readDomain() (string, *net.TCPAddr, error) {
+	n, err := tcp.clientR.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, int(n)+2)
+	if _, err = io.ReadFull(tcp.clientR, b); err != nil {
+		return "", nil, err
+	}
+
+	host := string(b[:n])
+	raddr := &net.TCPAddr{
+		Port: int(binary.BigEndian.Uint16(b[n:])),
+	}
+	if isEcho(tcp.conf, host, raddr) {
+		raddr.IP = echoAddr.IP
+	}
+	return host, raddr, nil
+}
+
+// defaultDNSTimeout is used if dns_timeout is not set.
+const defaultDNSTimeout = 5 * time.Second
+
+// resolve returns the first IPv4 address of host (or the first IPv6 address if there are none)
+// and all resolved addresses.
+// Lookup uses user's resolver and is limited by dns_timeout, so unavailable resolver fails fast.
+func (tcp *TCPConn) resolve(ctx context.Context, host string) (net.IP, []net.IPAddr, error) {
+	timeout := tcp.conf.DNSTimeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addrs, err := tcp.conf.resolver(tcp.user).LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip, addrs, nil
+		}
+	}
+	for _, a := range addrs {
+		if ip := a.IP.To16(); ip != nil {
+			return ip, addrs, nil
+		}
+	}
+	return nil, addrs, fmt.Errorf("no IP address for %s", host)
+}
+
+// formatIPAddrs returns comma-separated list of addresses.
+func formatIPAddrs(addrs []net.IPAddr) string {
+	s := make([]string, len(addrs))
+	for i, a := range addrs {
+		s[i] = a.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Relay paths of established connections, logged as "relay_path" field.
+const (
+	relayPathDirect   = "direct"
+	relayPathPooled   = "direct pooled"
+	relayPathEcho     = "echo"
+	relayPathBind     = "bind"      // inbound connection accepted for BIND command
+	relayPathUpstream = "upstream " // followed by upstream address
+)
+
+// dial connects to the destination according to the connection policy directly or via given upstreams.
+// It returns the relay path taken.
+func (tcp *TCPConn) dial(ctx context.Context, raddr *net.TCPAddr, upstreams []Upstream, l *zap.SugaredLogger) (net.Conn, string, error) {
+	var c net.Conn
+	var path string
+	var err error
+	for attempt := 0; attempt <= tcp.policy.ConnectRetries; attempt++ {
+		if attempt > 0 {
+			l.Warnf("Connection attempt %d to %s failed: %s. Retrying...", attempt, raddr, err)
+		}
+
+		if len(upstreams) > 0 {
+			c, path, err = tcp.dialUpstreams(ctx, upstreams, raddr, l)
+		} else {
+			d := &net.Dialer{
+				Timeout: tcp.policy.ConnectTimeout,
+			}
+			path = relayPathDirect
+			c, err = tcp.dialDirect(ctx, d, raddr, l)
+		}
+		if err == nil {
+			return c, path, nil
+		}
+		if ctx.Err() != nil || err == errOutboundPortsExhausted {
+			break
+		}
+	}
+	return nil, "", err
+}
+
+// dialDirect connects to the destination directly. With port_affinity, it reuses local port
+// of the previous connection from the same client to the same destination, falling back to any port if it is in use.
+func (tcp *TCPConn) dialDirect(ctx context.Context, d *net.Dialer, raddr *net.TCPAddr, l *zap.SugaredLogger) (net.Conn, error) {
+	window := tcp.conf.PortAffinity
+	if window <= 0 {
+		return dialPortRange(ctx, d, "tcp", raddr.String(), tcp.policy.OutboundPortRange)
+	}
+
+	var key string
+	if addr, ok := tcp.client.RemoteAddr().(*net.TCPAddr); ok {
+		key = addr.IP.String() + " " + raddr.String()
+	}
+
+	var c net.Conn
+	var err error
+	if port := tcp.srv.affinity.Get(key, time.Now()); port != 0 {
+		pd := *d
+		pd.LocalAddr = &net.TCPAddr{Port: port}
+		if c, err = dialContext(ctx, &pd, "tcp", raddr.String()); err != nil && isAddrInUse(err) {
+			l.Debugf("Affinity port %d is in use, falling back to another one.", port)
+			c = nil
+		}
+	}
+	if c == nil && (err == nil || isAddrInUse(err)) {
+		c, err = dialPortRange(ctx, d, "tcp", raddr.String(), tcp.policy.OutboundPortRange)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		if laddr, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			tcp.srv.affinity.Set(key, laddr.Port, window, time.Now())
+		}
+	}
+	return c, nil
+}
+
+// dialUpstreams connects to the destination via the first available upstream in priority order.
+// Errors reported by upstream for the destination itself don't affect upstream's health.
+func (tcp *TCPConn) dialUpstreams(ctx context.Context, upstreams []Upstream, raddr *net.TCPAddr, l *zap.SugaredLogger) (net.Conn, string, error) {
+	h := tcp.srv.upstreams
+	maxFailures, cooldown := tcp.conf.upstreamHealthPolicy()
+	err := errNoHealthyUpstreams
+	for i := range upstreams {
+		u := &upstreams[i]
+		if !h.Available(u.Address, time.Now()) {
+			continue
+		}
+
+		var c net.Conn
+		c, err = dialUpstream(ctx, u, raddr, tcp.policy.ConnectTimeout, tcp.policy.OutboundPortRange)
+		if _, ok := err.(replyError); err == nil || ok {
+			if h.Succeeded(u.Address) {
+				l.Warnf("Upstream %s is healthy again.", u.Address)
+			}
+			return c, relayPathUpstream + u.Address, err
+		}
+		if ctx.Err() != nil || err == errOutboundPortsExhausted {
+			return nil, "", err
+		}
+
+		l.Warnf("Upstream %s failed: %s.", u.Address, err)
+		if h.Failed(u.Address, maxFailures, cooldown, time.Now()) {
+			l.Errorf("Upstream %s is unhealthy after %d consecutive failures, next try in %s.", u.Address, maxFailures, cooldown)
+		}
+	}
+	return nil, "", err
+}
+
+// idleSlackDivisor defines how far idle deadlines are extended beyond idle timeout: by 1/8 of it.
+// Deadlines are refreshed only when less than idle timeout remains, so a busy connection makes
+// at most one refresh per slack period instead of one per read, and an idle connection is closed
+// after idle timeout plus at most the slack.
+const idleSlackDivisor = 8
+
+// idleReader extends both connection read deadlines on reads, so relay in any direction
+// keeps the whole connection alive.
+type idleReader struct {
+	r   io.Reader
+	tcp *TCPConn
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	ir.tcp.touch(time.Now())
+	return ir.r.Read(p)
+}
+
+// touch extends idle read deadlines of both client and server connections, if needed.
+// Write deadlines are left for write_timeout.
+func (tcp *TCPConn) touch(now time.Time) {
+	idle := tcp.policy.IdleTimeout
+	current := atomic.LoadInt64(&tcp.idleDeadline)
+	if current-now.UnixNano() >= int64(idle) {
+		return
+	}
+
+	deadline := now.Add(idle + idle/idleSlackDivisor)
+	if !atomic.CompareAndSwapInt64(&tcp.idleDeadline, current, deadline.UnixNano()) {
+		return // extended by the other direction
+	}
+	tcp.client.SetReadDeadline(deadline)
+	tcp.server.SetReadDeadline(deadline)
+}
+
+// deadlineWriter limits duration of every write, so a peer that stopped reading is disconnected.
+type deadlineWriter struct {
+	c    net.Conn
+	peer string
+	tcp  *TCPConn
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	dw.c.SetWriteDeadline(time.Now().Add(dw.tcp.conf.WriteTimeout))
+	n, err := dw.c.Write(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && dw.tcp.stop(CloseWriteTimeout) {
+		dw.tcp.l.Infof("Write timeout %s exceeded, %s is not reading.", dw.tcp.conf.WriteTimeout, dw.peer)
+		dw.tcp.srv.metrics.Inc("write_timeouts_total", "peer", dw.peer)
+	}
+	return n, err
+}
+
+// relayWriter reports written bytes for traffic accounting, connection stats and slow connection detection.
+type relayWriter struct {
+	w       io.Writer
+	tcp     *TCPConn
+	relayed *int64 // connection's counter for this direction
+}
+
+func (rw *relayWriter) Write(p []byte) (int, error) {
+	if rw.tcp.limiter != nil {
+		return rateLimitedWrite(rw.write, p, rw.tcp.limiter, float64(rw.tcp.user.RateLimit))
+	}
+	return rw.write(p)
+}
+
+func (rw *relayWriter) write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	now := time.Now()
+	atomic.StoreInt64(&rw.tcp.lastActive, now.UnixNano())
+	atomic.AddInt64(rw.relayed, int64(n))
+	rw.tcp.countTraffic(n)
+	if rw.tcp.slow != nil && rw.tcp.slow.Add(n, now) {
+		rw.tcp.slowDetected()
+	}
+	return n, err
+}
+
+// slowDetected handles connection staying below throughput floor.
+func (tcp *TCPConn) slowDetected() {
+	tcp.l.Warnf(
+		"Slow connection to %s: below %s/s for %s.",
+		tcp.server.RemoteAddr(), tcp.conf.SlowConnectionThroughput, tcp.conf.SlowConnectionDuration,
+	)
+	tcp.srv.metrics.Inc("slow_connections_total")
+
+	if tcp.conf.SlowConnectionAction == SlowConnectionClose && tcp.stop(CloseSlowConnection) {
+		tcp.l.Infof("Slow connection closed.")
+	}
+}
+
+// stop closes both connections on purpose, so following relay errors are not logged.
+// Depending on abortive_close setting, connections are reset instead of being closed gracefully.
+// It returns false if connection was already stopped.
+func (tcp *TCPConn) stop(reason string) bool {
+	if !atomic.CompareAndSwapInt32(&tcp.stopped, 0, 1) {
+		return false
+	}
+
+	tcp.end(closeEndReasons[reason])
+	tcp.setAbortive(reason)
+	tcp.clientW.Close()
+	tcp.server.Close()
+	return true
+}
+
+// setAbortive makes connections reset (SO_LINGER 0) on close if abortive_close setting includes given reason,
+// or if they are reset by chaos testing.
+func (tcp *TCPConn) setAbortive(reason string) {
+	if reason != CloseChaosReset && !tcp.conf.abortiveClose(reason) {
+		return
+	}
+
+	atomic.StoreInt32(&tcp.abortive, 1)
+	for _, c := range []net.Conn{tcp.client, tcp.server} {
+		if lc, ok := c.(interface{ SetLinger(int) error }); ok {
+			lc.SetLinger(0)
+		}
+	}
+}
+
+// countTraffic adds relayed bytes to user's traffic, reporting crossed quota thresholds.
+func (tcp *TCPConn) countTraffic(n int) {
+	quota := tcp.user.MonthlyQuota
+	fired := tcp.srv.accounting.Add(tcp.user.Username, int64(n), int64(quota), tcp.conf.Quota.thresholds(), time.Now())
+	if len(fired) == 0 {
+		return
+	}
+
+	used := ByteSize(tcp.srv.accounting.Used(tcp.user.Username, time.Now()))
+	for _, t := range fired {
+		tcp.l.Warnf("Quota threshold %d%% reached: %s of monthly quota %s used.", t, used, quota)
+		labels := append(tcp.conf.userLabels(tcp.user.Username), "threshold", strconv.Itoa(t))
+		tcp.srv.metrics.Inc("quota_threshold_events_total", labels...)
+	}
+
+	// persist reported thresholds immediately, so they are not reported again after restart
+	if err := tcp.srv.saveAccounting(); err != nil {
+		tcp.l.Errorf("%s.", err)
+	}
+}
+
+// Run relays data in both directions until either side finishes.
+// Each direction reads into a single fixed buffer and blocks on write until the peer accepts data,
+// so a fast sender is throttled to the speed of a slow receiver (TCP backpressure) instead of growing memory;
+// a receiver that stopped reading completely is disconnected by write_timeout, if set.
 func (tcp *TCPConn) Run(ctx context.Context) {
+	tcp.step = "relay"
+	atomic.StoreInt64(&tcp.lastActive, time.Now().UnixNano())
+	tcp.srv.addRelay(tcp)
+	defer tcp.srv.removeRelay(tcp)
+
+	if age := tcp.policy.MaxConnectionAge; age > 0 {
+		t := time.AfterFunc(age, func() {
+			if tcp.stop(CloseMaxConnectionAge) {
+				tcp.l.Infof("Maximum connection age %s exceeded.", age)
+			}
+		})
+		defer t.Stop()
+	}
+
+	// relay is stopped on shutdown, so it doesn't wait for peers to finish
+	defer tcp.stopOnShutdown(ctx)()
+
+	if tcp.udp != nil {
+		tcp.relayUDP(ctx)
+		return
+	}
+
+	// clientR's small buffer is used only for handshake: bytes sent by the client before reply
+	// are drained from it, and then the client connection is read directly into the relay buffer.
+	// Handshake bytes are consumed from clientR before that, so only the pipelined ones are counted,
+	// once, and a connection closed during handshake has nothing relayed.
+	// Splice is not used either way, as relayed bytes pass through relayWriter for accounting.
+	clientR := io.MultiReader(io.LimitReader(tcp.clientR, int64(tcp.clientR.Buffered())), tcp.client)
+	var fromClient, fromServer io.Reader = clientR, tcp.server
+	var toServer, toClient io.Writer = tcp.server, tcp.clientW
+	if tcp.policy.IdleTimeout > 0 {
+		fromClient = &idleReader{r: fromClient, tcp: tcp}
+		fromServer = &idleReader{r: fromServer, tcp: tcp}
+	}
+	if t := tcp.conf.WriteTimeout; t > 0 {
+		toServer = &deadlineWriter{c: tcp.server, peer: "server", tcp: tcp}
+		toClient = &deadlineWriter{c: tcp.client, peer: "client", tcp: tcp}
+	}
+	if t := tcp.conf.SlowConnectionThroughput; t > 0 {
+		tcp.slow = newSlowMeter(t, tcp.conf.SlowConnectionDuration, time.Now())
+	}
+	if tcp.user.RateLimit > 0 {
+		tcp.limiter = tcp.srv.limiters.Get(tcp.user.Username)
+	}
+	var fromClientCapture, fromServerCapture *captureWriter
+	if tcp.capture != "" {
+		var err error
+		if fromClientCapture, fromServerCapture, err = tcp.openCapture(tcp.capture); err != nil {
+			tcp.l.Errorf("Failed to start capture: %s.", err)
+		} else {
+			// captured data is written after successful relaying, and capture errors are not returned
+			toServer = io.MultiWriter(toServer, fromClientCapture)
+			toClient = io.MultiWriter(toClient, fromServerCapture)
+			defer fromServerCapture.Close()
+		}
+	}
+	if fromClientTrace, fromServerTrace := tcp.traceWriters(); fromClientTrace != nil {
+		// like captured data, traced data is logged after successful relaying
+		toServer = io.MultiWriter(toServer, fromClientTrace)
+		toClient = io.MultiWriter(toClient, fromServerTrace)
+	}
+	toServer = &relayWriter{w: toServer, tcp: tcp, relayed: &tcp.fromClient}
+	toClient = &relayWriter{w: toClient, tcp: tcp, relayed: &tcp.fromServer}
+	fromClient, fromServer = tcp.chaosReaders(fromClient, fromServer)
+	fromClient = &pacedReader{r: fromClient, tcp: tcp}
+	fromServer = &pacedReader{r: fromServer, tcp: tcp}
+
+	budget := int64(tcp.conf.RelayMemoryBudget)
+	clientBuf := tcp.srv.buffers.Get(budget)
+	serverBuf := tcp.srv.buffers.Get(budget)
+	defer tcp.srv.buffers.Put(serverBuf)
+	if len(clientBuf) < relayBufferSize || len(serverBuf) < relayBufferSize {
+		tcp.l.Infof("Relay memory budget %s is nearly exhausted, using smaller buffers.", tcp.conf.RelayMemoryBudget)
+	}
+
+	clientDone := make(chan struct{})
 	go func() {
-		if _, err := io.Copy(tcp.server, tcp.clientR); err != nil {
-			tcp.l.Errorf("Failed to read from the client: %s.", err)
+		defer close(clientDone)
+		defer tcp.srv.buffers.Put(clientBuf)
+		if fromClientCapture != nil {
+			defer fromClientCapture.Close()
+		}
+
+		if _, err := io.CopyBuffer(toServer, fromClient, clientBuf); err != nil {
+			tcp.logRelayError("Failed to read from the client: %s.", err, endClientEOF)
+			return
+		}
+		tcp.end(endClientEOF)
+
+		// propagate client's EOF to the server
+		if cw, ok := tcp.server.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
-	if _, err := io.Copy(tcp.clientW, tcp.server); err != nil {
-		tcp.l.Errorf("Failed to read from the server: %s.", err)
+	if _, err := io.CopyBuffer(toClient, fromServer, serverBuf); err != nil {
+		tcp.logRelayError("Failed to read from the server: %s.", err, endServerEOF)
+	} else {
+		tcp.end(endServerEOF)
+	}
+
+	// the client direction (if still relaying, e.g. when the server closed its connection right after reply)
+	// is interrupted, so its following error is not a relay error, and it doesn't outlive the connection
+	atomic.StoreInt32(&tcp.stopped, 1)
+	tcp.clientW.Close()
+	<-clientDone
+}
+
+// stopOnShutdown stops the connection when ctx is canceled, until the returned function is called.
+// The returned function waits for the watching goroutine to exit.
+func (tcp *TCPConn) stopOnShutdown(ctx context.Context) (done func()) {
+	stopWatch := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			if tcp.stop(CloseShutdown) {
+				tcp.l.Infof("Connection closed on shutdown.")
+			}
+		case <-stopWatch:
+		}
+	}()
+	return func() {
+		close(stopWatch)
+		<-exited
+	}
+}
+
+// InterruptOnShutdown makes pending and following handshake reads from the client fail when ctx is canceled,
+// until the returned function is called, so connections that haven't started relaying don't delay shutdown.
+// The returned function waits for the watching goroutine to exit. Relay is stopped on shutdown by Run.
+func (tcp *TCPConn) InterruptOnShutdown(ctx context.Context) (done func()) {
+	stopWatch := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&tcp.interrupted, 1)
+			tcp.end(endShutdown)
+			tcp.client.SetReadDeadline(time.Unix(1, 0))
+		case <-stopWatch:
+		}
+	}()
+	return func() {
+		close(stopWatch)
+		<-exited
+
+		// a completed handshake is followed by relay, stopped on shutdown without read errors
+		if atomic.LoadInt32(&tcp.interrupted) == 1 {
+			tcp.client.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// logReadError logs error of reading handshake from the client, at debug level if it is interrupted on shutdown.
+func (tcp *TCPConn) logReadError(l *zap.SugaredLogger, format string, args ...interface{}) {
+	if atomic.LoadInt32(&tcp.interrupted) == 1 {
+		l.Debugf(format, args...)
+		return
+	}
+	l.Errorf(format, args...)
+}
+
+// logRelayError logs relay error, treating idle timeout and maximum age as a normal termination.
+// Errors caused by peers simply closing their connections (EOF, reset, broken pipe) or by closing connection
+// on our side (e.g. after the other direction is finished) are logged at debug level, and their class is added
+// to the close message. Errors are counted by class. Benign errors end the connection with eof reason.
+func (tcp *TCPConn) logRelayError(format string, err error, eof string) {
+	if atomic.LoadInt32(&tcp.stopped) == 1 {
+		return
+	}
+
+	class := classifyError(err)
+	tcp.srv.metrics.Inc("relay_errors_total", "class", class)
+	tcp.relayEnd.CompareAndSwap(nil, class)
+	switch {
+	case benignErrorClass(class):
+		tcp.end(eof)
+		tcp.l.Debugf(format, err)
+	case class == errClassTimeout && tcp.policy.IdleTimeout > 0:
+		tcp.end(endIdleTimeout)
+		tcp.l.Infof("Idle timeout %s exceeded.", tcp.policy.IdleTimeout)
+	default:
+		tcp.end(endRelayError)
+		tcp.l.Errorf(format, err)
 	}
 }
@@ -0,0 +1,1664 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// replyRecorder records bytes written to the client.
+type replyRecorder struct {
+	bytes.Buffer
+}
+
+func (r *replyRecorder) Close() error { return nil }
+
+// testTCPConn returns connection with replies to the client recorded.
+func testTCPConn(t *testing.T) (*TCPConn, *replyRecorder) {
+	t.Helper()
+
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c2.Close() })
+	tcp := NewTCPConn(c1, ListenerDefault, zap.NewNop().Sugar(), NewServer(conf))
+	r := new(replyRecorder)
+	tcp.clientW = r
+	t.Cleanup(tcp.Close)
+	return tcp, r
+}
+
+func TestWriteReply(t *testing.T) {
+	for name, tc := range map[string]struct {
+		rep      byte
+		bnd      *net.TCPAddr
+		expected []byte
+	}{
+		"IPv4": {
+			bnd:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080},
+			expected: []byte{5, 0, 0, 1, 192, 0, 2, 1, 0x04, 0x38},
+		},
+		"IPv4Mapped": {
+			bnd:      &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443},
+			expected: []byte{5, 0, 0, 1, 192, 0, 2, 1, 0x01, 0xbb},
+		},
+		"IPv6": {
+			bnd: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			expected: []byte{
+				5, 0, 0, 4,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0x01, 0xbb,
+			},
+		},
+		"Nil": {
+			expected: []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		"Failure": {
+			rep:      5,
+			bnd:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+			expected: []byte{5, 5, 0, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tcp, r := testTCPConn(t)
+			if err := tcp.writeReply(tc.rep, tc.bnd); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(r.Bytes(), tc.expected) {
+				t.Errorf("expected % x, got % x", tc.expected, r.Bytes())
+			}
+		})
+	}
+}
+
+func TestReplyFailure(t *testing.T) {
+	for reason, rep := range failReplies {
+		t.Run(reason, func(t *testing.T) {
+			tcp, r := testTCPConn(t)
+			tcp.replyFailure(reason, zap.NewNop().Sugar())
+
+			// complete reply with zero bound address
+			expected := []byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0}
+			if !bytes.Equal(r.Bytes(), expected) {
+				t.Errorf("expected % x, got % x", expected, r.Bytes())
+			}
+		})
+	}
+}
+
+func TestConnectReply(t *testing.T) {
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	_, addr := testServer(t, conf)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := ln.Addr().(*net.TCPAddr)
+
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dst)
+	defer c.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// bound address is the one the server connected from
+	local := server.RemoteAddr().(*net.TCPAddr)
+	expected := []byte{5, 0, 0, 1, 127, 0, 0, 1, byte(local.Port >> 8), byte(local.Port)}
+	if !bytes.Equal(res, expected) {
+		t.Errorf("expected % x, got % x", expected, res)
+	}
+
+	// nothing listens on the port now
+	ln.Close()
+	c, res = testRequest(t, addr, "user1", "pass1", cmdConnect, dst)
+	defer c.Close()
+	expected = []byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(res, expected) {
+		t.Errorf("expected % x, got % x", expected, res)
+	}
+}
+
+func TestFailRepliesTable(t *testing.T) {
+	// policy denials are "connection not allowed by ruleset"
+	expected := map[string]byte{
+		failQuota:                2,
+		failMaxConnections:       2,
+		failDistinctDestinations: 2,
+		failEarlyData:            2,
+		failDestinationLimit:     2,
+		failDestinationType:      2,
+		failUDPAssociations:      2,
+
+		failCommand:            7,
+		failAddressType:        8,
+		failResolve:            4,
+		failConnect:            1,
+		failNetworkUnreachable: 3,
+		failHostUnreachable:    4,
+		failConnectRefused:     5,
+		failConnectTimeout:     6,
+		failBindTimeout:        6,
+		failMemoryPressure:     1,
+	}
+	if len(failReplies) != len(expected) {
+		t.Errorf("expected %d reasons, got %d", len(expected), len(failReplies))
+	}
+	for reason, rep := range expected {
+		if actual, ok := failReplies[reason]; !ok || actual != rep {
+			t.Errorf("%s: expected %d, got %d (%t)", reason, rep, actual, ok)
+		}
+	}
+}
+
+func TestPolicyDenials(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		<-ctx.Done()
+		c.Close()
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	denied := []byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	for name, tc := range map[string]struct {
+		conf  func(conf *Config)
+		first *net.TCPAddr // connection kept open before the denied one, if not nil
+		srv   func(srv *Server)
+	}{
+		"Quota": {
+			conf: func(conf *Config) { conf.Users[0].MonthlyQuota = 1024 },
+			srv: func(srv *Server) {
+				srv.accounting.Add("user1", 2048, 1024, nil, time.Now())
+			},
+		},
+		"MaxConnections": {
+			conf:  func(conf *Config) { conf.Users[0].MaxConnections = 1 },
+			first: dstAddr,
+		},
+		"DistinctDestinations": {
+			conf: func(conf *Config) {
+				conf.DistinctDestinations = DistinctDestinations{Limit: 1, Window: time.Minute, Reject: true}
+			},
+			first: echoAddr, // distinct destinations are counted by host
+		},
+		"DestinationLimit": {
+			conf:  func(conf *Config) { conf.DestinationLimit = DestinationLimit{MaxPerUser: 1} },
+			first: dstAddr,
+		},
+		"DestinationType": {
+			conf: func(conf *Config) { conf.DestinationType = DestinationTypeHostname },
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			tc.conf(conf)
+			srv, addr := testServer(t, conf)
+			if tc.srv != nil {
+				tc.srv(srv)
+			}
+
+			if tc.first != nil {
+				c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, tc.first)
+				defer c.Close()
+				if res[1] != 0 {
+					t.Fatalf("first request failed: % x", res)
+				}
+			}
+
+			c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+			defer c.Close()
+			if !bytes.Equal(res, denied) {
+				t.Fatalf("expected % x, got % x", denied, res)
+			}
+
+			// connection is closed after the reply
+			if n, err := c.Read(make([]byte, 1)); err == nil {
+				t.Fatalf("expected connection to be closed, read %d bytes", n)
+			}
+		})
+	}
+}
+
+func TestDestinationType(t *testing.T) {
+	// the same port on IPv4 and IPv6 loopback
+	dst := testListen(t, func(ctx context.Context, c net.Conn) { c.Close() })
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	ln6, err := net.Listen("tcp6", net.JoinHostPort("::1", strconv.Itoa(dstAddr.Port)))
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %s", err)
+	}
+	defer ln6.Close()
+	go func() {
+		for {
+			c, err := ln6.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// destination address of the request with given ATYP
+	port := []byte{byte(dstAddr.Port >> 8), byte(dstAddr.Port)}
+	hostname := "named.example"
+	atyps := map[string][]byte{
+		"IPv4":   append([]byte{1, 127, 0, 0, 1}, port...),
+		"Domain": append(append([]byte{3, byte(len(hostname))}, hostname...), port...),
+		"IPv6":   append(append([]byte{4}, net.IPv6loopback...), port...),
+
+		// IP addresses sent as domain names are treated as IP addresses
+		"DomainIP": append(append([]byte{3, 9}, "127.0.0.1"...), port...),
+	}
+
+	for mode, allowed := range map[string]map[string]bool{
+		"":                      {"IPv4": true, "Domain": true, "IPv6": true, "DomainIP": true},
+		DestinationTypeAny:      {"IPv4": true, "Domain": true, "IPv6": true, "DomainIP": true},
+		DestinationTypeHostname: {"Domain": true},
+		DestinationTypeIP:       {"IPv4": true, "IPv6": true, "DomainIP": true},
+	} {
+		for atyp, req := range atyps {
+			mode, allowed, atyp, req := mode, allowed[atyp], atyp, req
+			t.Run(mode+"/"+atyp, func(t *testing.T) {
+				conf := &Config{
+					Users:           []User{{Username: "user1", Password: "pass1", Resolver: "named"}},
+					Resolvers:       []Resolver{{Name: "named", Address: testResolver(t, dstAddr.IP)}},
+					DestinationType: mode,
+				}
+				_, addr := testServer(t, conf)
+
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				b := append([]byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, cmdConnect, 0}, req...)
+				if _, err = c.Write(b); err != nil {
+					t.Fatal(err)
+				}
+
+				// authentication reply, VER and REP
+				res := make([]byte, 4+2)
+				if _, err = io.ReadFull(c, res); err != nil {
+					t.Fatal(err)
+				}
+				expected := byte(2)
+				if allowed {
+					expected = 0
+				}
+				if res[5] != expected {
+					t.Errorf("expected REP %d, got % x", expected, res)
+				}
+			})
+		}
+	}
+}
+
+// oneByteConn returns at most one byte per Read call.
+type oneByteConn struct {
+	net.Conn
+}
+
+func (c *oneByteConn) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.Conn.Read(p)
+}
+
+func TestHandshakeOneByteReads(t *testing.T) {
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	addr := testListen(t, func(ctx context.Context, c net.Conn) {
+		testHandle(ctx, &oneByteConn{Conn: c}, zap.NewNop().Sugar(), srv)
+	})
+
+	// the whole handshake is sent at once, and read by the server byte by byte
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+	defer c.Close()
+	expected := []byte{5, 0, 0, 1, 0, 0, 0, 1, 0, 7}
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("expected % x, got % x", expected, res)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected data %q", b)
+	}
+}
+
+func TestBufferedHandshakeBytes(t *testing.T) {
+	payload := make([]byte, 100)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	// reads payload and closes connection
+	received := make(chan []byte, 1)
+	sink := testListen(t, func(ctx context.Context, c net.Conn) {
+		b := make([]byte, len(payload))
+		n, _ := io.ReadFull(c, b)
+		received <- b[:n]
+		c.Close()
+	})
+	sinkAddr, _ := net.ResolveTCPAddr("tcp", sink)
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusedAddr := refused.Addr().(*net.TCPAddr)
+	refused.Close()
+
+	request := func(dst *net.TCPAddr) []byte {
+		b := []byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, cmdConnect, 0, 1}
+		b = append(b, dst.IP.To4()...)
+		return append(b, byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	for name, tc := range map[string]struct {
+		data       []byte
+		fromClient int64
+	}{
+		// closed in the middle of authentication
+		"Auth": {data: []byte{5, 1, 2, 1, 5, 'u', 's', 'e'}},
+
+		// pipelined payload is buffered, but the request fails
+		"Refused": {data: append(request(refusedAddr), payload...)},
+
+		// pipelined payload is buffered and relayed, then the server closes connection
+		"Relayed": {data: append(request(sinkAddr), payload...), fromClient: int64(len(payload))},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			conns := make(chan *TCPConn, 1)
+			addr := testListen(t, func(ctx context.Context, c net.Conn) {
+				tcp := NewTCPConn(c, ListenerDefault, zap.NewNop().Sugar(), srv)
+				if tcp.EnterPreAuth() && tcp.Sniff() && tcp.Auth(ctx) && tcp.Req(ctx) {
+					tcp.Run(ctx)
+				}
+				tcp.Close()
+				conns <- tcp
+			})
+
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.Write(tc.data); err != nil {
+				t.Fatal(err)
+			}
+			if name == "Auth" {
+				c.Close()
+			} else {
+				defer c.Close()
+			}
+
+			var tcp *TCPConn
+			select {
+			case tcp = <-conns:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+			fromClient, fromServer := atomic.LoadInt64(&tcp.fromClient), atomic.LoadInt64(&tcp.fromServer)
+			if fromClient != tc.fromClient || fromServer != 0 {
+				t.Errorf("expected %d bytes from client and 0 from server, got %d and %d", tc.fromClient, fromClient, fromServer)
+			}
+			if used := srv.accounting.Used("user1", time.Now()); used != tc.fromClient {
+				t.Errorf("expected %d bytes accounted, got %d", tc.fromClient, used)
+			}
+
+			// pipelined payload arrives unchanged
+			if tc.fromClient > 0 {
+				if b := <-received; !bytes.Equal(b, payload) {
+					t.Errorf("expected % x, got % x", payload, b)
+				}
+			}
+		})
+	}
+}
+
+func TestRunShutdown(t *testing.T) {
+	// echoes data and never closes connection itself
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	addr := testListen(t, func(testCtx context.Context, c net.Conn) {
+		defer close(done)
+		testHandle(ctx, c, zap.NewNop().Sugar(), srv)
+	})
+
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+
+	// both directions are relaying
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Active() != 1 || srv.buffers.Used() == 0 {
+		t.Fatalf("unexpected state: %d active connections, %d buffered bytes", srv.Active(), srv.buffers.Used())
+	}
+
+	cancel()
+	waitReturned(t, done)
+
+	// relay buffers are returned by both directions, and the client is disconnected
+	if used := srv.buffers.Used(); used != 0 {
+		t.Errorf("expected all relay buffers to be returned, %d bytes are used", used)
+	}
+	if srv.Active() != 0 {
+		t.Errorf("expected no active connections, got %d", srv.Active())
+	}
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected connection to be closed, read %d bytes", n)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	// fast upstream writes as much as it can
+	var written int64
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 32*1024)
+		for ctx.Err() == nil {
+			c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := c.Write(b)
+			atomic.AddInt64(&written, int64(n))
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				return
+			}
+		}
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	srv, addr := testServer(t, conf)
+
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	// client never reads
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+
+	// wait until socket buffers are full and the proxy stops reading the upstream
+	var last int64
+	stalled := time.Now()
+	for start := time.Now(); time.Since(stalled) < 500*time.Millisecond; time.Sleep(50 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("upstream is not throttled, %d bytes written", atomic.LoadInt64(&written))
+		}
+		if w := atomic.LoadInt64(&written); w != last {
+			last, stalled = w, time.Now()
+		}
+	}
+
+	// only socket buffers of both connections and a single relay buffer are filled
+	const limit = 64 << 20
+	if last == 0 || last > limit {
+		t.Errorf("expected upstream to write between 0 and %d bytes, wrote %d", limit, last)
+	}
+	if used := srv.buffers.Used(); used > 2*relayBufferSize {
+		t.Errorf("expected at most %d relay buffer bytes, got %d", 2*relayBufferSize, used)
+	}
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	if growth := int64(after.HeapAlloc) - int64(before.HeapAlloc); growth > 16<<20 {
+		t.Errorf("heap grew by %d bytes", growth)
+	}
+}
+
+// testBlackhole makes outbound dials wait for dialer's timeout or context cancellation, like dials
+// to a black-holed destination. Started dials and their errors are sent to the returned channels.
+// It should be called before servers are started, so they are stopped before dials are restored.
+func testBlackhole(t *testing.T) (<-chan string, <-chan error) {
+	t.Helper()
+
+	started := make(chan string, 10)
+	errs := make(chan error, 10)
+	orig := dialContext
+	t.Cleanup(func() { dialContext = orig })
+	dialContext = func(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+		started <- address
+		if d.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+			defer cancel()
+		}
+		<-ctx.Done()
+
+		err := &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+		if ctx.Err() == context.DeadlineExceeded {
+			err.Err = os.ErrDeadlineExceeded
+		}
+		errs <- err
+		return nil, err
+	}
+	return started, errs
+}
+
+func TestDialTimeout(t *testing.T) {
+	_, errs := testBlackhole(t)
+	conf := &Config{
+		Users:       []User{{Username: "user1", Password: "pass1"}},
+		DialTimeout: 100 * time.Millisecond,
+	}
+	_, addr := testServer(t, conf)
+
+	start := time.Now()
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+	defer c.Close()
+	elapsed := time.Since(start)
+
+	// TTL expired
+	expected := []byte{5, 6, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("expected % x, got % x", expected, res)
+	}
+	if elapsed < conf.DialTimeout || elapsed > 5*time.Second {
+		t.Errorf("expected reply after dial timeout %s, got it after %s", conf.DialTimeout, elapsed)
+	}
+	if err := <-errs; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("unexpected dial error %v", err)
+	}
+	if n, err := c.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected connection to be closed, read %d bytes", n)
+	}
+}
+
+func TestDialAbandoned(t *testing.T) {
+	started, errs := testBlackhole(t)
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	addr, conns := testConns(t, context.Background(), zap.NewNop().Sugar(), srv)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := []byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, cmdConnect, 0, 1, 192, 0, 2, 1, 0, 80}
+	if _, err = c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.ReadFull(c, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dial blocks for default dial timeout, but the client goes away
+	select {
+	case address := <-started:
+		if address != "192.0.2.1:80" {
+			t.Fatalf("unexpected address %s", address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial is not started")
+	}
+	start := time.Now()
+	c.Close()
+
+	select {
+	case err = <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected dial to be canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial is not canceled")
+	}
+	tcp := testNextConn(t, conns)
+	if elapsed := time.Since(start); elapsed > defaultDialTimeout/2 {
+		t.Errorf("connection closed after %s", elapsed)
+	}
+	if reason := tcp.closeReason(); reason != endClientAbandoned {
+		t.Errorf("expected %q, got %q", endClientAbandoned, reason)
+	}
+}
+
+// discardWriter discards written data, hiding io.ReaderFrom of ioutil.Discard like relay writers do.
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+// BenchmarkRelayClientReader compares relaying from the client through the small handshake buffer
+// with relaying from the client connection directly, as Run does.
+func BenchmarkRelayClientReader(b *testing.B) {
+	for name, reader := range map[string]func(c net.Conn) io.Reader{
+		"Bufio128": func(c net.Conn) io.Reader { return bufio.NewReaderSize(c, 128) },
+		"Direct": func(c net.Conn) io.Reader {
+			br := bufio.NewReaderSize(c, 128)
+			return io.MultiReader(io.LimitReader(br, int64(br.Buffered())), c)
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			chunk := make([]byte, relayBufferSize)
+			addr := testListen(b, func(ctx context.Context, c net.Conn) {
+				defer c.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.Write(chunk); err != nil {
+						return
+					}
+				}
+			})
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			// io.WriterTo is hidden like in Run, so reads are made into the relay buffer
+			n, err := io.CopyBuffer(discardWriter{}, struct{ io.Reader }{reader(c)}, make([]byte, relayBufferSize))
+			if err != nil || n != int64(b.N*len(chunk)) {
+				b.Fatalf("%d, %v", n, err)
+			}
+		})
+	}
+}
+
+// BenchmarkRelay measures relay throughput from the client to the destination.
+func BenchmarkRelay(b *testing.B) {
+	dst := testListen(b, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		io.Copy(ioutil.Discard, c)
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	_, addr := testServer(b, conf)
+
+	c, res := testRequest(b, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		b.Fatalf("request failed: % x", res)
+	}
+
+	chunk := make([]byte, relayBufferSize)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	// reads everything until EOF
+	received := make(chan []byte, 1)
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- b
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+	_, addr := testServer(t, conf)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// greeting, credentials, request and payload in a single segment
+	b := []byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, cmdConnect, 0, 1}
+	b = append(b, dstAddr.IP.To4()...)
+	b = append(b, byte(dstAddr.Port>>8), byte(dstAddr.Port))
+	b = append(b, "first"...)
+	if _, err = c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	res := make([]byte, 2+2+10)
+	if _, err = io.ReadFull(c, res); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res[:5], []byte{5, 2, 1, 0, 5}) || res[5] != 0 {
+		t.Fatalf("unexpected replies % x", res)
+	}
+
+	// payload sent after the reply follows pipelined one
+	if _, err = c.Write([]byte(" second")); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	select {
+	case b := <-received:
+		if string(b) != "first second" {
+			t.Fatalf("unexpected data %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestDistinctDestinationsAlert(t *testing.T) {
+	testBlackhole(t)
+	conf := &Config{
+		Users:                []User{{Username: "user1", Password: "pass1"}},
+		DialTimeout:          10 * time.Millisecond,
+		DistinctDestinations: DistinctDestinations{Limit: 2, Window: time.Minute},
+	}
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, conf, l)
+
+	// the third and fourth hosts exceed the limit; connections are not refused without reject
+	for i := 1; i <= 4; i++ {
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 80})
+		c.Close()
+		if res[1] != failReplies[failConnectTimeout] {
+			t.Fatalf("request %d: unexpected reply % x", i, res)
+		}
+	}
+
+	// the same host doesn't count again
+	c, _ := testRequest(t, addr, "user1", "pass1", cmdConnect, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80})
+	c.Close()
+
+	waitFor(t, func() bool { return srv.Active() == 0 })
+	if entries := log.Entries("User connected to more than 2 distinct destinations within 1m0s."); len(entries) != 1 {
+		t.Errorf("expected a single alert, got %v", entries)
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), "telesock_distinct_destinations_exceeded_total 1\n") {
+		t.Errorf("expected a single alert to be counted:\n%s", metrics.String())
+	}
+}
+
+func TestRelayPath(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	// plain upstream, tunnel upstream, and upstream that is down
+	users := []User{{Username: "upstream-user", Password: "upstream-password"}}
+	_, plain := testServer(t, &Config{Users: users})
+	tunnelConf := &Config{Users: users, Tunnel: Tunnel{PSK: testPSK}}
+	if err := tunnelConf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tunnelSrv := NewServer(tunnelConf)
+	tunnel := testListen(t, func(ctx context.Context, c net.Conn) {
+		tc, err := NewTunnelServer(c, testPSK)
+		if err != nil {
+			t.Error(err)
+			c.Close()
+			return
+		}
+		testHandle(ctx, tc, zap.NewNop().Sugar(), tunnelSrv)
+	})
+	down := testListen(t, func(ctx context.Context, c net.Conn) { c.Close() })
+
+	upstream := func(addr, psk string, priority int) Upstream {
+		return Upstream{Address: addr, Username: "upstream-user", Password: "upstream-password", PSK: psk, Priority: priority}
+	}
+	for name, tc := range map[string]struct {
+		conf func(conf *Config)
+		path string
+	}{
+		"Direct": {
+			path: relayPathDirect,
+		},
+		"Upstream": {
+			conf: func(conf *Config) { conf.Upstreams = []Upstream{upstream(plain, "", 0)} },
+			path: relayPathUpstream + plain,
+		},
+		"Failover": {
+			conf: func(conf *Config) { conf.Upstreams = []Upstream{upstream(down, "", 0), upstream(plain, "", 1)} },
+			path: relayPathUpstream + plain,
+		},
+		"Tunnel": {
+			conf: func(conf *Config) { conf.Upstreams = []Upstream{upstream(tunnel, testPSK, 0)} },
+			path: relayPathUpstream + tunnel,
+		},
+		"Bypass": {
+			conf: func(conf *Config) {
+				conf.Upstreams = []Upstream{upstream(plain, "", 0)}
+				conf.BypassUpstream = []string{"127.0.0.1"}
+			},
+			path: relayPathDirect,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			if tc.conf != nil {
+				tc.conf(conf)
+			}
+			l, log := testLogger(zapcore.InfoLevel)
+			srv, addr := testServerLog(t, conf, l)
+
+			c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+			if res[1] != 0 {
+				c.Close()
+				t.Fatalf("request failed: % x", res)
+			}
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, 4)
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(c, b); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+
+			// path actually taken is logged with all following messages, including the access log
+			waitFor(t, func() bool { return srv.Active() == 0 })
+			entries := log.Entries("Connection closed.")
+			if len(entries) != 1 || entries[0]["relay_path"] != tc.path {
+				t.Errorf("expected relay_path %q, got %v", tc.path, entries)
+			}
+		})
+	}
+}
+
+func TestUpstreamConnID(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	l, log := testLogger(zapcore.DebugLevel)
+	srv, addr := testServerLog(t, &Config{Users: []User{{Username: "user1", Password: "pass1"}}}, l)
+
+	// connections to the destination are interleaved; echo connection has no upstream
+	const n = 3
+	var conns []net.Conn
+	for _, dst := range []*net.TCPAddr{dstAddr, dstAddr, echoAddr, dstAddr} {
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dst)
+		defer c.Close()
+		if res[1] != 0 {
+			t.Fatalf("request failed: % x", res)
+		}
+		conns = append(conns, c)
+	}
+	for _, c := range conns {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+	}
+	waitFor(t, func() bool { return srv.Active() == 0 })
+
+	// each connection has a single upstream ID logged with all messages after connect,
+	// including the access log; IDs of different connections differ
+	upstreamIDs := make(map[float64]float64) // by conn_id
+	lines := make(map[float64]int)
+	for _, e := range log.Entries("") {
+		connID, ok := e["conn_id"].(float64)
+		if !ok {
+			continue
+		}
+		upstreamID, ok := e["upstream_conn_id"].(float64)
+		if !ok {
+			if e["msg"] == "Connection closed." && e["relay_path"] != relayPathEcho {
+				t.Errorf("no upstream_conn_id in %v", e)
+			}
+			continue
+		}
+		if prev, ok := upstreamIDs[connID]; ok && prev != upstreamID {
+			t.Errorf("conn_id %v: upstream_conn_id changed from %v to %v", connID, prev, upstreamID)
+		}
+		upstreamIDs[connID] = upstreamID
+		lines[connID]++
+	}
+	if len(upstreamIDs) != n {
+		t.Fatalf("expected %d connections with upstream_conn_id, got %v", n, upstreamIDs)
+	}
+	seen := make(map[float64]bool)
+	for connID, upstreamID := range upstreamIDs {
+		if lines[connID] < 2 {
+			t.Errorf("conn_id %v: expected several lines with upstream_conn_id, got %d", connID, lines[connID])
+		}
+		if seen[upstreamID] {
+			t.Errorf("conn_id %v: upstream_conn_id %v is not unique in %v", connID, upstreamID, upstreamIDs)
+		}
+		seen[upstreamID] = true
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// destination sends data as fast as possible until its connection is closed
+	dstClosed := make(chan struct{})
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer close(dstClosed)
+		defer c.Close()
+		b := make([]byte, relayBufferSize)
+		for {
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{
+		Users:        []User{{Username: "user1", Password: "pass1"}},
+		WriteTimeout: 200 * time.Millisecond,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, conns := testConns(t, ctx, zap.NewNop().Sugar(), srv)
+
+	// the client never reads
+	start := time.Now()
+	c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+
+	tcp := testNextConn(t, conns)
+	if elapsed := time.Since(start); elapsed < conf.WriteTimeout {
+		t.Errorf("connection closed after %s, before write timeout", elapsed)
+	}
+	if reason := tcp.closeReason(); reason != endWriteTimeout {
+		t.Errorf("expected %q, got %q", endWriteTimeout, reason)
+	}
+	select {
+	case <-dstClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("destination connection is not closed")
+	}
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), `telesock_write_timeouts_total{peer="client"} 1`+"\n") {
+		t.Errorf("expected write timeout to be counted:\n%s", metrics.String())
+	}
+
+	// buffered data is followed by EOF or reset, not by more data
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, c); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("client connection is not closed")
+	}
+}
+
+func TestResolveBroken(t *testing.T) {
+	// closed port, server that never replies, and server that replies with garbage
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	testDNS := func(reply []byte) string {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			b := make([]byte, 512)
+			for {
+				_, addr, err := pc.ReadFrom(b)
+				if err != nil {
+					return
+				}
+				if reply != nil {
+					pc.WriteTo(reply, addr)
+				}
+			}
+		}()
+		return pc.LocalAddr().String()
+	}
+
+	for name, address := range map[string]string{
+		"Refused": closed.LocalAddr().String(),
+		"Silent":  testDNS(nil),
+		"Garbage": testDNS([]byte("garbage")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{
+				Users:      []User{{Username: "user1", Password: "pass1", Resolver: "broken"}},
+				Resolvers:  []Resolver{{Name: "broken", Address: address}},
+				DNSTimeout: 200 * time.Millisecond,
+			}
+			srv, addr := testServer(t, conf)
+
+			start := time.Now()
+			c, res := testDomainRequest(t, addr, "user1", "pass1", "example.com", 80)
+			defer c.Close()
+
+			// the client gets host unreachable quickly, and the failure is counted
+			if res[1] != 4 {
+				t.Errorf("expected host unreachable reply, got % x", res)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("reply took %s", elapsed)
+			}
+			var metrics strings.Builder
+			srv.metrics.WriteText(&metrics)
+			if !strings.Contains(metrics.String(), "telesock_dns_failures_total 1\n") {
+				t.Errorf("expected DNS failure to be counted:\n%s", metrics.String())
+			}
+		})
+	}
+}
+
+func TestUserLogLevel(t *testing.T) {
+	conf := &Config{
+		Users: []User{
+			{Username: "debug-user", Password: "pass1", LogLevel: "debug"},
+			{Username: "user2", Password: "pass2"},
+			{Username: "quiet-user", Password: "pass3", LogLevel: "error"},
+		},
+	}
+	l, log := testLogger(zapcore.InfoLevel)
+	srv, addr := testServerLog(t, conf, l)
+
+	for _, u := range conf.Users {
+		c, res := testRequest(t, addr, u.Username, u.Password, cmdConnect, echoAddr)
+		c.Close()
+		if res[1] != 0 {
+			t.Fatalf("%s: request failed: % x", u.Username, res)
+		}
+	}
+	waitFor(t, func() bool { return srv.Active() == 0 })
+
+	levels := make(map[string]map[string]int) // user -> level -> count
+	for _, e := range log.Entries("") {
+		user, _ := e["user"].(string)
+		if levels[user] == nil {
+			levels[user] = make(map[string]int)
+		}
+		levels[user][e["level"].(string)]++
+	}
+	if levels["debug-user"]["debug"] == 0 || levels["debug-user"]["info"] == 0 {
+		t.Errorf("expected debug and info lines for debug-user, got %v", levels["debug-user"])
+	}
+	if levels["user2"]["debug"] != 0 || levels["user2"]["info"] == 0 {
+		t.Errorf("expected only info lines for user2, got %v", levels["user2"])
+	}
+	if len(levels["quiet-user"]) != 0 {
+		t.Errorf("expected no lines for quiet-user, got %v", levels["quiet-user"])
+	}
+	if levels[""]["debug"] != 0 {
+		t.Errorf("expected no debug lines before authentication, got %v", levels[""])
+	}
+}
+
+func TestAuthEmptyCredentials(t *testing.T) {
+	for name, tc := range map[string]struct {
+		credentials []byte
+		msg         string
+	}{
+		"Username": {[]byte{1, 0}, "Empty username."},
+		"Password": {[]byte{1, 5, 'u', 's', 'e', 'r', '1', 0}, "Empty password."},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, log := testLogger(zapcore.InfoLevel)
+			srv, addr := testServerLog(t, &Config{Users: []User{{Username: "user1", Password: "pass1"}}}, l)
+
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = c.Write(append([]byte{5, 1, 2}, tc.credentials...)); err != nil {
+				t.Fatal(err)
+			}
+
+			// method selection and authentication failure replies are followed by close
+			b, _ := ioutil.ReadAll(c)
+			if expected := []byte{5, 2, 1, 1}; !bytes.Equal(b, expected) {
+				t.Errorf("expected % x, got % x", expected, b)
+			}
+
+			waitFor(t, func() bool { return srv.Active() == 0 })
+			if entries := log.Entries(tc.msg); len(entries) != 1 || entries[0]["level"] != "error" {
+				t.Errorf("expected a single %q error, got %v", tc.msg, entries)
+			}
+		})
+	}
+}
+
+func TestReadDomainLengths(t *testing.T) {
+	for _, n := range []int{0, 1, 255} {
+		n := n
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			host := strings.Repeat("a", n)
+			b := append(append([]byte{byte(n)}, host...), 0x1f, 0x90)
+
+			// the next request byte is not consumed
+			tcp, _ := testTCPConn(t)
+			tcp.clientR = bufio.NewReader(bytes.NewReader(append(b, 0xff)))
+			actualHost, raddr, err := tcp.readDomain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actualHost != host || raddr.Port != 8080 || raddr.IP != nil {
+				t.Errorf("expected %q:8080 without IP, got %q %v", host, actualHost, raddr)
+			}
+			if next, err := tcp.clientR.ReadByte(); next != 0xff || err != nil {
+				t.Errorf("expected the next byte to be left, got %x %v", next, err)
+			}
+
+			// truncated name or port
+			for i := 1; i < len(b); i++ {
+				tcp, _ := testTCPConn(t)
+				tcp.clientR = bufio.NewReader(bytes.NewReader(b[:i]))
+				if _, _, err := tcp.readDomain(); err == nil {
+					t.Errorf("%d of %d bytes: expected error", i, len(b))
+				}
+			}
+		})
+	}
+}
+
+// see also TestAuthEmptyCredentials
+func TestAuthLengths(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	for name, tc := range map[string]struct {
+		username, password string
+	}{
+		"1/1":     {"u", "p"},
+		"1/255":   {"u", long},
+		"255/1":   {long, "p"},
+		"255/255": {long, long},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Users: []User{{Username: tc.username, Password: tc.password}}}
+			_, addr := testServer(t, conf)
+
+			// testRequest checks authentication reply, and the request after credentials is parsed
+			c, res := testRequest(t, addr, tc.username, tc.password, cmdConnect, echoAddr)
+			defer c.Close()
+			if res[1] != 0 {
+				t.Fatalf("request failed: % x", res)
+			}
+
+			// credentials one byte shorter fail
+			c2, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c2.Close()
+			c2.SetDeadline(time.Now().Add(5 * time.Second))
+			b := []byte{5, 1, 2, 1, byte(len(tc.username))}
+			b = append(b, tc.username...)
+			b = append(b, byte(len(tc.password)-1))
+			b = append(b, tc.password[1:]...)
+			if _, err = c2.Write(b); err != nil {
+				t.Fatal(err)
+			}
+			b, _ = ioutil.ReadAll(c2)
+			if expected := []byte{5, 2, 1, 1}; !bytes.Equal(b, expected) {
+				t.Errorf("expected % x, got % x", expected, b)
+			}
+		})
+	}
+}
+
+func TestPortAffinity(t *testing.T) {
+	// destination reports source ports and closes connections first, so ports are not left in TIME_WAIT
+	ports := make(chan int, 10)
+	release := make(chan struct{})
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		ports <- c.RemoteAddr().(*net.TCPAddr).Port
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{
+		Users:        []User{{Username: "user1", Password: "pass1"}},
+		PortAffinity: time.Minute,
+	}
+	srv, addr := testServer(t, conf)
+	connect := func() (net.Conn, int) {
+		t.Helper()
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+		if res[1] != 0 {
+			c.Close()
+			t.Fatalf("request failed: % x", res)
+		}
+		select {
+		case port := <-ports:
+			return c, port
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+			return nil, 0
+		}
+	}
+
+	// sequential connections reuse the source port
+	c, first := connect()
+	release <- struct{}{}
+	io.Copy(ioutil.Discard, c)
+	c.Close()
+	waitFor(t, func() bool { return srv.Active() == 0 })
+
+	// wait for the outbound socket to leave LAST_ACK state
+	waitFor(t, func() bool {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(first)))
+		if err != nil {
+			return false
+		}
+		ln.Close()
+		return true
+	})
+	c, second := connect()
+	defer c.Close()
+	if first != second {
+		t.Errorf("expected source port %d to be reused, got %d", first, second)
+	}
+
+	// concurrent connection can't use the same port, and falls back to another one
+	c2, third := connect()
+	defer c2.Close()
+	if third == second {
+		t.Errorf("source port %d is used twice", third)
+	}
+	close(release)
+}
+
+func TestIdleTimeoutSliding(t *testing.T) {
+	// destination echoes, or sends a byte periodically when the client asks it to by sending "tick"
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return
+		}
+		if string(b) == "tick" {
+			for ctx.Err() == nil {
+				time.Sleep(50 * time.Millisecond)
+				if _, err := c.Write([]byte{0}); err != nil {
+					return
+				}
+			}
+			return
+		}
+		c.Write(b)
+		io.Copy(c, c)
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	conf := &Config{
+		Users:       []User{{Username: "user1", Password: "pass1"}},
+		IdleTimeout: 200 * time.Millisecond,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, conns := testConns(t, ctx, zap.NewNop().Sugar(), srv)
+
+	// silent connection is reaped after idle timeout and slack
+	start := time.Now()
+	silent, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer silent.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	tcp := testNextConn(t, conns)
+	if reason := tcp.closeReason(); reason != endIdleTimeout {
+		t.Errorf("expected %q, got %q", endIdleTimeout, reason)
+	}
+	if elapsed := time.Since(start); elapsed > 2*conf.IdleTimeout {
+		t.Errorf("silent connection closed after %s", elapsed)
+	}
+
+	// connections active in either direction survive many idle periods
+	client, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer client.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	server, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+	defer server.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Write([]byte("tick")); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 5*conf.IdleTimeout; time.Sleep(conf.IdleTimeout / 2) {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case tcp := <-conns:
+		t.Fatalf("active connection closed: %s", tcp.closeReason())
+	default:
+	}
+	if _, err := io.ReadFull(server, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// and are reaped once they stop
+	client.Close()
+	server.Close()
+	for i := 0; i < 2; i++ {
+		testNextConn(t, conns)
+	}
+}
+
+// testResolver starts DNS server answering any A and AAAA query with given addresses
+// and returns its address.
+func testResolver(t testing.TB, ips ...net.IP) string {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			// header and a single question: name, type, class
+			q := b[:n]
+			end := 12
+			for end < len(q) && q[end] != 0 {
+				end += int(q[end]) + 1
+			}
+			end += 5
+			if end > len(q) {
+				continue
+			}
+			qtype := binary.BigEndian.Uint16(q[end-4:])
+
+			var answers [][]byte
+			for _, ip := range ips {
+				rr := []byte{0xc0, 12, 0, 0, 0, 1, 0, 0, 0, 60, 0, 0} // name pointer, type, class IN, TTL, rdlength
+				switch ip4 := ip.To4(); {
+				case qtype == 1 && ip4 != nil:
+					rr[3], rr[11] = 1, 4
+					rr = append(rr, ip4...)
+				case qtype == 28 && ip4 == nil:
+					rr[3], rr[11] = 28, 16
+					rr = append(rr, ip.To16()...)
+				default:
+					continue
+				}
+				answers = append(answers, rr)
+			}
+
+			reply := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0}, q[12:end]...)
+			for _, rr := range answers {
+				reply = append(reply, rr...)
+			}
+			pc.WriteTo(reply, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String()
+}
+
+func TestResolvedAddresses(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) { c.Close() })
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+	// several IPv4 and IPv6 addresses, only the first IPv4 one is listening
+	ips := []net.IP{net.ParseIP("::1"), dstAddr.IP, net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}
+	conf := &Config{
+		Users:     []User{{Username: "user1", Password: "pass1", Resolver: "multi"}},
+		Resolvers: []Resolver{{Name: "multi", Address: testResolver(t, ips...)}},
+	}
+	l, log := testLogger(zapcore.DebugLevel)
+	srv, addr := testServerLog(t, conf, l)
+
+	host := "multi.example"
+	c, res := testDomainRequest(t, addr, "user1", "pass1", host, dstAddr.Port)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+	c.Close()
+	waitFor(t, func() bool { return srv.Active() == 0 })
+
+	// the full set and the chosen address are logged once
+	var found []string
+	for _, e := range log.Entries("") {
+		if msg, _ := e["msg"].(string); strings.HasPrefix(msg, host+" resolved to ") {
+			found = append(found, msg)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("expected a single resolved addresses message, got %q", found)
+	}
+	msg := found[0]
+	if !strings.HasPrefix(msg, host+" resolved to 4 addresses: ") || !strings.HasSuffix(msg, "; using "+dstAddr.IP.String()+".") {
+		t.Errorf("unexpected message %q", msg)
+	}
+	for _, ip := range ips {
+		if !strings.Contains(msg, ip.String()) {
+			t.Errorf("%s is not logged in %q", ip, msg)
+		}
+	}
+	if l := log.Entries(msg); len(l) != 1 || l[0]["level"] != "debug" {
+		t.Errorf("expected debug level, got %v", l)
+	}
+}
+
+func TestNonTCPConn(t *testing.T) {
+	// options using client's TCP address and socket are enabled
+	conf := &Config{
+		Users:         []User{{Username: "user1", Password: "pass1"}},
+		DenyClients:   []string{"192.0.2.0/24"},
+		PreAuth:       PreAuth{MaxPerClient: 1},
+		PortAffinity:  time.Minute,
+		AbortiveClose: []string{CloseProtocolMismatch},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf)
+
+	for name, tc := range map[string]struct {
+		b      string
+		reply  string
+		reason string
+	}{
+		"Echo": {
+			b:      "\x05\x01\x02\x01\x05user1\x05pass1\x05\x01\x00\x01\x00\x00\x00\x01\x00\x07ping",
+			reply:  "\x05\x02\x01\x00\x05\x00\x00\x01\x00\x00\x00\x01\x00\x07ping",
+			reason: endClientEOF,
+		},
+		"ProtocolMismatch": {
+			b:      "GET / HTTP/1.1\r\n\r\n",
+			reason: endHandshakeFailed + "(sniff)",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			l, log := testLogger(zapcore.InfoLevel)
+			client, c := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			done := make(chan *TCPConn)
+			go func() {
+				if srv.RejectDenied(context.Background(), c, l) {
+					t.Error("non-TCP client is denied")
+				}
+				tcp := NewTCPConn(c, ListenerDefault, l, srv)
+				if tcp.EnterPreAuth() && tcp.Sniff() && tcp.Auth(context.Background()) && tcp.Req(context.Background()) {
+					tcp.Run(context.Background())
+				}
+				tcp.Close()
+				done <- tcp
+			}()
+
+			go client.Write([]byte(tc.b))
+			reply := make([]byte, len(tc.reply))
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatal(err)
+			}
+			if string(reply) != tc.reply {
+				t.Errorf("expected reply %q, got %q", tc.reply, reply)
+			}
+			if tc.reply == "" {
+				io.Copy(ioutil.Discard, client) // until rejected
+			}
+			client.Close()
+
+			// the connection is served or rejected without panics and without errors from skipped options
+			tcp := <-done
+			if reason := tcp.closeReason(); reason != tc.reason {
+				t.Errorf("expected %q, got %q", tc.reason, reason)
+			}
+			for _, e := range log.Entries("") {
+				msg, _ := e["msg"].(string)
+				if e["level"] == "error" && !strings.HasPrefix(msg, "Not a SOCKS5 client (http): ") {
+					t.Errorf("unexpected error %q", msg)
+				}
+			}
+		})
+	}
+}
+
+func TestServerClosesImmediately(t *testing.T) {
+	for name, reset := range map[string]bool{"Close": false, "Reset": true} {
+		t.Run(name, func(t *testing.T) {
+			dst := testListen(t, func(ctx context.Context, c net.Conn) {
+				if reset {
+					c.(*net.TCPConn).SetLinger(0)
+				}
+				c.Close()
+			})
+			dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			l, log := testLogger(zapcore.InfoLevel)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			addr, conns := testConns(t, ctx, l, srv)
+
+			// the client stays silent, so only the server direction finishes by itself
+			c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, dstAddr)
+			defer c.Close()
+			if res[1] != 0 {
+				t.Fatalf("request failed: % x", res)
+			}
+
+			// Run returns only after both directions are finished
+			tcp := testNextConn(t, conns)
+			if reason := tcp.closeReason(); reason != endServerEOF {
+				t.Errorf("expected %q, got %q", endServerEOF, reason)
+			}
+			if st := tcp.stats(time.Now()); st.FromClient != 0 || st.FromServer != 0 {
+				t.Errorf("expected nothing relayed, got %+v", st)
+			}
+			if used := srv.accounting.Used("user1", time.Now()); used != 0 {
+				t.Errorf("expected no traffic, got %d", used)
+			}
+			for _, e := range log.Entries("") {
+				if e["level"] == "error" {
+					t.Errorf("unexpected error %v", e)
+				}
+			}
+
+			// and the client is disconnected
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := io.Copy(ioutil.Discard, c); n != 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("expected EOF, got %d bytes and %v", n, err)
+			}
+		})
+	}
+}
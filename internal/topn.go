@@ -0,0 +1,79 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"sort"
+	"sync"
+)
+
+// topN approximately tracks the most frequent keys in bounded memory using Space-Saving algorithm:
+// when capacity is reached, the least frequent key is evicted and the new one inherits its count.
+// Counts of the most frequent keys are accurate as long as their number is much less than capacity.
+type topN struct {
+	m        sync.Mutex
+	capacity int
+	counts   map[string]uint64
+}
+
+// topEntry represents a single key with its count.
+type topEntry struct {
+	Key   string
+	Count uint64
+}
+
+func newTopN(capacity int) *topN {
+	return &topN{
+		capacity: capacity,
+		counts:   make(map[string]uint64, capacity),
+	}
+}
+
+// Add increments count for given key.
+func (t *topN) Add(key string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if c, ok := t.counts[key]; ok || len(t.counts) < t.capacity {
+		t.counts[key] = c + 1
+		return
+	}
+
+	var minKey string
+	var minCount uint64
+	for k, c := range t.counts {
+		if minKey == "" || c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	delete(t.counts, minKey)
+	t.counts[key] = minCount + 1
+}
+
+// Top returns up to n most frequent keys in descending order.
+func (t *topN) Top(n int) []topEntry {
+	t.m.Lock()
+	res := make([]topEntry, 0, len(t.counts))
+	for k, c := range t.counts {
+		res = append(res, topEntry{Key: k, Count: c})
+	}
+	t.m.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
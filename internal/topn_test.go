@@ -0,0 +1,81 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTopN(t *testing.T) {
+	top := newTopN(3)
+	for key, n := range map[string]int{"a": 5, "b": 3, "c": 4} {
+		for i := 0; i < n; i++ {
+			top.Add(key)
+		}
+	}
+
+	// descending order, limited by n
+	expected := []topEntry{{"a", 5}, {"c", 4}}
+	if actual := top.Top(2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	// the least frequent key is evicted, and the new one inherits its count
+	top.Add("d")
+	expected = []topEntry{{"a", 5}, {"c", 4}, {"d", 4}}
+	if actual := top.Top(10); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	// memory is bounded, and a stream of rare keys doesn't push out the frequent one
+	for i := 0; i < 100; i++ {
+		top.Add("a")
+		top.Add(fmt.Sprintf("rare%d", i))
+	}
+	actual := top.Top(10)
+	if len(actual) != 3 || actual[0] != (topEntry{"a", 105}) {
+		t.Errorf("unexpected top: %v", actual)
+	}
+}
+
+func TestTopDestinations(t *testing.T) {
+	dst := testListen(t, func(ctx context.Context, c net.Conn) {
+		<-ctx.Done()
+		c.Close()
+	})
+	dstAddr, _ := net.ResolveTCPAddr("tcp", dst)
+	conf := &Config{
+		Users:           []User{{Username: "user1", Password: "pass1"}},
+		TopDestinations: 1,
+	}
+	srv, addr := testServer(t, conf)
+
+	for _, d := range []*net.TCPAddr{dstAddr, echoAddr, dstAddr, dstAddr, echoAddr} {
+		c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, d)
+		c.Close()
+		if res[1] != 0 {
+			t.Fatalf("request to %s failed: % x", d, res)
+		}
+	}
+
+	// only the busiest destination is exposed
+	srv.updateGauges()
+	var metrics strings.Builder
+	srv.metrics.WriteText(&metrics)
+	if !strings.Contains(metrics.String(), `telesock_destination_connections{host="127.0.0.1"} 3`+"\n") ||
+		strings.Contains(metrics.String(), `host="0.0.0.1"`) {
+		t.Errorf("unexpected metrics:\n%s", metrics.String())
+	}
+}
@@ -0,0 +1,60 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// MaxTracePayload is the maximal number of traced bytes of each relay direction.
+const MaxTracePayload = 4096
+
+// SetTracePayload sets the number of the first bytes of each relay direction logged at debug level.
+// It should be called before connections are accepted; zero disables tracing.
+func (s *Server) SetTracePayload(n int) {
+	s.tracePayload = n
+}
+
+// traceWriter logs the first relayed bytes of a single direction in hex and ASCII.
+type traceWriter struct {
+	l      *zap.SugaredLogger
+	peer   string // sender
+	offset int
+	left   int
+}
+
+func (tw *traceWriter) Write(p []byte) (int, error) {
+	if tw.left == 0 {
+		return len(p), nil
+	}
+
+	b := p
+	if len(b) > tw.left {
+		b = b[:tw.left]
+	}
+	tw.l.Debugf("Payload from the %s, bytes %d-%d:\n%s", tw.peer, tw.offset, tw.offset+len(b)-1, strings.TrimSuffix(hex.Dump(b), "\n"))
+	tw.offset += len(b)
+	tw.left -= len(b)
+	return len(p), nil
+}
+
+// traceWriters returns writers logging the first relayed bytes sent by the client and by the server,
+// or nils if tracing is disabled or connection is not logged at debug level.
+func (tcp *TCPConn) traceWriters() (fromClient, fromServer *traceWriter) {
+	n := tcp.srv.tracePayload
+	if n <= 0 || !tcp.l.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		return nil, nil
+	}
+	return &traceWriter{l: tcp.l, peer: "client", left: n}, &traceWriter{l: tcp.l, peer: "server", left: n}
+}
@@ -0,0 +1,95 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestTracePayload(t *testing.T) {
+	const n = 16
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 8)
+
+	for name, tc := range map[string]struct {
+		trace int
+		level zapcore.Level
+		dump  bool
+	}{
+		"Disabled":     {0, zapcore.DebugLevel, false},
+		"Enabled":      {n, zapcore.DebugLevel, true},
+		"EnabledInfo":  {n, zapcore.InfoLevel, false},
+		"EnabledWarn":  {n, zapcore.WarnLevel, false},
+		"DisabledInfo": {0, zapcore.InfoLevel, false},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Users: []User{{Username: "user1", Password: "pass1"}}}
+			if err := conf.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			srv := NewServer(conf)
+			srv.SetTracePayload(tc.trace)
+			l, log := testLogger(tc.level)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			addr, conns := testConns(t, ctx, l, srv)
+
+			c, res := testRequest(t, addr, "user1", "pass1", cmdConnect, echoAddr)
+			defer c.Close()
+			if res[1] != 0 {
+				t.Fatalf("request failed: % x", res)
+			}
+			c.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, len(payload))
+			if _, err := io.ReadFull(c, b); err != nil {
+				t.Fatal(err)
+			}
+			c.Close()
+			testNextConn(t, conns)
+
+			// only the first n bytes of each direction are dumped
+			expected := map[string]bool{
+				"Payload from the client, bytes 0-15:\n" + strings.TrimSuffix(hex.Dump(payload[:n]), "\n"): true,
+				"Payload from the server, bytes 0-15:\n" + strings.TrimSuffix(hex.Dump(payload[:n]), "\n"): true,
+			}
+			var dumps []string
+			for _, e := range log.Entries("") {
+				if msg, _ := e["msg"].(string); strings.HasPrefix(msg, "Payload from the ") {
+					dumps = append(dumps, msg)
+				}
+			}
+			if !tc.dump {
+				if len(dumps) != 0 {
+					t.Errorf("expected no payload dumps, got %q", dumps)
+				}
+				return
+			}
+			if len(dumps) != len(expected) {
+				t.Fatalf("expected %d payload dumps, got %q", len(expected), dumps)
+			}
+			for _, d := range dumps {
+				if !expected[d] {
+					t.Errorf("unexpected payload dump %q", d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Encrypted tunnel between two telesock instances.
+//
+// Both sides send 32 random bytes of salt, then derive AES-256-GCM keys for each direction
+// from pre-shared key and both salts. After that, stream is split into frames; each frame is
+// a sealed 2-byte big-endian payload length followed by sealed payload. Nonces are per-direction
+// frame counters. The client sends a sealed magic frame first, so the server detects PSK mismatch
+// before doing anything else.
+
+const (
+	tunnelSaltSize       = 32
+	tunnelMaxPayloadSize = 16*1024 - 1
+	tunnelMagic          = "telesock-tunnel"
+)
+
+type tunnelConn struct {
+	wrappedConn // frames are written whole, so EOF from CloseWrite is seen on a frame boundary
+
+	rm     sync.Mutex
+	r      cipher.AEAD
+	rNonce []byte
+	rBuf   []byte // decrypted but not yet returned data
+
+	wm     sync.Mutex
+	w      cipher.AEAD
+	wNonce []byte
+}
+
+func tunnelKey(psk string, direction string, clientSalt, serverSalt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write([]byte(direction))
+	mac.Write(clientSalt)
+	mac.Write(serverSalt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func newTunnelConn(c net.Conn, psk string, client bool) (*tunnelConn, error) {
+	local := make([]byte, tunnelSaltSize)
+	if _, err := rand.Read(local); err != nil {
+		return nil, err
+	}
+	if _, err := c.Write(local); err != nil {
+		return nil, err
+	}
+	remote := make([]byte, tunnelSaltSize)
+	if _, err := io.ReadFull(c, remote); err != nil {
+		return nil, err
+	}
+
+	clientSalt, serverSalt := local, remote
+	if !client {
+		clientSalt, serverSalt = remote, local
+	}
+	c2s, err := tunnelKey(psk, "c2s", clientSalt, serverSalt)
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := tunnelKey(psk, "s2c", clientSalt, serverSalt)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tunnelConn{
+		wrappedConn: wrappedConn{c},
+		r:           s2c,
+		rNonce:      make([]byte, s2c.NonceSize()),
+		w:           c2s,
+		wNonce:      make([]byte, c2s.NonceSize()),
+	}
+	if !client {
+		t.r, t.w = c2s, s2c
+	}
+	return t, nil
+}
+
+// NewTunnelClient performs client side of encrypted tunnel handshake over c.
+func NewTunnelClient(c net.Conn, psk string) (net.Conn, error) {
+	t, err := newTunnelConn(c, psk, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = t.Write([]byte(tunnelMagic)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewTunnelServer performs server side of encrypted tunnel handshake over c.
+// It returns error if the client uses different pre-shared key.
+func NewTunnelServer(c net.Conn, psk string) (net.Conn, error) {
+	t, err := newTunnelConn(c, psk, false)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(tunnelMagic))
+	if _, err = io.ReadFull(t, magic); err != nil {
+		return nil, fmt.Errorf("tunnel handshake failed (pre-shared key mismatch?): %s", err)
+	}
+	if string(magic) != tunnelMagic {
+		return nil, fmt.Errorf("tunnel handshake failed: unexpected magic %q", magic)
+	}
+	return t, nil
+}
+
+// incNonce increments little-endian frame counter.
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (t *tunnelConn) open(b []byte) ([]byte, error) {
+	res, err := t.r.Open(b[:0], t.rNonce, b, nil)
+	incNonce(t.rNonce)
+	return res, err
+}
+
+func (t *tunnelConn) Read(p []byte) (int, error) {
+	t.rm.Lock()
+	defer t.rm.Unlock()
+
+	if len(t.rBuf) == 0 {
+		overhead := t.r.Overhead()
+		b := make([]byte, 2+overhead)
+		if _, err := io.ReadFull(t.Conn, b); err != nil {
+			return 0, err
+		}
+		l, err := t.open(b)
+		if err != nil {
+			return 0, err
+		}
+
+		b = make([]byte, int(binary.BigEndian.Uint16(l))+overhead)
+		if _, err = io.ReadFull(t.Conn, b); err != nil {
+			return 0, err
+		}
+		if t.rBuf, err = t.open(b); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, t.rBuf)
+	t.rBuf = t.rBuf[n:]
+	return n, nil
+}
+
+func (t *tunnelConn) Write(p []byte) (int, error) {
+	t.wm.Lock()
+	defer t.wm.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > tunnelMaxPayloadSize {
+			chunk = chunk[:tunnelMaxPayloadSize]
+		}
+
+		overhead := t.w.Overhead()
+		frame := make([]byte, 2, 2+overhead+len(chunk)+overhead)
+		binary.BigEndian.PutUint16(frame, uint16(len(chunk)))
+		frame = t.w.Seal(frame[:0], t.wNonce, frame[:2], nil)
+		incNonce(t.wNonce)
+		frame = t.w.Seal(frame, t.wNonce, chunk, nil)
+		incNonce(t.wNonce)
+
+		if _, err := t.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,272 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testPSK = "0123456789abcdef-test"
+
+// tapConn records bytes read from and written to the underlying connection.
+type tapConn struct {
+	net.Conn
+
+	m       sync.Mutex
+	read    []byte
+	written []byte
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.Lock()
+	c.read = append(c.read, p[:n]...)
+	c.m.Unlock()
+	return n, err
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.Lock()
+	c.written = append(c.written, p[:n]...)
+	c.m.Unlock()
+	return n, err
+}
+
+// wire returns copies of recorded bytes.
+func (c *tapConn) wire() (read, written []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]byte(nil), c.read...), append([]byte(nil), c.written...)
+}
+
+// tamperConn flips a single byte at given offset of the stream read from the underlying connection.
+type tamperConn struct {
+	net.Conn
+	offset int
+	pos    int
+}
+
+func (c *tamperConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if i := c.offset - c.pos; i >= 0 && i < n {
+		p[i] ^= 0x01
+	}
+	c.pos += n
+	return n, err
+}
+
+// testConnPair returns both sides of a loopback TCP connection.
+func testConnPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestTunnel(t *testing.T) {
+	echo := testListen(t, func(ctx context.Context, c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+
+	// the second instance accepts tunnel connections
+	confB := &Config{
+		Users:  []User{{Username: "tunnel-user", Password: "tunnel-password"}},
+		Tunnel: Tunnel{PSK: testPSK},
+	}
+	if err := confB.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srvB := NewServer(confB)
+	var tapM sync.Mutex
+	var taps []*tapConn
+	addrB := testListen(t, func(ctx context.Context, c net.Conn) {
+		tap := &tapConn{Conn: c}
+		tapM.Lock()
+		taps = append(taps, tap)
+		tapM.Unlock()
+
+		tc, err := NewTunnelServer(tap, testPSK)
+		if err != nil {
+			t.Error(err)
+			c.Close()
+			return
+		}
+		testHandle(ctx, tc, zap.NewNop().Sugar(), srvB)
+	})
+
+	// the first instance uses the second one as upstream
+	confA := &Config{
+		Users: []User{{Username: "user1", Password: "pass1"}},
+		Upstreams: []Upstream{{
+			Address:  addrB,
+			Username: "tunnel-user",
+			Password: "tunnel-password",
+			PSK:      testPSK,
+		}},
+	}
+	_, addrA := testServer(t, confA)
+
+	echoAddr, err := net.ResolveTCPAddr("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, res := testRequest(t, addrA, "user1", "pass1", cmdConnect, echoAddr)
+	defer c.Close()
+	if res[1] != 0 {
+		t.Fatalf("request failed: % x", res)
+	}
+
+	// larger than a single frame
+	plaintext := bytes.Repeat([]byte("telesock tunnel plaintext "), 4*tunnelMaxPayloadSize/26)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	go c.Write(plaintext)
+	actual := make([]byte, len(plaintext))
+	if _, err = io.ReadFull(c, actual); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, plaintext) {
+		t.Fatal("data is corrupted")
+	}
+
+	tapM.Lock()
+	defer tapM.Unlock()
+	if len(taps) != 1 {
+		t.Fatalf("expected 1 tunnel connection, got %d", len(taps))
+	}
+	read, written := taps[0].wire()
+	for name, wire := range map[string][]byte{"client to server": read, "server to client": written} {
+		if len(wire) <= len(plaintext) {
+			t.Errorf("%s: expected more than %d bytes on the wire, got %d", name, len(plaintext), len(wire))
+		}
+		for _, s := range []string{"telesock tunnel plaintext", "tunnel-user", "tunnel-password", tunnelMagic} {
+			if bytes.Contains(wire, []byte(s)) {
+				t.Errorf("%s: %q found on the wire", name, s)
+			}
+		}
+	}
+}
+
+func TestTunnelTampering(t *testing.T) {
+	overhead := 16                                           // AES-GCM tag
+	magicFrame := 2 + overhead + len(tunnelMagic) + overhead // sealed length and sealed payload
+	dataFrame := tunnelSaltSize + magicFrame
+
+	for name, tc := range map[string]struct {
+		offset    int
+		handshake bool // true if handshake should fail
+	}{
+		"Salt":        {offset: 0, handshake: true},
+		"MagicLength": {offset: tunnelSaltSize, handshake: true},
+		"Magic":       {offset: tunnelSaltSize + 2 + overhead + 1, handshake: true},
+		"Length":      {offset: dataFrame},
+		"LengthTag":   {offset: dataFrame + 2 + 1},
+		"Payload":     {offset: dataFrame + 2 + overhead + 1},
+		"PayloadTag":  {offset: dataFrame + 2 + overhead + len("hello") + 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server := testConnPair(t)
+
+			errC := make(chan error, 1)
+			go func() {
+				tun, err := NewTunnelClient(client, testPSK)
+				if err == nil {
+					_, err = tun.Write([]byte("hello"))
+				}
+				errC <- err
+			}()
+
+			ts, err := NewTunnelServer(&tamperConn{Conn: server, offset: tc.offset}, testPSK)
+			if clientErr := <-errC; clientErr != nil {
+				t.Fatal(clientErr)
+			}
+			if tc.handshake {
+				if err == nil {
+					t.Fatal("expected handshake to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := make([]byte, 10)
+			n, err := ts.Read(b)
+			if err == nil {
+				t.Fatalf("expected authentication error, read %q", b[:n])
+			}
+		})
+	}
+}
+
+func TestTunnelUntampered(t *testing.T) {
+	client, server := testConnPair(t)
+
+	errC := make(chan error, 1)
+	go func() {
+		tun, err := NewTunnelClient(client, testPSK)
+		if err == nil {
+			_, err = tun.Write([]byte("hello"))
+		}
+		errC <- err
+	}()
+
+	ts, err := NewTunnelServer(&tamperConn{Conn: server, offset: -1}, testPSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errC; err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	n, err := ts.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "hello" {
+		t.Fatalf("unexpected data %q", b[:n])
+	}
+}
+
+func TestTunnelPSKMismatch(t *testing.T) {
+	client, server := testConnPair(t)
+
+	go NewTunnelClient(client, testPSK)
+
+	if _, err := NewTunnelServer(server, testPSK+"-other"); err == nil {
+		t.Fatal("expected handshake to fail")
+	}
+}
@@ -0,0 +1,418 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultUDPIdleTimeout is used when udp_associate idle_timeout is not set.
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+const (
+	// maxUDPDatagram is the maximal size of UDP datagram, including SOCKS5 header.
+	maxUDPDatagram = 65535
+
+	// maxUDPPeers is the maximal number of destinations of a single association, including resolved host names;
+	// datagrams to more destinations are dropped.
+	maxUDPPeers = 1024
+)
+
+// UDPAssociate configures support of SOCKS5 UDP ASSOCIATE command.
+type UDPAssociate struct {
+	Enabled         bool          `yaml:"enabled"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`     // defaultUDPIdleTimeout if not set
+	MaxAssociations int           `yaml:"max_associations"` // for all users, zero means unlimited
+	MaxPerUser      int           `yaml:"max_per_user"`     // zero means unlimited
+}
+
+// validate checks UDP ASSOCIATE settings.
+func (u *UDPAssociate) validate() error {
+	if u.IdleTimeout < 0 || u.MaxAssociations < 0 || u.MaxPerUser < 0 {
+		return fmt.Errorf("udp_associate: idle_timeout, max_associations and max_per_user should not be negative")
+	}
+	return nil
+}
+
+// idleTimeout returns the time after which association without datagrams is closed.
+func (u *UDPAssociate) idleTimeout() time.Duration {
+	if u.IdleTimeout > 0 {
+		return u.IdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// udpAssociations tracks active UDP associations for max_associations and max_per_user limits.
+type udpAssociations struct {
+	m     sync.Mutex
+	total int
+	users map[string]int
+}
+
+func newUDPAssociations() *udpAssociations {
+	return &udpAssociations{
+		users: make(map[string]int),
+	}
+}
+
+// Len returns the number of active associations.
+func (a *udpAssociations) Len() int {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.total
+}
+
+// Acquire registers user's association. It returns false if limit is reached.
+func (a *udpAssociations) Acquire(user string, limits UDPAssociate) bool {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if (limits.MaxAssociations > 0 && a.total >= limits.MaxAssociations) ||
+		(limits.MaxPerUser > 0 && a.users[user] >= limits.MaxPerUser) {
+		return false
+	}
+	a.total++
+	a.users[user]++
+	return true
+}
+
+// Release unregisters user's association.
+func (a *udpAssociations) Release(user string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.total--
+	if a.users[user]--; a.users[user] <= 0 {
+		delete(a.users, user)
+	}
+}
+
+// udpRelay is the state of UDP association.
+type udpRelay struct {
+	conn     *net.UDPConn
+	client   *net.UDPAddr // the only source of client's datagrams; port is zero until the first one
+	peers    map[string]bool
+	resolved map[string]net.IP
+	destIPs  map[string]bool // registered for destination_limit
+	captured map[string]bool // peers matching capture rules
+
+	// nil until the first captured peer
+	fromClientCapture, fromServerCapture *captureWriter
+}
+
+// udpAssociate handles UDP ASSOCIATE request: it opens UDP relay socket and replies with its address.
+// raddr is the address the client is going to send datagrams from; zero IP address and port mean unknown.
+// It returns false if request is refused.
+func (tcp *TCPConn) udpAssociate(raddr *net.TCPAddr, l *zap.SugaredLogger) bool {
+	if !tcp.admit("UDP relay", "", l) {
+		return false
+	}
+
+	limits := tcp.conf.UDPAssociate
+	if !tcp.srv.udpAssocs.Acquire(tcp.user.Username, limits) {
+		l.Warnf(
+			"UDP association refused: associations limit reached (max_associations=%d, max_per_user=%d).",
+			limits.MaxAssociations, limits.MaxPerUser,
+		)
+		tcp.srv.metrics.Inc("udp_associations_refused_total")
+		tcp.replyFailure(failUDPAssociations, l)
+		return false
+	}
+
+	// socket is not bound to the address the client connected to, so datagrams can be sent to any destination
+	uc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		tcp.srv.udpAssocs.Release(tcp.user.Username)
+		l.Errorf("Failed to open UDP relay socket: %s.", err)
+		tcp.replyFailure(failConnect, l)
+		return false
+	}
+	tcp.server = uc // closed by Close, association is released there too
+
+	// only the client's IP address is accepted if the client doesn't know its address (e.g. behind NAT)
+	client := &net.UDPAddr{Port: raddr.Port}
+	if raddr.IP != nil && !raddr.IP.IsUnspecified() {
+		client.IP = raddr.IP
+	} else if addr, ok := tcp.client.RemoteAddr().(*net.TCPAddr); ok {
+		client.IP = addr.IP
+	}
+	tcp.udp = &udpRelay{
+		conn:     uc,
+		client:   client,
+		peers:    make(map[string]bool),
+		resolved: make(map[string]net.IP),
+		destIPs:  make(map[string]bool),
+		captured: make(map[string]bool),
+	}
+	tcp.target = "udp"
+
+	// bound address is the one the client connected to, unknown for non-TCP connections (e.g. tunnel)
+	bnd := &net.TCPAddr{Port: uc.LocalAddr().(*net.UDPAddr).Port}
+	if addr, ok := tcp.client.LocalAddr().(*net.TCPAddr); ok {
+		bnd.IP = addr.IP
+	}
+	tcp.chaosReplyDelay()
+	if err = tcp.writeReply(0, bnd); err != nil {
+		l.Error(err)
+		return false
+	}
+
+	tcp.srv.metrics.Inc("udp_associations_total")
+	l.Infof("UDP relay %s is associated with client %s.", bnd, client)
+	return true
+}
+
+// relayUDP relays datagrams until the client closes control connection, association becomes idle,
+// or it is stopped (e.g. on shutdown).
+func (tcp *TCPConn) relayUDP(ctx context.Context) {
+	u := tcp.udp
+	timeout := tcp.conf.UDPAssociate.idleTimeout()
+	defer tcp.udpRelease()
+
+	// association lives as long as control connection, nothing is expected from the client over it
+	go func() {
+		io.Copy(ioutil.Discard, tcp.clientR)
+		tcp.end(endClientEOF)
+		u.conn.Close()
+	}()
+
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		if err := u.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return
+		}
+		n, from, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				tcp.l.Infof("No UDP datagrams for %s, closing association.", timeout)
+				tcp.end(endIdleTimeout)
+			}
+			return
+		}
+
+		switch {
+		case from.IP.Equal(u.client.IP) && (u.client.Port == 0 || u.client.Port == from.Port):
+			if u.client.Port == 0 {
+				u.client.Port = from.Port
+				tcp.l.Debugf("UDP client address is %s.", from)
+			}
+			tcp.udpFromClient(ctx, buf[:n])
+		case u.peers[from.String()]:
+			tcp.udpToClient(from, buf[:n])
+		default:
+			tcp.l.Debugf("Dropping UDP datagram from unknown address %s.", from)
+			tcp.srv.metrics.Inc("udp_dropped_total", "reason", "unknown_source")
+		}
+	}
+}
+
+// udpFromClient sends client's datagram b with SOCKS5 UDP request header to the destination.
+func (tcp *TCPConn) udpFromClient(ctx context.Context, b []byte) {
+	u := tcp.udp
+	l := tcp.l
+
+	// RSV, FRAG, ATYP
+	if len(b) < 4 || b[0] != 0 || b[1] != 0 {
+		l.Debugf("Dropping malformed UDP datagram of %d bytes.", len(b))
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "malformed")
+		return
+	}
+	if frag := b[2]; frag != 0 {
+		// fragmentation is optional, and virtually no client uses it
+		l.Debugf("Dropping fragmented UDP datagram (FRAG=%d), fragmentation is not supported.", frag)
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "fragmented")
+		return
+	}
+
+	var host string
+	var ip net.IP
+	var rest []byte
+	switch b[3] {
+	case 1:
+		if len(b) < 4+net.IPv4len+2 {
+			break
+		}
+		ip, rest = net.IP(b[4:4+net.IPv4len]), b[4+net.IPv4len:]
+		host = ip.String()
+	case 4:
+		if len(b) < 4+net.IPv6len+2 {
+			break
+		}
+		ip, rest = net.IP(b[4:4+net.IPv6len]), b[4+net.IPv6len:]
+		host = ip.String()
+	case 3:
+		if len(b) < 5 || len(b) < 5+int(b[4])+2 {
+			break
+		}
+		host, rest = string(b[5:5+int(b[4])]), b[5+int(b[4]):]
+	}
+	if rest == nil {
+		l.Debugf("Dropping UDP datagram with malformed or unsupported destination address (ATYP=%d).", b[3])
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "malformed")
+		return
+	}
+	raddr := &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(rest))}
+	payload := rest[2:]
+
+	if isEcho(tcp.conf, host, raddr) {
+		tcp.udpAccount(&tcp.fromClient, len(payload))
+		tcp.udpToClient(&net.UDPAddr{IP: echoAddr.IP, Port: raddr.Port}, payload)
+		return
+	}
+	if !tcp.destinationTypeAllowed(host, raddr) {
+		l.Debugf("Dropping UDP datagram to %s: destination_type is %s.", host, tcp.conf.DestinationType)
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "destination_type")
+		return
+	}
+
+	if ip == nil {
+		if ip = u.resolved[host]; ip == nil {
+			var err error
+			if ip, _, err = tcp.resolve(ctx, host); err != nil {
+				l.Debugf("Dropping UDP datagram to %s: %s.", host, err)
+				tcp.srv.metrics.Inc("udp_dropped_total", "reason", "resolve")
+				return
+			}
+			if len(u.resolved) < maxUDPPeers {
+				u.resolved[host] = ip
+			}
+		}
+	}
+
+	dst := &net.UDPAddr{IP: ip, Port: raddr.Port}
+	key := dst.String()
+	if !u.peers[key] {
+		if len(u.peers) >= maxUDPPeers {
+			l.Debugf("Dropping UDP datagram to %s: too many destinations.", dst)
+			tcp.srv.metrics.Inc("udp_dropped_total", "reason", "too_many_destinations")
+			return
+		}
+		if !tcp.udpAllowPeer(host, dst) {
+			return
+		}
+		// replies are accepted only from destinations the client has sent datagrams to
+		u.peers[key] = true
+		l.Debugf("UDP destination %s (%s).", host, dst)
+	}
+
+	if _, err := u.conn.WriteToUDP(payload, dst); err != nil {
+		l.Debugf("Failed to send UDP datagram to %s: %s.", dst, err)
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "send")
+		return
+	}
+	tcp.udpAccount(&tcp.fromClient, len(payload))
+	if u.captured[key] {
+		u.fromClientCapture.Write(payload)
+	}
+}
+
+// udpAllowPeer applies the same per-destination policy as CONNECT request to a new destination of association:
+// distinct destinations limit, destination connections limit, and capture rules.
+// It returns false if datagrams to that destination should be dropped.
+func (tcp *TCPConn) udpAllowPeer(host string, dst *net.UDPAddr) bool {
+	u := tcp.udp
+	l := tcp.l
+
+	if d := tcp.conf.DistinctDestinations; d.Limit > 0 && !tcp.checkDistinct(d, host, l) {
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", failDistinctDestinations)
+		return false
+	}
+
+	// every destination IP address is counted once per association until it is closed;
+	// datagrams are not queued waiting for a free slot
+	if d := tcp.conf.DestinationLimit; d.enabled() && !u.destIPs[dst.IP.String()] {
+		ip := dst.IP.String()
+		d.QueueTimeout = 0
+		if !tcp.srv.destConns.Acquire(context.Background(), ip, tcp.user.Username, d) {
+			l.Warnf(
+				"Dropping UDP datagram to %s: destination connections limit reached (max_connections=%d, max_per_user=%d).",
+				dst, d.MaxConnections, d.MaxPerUser,
+			)
+			tcp.srv.metrics.Inc("destination_limit_refused_total")
+			tcp.srv.metrics.Inc("udp_dropped_total", "reason", failDestinationLimit)
+			return false
+		}
+		u.destIPs[ip] = true
+	}
+
+	if tcp.srv.captureMatch(tcp.conf, tcp.user.Username, host, dst.IP) {
+		if u.fromClientCapture == nil {
+			var err error
+			if u.fromClientCapture, u.fromServerCapture, err = tcp.openCapture("udp"); err != nil {
+				tcp.l.Errorf("Failed to start capture: %s.", err)
+				return true
+			}
+		}
+		l.Infof("Datagrams of UDP destination %s (%s) are captured.", host, dst)
+		u.captured[dst.String()] = true
+	}
+	return true
+}
+
+// udpRelease releases destinations registered for destination_limit and finishes capture.
+func (tcp *TCPConn) udpRelease() {
+	u := tcp.udp
+	for ip := range u.destIPs {
+		tcp.srv.destConns.Release(ip, tcp.user.Username)
+	}
+	u.destIPs = nil
+	if u.fromClientCapture != nil {
+		u.fromClientCapture.Close()
+		u.fromServerCapture.Close()
+	}
+}
+
+// udpToClient sends datagram b received from the destination to the client with SOCKS5 UDP request header.
+func (tcp *TCPConn) udpToClient(from *net.UDPAddr, b []byte) {
+	u := tcp.udp
+	if u.client.Port == 0 {
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "unknown_client")
+		return
+	}
+
+	d := make([]byte, 0, 4+net.IPv6len+2+len(b))
+	if ip4 := from.IP.To4(); ip4 != nil {
+		d = append(d, 0, 0, 0, 1)
+		d = append(d, ip4...)
+	} else {
+		d = append(d, 0, 0, 0, 4)
+		d = append(d, from.IP.To16()...)
+	}
+	d = append(d, byte(from.Port>>8), byte(from.Port))
+	d = append(d, b...)
+
+	if _, err := u.conn.WriteToUDP(d, u.client); err != nil {
+		tcp.l.Debugf("Failed to send UDP datagram to client %s: %s.", u.client, err)
+		tcp.srv.metrics.Inc("udp_dropped_total", "reason", "send")
+		return
+	}
+	tcp.udpAccount(&tcp.fromServer, len(b))
+	if u.captured[from.String()] {
+		u.fromServerCapture.Write(b)
+	}
+}
+
+// udpAccount adds relayed payload bytes to connection's counter and user's traffic.
+func (tcp *TCPConn) udpAccount(relayed *int64, n int) {
+	atomic.StoreInt64(&tcp.lastActive, time.Now().UnixNano())
+	atomic.AddInt64(relayed, int64(n))
+	tcp.countTraffic(n)
+}
@@ -0,0 +1,93 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho sends datagram to built-in echo destination via UDP relay at bnd, returning true if it is echoed.
+func udpEcho(t *testing.T, bnd []byte) bool {
+	t.Helper()
+
+	relay := &net.UDPAddr{IP: net.IP(bnd[4:8]), Port: int(bnd[8])<<8 | int(bnd[9])}
+	c, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	d := []byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 7, 'p', 'i', 'n', 'g'}
+	if _, err = c.Write(d); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	b := make([]byte, 100)
+	n, err := c.Read(b)
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(b[:n], d) {
+		t.Fatalf("unexpected datagram % x", b[:n])
+	}
+	return true
+}
+
+func TestUDPAssociateLimits(t *testing.T) {
+	conf := &Config{
+		Users: []User{
+			{Username: "user1", Password: "pass1"},
+			{Username: "user2", Password: "pass2"},
+		},
+		UDPAssociate: UDPAssociate{Enabled: true, MaxAssociations: 3, MaxPerUser: 2},
+	}
+	srv, addr := testServer(t, conf)
+	unspecified := &net.TCPAddr{IP: net.IPv4zero}
+	refused := []byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	associate := func(username, password string) (net.Conn, []byte) {
+		c, res := testRequest(t, addr, username, password, cmdUDPAssociate, unspecified)
+		t.Cleanup(func() { c.Close() })
+		return c, res
+	}
+
+	c1, res1 := associate("user1", "pass1")
+	if res1[1] != 0 || !udpEcho(t, res1) {
+		t.Fatalf("association failed: % x", res1)
+	}
+	if _, res := associate("user1", "pass1"); res[1] != 0 {
+		t.Fatalf("association failed: % x", res)
+	}
+	if _, res := associate("user1", "pass1"); !bytes.Equal(res, refused) {
+		t.Fatalf("expected max_per_user to be reached, got % x", res)
+	}
+	if _, res := associate("user2", "pass2"); res[1] != 0 {
+		t.Fatalf("association failed: % x", res)
+	}
+	if _, res := associate("user2", "pass2"); !bytes.Equal(res, refused) {
+		t.Fatalf("expected max_associations to be reached, got % x", res)
+	}
+	if n := srv.udpAssocs.Len(); n != 3 {
+		t.Fatalf("expected 3 associations, got %d", n)
+	}
+
+	// closing control connection tears down its association
+	c1.Close()
+	waitFor(t, func() bool { return srv.udpAssocs.Len() == 2 })
+	if udpEcho(t, res1) {
+		t.Fatal("association is still relaying after control connection is closed")
+	}
+	if _, res := associate("user2", "pass2"); res[1] != 0 {
+		t.Fatalf("association failed after another one was closed: % x", res)
+	}
+}
@@ -0,0 +1,207 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// errNoHealthyUpstreams is returned when all upstreams are unhealthy.
+var errNoHealthyUpstreams = errors.New("no healthy upstreams")
+
+// upstreamHealth tracks health of upstream servers by address.
+// Upstream becomes unhealthy after a number of consecutive failures and is not used until cooldown expires;
+// then it is tried again.
+type upstreamHealth struct {
+	m      sync.Mutex
+	states map[string]*upstreamState
+}
+
+type upstreamState struct {
+	failures  int
+	downUntil time.Time // zero if healthy
+}
+
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{
+		states: make(map[string]*upstreamState),
+	}
+}
+
+// Healthy returns true if upstream is healthy.
+func (h *upstreamHealth) Healthy(address string) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	st := h.states[address]
+	return st == nil || st.downUntil.IsZero()
+}
+
+// Available returns true if upstream is healthy or its cooldown expired.
+func (h *upstreamHealth) Available(address string, now time.Time) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	st := h.states[address]
+	return st == nil || !now.Before(st.downUntil)
+}
+
+// Failed records upstream failure. It returns true if upstream became unhealthy.
+func (h *upstreamHealth) Failed(address string, maxFailures int, cooldown time.Duration, now time.Time) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	st := h.states[address]
+	if st == nil {
+		st = new(upstreamState)
+		h.states[address] = st
+	}
+
+	st.failures++
+	if st.failures < maxFailures {
+		return false
+	}
+	wasHealthy := st.downUntil.IsZero()
+	st.downUntil = now.Add(cooldown)
+	return wasHealthy
+}
+
+// Succeeded records upstream success. It returns true if upstream became healthy again.
+func (h *upstreamHealth) Succeeded(address string) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	st := h.states[address]
+	if st == nil {
+		return false
+	}
+	delete(h.states, address)
+	return !st.downUntil.IsZero()
+}
+
+// dialUpstream connects to the destination via upstream SOCKS5 server.
+// If raddr is nil, only handshake is performed.
+func dialUpstream(ctx context.Context, u *Upstream, raddr *net.TCPAddr, timeout time.Duration, ports PortRange) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout: timeout,
+	}
+	c, err := dialPortRange(ctx, d, "tcp", u.Address, ports)
+	if err != nil {
+		return nil, err
+	}
+
+	// limit handshake duration by the same timeout and context
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+
+	upstream := c
+	if u.PSK != "" {
+		if upstream, err = NewTunnelClient(c, u.PSK); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	stop := interruptOnCancel(ctx, c)
+	if err = socksHandshake(upstream, u.Username, u.Password); err == nil && raddr != nil {
+		err = socksRequest(upstream, raddr)
+	}
+	stop()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+	return upstream, nil
+}
+
+// RunUpstreamProbes periodically checks all upstreams until context is canceled.
+// Probe interval is read once, so changing it requires restart.
+func (s *Server) RunUpstreamProbes(ctx context.Context, l *zap.SugaredLogger) {
+	interval := s.Config().UpstreamHealthCheck.Interval
+	if interval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.probeUpstreams(ctx, l)
+		}
+	}
+}
+
+// probeUpstreams checks all upstreams concurrently, updating their health.
+// Probes are not real connections: they are not counted in metrics other than upstream ones and in traffic accounting.
+func (s *Server) probeUpstreams(ctx context.Context, l *zap.SugaredLogger) {
+	conf := s.Config()
+	hc := conf.UpstreamHealthCheck
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	var target *net.TCPAddr
+	if hc.Target != "" {
+		var err error
+		if target, err = net.ResolveTCPAddr("tcp4", hc.Target); err != nil {
+			l.Errorf("Probe target %s can't be resolved: %s.", hc.Target, err)
+			return
+		}
+	}
+
+	maxFailures, cooldown := conf.upstreamHealthPolicy()
+	var wg sync.WaitGroup
+	for _, u := range conf.upstreams() {
+		wg.Add(1)
+		go func(u Upstream) {
+			defer wg.Done()
+
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			c, err := dialUpstream(pctx, &u, target, timeout, PortRange{})
+			cancel()
+			if err == nil {
+				c.Close()
+			}
+
+			// destination errors reported by upstream mean it works
+			if _, ok := err.(replyError); err != nil && !ok {
+				if ctx.Err() != nil {
+					return
+				}
+				l.Warnf("Probe of upstream %s failed: %s.", u.Address, err)
+				s.metrics.Inc("upstream_probes_total", "upstream", u.Address, "result", "failure")
+				if s.upstreams.Failed(u.Address, maxFailures, cooldown, time.Now()) {
+					l.Errorf("Upstream %s is unhealthy after %d consecutive failures.", u.Address, maxFailures)
+				}
+				return
+			}
+
+			l.Debugf("Probe of upstream %s succeeded.", u.Address)
+			s.metrics.Inc("upstream_probes_total", "upstream", u.Address, "result", "success")
+			if s.upstreams.Succeeded(u.Address) {
+				l.Warnf("Upstream %s is healthy again.", u.Address)
+			}
+		}(u)
+	}
+	wg.Wait()
+}
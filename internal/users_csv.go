@@ -0,0 +1,112 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/units"
+	"go.uber.org/multierr"
+)
+
+// usersCSVColumns are columns of users CSV file; the first two are required.
+var usersCSVColumns = []string{"username", "password", "label", "quota", "expires"}
+
+// utf8BOM is added by Excel to exported CSV files.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// readUsersCSV reads users from CSV file with columns username,password[,label,quota,expires].
+// The first line is skipped if it is a header. All invalid lines are reported at once.
+func readUsersCSV(path string) ([]User, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(b, utf8BOM)))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	var users []User
+	var errs error
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// quoting errors already contain line and column
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		line, _ := r.FieldPos(0)
+		if first && strings.EqualFold(strings.TrimSpace(record[0]), usersCSVColumns[0]) {
+			continue
+		}
+
+		u, err := parseUsersCSVRecord(record)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: line %d, %s", path, line, err))
+			continue
+		}
+		u.source = fmt.Sprintf("%s:%d", path, line)
+		users = append(users, u)
+	}
+	return users, errs
+}
+
+// parseUsersCSVRecord converts CSV record to User.
+func parseUsersCSVRecord(record []string) (User, error) {
+	var u User
+	if len(record) < 2 || len(record) > len(usersCSVColumns) {
+		return u, fmt.Errorf("expected 2-%d columns, got %d", len(usersCSVColumns), len(record))
+	}
+
+	// Excel may pad exported rows with spaces
+	for i := range record {
+		record[i] = strings.TrimSpace(record[i])
+	}
+	columnErr := func(i int, format string, a ...interface{}) error {
+		return fmt.Errorf("column %d (%s): %s", i+1, usersCSVColumns[i], fmt.Sprintf(format, a...))
+	}
+
+	u.Username, u.Password = record[0], record[1]
+	if len(record) > 2 {
+		u.Label = record[2]
+	}
+	if len(record) > 3 && record[3] != "" {
+		n, err := units.ParseStrictBytes(record[3])
+		if err != nil {
+			return u, columnErr(3, "invalid size %q", record[3])
+		}
+		u.MonthlyQuota = ByteSize(n)
+	}
+	if len(record) > 4 && record[4] != "" {
+		t, err := parseExpires(record[4])
+		if err != nil {
+			return u, columnErr(4, "invalid date %q, expected YYYY-MM-DD or RFC 3339", record[4])
+		}
+		u.Expires = t
+	}
+	return u, nil
+}
+
+// parseExpires parses date (midnight UTC) or RFC 3339 timestamp.
+func parseExpires(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,82 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/multierr"
+	"gopkg.in/yaml.v2"
+)
+
+// usersDirExt is the extension of files read from users directory.
+const usersDirExt = ".yaml"
+
+// readUsersDir reads users from all *.yaml files in directory, in file name order.
+// Every file contains a single user or a list of users. All invalid files are reported at once.
+func readUsersDir(dir string) ([]User, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	var errs error
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), usersDirExt) {
+			continue
+		}
+
+		path := filepath.Join(dir, fi.Name())
+		u, err := readUsersFile(path)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %s", path, err))
+			continue
+		}
+		users = append(users, u...)
+	}
+	return users, errs
+}
+
+// readUsersFile reads a single user or a list of users from YAML file.
+func readUsersFile(path string) ([]User, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err = yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	var users []User
+	switch v.(type) {
+	case []interface{}:
+		err = yaml.UnmarshalStrict(b, &users)
+	case map[interface{}]interface{}:
+		users = make([]User, 1)
+		err = yaml.UnmarshalStrict(b, &users[0])
+	case nil:
+		// empty file
+	default:
+		err = fmt.Errorf("expected user or list of users")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range users {
+		users[i].source = path
+	}
+	return users, nil
+}
@@ -0,0 +1,236 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekSi/telesock/internal"
+)
+
+// advertisedServer returns server address for share links: configured server or, if it is empty,
+// the host part of the listen address unless it is unspecified. IPv6 literals are enclosed in brackets.
+func advertisedServer(server, listenHost string) string {
+	if server == "" {
+		if ip := net.ParseIP(listenHost); ip == nil || ip.IsUnspecified() {
+			return ""
+		}
+		server = listenHost
+	}
+
+	server = strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+	if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return server
+}
+
+// serverLinks holds share links of all users for a single advertised server.
+type serverLinks struct {
+	server string // host:port
+	users  []string
+	links  []string
+}
+
+// shareLinks returns t.me share links for all combinations of advertised servers and users, grouped by server.
+// The "auto" server is replaced with detected public address, or skipped if it is empty.
+func shareLinks(config *internal.Config, listenHost, port, public string) []serverLinks {
+	servers := config.AdvertisedServers()
+	if len(servers) == 0 {
+		// derive from listen host
+		servers = []internal.AdvertisedServer{{}}
+	}
+
+	var res []serverLinks
+	for _, s := range servers {
+		host := s.Host
+		if host == internal.AutoServer {
+			if public == "" {
+				continue
+			}
+			host = public
+		}
+		server := advertisedServer(host, listenHost)
+		if server == "" {
+			continue
+		}
+		p := port
+		if s.Port != 0 {
+			p = strconv.Itoa(s.Port)
+		}
+
+		sl := serverLinks{
+			server: server + ":" + p,
+		}
+		u := &url.URL{
+			Scheme: "https",
+			Host:   "t.me",
+			Path:   "socks",
+		}
+		for _, user := range config.Users {
+			// plain password is unknown for htpasswd users
+			if user.PasswordHashed() {
+				continue
+			}
+
+			q := make(url.Values)
+			q.Set("server", server)
+			q.Set("port", p)
+			q.Set("user", user.Username)
+			q.Set("pass", user.Password)
+			u.RawQuery = q.Encode()
+
+			sl.users = append(sl.users, user.Username)
+			sl.links = append(sl.links, u.String())
+		}
+		res = append(res, sl)
+
+		for _, listener := range config.Listeners {
+			if listener.Type == internal.ListenerTypeMTProto {
+				if _, mp, err := net.SplitHostPort(listener.Listen); err == nil {
+					res = append(res, mtprotoLinks(config, server, mp))
+				}
+			}
+		}
+	}
+	return res
+}
+
+// mtprotoLinks returns t.me MTProto proxy share links of users with secrets for a single advertised server.
+func mtprotoLinks(config *internal.Config, server, port string) serverLinks {
+	sl := serverLinks{
+		server: server + ":" + port + " (MTProto)",
+	}
+	u := &url.URL{
+		Scheme: "https",
+		Host:   "t.me",
+		Path:   "proxy",
+	}
+	for _, user := range config.Users {
+		secret := user.MTProtoLinkSecret(config.MTProto.FakeTLSDomain)
+		if secret == "" {
+			continue
+		}
+
+		q := make(url.Values)
+		q.Set("server", server)
+		q.Set("port", port)
+		q.Set("secret", secret)
+		u.RawQuery = q.Encode()
+
+		sl.users = append(sl.users, user.Username)
+		sl.links = append(sl.links, u.String())
+	}
+	return sl
+}
+
+// logLinks logs share links.
+func logLinks(config *internal.Config, listenHost, port, public string, l *zap.SugaredLogger) {
+	for _, sl := range shareLinks(config, listenHost, port, public) {
+		l.Infof("Links for %s:", sl.server)
+		for i, link := range sl.links {
+			l.Infof("%20s: %s", sl.users[i], link)
+		}
+	}
+}
+
+// printLinks prints share links for links command.
+func printLinks(w io.Writer, config *internal.Config, listenHost, port, public string) {
+	for i, sl := range shareLinks(config, listenHost, port, public) {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "# %s\n", sl.server)
+		for j, link := range sl.links {
+			fmt.Fprintf(w, "%s: %s\n", sl.users[j], link)
+		}
+	}
+}
+
+// checkServers checks that advertised server names resolve to addresses of this host: local interface addresses,
+// or public address (detected one, or detected on demand for hosts behind NAT). It also checks that advertised
+// ports match the listen port. Problems are logged as warnings; it returns false if there were any.
+// The "auto" server is checked on detection instead.
+func checkServers(config *internal.Config, public string, port string, l *zap.SugaredLogger) bool {
+	local := make(map[string]bool)
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				local[ipnet.IP.String()] = true
+			}
+		}
+	}
+	if public != "" {
+		local[public] = true
+	}
+
+	ok := true
+	var detected bool
+	for _, s := range config.AdvertisedServers() {
+		if s.Port != 0 && strconv.Itoa(s.Port) != port {
+			l.Warnf("Advertised server %s port %d doesn't match listen port %s.", s.Host, s.Port, port)
+			ok = false
+		}
+
+		if s.Host == internal.AutoServer {
+			continue
+		}
+		host := strings.TrimSuffix(strings.TrimPrefix(s.Host, "["), "]")
+		if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+			l.Warnf("Advertised server %s is not a public address, links will not work from the Internet.", host)
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			l.Warnf("Advertised server %s doesn't resolve: %s.", host, err)
+			ok = false
+			continue
+		}
+
+		found := matchAddrs(addrs, local)
+		if !found && !detected {
+			// maybe we are behind NAT
+			detected = true
+			if ip, method, err := detectPublicAddress(context.Background(), config.PublicAddress.Endpoint()); err == nil {
+				l.Infof("Public address %s detected via %s.", ip, method)
+				local[ip.String()] = true
+				found = matchAddrs(addrs, local)
+			}
+		}
+
+		switch {
+		case found:
+		case net.ParseIP(host) != nil:
+			l.Warnf("Advertised server %s is not an address of this host.", host)
+			ok = false
+		default:
+			l.Warnf("Advertised server %s resolves to %s, not to this host's addresses.", host, strings.Join(addrs, ", "))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// matchAddrs returns true if any of addrs is in set.
+func matchAddrs(addrs []string, set map[string]bool) bool {
+	for _, a := range addrs {
+		if set[net.ParseIP(a).String()] {
+			return true
+		}
+	}
+	return false
+}
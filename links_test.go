@@ -0,0 +1,74 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/AlekSi/telesock/internal"
+)
+
+func TestShareLinks(t *testing.T) {
+	for name, tc := range map[string]struct {
+		server     string
+		listenHost string
+		expected   string // server query parameter, or empty if there should be no links
+	}{
+		"IPv4":              {server: "203.0.113.1", expected: "203.0.113.1"},
+		"IPv6":              {server: "2001:db8::1", expected: "[2001:db8::1]"},
+		"IPv6Bracketed":     {server: "[2001:db8::1]", expected: "[2001:db8::1]"},
+		"Hostname":          {server: "proxy.example.com", listenHost: "203.0.113.1", expected: "proxy.example.com"},
+		"ListenIPv4":        {listenHost: "203.0.113.2", expected: "203.0.113.2"},
+		"ListenIPv6":        {listenHost: "2001:db8::2", expected: "[2001:db8::2]"},
+		"ListenUnspecified": {listenHost: "0.0.0.0"},
+		"ListenIPv6Any":     {listenHost: "::"},
+		"ListenHostname":    {listenHost: "localhost"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := &internal.Config{
+				Server: tc.server,
+				Users:  []internal.User{{Username: "user 1", Password: "p&ss=1?"}},
+			}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			res := shareLinks(config, tc.listenHost, "1080", "")
+			if tc.expected == "" {
+				if len(res) != 0 {
+					t.Fatalf("expected no links, got %v", res)
+				}
+				return
+			}
+			if len(res) != 1 || len(res[0].links) != 1 {
+				t.Fatalf("expected a single link, got %v", res)
+			}
+			if expected := tc.expected + ":1080"; res[0].server != expected {
+				t.Errorf("expected server %q, got %q", expected, res[0].server)
+			}
+
+			// link is a valid URL with all parameters preserved
+			u, err := url.Parse(res[0].links[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Scheme != "https" || u.Host != "t.me" || u.Path != "/socks" {
+				t.Errorf("unexpected link %s", u)
+			}
+			q := u.Query()
+			for k, v := range map[string]string{"server": tc.expected, "port": "1080", "user": "user 1", "pass": "p&ss=1?"} {
+				if actual := q.Get(k); actual != v {
+					t.Errorf("expected %s=%q, got %q", k, v, actual)
+				}
+			}
+		})
+	}
+}
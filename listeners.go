@@ -0,0 +1,108 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekSi/telesock/internal"
+)
+
+// taggedListener is a running additional listener.
+type taggedListener struct {
+	cancel context.CancelFunc
+}
+
+// taggedListeners runs additional tagged listeners from configuration and updates them on reload:
+// added listeners are started, removed ones are stopped, unchanged ones are kept with their connections.
+// Stopped listeners stop accepting, while their established connections are finished normally.
+type taggedListeners struct {
+	m       sync.Mutex
+	ctx     context.Context // nil until started
+	stopped bool
+	wg      sync.WaitGroup
+	l       *zap.SugaredLogger
+	srv     *internal.Server
+	running map[internal.Listener]*taggedListener
+}
+
+// listeners is updated by reloadConfig.
+var listeners taggedListeners
+
+// start starts listeners from the current configuration. They are stopped when ctx is canceled.
+func (tl *taggedListeners) start(ctx context.Context, l *zap.SugaredLogger, srv *internal.Server) {
+	tl.m.Lock()
+	defer tl.m.Unlock()
+
+	tl.ctx, tl.l, tl.srv = ctx, l, srv
+	tl.running = make(map[internal.Listener]*taggedListener)
+	tl.update(srv.Config().Listeners)
+}
+
+// Update starts added and stops removed listeners. It does nothing before start and after wait.
+func (tl *taggedListeners) Update(listeners []internal.Listener) {
+	tl.m.Lock()
+	defer tl.m.Unlock()
+
+	if tl.ctx == nil || tl.stopped {
+		return
+	}
+	tl.update(listeners)
+}
+
+func (tl *taggedListeners) update(listeners []internal.Listener) {
+	keep := make(map[internal.Listener]bool, len(listeners))
+	for _, listener := range listeners {
+		keep[listener] = true
+	}
+	for listener, r := range tl.running {
+		if !keep[listener] {
+			tl.l.Warnf("Stopping listener %q on %s removed from configuration.", listener.Tag, listener.Listen)
+			r.cancel()
+			delete(tl.running, listener)
+		}
+	}
+
+	for _, listener := range listeners {
+		if tl.running[listener] != nil {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(tl.ctx)
+		r := &taggedListener{cancel: cancel}
+		tl.running[listener] = r
+		listener := listener
+		tl.wg.Add(1)
+		go func() {
+			defer tl.wg.Done()
+			runTCPListener(ctx, tl.ctx, listener.Listen, listener.Tag, listener.Type, false, tl.l, tl.srv)
+
+			// forget listener that failed to start, so it is retried on the next reload
+			tl.m.Lock()
+			if tl.running[listener] == r {
+				delete(tl.running, listener)
+			}
+			tl.m.Unlock()
+			cancel()
+		}()
+	}
+}
+
+// wait waits for all listeners and their connections to stop after context is canceled.
+func (tl *taggedListeners) wait() {
+	tl.m.Lock()
+	tl.stopped = true
+	tl.m.Unlock()
+
+	tl.wg.Wait()
+}
@@ -11,11 +11,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -27,40 +30,120 @@ import (
 	"github.com/AlekSi/telesock/internal"
 )
 
-func runTCPConn(ctx context.Context, c *net.TCPConn, l *zap.SugaredLogger, conf *internal.Config) {
-	tcp := internal.NewTCPConn(c, l, conf)
+func runTCPConn(ctx context.Context, c net.Conn, tag, typ string, tunnel bool, l *zap.SugaredLogger, srv *internal.Server) {
+	if srv.RejectDenied(ctx, c, l) {
+		return
+	}
+
+	if tunnel {
+		// limit handshake duration
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		tc, err := internal.NewTunnelServer(c, srv.Config().Tunnel.PSK)
+		if err != nil {
+			l.Error(err)
+			c.Close()
+			return
+		}
+		c.SetDeadline(time.Time{})
+		c = tc
+	}
+
+	tcp := internal.NewTCPConn(c, tag, l, srv)
 	defer tcp.Close()
 
-	if !tcp.Auth(ctx) {
-		return
+	// handshake is interrupted on shutdown, and relay is stopped by Run
+	interruptDone := tcp.InterruptOnShutdown(ctx)
+	ok := handshakeTCPConn(ctx, tcp, typ, srv)
+	interruptDone()
+	if ok {
+		tcp.Run(ctx)
 	}
-	if !tcp.Req(ctx) {
-		return
+}
+
+// handshakeTCPConn performs SOCKS5 or MTProto proxy handshake. It returns true if the connection should be relayed.
+func handshakeTCPConn(ctx context.Context, tcp *internal.TCPConn, typ string, srv *internal.Server) bool {
+	if !tcp.EnterPreAuth() {
+		return false
+	}
+
+	if typ == internal.ListenerTypeMTProto {
+		// clients get no response during maintenance
+		return !srv.Maintenance() && tcp.MTProto(ctx)
+	}
+
+	if !tcp.Sniff() {
+		return false
+	}
+
+	if srv.Maintenance() {
+		tcp.Refuse()
+		return false
+	}
+
+	return tcp.Auth(ctx) && tcp.Req(ctx)
+}
+
+// remoteAddr returns remote address of the connection for logging, or "unknown" if it is not available.
+func remoteAddr(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil {
+		return addr.String()
 	}
-	tcp.Run(ctx)
+	return "unknown"
 }
 
-func runTCPListener(ctx context.Context, addr string, l *zap.SugaredLogger, conf *internal.Config) {
+// runTCPListener accepts SOCKS5 or MTProto proxy connections on given address, tagging them with given listener tag,
+// until ctx is canceled. Accepted connections are stopped when shutdown is canceled; it returns after they are finished.
+// If tunnel is true, connections are expected to be wrapped in encrypted tunnel.
+func runTCPListener(ctx, shutdown context.Context, addr, tag, typ string, tunnel bool, l *zap.SugaredLogger, srv *internal.Server) {
 	tcp, err := net.Listen("tcp", addr)
 	if err != nil {
 		l.Error(err)
 		return
 	}
 
+	// connections are stopped on shutdown after the listener is closed, so no new ones are accepted meanwhile
+	connCtx, connCancel := context.WithCancel(context.Background())
+	defer connCancel()
 	go func() {
 		<-ctx.Done()
 		tcp.Close()
 		l.Infof("Listener closed.")
+
+		select {
+		case <-shutdown.Done():
+			connCancel()
+		case <-connCtx.Done():
+		}
 	}()
 
+	n := srv.Config().AcceptGoroutines
+	if n == 0 {
+		n = 1
+	}
+
+	// connections are set up in their own goroutines, so accept goroutines only accept them
 	var wg sync.WaitGroup
-	l.Infof("Listener started on %s.", tcp.Addr())
+	l.Infof("Listener %q started on %s with %d accept goroutines.", tag, tcp.Addr(), n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acceptTCPConns(connCtx, tcp, tag, typ, tunnel, l, srv, &wg)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// acceptTCPConns accepts connections until listener is closed, running each in a new goroutine added to wg.
+func acceptTCPConns(ctx context.Context, tcp net.Listener, tag, typ string, tunnel bool, l *zap.SugaredLogger, srv *internal.Server, wg *sync.WaitGroup) {
 	for {
+		srv.WaitFDs(ctx, l)
 		c, err := tcp.Accept()
 		if err != nil {
 			// are we done?
-			if ctx.Err() != nil {
-				break
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
 
 			// wait a little before next accept attempt to give OS a chance to free resources
@@ -69,112 +152,455 @@ func runTCPListener(ctx context.Context, addr string, l *zap.SugaredLogger, conf
 			continue
 		}
 
-		conn := c.(*net.TCPConn)
-		if err = conn.SetReadBuffer(4096); err != nil {
-			l.Warn(err)
-		}
-		if err = conn.SetWriteBuffer(4096); err != nil {
-			l.Warn(err)
-		}
-
 		wg.Add(1)
-		go runTCPConn(ctx, conn, l.With(zap.String("client", c.RemoteAddr().String())), conf)
+		go func() {
+			defer wg.Done()
+
+			// buffer tuning is TCP-specific; other listeners' connections are served as is
+			if conn, ok := c.(*net.TCPConn); ok {
+				if err := conn.SetReadBuffer(4096); err != nil {
+					l.Warn(err)
+				}
+				if err := conn.SetWriteBuffer(4096); err != nil {
+					l.Warn(err)
+				}
+			}
+
+			cl := l.With(zap.String("listener", tag), zap.String("client", remoteAddr(c)))
+			runTCPConn(ctx, c, tag, typ, tunnel, cl, srv)
+		}()
 	}
+}
 
-	wg.Wait()
+func runAdmin(ctx context.Context, addr string, l *zap.SugaredLogger, srv *internal.Server) {
+	s := &http.Server{
+		Addr:    addr,
+		Handler: srv.AdminHandler(l),
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	l.Infof("Admin API started on %s.", addr)
+	if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		l.Error(err)
+		return
+	}
+	l.Infof("Admin API stopped.")
 }
 
-func loadConfig(path string, l *zap.SugaredLogger, port string) *internal.Config {
-	// read and parse config
+// readConfig reads, parses and validates configuration file.
+func readConfig(path string) (*internal.Config, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		l.Fatalf("Can't read configuration file: %s.", err)
+		return nil, fmt.Errorf("can't read configuration file: %s", err)
 	}
 	var config internal.Config
 	if err = yaml.UnmarshalStrict(b, &config); err != nil {
-		l.Fatalf("Can't read configuration: %s.", err)
+		return nil, fmt.Errorf("can't read configuration: %s", err)
+	}
+	if err = config.LoadUserFiles(); err != nil {
+		return nil, fmt.Errorf("can't read users: %s", err)
+	}
+	if *dialTimeoutF != 0 {
+		config.DialTimeout = *dialTimeoutF
+	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %s", err)
+	}
+	if config.Chaos.Enabled && !*allowChaosF {
+		return nil, fmt.Errorf("chaos testing is enabled in configuration, but --unsafe-allow-chaos flag is not set")
+	}
+	return &config, nil
+}
+
+func loadConfig(path string, l *zap.SugaredLogger) *internal.Config {
+	config, err := readConfig(path)
+	if err != nil {
+		l.Fatalf("%s.", err)
 	}
 
 	l.Infof("Loaded %d users.", len(config.Users))
-	if config.Server == "" {
-		return &config
+	warnCapture(config, l)
+	warnChaos(config, l)
+	return config
+}
+
+// reloadM serializes configuration reloads requested by signals, service control and users directory watcher.
+var reloadM sync.Mutex
+
+// reloadConfig replaces server configuration, keeping the old one on error.
+func reloadConfig(path string, l *zap.SugaredLogger, srv *internal.Server) {
+	reloadM.Lock()
+	defer reloadM.Unlock()
+
+	// reload may be requested by users directory watcher or Service Control Manager after shutdown has begun
+	if srv.ShuttingDown() {
+		l.Warnf("Configuration is not reloaded during shutdown.")
+		return
 	}
 
-	u := &url.URL{
-		Scheme: "https",
-		Host:   "t.me",
-		Path:   "socks",
+	config, err := readConfig(path)
+	if err != nil {
+		l.Errorf("Configuration is not reloaded: %s.", err)
+		return
 	}
-	for _, user := range config.Users {
-		q := make(url.Values)
-		q.Set("server", config.Server)
-		q.Set("port", port)
-		q.Set("user", user.Username)
-		q.Set("pass", user.Password)
-		u.RawQuery = q.Encode()
 
-		l.Infof("%20s: %s", user.Username, u.String())
+	srv.SetConfig(config)
+	l.Warnf("Configuration reloaded, %d users.", len(config.Users))
+	listeners.Update(config.Listeners)
+	warnCapture(config, l)
+	warnChaos(config, l)
+}
+
+// beginShutdown marks server as shutting down, so readiness check fails. It waits for reload in progress,
+// and later reloads are ignored.
+func beginShutdown(l *zap.SugaredLogger, srv *internal.Server) {
+	reloadM.Lock()
+	defer reloadM.Unlock()
+
+	srv.SetShuttingDown()
+	l.Infof("Shutting down, readiness check fails, %d active connections.", srv.Active())
+}
+
+// warnCapture reminds that traffic capture is enabled, as captured data is sensitive.
+func warnCapture(config *internal.Config, l *zap.SugaredLogger) {
+	if c := config.Capture; c.Enabled {
+		l.Warnf(
+			"Traffic capture is enabled for %d rules (more may be added via admin API): all relayed data "+
+				"of matching connections, including credentials and personal data, is written to %s.", len(c.Rules), c.Dir,
+		)
 	}
+}
 
-	return &config
+// warnChaos reminds that chaos testing is enabled, as client connections are broken on purpose.
+func warnChaos(config *internal.Config, l *zap.SugaredLogger) {
+	if c := config.Chaos; c.Enabled {
+		l.Warnf("Chaos testing is enabled (settings may be changed via admin API): %s.", &c)
+	}
 }
 
+// usersDirPollInterval is the interval between checks of users directory.
+const usersDirPollInterval = 2 * time.Second
+
+// usersDirState returns a string that changes when user files are added, removed or modified.
+func usersDirState(dir string) string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err.Error()
+	}
+
+	var b strings.Builder
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), ".yaml") {
+			fmt.Fprintf(&b, "%s %d %d\n", fi.Name(), fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// watchUsersDir reloads configuration when users directory changes, until context is canceled.
+// Directory is polled, so it works the same way on all platforms and file systems.
+func watchUsersDir(ctx context.Context, reload func(), l *zap.SugaredLogger, srv *internal.Server) {
+	t := time.NewTicker(usersDirPollInterval)
+	defer t.Stop()
+
+	dir := srv.Config().UsersDir
+	var state string
+	if dir != "" {
+		state = usersDirState(dir)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		// directory itself may be changed by reload
+		d := srv.Config().UsersDir
+		if d == "" {
+			dir = ""
+			continue
+		}
+		s := usersDirState(d)
+		if d != dir {
+			dir, state = d, s
+			continue
+		}
+		if s == state {
+			continue
+		}
+
+		state = s
+		l.Warnf("Users directory %s changed, reloading configuration.", dir)
+		reload()
+	}
+}
+
+// exit terminates the process; tests replace it.
+var exit = os.Exit
+
+// handleSignals handles signals one by one, so configuration reload never races with shutdown:
+// once shutdown has begun, reload and maintenance signals are ignored,
+// and the second termination signal forces immediate exit without waiting for connections to finish.
+func handleSignals(ctx context.Context, cancel context.CancelFunc, signals <-chan os.Signal, configPath string, l *zap.SugaredLogger, srv *internal.Server) {
+	for s := range signals {
+		if ctx.Err() != nil {
+			if s == syscall.SIGTERM || s == syscall.SIGINT {
+				l.Errorf("Got %v (%d) signal during shutdown, exiting immediately with %d active connections.", s, s, srv.Active())
+				l.Sync()
+				exit(1)
+			}
+			l.Warnf("Got %v signal during shutdown, ignoring.", s)
+			continue
+		}
+
+		switch s {
+		case syscall.SIGHUP:
+			reloadConfig(configPath, l, srv)
+
+		case maintenanceSignal:
+			if srv.SetMaintenance(true) {
+				l.Warnf("Entering maintenance mode, %d active connections.", srv.Active())
+				continue
+			}
+			srv.SetMaintenance(false)
+			l.Warnf("Leaving maintenance mode.")
+
+		default:
+			l.Warnf("Got %v (%d) signal, shutting down...", s, s)
+			cancel()
+		}
+	}
+}
+
+var (
+	runCmd   = kingpin.Command("run", "Run server.").Default()
+	linksCmd = kingpin.Command("links", "Print share links for all users and advertised servers.")
+	checkCmd = kingpin.Command("check", "Check configuration and advertised servers.")
+
+	// chaos testing breaks connections on purpose, so configuration alone is not enough to enable it
+	allowChaosF = kingpin.Flag("unsafe-allow-chaos", "Allow chaos testing (breaks client connections, never use in production)").Bool()
+
+	// applied on every configuration reload
+	dialTimeoutF = kingpin.Flag("dial-timeout", "Timeout of outbound connections if connect_timeout is not set (overrides dial_timeout)").Duration()
+)
+
 func main() {
 	// parse flags
 	tcpListenF := kingpin.Flag("tcp-listen", "TCP address to listen").Default(":1080").String()
 	configF := kingpin.Flag("config", "Config file name").Default("telesock.yaml").String()
 	verboseF := kingpin.Flag("verbose", "Log INFO level log messages").Bool()
 	debugF := kingpin.Flag("debug", "Log DEBUG level log messages (implies --verbose)").Bool()
-	kingpin.Parse()
+	adminListenF := kingpin.Flag("admin-listen", "HTTP address for admin API (disabled if empty)").String()
+	summaryIntervalF := kingpin.Flag("summary-interval", "Interval of periodic summary log messages (disabled if zero)").Duration()
+	configSummaryF := kingpin.Flag("config-summary", "Log effective configuration on start (secrets are redacted)").Default("true").Bool()
+	tracePayloadF := kingpin.Flag(
+		"trace-payload", "Log the first N bytes of each relay direction of connections logged at DEBUG level (for debugging only, logs contain sensitive data)",
+	).Default("0").Int()
+	command := kingpin.Parse()
 
 	// setup logger
+	// the core enables all levels; global level is applied on top of it, so it may be overridden per user
 	loggerConfig := zap.NewDevelopmentConfig()
 	loggerConfig.DisableStacktrace = true
-	logger, err := loggerConfig.Build()
+	loggerConfig.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	level := zap.NewAtomicLevelAt(zap.DebugLevel)
+	logger, err := loggerConfig.Build(internal.LevelOption(level))
 	if err != nil {
 		panic(err)
 	}
 	l := logger.Sugar()
 	defer l.Sync()
 
-	_, port, err := net.SplitHostPort(*tcpListenF)
+	if manageService(command, *configF, l) {
+		return
+	}
+
+	listenHost, port, err := net.SplitHostPort(*tcpListenF)
 	if err != nil {
 		l.Fatal(err)
 	}
 
-	config := loadConfig(*configF, l, port)
+	config := loadConfig(*configF, l)
+	public := publicAddress(context.Background(), config, l)
+	serversOk := checkServers(config, public, port, l)
+	switch {
+	case command == checkCmd.FullCommand():
+		if !serversOk {
+			l.Fatalf("Advertised servers don't match this host.")
+		}
+		l.Infof("Configuration is valid.")
+		return
+	case !serversOk && config.StrictServerCheck:
+		l.Fatalf("Advertised servers don't match this host, exiting due to strict_server_check.")
+	}
+	if command == linksCmd.FullCommand() {
+		printLinks(os.Stdout, config, listenHost, port, public)
+		return
+	}
+	logLinks(config, listenHost, port, public, l)
+
+	if err = config.Admin.CheckListen(*adminListenF); err != nil {
+		l.Fatalf("Can't start admin API: %s.", err)
+	}
+
+	srv := internal.NewServer(config)
+	srv.LoadAccounting(l)
+	srv.LoadGeoIP(l)
+
+	if n := *tracePayloadF; n != 0 {
+		if n < 0 || n > internal.MaxTracePayload {
+			l.Fatalf("--trace-payload should be between 0 and %d.", internal.MaxTracePayload)
+		}
+		l.Warnf(
+			"Payload tracing is enabled: the first %d bytes of each relay direction, including credentials and personal data, "+
+				"are logged for connections logged at DEBUG level.", n,
+		)
+		srv.SetTracePayload(n)
+	}
 
 	// set logger level after config is parsed
 	switch {
 	case *debugF:
-		loggerConfig.Level.SetLevel(zap.DebugLevel)
+		level.SetLevel(zap.DebugLevel)
 	case *verboseF:
-		loggerConfig.Level.SetLevel(zap.InfoLevel)
+		level.SetLevel(zap.InfoLevel)
 	default:
-		loggerConfig.Level.SetLevel(zap.WarnLevel)
+		level.SetLevel(zap.WarnLevel)
+	}
+
+	if *configSummaryF {
+		l.Warnw("Effective configuration.", "listen", *tcpListenF, "admin_listen", *adminListenF, "config", config.Summary())
+	}
+
+	reload := func() {
+		reloadConfig(*configF, l, srv)
+	}
+	run := func(ctx context.Context) {
+		go watchUsersDir(ctx, reload, l.With(zap.String("component", "users_dir")), srv)
+		serve(ctx, *tcpListenF, *adminListenF, *summaryIntervalF, public, l, srv)
+	}
+	if runService(command, run, reload, l) {
+		return
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// handle termination signals
+	// handle signals
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	if maintenanceSignal != nil {
+		signal.Notify(signals, maintenanceSignal)
+	}
+	go handleSignals(ctx, cancel, signals, *configF, l, srv)
+
+	run(ctx)
+}
+
+// serve starts all listeners and waits for them to stop after context is canceled.
+// public is the detected public address for "auto" advertised server.
+// Shutdown is ordered: readiness check fails first, then listeners and background tasks are stopped
+// and relayed connections are closed, and admin API (with metrics) is stopped last.
+func serve(ctx context.Context, tcpListen, adminListen string, summaryInterval time.Duration, public string, l *zap.SugaredLogger, srv *internal.Server) {
+	// start admin API
+	adminCtx, adminCancel := context.WithCancel(context.Background())
+	defer adminCancel()
+	var adminWG sync.WaitGroup
+	if adminListen != "" {
+		adminWG.Add(1)
+		go func() {
+			defer adminWG.Done()
+			runAdmin(adminCtx, adminListen, l.With(zap.String("component", "admin")), srv)
+		}()
+	}
+
+	// everything else is stopped after readiness check starts to fail
+	parent := ctx
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
-		s := <-signals
-		signal.Stop(signals)
-		l.Warnf("Got %v (%d) signal, shutting down...", s, s)
+		<-parent.Done()
+		beginShutdown(l, srv)
 		cancel()
 	}()
 
 	var wg sync.WaitGroup
 
+	// start periodic summary
+	if summaryInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.RunSummary(ctx, summaryInterval, l.With(zap.String("component", "summary")))
+		}()
+	}
+
+	// start periodic flushing of traffic counters
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.RunAccounting(ctx, l.With(zap.String("component", "accounting")))
+	}()
+
+	// start memory watchdog
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.RunMemoryWatchdog(ctx, l.With(zap.String("component", "memory")))
+	}()
+
+	// start sending audit events
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.RunAudit(ctx, l.With(zap.String("component", "audit")))
+	}()
+
+	// start active health checks of upstreams
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		srv.RunUpstreamProbes(ctx, l.With(zap.String("component", "probe")))
+	}()
+
+	// start periodic re-checks of public address
+	if config := srv.Config(); config.HasAutoServer() && config.PublicAddress.RecheckInterval > 0 {
+		if listenHost, port, err := net.SplitHostPort(tcpListen); err == nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				watchPublicAddress(ctx, public, listenHost, port, l.With(zap.String("component", "public_address")), srv)
+			}()
+		}
+	}
+
 	// start TCP listener
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		runTCPListener(ctx, *tcpListenF, l.With(zap.String("component", "tcp")), config)
+		runTCPListener(ctx, ctx, tcpListen, internal.ListenerDefault, internal.ListenerTypeSOCKS5, false, l.With(zap.String("component", "tcp")), srv)
 	}()
 
+	// start additional tagged listeners, updated on reload
+	listeners.start(ctx, l.With(zap.String("component", "tcp")), srv)
+
+	// start encrypted tunnel listener
+	if addr := srv.Config().Tunnel.Listen; addr != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runTCPListener(ctx, ctx, addr, internal.ListenerTunnel, internal.ListenerTypeSOCKS5, true, l.With(zap.String("component", "tunnel")), srv)
+		}()
+	}
+
 	wg.Wait()
+	listeners.wait()
+
+	adminCancel()
+	adminWG.Wait()
 }
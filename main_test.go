@@ -0,0 +1,753 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/AlekSi/telesock/internal"
+)
+
+func TestReloadDuringShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telesock.yaml")
+	if err := ioutil.WriteFile(path, []byte("users:\n  - username: user1\n    password: pass1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		config, err := readConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := internal.NewServer(config)
+		var buf bytes.Buffer
+		core := zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), zapcore.Lock(zapcore.AddSync(&buf)), zap.DebugLevel)
+		l := zap.New(core).Sugar()
+
+		// reload and shutdown at almost the same moment
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			reloadConfig(path, l, srv)
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			beginShutdown(l, srv)
+		}()
+		close(start)
+		wg.Wait()
+
+		// reload either completes before shutdown, or is ignored
+		log := buf.String()
+		shutdown := strings.Index(log, "Shutting down")
+		reloaded := strings.Index(log, "Configuration reloaded")
+		ignored := strings.Index(log, "Configuration is not reloaded during shutdown")
+		switch {
+		case shutdown < 0:
+			t.Fatalf("shutdown is not logged:\n%s", log)
+		case reloaded >= 0 && ignored < 0:
+			if reloaded > shutdown {
+				t.Fatalf("configuration is reloaded after shutdown has begun:\n%s", log)
+			}
+		case reloaded < 0 && ignored >= 0:
+			if ignored < shutdown {
+				t.Fatalf("reload is ignored before shutdown has begun:\n%s", log)
+			}
+			if srv.Config() != config {
+				t.Fatal("configuration is replaced")
+			}
+		default:
+			t.Fatalf("unexpected log:\n%s", log)
+		}
+
+		// later reloads are always ignored
+		current := srv.Config()
+		reloadConfig(path, l, srv)
+		if srv.Config() != current {
+			t.Fatal("configuration is replaced after shutdown")
+		}
+	}
+}
+
+func TestDialTimeoutFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "telesock.yaml")
+	if err := ioutil.WriteFile(path, []byte("dial_timeout: 5s\nusers:\n  - username: user1\n    password: pass1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for flag, expected := range map[time.Duration]time.Duration{
+		0:           5 * time.Second,
+		time.Second: time.Second,
+	} {
+		*dialTimeoutF = flag
+		config, err := readConfig(path)
+		*dialTimeoutF = 0
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.DialTimeout != expected {
+			t.Errorf("--dial-timeout=%s: expected %s, got %s", flag, expected, config.DialTimeout)
+		}
+		if p := config.Policy(nil, "192.0.2.1", net.IPv4(192, 0, 2, 1)); p.ConnectTimeout != expected {
+			t.Errorf("--dial-timeout=%s: expected connect timeout %s, got %s", flag, expected, p.ConnectTimeout)
+		}
+	}
+}
+
+func TestSecondSignal(t *testing.T) {
+	for _, second := range []os.Signal{syscall.SIGTERM, syscall.SIGINT} {
+		t.Run(second.String(), func(t *testing.T) {
+			codes := make(chan int, 1)
+			exit = func(code int) { codes <- code }
+			defer func() { exit = os.Exit }()
+
+			config := &internal.Config{Users: []internal.User{{Username: "user1", Password: "pass1"}}}
+			if err := config.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handleSignals(ctx, cancel, signals, "", zap.NewNop().Sugar(), internal.NewServer(config))
+			}()
+
+			// the first signal begins shutdown, which never finishes
+			signals <- syscall.SIGTERM
+			<-ctx.Done()
+			signals <- syscall.SIGHUP
+			select {
+			case code := <-codes:
+				t.Fatalf("unexpected exit with %d", code)
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			signals <- second
+			select {
+			case code := <-codes:
+				if code != 1 {
+					t.Errorf("expected exit code 1, got %d", code)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+
+			close(signals)
+			<-done
+		})
+	}
+}
+
+// BenchmarkConnChurn measures the rate of short-lived connections a listener accepts and serves,
+// depending on the number of accept goroutines.
+func BenchmarkConnChurn(b *testing.B) {
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("AcceptGoroutines%d", n), func(b *testing.B) {
+			config := &internal.Config{
+				Users:            []internal.User{{Username: "user1", Password: "pass1"}},
+				AcceptGoroutines: n,
+			}
+			if err := config.Validate(); err != nil {
+				b.Fatal(err)
+			}
+			srv := internal.NewServer(config)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			addr := ln.Addr().String()
+			ln.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				runTCPListener(ctx, ctx, addr, internal.ListenerDefault, internal.ListenerTypeSOCKS5, false, zap.NewNop().Sugar(), srv)
+			}()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			// authenticate and connect to the built-in echo destination
+			request := []byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, 1, 0, 1, 0, 0, 0, 1, 0, 7}
+			churn := func() error {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					return err
+				}
+				defer c.Close()
+
+				// avoid running out of local ports because of TIME_WAIT
+				c.(*net.TCPConn).SetLinger(0)
+				if _, err = c.Write(request); err != nil {
+					return err
+				}
+				_, err = io.ReadFull(c, make([]byte, 2+2+10))
+				return err
+			}
+			for start := time.Now(); churn() != nil; time.Sleep(10 * time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					b.Fatal("listener is not started")
+				}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := churn(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
+
+// nilAddrConn is a connection without remote address.
+type nilAddrConn struct {
+	net.Conn
+}
+
+func (nilAddrConn) RemoteAddr() net.Addr { return nil }
+
+// chanListener returns connections sent to the channel; Accept fails after Close.
+type chanListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (cl *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-cl.conns:
+		return c, nil
+	case <-cl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (cl *chanListener) Close() error {
+	cl.once.Do(func() { close(cl.closed) })
+	return nil
+}
+
+func (cl *chanListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestNilRemoteAddr(t *testing.T) {
+	config := &internal.Config{Users: []internal.User{{Username: "user1", Password: "pass1"}}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := internal.NewServer(config)
+	var buf bytes.Buffer
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.Lock(zapcore.AddSync(&buf)), zap.DebugLevel)
+	l := zap.New(core).Sugar()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ln := &chanListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	ln.conns <- nilAddrConn{c1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		acceptTCPConns(ctx, ln, internal.ListenerDefault, internal.ListenerTypeSOCKS5, false, l, srv, &wg)
+		wg.Wait()
+	}()
+
+	// the connection is served as usual: authenticate and relay via the built-in echo destination
+	c2.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{5, 1, 2, 1, 5, 'u', 's', 'e', 'r', '1', 5, 'p', 'a', 's', 's', '1', 5, 1, 0, 1, 0, 0, 0, 1, 0, 7}
+	if _, err := c2.Write(append(request, "ping"...)); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 2+2+10+4)
+	if _, err := io.ReadFull(c2, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[5] != 0 || string(res[14:]) != "ping" {
+		t.Fatalf("unexpected response % x", res)
+	}
+	c2.Close()
+
+	cancel()
+	ln.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	if s := remoteAddr(nilAddrConn{c1}); s != "unknown" {
+		t.Errorf("expected unknown, got %q", s)
+	}
+	if !strings.Contains(buf.String(), `"client":"unknown"`) {
+		t.Errorf("expected client field to be unknown:\n%s", buf.String())
+	}
+}
+
+// testLogBuffer collects log entries written by concurrent goroutines.
+type testLogBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (tb *testLogBuffer) Write(p []byte) (int, error) {
+	tb.m.Lock()
+	defer tb.m.Unlock()
+	return tb.buf.Write(p)
+}
+
+func (tb *testLogBuffer) Sync() error { return nil }
+
+// Logger returns logger writing JSON entries of given level and above to the buffer.
+func (tb *testLogBuffer) Logger(level zapcore.Level) *zap.SugaredLogger {
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), tb, level)
+	return zap.New(core).Sugar()
+}
+
+// Entries returns logged entries with given message (all if empty).
+func (tb *testLogBuffer) Entries(msg string) []map[string]interface{} {
+	tb.m.Lock()
+	defer tb.m.Unlock()
+
+	var res []map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(tb.buf.Bytes()))
+	for {
+		var e map[string]interface{}
+		if err := d.Decode(&e); err != nil {
+			return res
+		}
+		if msg == "" || e["msg"] == msg {
+			res = append(res, e)
+		}
+	}
+}
+
+// testFreeAddr returns loopback address with a port that was free a moment ago.
+func testFreeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// testEchoRequest authenticates and connects to the built-in echo destination via proxy on addr,
+// waiting for the listener to start. It returns the connection and the authentication status.
+func testEchoRequest(t *testing.T, addr, username, password string) (net.Conn, byte) {
+	t.Helper()
+
+	var c net.Conn
+	var err error
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if c, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal(err)
+		}
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := []byte{5, 1, 2, 1, byte(len(username))}
+	b = append(b, username...)
+	b = append(b, byte(len(password)))
+	b = append(b, password...)
+	if _, err = c.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, 4)
+	if _, err = io.ReadFull(c, res); err != nil {
+		t.Fatal(err)
+	}
+	if res[3] != 0 {
+		return c, res[3]
+	}
+
+	if _, err = c.Write([]byte{5, 1, 0, 1, 0, 0, 0, 1, 0, 7}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(c, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, 0
+}
+
+// testMetrics returns metrics from admin API.
+func testMetrics(t *testing.T, srv *internal.Server) string {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}))
+	rw := httptest.NewRecorder()
+	srv.AdminHandler(zap.NewNop().Sugar()).ServeHTTP(rw, req)
+	if rw.Code != 200 {
+		t.Fatalf("unexpected status %d", rw.Code)
+	}
+	return rw.Body.String()
+}
+
+func TestTaggedListeners(t *testing.T) {
+	internalAddr, externalAddr := testFreeAddr(t), testFreeAddr(t)
+	config := &internal.Config{
+		Users: []internal.User{
+			{Username: "user1", Password: "pass1", Listeners: []string{"internal"}},
+			{Username: "user2", Password: "pass2"},
+		},
+		Listeners: []internal.Listener{
+			{Listen: internalAddr, Tag: "internal"},
+			{Listen: externalAddr, Tag: "external"},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := internal.NewServer(config)
+	var logs testLogBuffer
+	l := logs.Logger(zap.InfoLevel)
+
+	var tl taggedListeners
+	ctx, cancel := context.WithCancel(context.Background())
+	tl.start(ctx, l, srv)
+
+	// the tag is used for per-listener access control
+	for _, r := range []struct {
+		addr, username, password string
+		status                   byte
+	}{
+		{internalAddr, "user1", "pass1", 0},
+		{externalAddr, "user1", "pass1", 1},
+		{internalAddr, "user2", "pass2", 0},
+		{externalAddr, "user2", "pass2", 0},
+	} {
+		c, status := testEchoRequest(t, r.addr, r.username, r.password)
+		c.Close()
+		if status != r.status {
+			t.Errorf("%s on %s: expected status %d, got %d", r.username, r.addr, r.status, status)
+		}
+	}
+	for start := time.Now(); srv.Active() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("timeout")
+		}
+	}
+
+	// and is exposed in metrics and logs
+	metrics := testMetrics(t, srv)
+	for _, line := range []string{
+		`telesock_listener_connections_total{listener="internal"} 2`,
+		`telesock_listener_connections_total{listener="external"} 2`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, metrics)
+		}
+	}
+
+	cancel()
+	tl.wait()
+	closed := make(map[string]int)
+	for _, e := range logs.Entries("Connection closed.") {
+		closed[fmt.Sprintf("%v %v", e["listener"], e["user"])]++
+	}
+	expected := map[string]int{"internal user1": 1, "external <nil>": 1, "internal user2": 1, "external user2": 1}
+	if !reflect.DeepEqual(closed, expected) {
+		t.Errorf("expected %v, got %v", expected, closed)
+	}
+}
+
+func TestShutdownNoErrors(t *testing.T) {
+	config := &internal.Config{Users: []internal.User{{Username: "user1", Password: "pass1"}}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := internal.NewServer(config)
+	var logs testLogBuffer
+	addr := testFreeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runTCPListener(ctx, ctx, addr, internal.ListenerDefault, internal.ListenerTypeSOCKS5, false, logs.Logger(zap.DebugLevel), srv)
+	}()
+
+	for i := 0; i < 3; i++ {
+		c, status := testEchoRequest(t, addr, "user1", "pass1")
+		defer c.Close()
+		if status != 0 {
+			t.Fatalf("unexpected status %d", status)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// connections in handshake are not waited for
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	partial, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Close()
+	if _, err = partial.Write([]byte{5, 1, 2, 1, 5, 'u', 's'}); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); srv.Active() != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("expected 5 active connections, got %d", srv.Active())
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// closed listener and connections are not errors
+	for _, e := range logs.Entries("") {
+		if e["level"] == "error" {
+			t.Errorf("unexpected error %v", e)
+		}
+	}
+	if entries := logs.Entries("Listener closed."); len(entries) != 1 {
+		t.Errorf("expected a single listener close message, got %v", entries)
+	}
+	if entries := logs.Entries("Connection closed on shutdown."); len(entries) != 3 {
+		t.Errorf("expected 3 connections closed on shutdown, got %v", entries)
+	}
+	entries := logs.Entries("Connection closed.")
+	for _, e := range entries {
+		if e["close_reason"] != "shutdown" {
+			t.Errorf("unexpected close reason %v", e)
+		}
+	}
+	if len(entries) != 5 {
+		t.Errorf("expected 5 closed connections, got %v", entries)
+	}
+}
+
+func TestServeShutdownOrder(t *testing.T) {
+	config := &internal.Config{Users: []internal.User{{Username: "user1", Password: "pass1"}}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	srv := internal.NewServer(config)
+	var logs testLogBuffer
+	addr, adminAddr := testFreeAddr(t), testFreeAddr(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(ctx, addr, adminAddr, 0, "", logs.Logger(zap.InfoLevel), srv)
+	}()
+
+	// relayed connection and connection in handshake
+	c, status := testEchoRequest(t, addr, "user1", "pass1")
+	defer c.Close()
+	if status != 0 {
+		t.Fatalf("unexpected status %d", status)
+	}
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + adminAddr + "/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == 200 && srv.Active() == 2 {
+				break
+			}
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("not ready: %v", err)
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	// everything is closed when serve returns
+	for _, a := range []string{addr, adminAddr} {
+		if c, err := net.Dial("tcp", a); err == nil {
+			c.Close()
+			t.Errorf("%s is still listening", a)
+		}
+	}
+	if srv.Active() != 0 {
+		t.Errorf("%d connections are still active", srv.Active())
+	}
+
+	// readiness check fails first, then the listener is closed, connections are closed, and admin API is stopped last
+	var order []string
+	for _, e := range logs.Entries("") {
+		msg, _ := e["msg"].(string)
+		switch {
+		case strings.HasPrefix(msg, "Shutting down, readiness check fails"):
+			order = append(order, "ready")
+		case msg == "Listener closed.":
+			order = append(order, "listener")
+		case msg == "Connection closed.":
+			order = append(order, "connection")
+		case msg == "Admin API stopped.":
+			order = append(order, "admin")
+		}
+	}
+	expected := []string{"ready", "listener", "connection", "connection", "admin"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected %v, got %v", expected, order)
+	}
+}
+
+func TestReloadListeners(t *testing.T) {
+	keepAddr, oldAddr, newAddr := testFreeAddr(t), testFreeAddr(t), testFreeAddr(t)
+	path := filepath.Join(t.TempDir(), "telesock.yaml")
+	writeConfig := func(listeners ...string) {
+		b := []byte("users:\n  - username: user1\n    password: pass1\nlisteners:\n")
+		for _, l := range listeners {
+			b = append(b, l...)
+		}
+		if err := ioutil.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keep := "  - listen: " + keepAddr + "\n    tag: keep\n"
+	writeConfig(keep, "  - listen: "+oldAddr+"\n    tag: old\n")
+	config, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := internal.NewServer(config)
+	var logs testLogBuffer
+	l := logs.Logger(zap.InfoLevel)
+
+	// reloadConfig updates global listeners
+	listeners = taggedListeners{}
+	ctx, cancel := context.WithCancel(context.Background())
+	listeners.start(ctx, l, srv)
+	defer listeners.wait()
+	defer cancel()
+
+	ping := func(c net.Conn) error {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(c, make([]byte, 4))
+		return err
+	}
+	var conns []net.Conn
+	for _, addr := range []string{keepAddr, oldAddr} {
+		c, status := testEchoRequest(t, addr, "user1", "pass1")
+		defer c.Close()
+		if status != 0 {
+			t.Fatalf("%s: unexpected status %d", addr, status)
+		}
+		conns = append(conns, c)
+	}
+
+	// one listener is removed, and another one is added
+	writeConfig(keep, "  - listen: "+newAddr+"\n    tag: new\n")
+	reloadConfig(path, l, srv)
+
+	c, status := testEchoRequest(t, newAddr, "user1", "pass1")
+	defer c.Close()
+	if status != 0 {
+		t.Fatalf("unexpected status %d", status)
+	}
+	conns = append(conns, c)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		c, err := net.Dial("tcp", oldAddr)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("removed listener still accepts connections")
+		}
+	}
+
+	// established connections of all listeners are not affected
+	for i, c := range conns {
+		if err := ping(c); err != nil {
+			t.Errorf("connection %d: %s", i, err)
+		}
+	}
+	if entries := logs.Entries("Connection closed."); len(entries) != 0 {
+		t.Errorf("unexpected closed connections %v", entries)
+	}
+	if entries := logs.Entries(`Stopping listener "old" on ` + oldAddr + " removed from configuration."); len(entries) != 1 {
+		t.Errorf("expected a single stopped listener message, got %v", entries)
+	}
+	if entries := logs.Entries(`Listener "keep" started on ` + keepAddr + " with 1 accept goroutines."); len(entries) != 1 {
+		t.Errorf("expected kept listener to be started once, got %v", entries)
+	}
+
+	// until shutdown
+	cancel()
+	listeners.wait()
+	if entries := logs.Entries("Connection closed on shutdown."); len(entries) != 3 {
+		t.Errorf("expected 3 connections closed on shutdown, got %v", entries)
+	}
+}
@@ -0,0 +1,141 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/AlekSi/telesock/internal"
+)
+
+// isPublicIP returns true if ip is a global unicast address outside of private ranges.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// defaultRouteIP returns local address of the default route interface.
+// No packets are sent: connecting UDP socket only selects the route.
+func defaultRouteIP() (net.IP, error) {
+	c, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// endpointIP returns address reported by HTTPS "what's my IP" endpoint.
+func endpointIP(ctx context.Context, endpoint string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s returned unexpected response %q", endpoint, b)
+	}
+	return ip, nil
+}
+
+// detectPublicAddress returns public address of this host and the way it was detected:
+// the default route interface address if it is public, or the address reported by endpoint.
+// Private addresses are never returned.
+func detectPublicAddress(ctx context.Context, endpoint string) (net.IP, string, error) {
+	ip, err := defaultRouteIP()
+	if err == nil && isPublicIP(ip) {
+		return ip, "default route interface", nil
+	}
+
+	ip, err = endpointIP(ctx, endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	if !isPublicIP(ip) {
+		return nil, "", fmt.Errorf("%s returned non-public address %s", endpoint, ip)
+	}
+	return ip, endpoint, nil
+}
+
+// publicAddress detects public address for "auto" advertised server, if configured.
+// It returns empty string if it is not needed or can't be detected.
+func publicAddress(ctx context.Context, config *internal.Config, l *zap.SugaredLogger) string {
+	if !config.HasAutoServer() {
+		return ""
+	}
+
+	ip, method, err := detectPublicAddress(ctx, config.PublicAddress.Endpoint())
+	if err != nil {
+		l.Errorf("Public address is not detected, links for %q server are not generated: %s.", internal.AutoServer, err)
+		return ""
+	}
+	l.Infof("Public address %s detected via %s.", ip, method)
+	return ip.String()
+}
+
+// watchPublicAddress periodically re-detects public address, logging links when it changes.
+func watchPublicAddress(ctx context.Context, current string, listenHost, port string, l *zap.SugaredLogger, srv *internal.Server) {
+	interval := srv.Config().PublicAddress.RecheckInterval
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		config := srv.Config()
+		ip, method, err := detectPublicAddress(ctx, config.PublicAddress.Endpoint())
+		if err != nil {
+			if ctx.Err() == nil {
+				l.Warnf("Public address is not re-checked: %s.", err)
+			}
+			continue
+		}
+		if ip.String() == current {
+			l.Debugf("Public address %s is not changed.", current)
+			continue
+		}
+
+		if current == "" {
+			l.Warnf("Public address %s detected via %s.", ip, method)
+		} else {
+			l.Warnf("Public address changed from %s to %s (detected via %s), share links changed.", current, ip, method)
+		}
+		current = ip.String()
+		logLinks(config, listenHost, port, current, l)
+	}
+}
@@ -0,0 +1,29 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// manageService handles Windows service management commands. It is no-op on other platforms.
+func manageService(command string, configPath string, l *zap.SugaredLogger) bool {
+	return false
+}
+
+// runService runs server under Windows Service Control Manager. It is no-op on other platforms.
+func runService(command string, run func(ctx context.Context), reload func(), l *zap.SugaredLogger) bool {
+	return false
+}
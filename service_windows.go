@@ -0,0 +1,253 @@
+// telesock - Fast and simple SOCKS5 proxy.
+// Written in 2018 by Alexey Palazhchenko.
+//
+// To the extent possible under law, the author(s) have dedicated all copyright and related and neighboring rights
+// to this software to the public domain worldwide. This software is distributed without any warranty.
+//
+// You should have received a copy of the CC0 Public Domain Dedication along with this software.
+// If not, see <http://creativecommons.org/publicdomain/zero/1.0/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Windows service integration.
+//
+// Signals are not available, so Service Control Manager's "paramchange" control
+// (sc control telesock paramchange) reloads configuration, and maintenance mode is toggled via admin API.
+
+const serviceName = "telesock"
+
+var (
+	serviceCmd          = kingpin.Command("service", "Manage Windows service.")
+	serviceInstallCmd   = serviceCmd.Command("install", "Install Windows service running with given flags.")
+	serviceUninstallCmd = serviceCmd.Command("uninstall", "Uninstall Windows service.")
+	serviceStartCmd     = serviceCmd.Command("start", "Start Windows service.")
+	serviceStopCmd      = serviceCmd.Command("stop", "Stop Windows service.")
+	serviceRunCmd       = serviceCmd.Command("run", "Run as Windows service (used by Service Control Manager).").Hidden()
+)
+
+// serviceArgs returns command-line arguments for the service: current flags without the leading
+// service management command, absolute configuration file path and service run command.
+func serviceArgs(configPath string) ([]string, error) {
+	configPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// flag values may be passed as separate arguments, so they should not be mistaken for commands
+	valueFlags := make(map[string]bool)
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		valueFlags[f.Name] = !f.IsBoolFlag()
+	}
+
+	var args []string
+	var commands int
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		if !strings.HasPrefix(arg, "--") {
+			// "service install"
+			if commands < 2 {
+				commands++
+				continue
+			}
+			args = append(args, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		flag := []string{arg}
+		if !strings.Contains(name, "=") && valueFlags[name] && i+1 < len(os.Args) {
+			i++
+			flag = append(flag, os.Args[i])
+		}
+		if name == "config" || strings.HasPrefix(name, "config=") {
+			continue
+		}
+		args = append(args, flag...)
+	}
+	return append(args, "--config="+configPath, "service", "run"), nil
+}
+
+func installService(configPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	args, err := serviceArgs(configPath)
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't connect to Service Control Manager: %s", err)
+	}
+	defer m.Disconnect()
+
+	conf := mgr.Config{
+		DisplayName: "Telesock SOCKS5 proxy",
+		StartType:   mgr.StartAutomatic,
+	}
+	s, err := m.CreateService(serviceName, exe, conf, args...)
+	if err != nil {
+		return fmt.Errorf("can't create service %s: %s", serviceName, err)
+	}
+	defer s.Close()
+
+	if err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("can't register event log source %s: %s", serviceName, err)
+	}
+	return nil
+}
+
+// openService opens service with given name, calling f with it.
+func openService(f func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't connect to Service Control Manager: %s", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("can't open service %s: %s", serviceName, err)
+	}
+	defer s.Close()
+
+	return f(s)
+}
+
+// manageService handles Windows service management commands.
+// It returns true if command was handled and program should exit.
+func manageService(command string, configPath string, l *zap.SugaredLogger) bool {
+	var err error
+	switch command {
+	case serviceInstallCmd.FullCommand():
+		err = installService(configPath)
+
+	case serviceUninstallCmd.FullCommand():
+		err = openService(func(s *mgr.Service) error {
+			if err := s.Delete(); err != nil {
+				return err
+			}
+			return eventlog.Remove(serviceName)
+		})
+
+	case serviceStartCmd.FullCommand():
+		err = openService(func(s *mgr.Service) error {
+			return s.Start()
+		})
+
+	case serviceStopCmd.FullCommand():
+		err = openService(func(s *mgr.Service) error {
+			_, err := s.Control(svc.Stop)
+			return err
+		})
+
+	default:
+		return false
+	}
+
+	if err != nil {
+		l.Fatalf("%s: %s.", command, err)
+	}
+	l.Warnf("%s: done.", command)
+	return true
+}
+
+// windowsService implements svc.Handler.
+type windowsService struct {
+	run    func(ctx context.Context)
+	reload func()
+	log    *eventlog.Log // nil if event log is not available
+}
+
+// info writes message to Windows Application event log, as there is no console.
+func (s *windowsService) info(msg string) {
+	if s.log != nil {
+		s.log.Info(1, msg)
+	}
+}
+
+// Execute implements svc.Handler.
+func (s *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange}
+	s.info("Telesock started.")
+
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				s.info("Telesock is shutting down.")
+				cancel()
+				<-done
+				break loop
+
+			case svc.ParamChange:
+				// the same as SIGHUP
+				go s.reload()
+
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			}
+		}
+	}
+
+	s.info("Telesock stopped.")
+	changes <- svc.Status{State: svc.Stopped}
+	return false, 0
+}
+
+// runService runs server under Windows Service Control Manager if requested by command.
+// It returns true if server was run and program should exit.
+func runService(command string, run func(ctx context.Context), reload func(), l *zap.SugaredLogger) bool {
+	if command != serviceRunCmd.FullCommand() {
+		return false
+	}
+
+	s := &windowsService{
+		run:    run,
+		reload: reload,
+	}
+	if log, err := eventlog.Open(serviceName); err == nil {
+		s.log = log
+		defer log.Close()
+	}
+	if err := svc.Run(serviceName, s); err != nil {
+		if s.log != nil {
+			s.log.Error(1, fmt.Sprintf("Can't run service: %s.", err))
+		}
+		l.Fatalf("Can't run service (not running as a service?): %s.", err)
+	}
+	return true
+}